@@ -0,0 +1,229 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configEntry is an option set in a config file.  Options given as a
+// list, like -H, have a value per element.
+type configEntry struct {
+	key    string
+	values []string
+	line   int
+}
+
+// loadConfig sets the flags in fs that weren't given on the command
+// line from the config file at path, and returns the script it names,
+// if any, relative to the current directory.  Keys are flag names
+// (with underscores accepted in place of dashes), plus "script":
+//
+//	script = "checkout.star"
+//	c = 50
+//	z = "5m"
+//	H = ["X-Run: nightly"]
+//
+// Both this flat subset of TOML and the equivalent YAML, with
+// "key: value" lines and block lists, are accepted.
+func loadConfig(fs *flag.FlagSet, path string) (script string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	entries, err := parseConfig(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, e := range entries {
+		key := strings.Replace(e.key, "_", "-", -1)
+		if key == "script" {
+			if len(e.values) != 1 {
+				return "", fmt.Errorf("%s:%d: expected a single script", path, e.line)
+			}
+			script = e.values[0]
+			// URIs, like git+https://..., aren't relative to anything
+			if !filepath.IsAbs(script) && !strings.Contains(script, ":") {
+				script = filepath.Join(filepath.Dir(path), script)
+			}
+			continue
+		}
+		if fs.Lookup(key) == nil || key == "config" {
+			return "", fmt.Errorf("%s:%d: unknown option %q", path, e.line, e.key)
+		}
+		if set[key] {
+			continue
+		}
+		for _, v := range e.values {
+			if err := fs.Set(key, v); err != nil {
+				return "", fmt.Errorf("%s:%d: %s: %w", path, e.line, e.key, err)
+			}
+		}
+	}
+	return script, nil
+}
+
+// parseConfig parses the "key = value" or "key: value" lines of a
+// config file.  Values are bare words, quoted strings, or lists of
+// them.
+func parseConfig(r io.Reader) ([]configEntry, error) {
+	var entries []configEntry
+	// list is the entry a YAML block list belongs to, if any
+	var list *configEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if list == nil {
+				return nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			v, err := parseConfigValue(strings.TrimSpace(line[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			list.values = append(list.values, v)
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables aren't supported", n)
+		}
+
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isConfigKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+		e := configEntry{key: key, line: n}
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case value == "":
+			// a YAML block list may follow
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", n)
+			}
+			for _, elem := range splitConfigList(value[1 : len(value)-1]) {
+				v, err := parseConfigValue(elem)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				e.values = append(e.values, v)
+			}
+		default:
+			v, err := parseConfigValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			e.values = []string{v}
+		}
+		entries = append(entries, e)
+		list = nil
+		if value == "" {
+			list = &entries[len(entries)-1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	return entries, nil
+}
+
+func isConfigKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment removes a comment from the end of line.  As in YAML, a
+// "#" only starts a comment at the start of a line or after
+// whitespace, so that unquoted URLs can contain fragments.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitConfigList splits the elements of a list on commas outside of
+// quotes.
+func splitConfigList(s string) []string {
+	var elems []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			elems = append(elems, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		// TOML allows a trailing comma
+		elems = append(elems, last)
+	}
+	return elems
+}
+
+func parseConfigValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("malformed string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("malformed string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return s, nil
+}
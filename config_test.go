@@ -0,0 +1,144 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	want := []configEntry{
+		{key: "script", values: []string{"run.star"}},
+		{key: "c", values: []string{"50"}},
+		{key: "z", values: []string{"5m"}},
+		{key: "user-agent", values: []string{"it's # me"}},
+		{key: "H", values: []string{"X-A: 1", "X-B: 2"}},
+	}
+	for _, src := range []string{
+		`# TOML
+script = "run.star"
+c = 50 # workers
+z = "5m"
+user-agent = 'it''s # me'
+H = ["X-A: 1", "X-B: 2",]
+`,
+		`---
+script: run.star
+c: 50 # workers
+z: 5m
+user-agent: "it's # me"
+H:
+  - "X-A: 1"
+  - 'X-B: 2'
+`,
+	} {
+		entries, err := parseConfig(strings.NewReader(src))
+		if err != nil {
+			t.Fatalf("parseConfig: %s", err)
+		}
+		for i := range entries {
+			entries[i].line = 0
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("got %+v; want %+v", entries, want)
+		}
+	}
+
+	for _, src := range []string{
+		"[run]\n",
+		"c 50\n",
+		"- a\n",
+		"H = [\"a\"\n",
+		"z = \"5m\n",
+	} {
+		if _, err := parseConfig(strings.NewReader(src)); err == nil {
+			t.Errorf("parseConfig(%q): expected an error", src)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.toml")
+	src := "script = \"run.star\"\nc = 50\nz = \"5m\"\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("hey", flag.ContinueOnError)
+	c := fs.Int("c", 2, "")
+	z := fs.Duration("z", 0, "")
+	if err := fs.Parse([]string{"-c", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	script, err := loadConfig(fs, path)
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	if want := filepath.Join(dir, "run.star"); script != want {
+		t.Errorf("got script %q; want %q", script, want)
+	}
+	// the command line takes precedence
+	if *c != 10 {
+		t.Errorf("got c %d; want 10", *c)
+	}
+	if *z != 5*time.Minute {
+		t.Errorf("got z %s; want 5m", *z)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("q = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fs, path); err == nil {
+		t.Errorf("expected an error for an unknown option")
+	}
+}
+
+func TestConfigAssertions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.yaml")
+	src := "assert:\n  - \"GET */api/* => status 2xx\"\n  - latency < 500ms\n"
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("hey", flag.ContinueOnError)
+	var asserts assertionList
+	fs.Var(&asserts, "assert", "")
+	if _, err := loadConfig(fs, path); err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	if got, want := fmt.Sprint(asserts), "[GET */api/* => status 2xx latency < 500ms]"; got != want {
+		t.Errorf("got assertions %s; want %s", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("assert = \"status ok\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(flag.NewFlagSet("hey", flag.ContinueOnError), path); err == nil {
+		t.Errorf("expected an error for an unknown option")
+	}
+	fs = flag.NewFlagSet("hey", flag.ContinueOnError)
+	fs.Var(&asserts, "assert", "")
+	if _, err := loadConfig(fs, path); err == nil {
+		t.Errorf("expected an error for an invalid assertion")
+	}
+}
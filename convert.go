@@ -0,0 +1,440 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	gourl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+var convertUsage = `Usage: hey convert --curl '<curl command>'
+
+Writes a script making the same request as a curl command, as copied
+from API docs or a browser's developer tools, to stdout.
+`
+
+func convertMain(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, convertUsage)
+	}
+	curl := fs.String("curl", "", "")
+	fs.Parse(args)
+	if *curl == "" {
+		fs.Usage()
+		return 2
+	}
+
+	src, err := convertCurl(*curl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "convert: %s\n", err)
+		return 1
+	}
+	io.WriteString(os.Stdout, src)
+	return 0
+}
+
+// curlRequest is the request a curl command line makes.
+type curlRequest struct {
+	method  string
+	url     string
+	headers http.Header
+	data    []string
+	get     bool
+	// notes are options that don't translate, left as comments in the
+	// script.
+	notes []string
+}
+
+// curlValueOptions are the options taking a value that are understood,
+// by short and long name.
+var curlValueOptions = map[string]string{
+	"-X": "--request",
+	"-H": "--header",
+	"-d": "--data",
+	"-u": "--user",
+	"-A": "--user-agent",
+	"-b": "--cookie",
+	"-e": "--referer",
+	"-o": "--output",
+	"-m": "--max-time",
+
+	"--request":         "--request",
+	"--header":          "--header",
+	"--data":            "--data",
+	"--data-ascii":      "--data",
+	"--data-binary":     "--data-binary",
+	"--data-raw":        "--data-raw",
+	"--data-urlencode":  "--data-urlencode",
+	"--json":            "--json",
+	"--user":            "--user",
+	"--user-agent":      "--user-agent",
+	"--cookie":          "--cookie",
+	"--referer":         "--referer",
+	"--url":             "--url",
+	"--output":          "--output",
+	"--max-time":        "--max-time",
+	"--connect-timeout": "--max-time",
+}
+
+// curlFlags are the options without a value that are understood, or
+// don't affect the request.
+var curlFlags = map[string]string{
+	"-G": "--get",
+	"-I": "--head",
+	"-k": "--insecure",
+	"-L": "--location",
+	"-s": "--silent",
+	"-S": "--show-error",
+	"-v": "--verbose",
+	"-i": "--include",
+	"-f": "--fail",
+
+	"--get":        "--get",
+	"--head":       "--head",
+	"--insecure":   "--insecure",
+	"--location":   "--location",
+	"--silent":     "--silent",
+	"--show-error": "--show-error",
+	"--verbose":    "--verbose",
+	"--include":    "--include",
+	"--fail":       "--fail",
+	"--compressed": "--compressed",
+}
+
+// parseCurl parses the arguments of a curl command.
+func parseCurl(args []string) (*curlRequest, error) {
+	if len(args) == 0 || args[0] != "curl" {
+		return nil, fmt.Errorf("expected a curl command")
+	}
+	r := &curlRequest{headers: make(http.Header)}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if r.url != "" {
+				return nil, fmt.Errorf("more than one URL: %s and %s", r.url, arg)
+			}
+			r.url = arg
+			continue
+		}
+
+		var opt, value string
+		hasValue := false
+		if strings.HasPrefix(arg, "--") {
+			if o, ok := curlValueOptions[arg]; ok {
+				opt, hasValue = o, true
+			} else if o, ok := curlFlags[arg]; ok {
+				opt = o
+			} else {
+				return nil, fmt.Errorf("unsupported option %s", arg)
+			}
+		} else {
+			// short options can be combined, as in -sSL, and the last
+			// one can have its value attached, as in -XPOST
+			for j := 1; j < len(arg); j++ {
+				short := "-" + arg[j:j+1]
+				if o, ok := curlValueOptions[short]; ok {
+					opt, hasValue = o, true
+					value = arg[j+1:]
+					break
+				}
+				o, ok := curlFlags[short]
+				if !ok {
+					return nil, fmt.Errorf("unsupported option %s", short)
+				}
+				if j < len(arg)-1 {
+					r.apply(o, "")
+				} else {
+					opt = o
+				}
+			}
+		}
+		if hasValue && value == "" {
+			i++
+			if i == len(args) {
+				return nil, fmt.Errorf("option %s needs a value", arg)
+			}
+			value = args[i]
+		}
+		if err := r.apply(opt, value); err != nil {
+			return nil, err
+		}
+	}
+	if r.url == "" {
+		return nil, fmt.Errorf("no URL")
+	}
+	return r, nil
+}
+
+func (r *curlRequest) apply(opt, value string) error {
+	switch opt {
+	case "--request":
+		r.method = strings.ToUpper(value)
+	case "--header":
+		i := strings.IndexByte(value, ':')
+		if i <= 0 {
+			return fmt.Errorf("malformed header %q", value)
+		}
+		if v := strings.TrimSpace(value[i+1:]); v != "" {
+			r.headers.Add(strings.TrimSpace(value[:i]), v)
+		}
+	case "--data", "--data-binary", "--data-raw":
+		if strings.HasPrefix(value, "@") && opt != "--data-raw" {
+			return fmt.Errorf("reading data from a file (%s) isn't supported", value)
+		}
+		if opt == "--data" {
+			// like curl, which strips newlines from -d
+			value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		}
+		r.data = append(r.data, value)
+	case "--data-urlencode":
+		if i := strings.IndexByte(value, '='); i >= 0 {
+			value = value[:i+1] + gourl.QueryEscape(value[i+1:])
+		} else {
+			value = gourl.QueryEscape(value)
+		}
+		r.data = append(r.data, value)
+	case "--json":
+		r.data = append(r.data, value)
+		if r.headers.Get("Content-Type") == "" {
+			r.headers.Set("Content-Type", "application/json")
+		}
+		if r.headers.Get("Accept") == "" {
+			r.headers.Set("Accept", "application/json")
+		}
+	case "--user":
+		r.headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(value)))
+	case "--user-agent":
+		r.notes = append(r.notes, fmt.Sprintf("the user agent is set with -user-agent, not to %q", value))
+	case "--cookie":
+		if strings.Contains(value, "=") {
+			r.headers.Add("Cookie", value)
+		} else {
+			return fmt.Errorf("reading cookies from a file (%s) isn't supported", value)
+		}
+	case "--referer":
+		r.headers.Set("Referer", value)
+	case "--url":
+		r.url = value
+	case "--get":
+		r.get = true
+	case "--head":
+		r.method = "HEAD"
+	case "--insecure":
+		// hey doesn't verify certificates
+	case "--location":
+		r.notes = append(r.notes, "redirects are always followed")
+	case "--max-time":
+		r.notes = append(r.notes, "the request timeout is set with -t")
+	}
+	return nil
+}
+
+// convertCurl returns a script making the request that the curl
+// command line cmd does.
+func convertCurl(cmd string) (string, error) {
+	args, err := splitShellWords(cmd)
+	if err != nil {
+		return "", err
+	}
+	r, err := parseCurl(args)
+	if err != nil {
+		return "", err
+	}
+
+	url := r.url
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	body := strings.Join(r.data, "&")
+	method := r.method
+	if r.get {
+		if body != "" {
+			sep := "?"
+			if strings.Contains(url, "?") {
+				sep = "&"
+			}
+			url += sep + body
+		}
+		body = ""
+		method = "GET"
+	}
+	if method == "" {
+		method = "GET"
+		if len(r.data) > 0 {
+			method = "POST"
+		}
+	}
+	if method != "GET" && method != "POST" {
+		return "", fmt.Errorf("the requests module only supports GET and POST, not %s", method)
+	}
+	if method == "POST" && len(r.data) > 0 && r.headers.Get("Content-Type") == "" {
+		// curl's default for -d
+		r.headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# converted from: %s\n", strings.Replace(strings.TrimSpace(cmd), "\n", "\n#   ", -1))
+	for _, note := range r.notes {
+		fmt.Fprintf(&buf, "# note: %s\n", note)
+	}
+	buf.WriteString("\ndef main(ctx):\n")
+	buf.WriteString("    headers = {")
+	if len(r.headers) > 0 {
+		buf.WriteString("\n")
+		keys := make([]string, 0, len(r.headers))
+		for k := range r.headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sep := ", "
+			if k == "Cookie" {
+				sep = "; "
+			}
+			fmt.Fprintf(&buf, "        %s: %s,\n", starlarkQuote(k), starlarkQuote(strings.Join(r.headers[k], sep)))
+		}
+		buf.WriteString("    ")
+	}
+	buf.WriteString("}\n")
+	data := "None"
+	if method == "POST" {
+		data = starlarkQuote(body)
+	}
+	fmt.Fprintf(&buf, "    r = requests.%s(%s, data=%s, headers=headers)\n", strings.ToLower(method), starlarkQuote(url), data)
+	buf.WriteString("    r.raise_for_status()\n")
+	return buf.String(), nil
+}
+
+// starlarkQuote returns s as a Starlark string literal.
+func starlarkQuote(s string) string {
+	return starlark.String(s).String()
+}
+
+// splitShellWords splits a command line into words the way a POSIX
+// shell would, handling quoting, escapes, line continuations and
+// bash's $'...' strings, which browsers use when copying requests as
+// curl commands.  Variables and other expansions aren't supported.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					word.WriteByte(s[i])
+					inWord = true
+				}
+			}
+		case c == '\'':
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			word.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+			inWord = true
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			n, err := ansiCString(&word, s[i+2:])
+			if err != nil {
+				return nil, err
+			}
+			i += n + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ansiCString decodes the body of a $'...' string from s into word,
+// returning the number of bytes consumed including the closing quote.
+func ansiCString(word *strings.Builder, s string) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return i + 1, nil
+		}
+		if c != '\\' || i+1 == len(s) {
+			word.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			word.WriteByte('\n')
+		case 'r':
+			word.WriteByte('\r')
+		case 't':
+			word.WriteByte('\t')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+3 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			v, err := strconv.ParseUint(s[i+1:j], 16, 8)
+			if err != nil {
+				return 0, fmt.Errorf("malformed escape in $'...' string")
+			}
+			word.WriteByte(byte(v))
+			i = j - 1
+		case 'u':
+			if i+5 > len(s) {
+				return 0, fmt.Errorf("malformed escape in $'...' string")
+			}
+			v, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return 0, fmt.Errorf("malformed escape in $'...' string")
+			}
+			word.WriteRune(rune(v))
+			i += 4
+		default:
+			// \\, \', \" and anything else stand for themselves
+			word.WriteByte(s[i])
+		}
+	}
+	return 0, fmt.Errorf("unterminated quote")
+}
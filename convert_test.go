@@ -0,0 +1,70 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/syntax"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	words, err := splitShellWords(`curl 'https://x/a b' -H "X-A: \"1\"" \
+  --data-raw $'{"a":"b\'c\n"}' plain\ word`)
+	if err != nil {
+		t.Fatalf("splitShellWords: %s", err)
+	}
+	want := []string{"curl", "https://x/a b", "-H", `X-A: "1"`, "--data-raw", "{\"a\":\"b'c\n\"}", "plain word"}
+	if !reflect.DeepEqual(words, want) {
+		t.Errorf("got %q; want %q", words, want)
+	}
+
+	if _, err := splitShellWords(`curl 'https://x`); err == nil {
+		t.Errorf("expected an error for an unterminated quote")
+	}
+}
+
+func TestConvertCurl(t *testing.T) {
+	src, err := convertCurl(`curl -sS -XPOST https://api.example.com/v1/items \
+  -H 'Accept: application/json' -u user:pass \
+  -d name=widget -d 'count=2'`)
+	if err != nil {
+		t.Fatalf("convertCurl: %s", err)
+	}
+	for _, want := range []string{
+		`        "Accept": "application/json",`,
+		`        "Authorization": "Basic dXNlcjpwYXNz",`,
+		`        "Content-Type": "application/x-www-form-urlencoded",`,
+		`    r = requests.post("https://api.example.com/v1/items", data="name=widget&count=2", headers=headers)`,
+	} {
+		if !strings.Contains(src, want+"\n") {
+			t.Errorf("expected %q in script:\n%s", want, src)
+		}
+	}
+	if _, err := syntax.Parse("convert.star", src, 0); err != nil {
+		t.Errorf("converted script doesn't parse: %s\n%s", err, src)
+	}
+
+	src, err = convertCurl(`curl -G example.com/search --data-urlencode 'q=a b'`)
+	if err != nil {
+		t.Fatalf("convertCurl: %s", err)
+	}
+	if want := `requests.get("http://example.com/search?q=a+b", data=None, headers=headers)`; !strings.Contains(src, want) {
+		t.Errorf("expected %q in script:\n%s", want, src)
+	}
+
+	for _, cmd := range []string{
+		`curl -X PUT https://example.com`,
+		`curl -F file=@x https://example.com`,
+		`wget https://example.com`,
+		`curl -s`,
+	} {
+		if _, err := convertCurl(cmd); err == nil {
+			t.Errorf("convertCurl(%q): expected an error", cmd)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ballast is a large allocation that is never touched, so it takes up
+// no physical memory, but raises the heap size that the GC paces
+// itself by, so that a generator with a small live heap collects much
+// less often.
+var ballast []byte
+
+// setGC tunes the garbage collector for long runs, where frequent
+// collections show up as latency spikes in the results: gogc is as for
+// the GOGC environment variable, a percentage or "off", and
+// memoryLimit, the soft memory limit, and ballastSize are sizes for
+// parseByteSize.  Empty values leave the defaults.
+func setGC(gogc, memoryLimit, ballastSize string) error {
+	if gogc != "" {
+		percent := -1
+		if gogc != "off" {
+			var err error
+			percent, err = strconv.Atoi(gogc)
+			if err != nil || percent < 0 {
+				return fmt.Errorf("-gogc must be a percentage or off, got %q", gogc)
+			}
+		}
+		debug.SetGCPercent(percent)
+	}
+	if memoryLimit != "" {
+		n, err := parseByteSize(memoryLimit)
+		if err != nil {
+			return fmt.Errorf("-memory-limit: %w", err)
+		}
+		debug.SetMemoryLimit(n)
+	}
+	if ballastSize != "" {
+		n, err := parseByteSize(ballastSize)
+		if err != nil {
+			return fmt.Errorf("-ballast: %w", err)
+		}
+		ballast = make([]byte, n)
+	}
+	return nil
+}
+
+// byteSizeUnits are the suffixes parseByteSize accepts, longest first
+// so that "MiB" isn't taken for "B".
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a number of bytes, with an optional unit as for
+// GOMEMLIMIT, like 512MiB or 2GiB, or a decimal one like 2GB.
+func parseByteSize(s string) (int64, error) {
+	num, unit := strings.TrimSpace(s), int64(1)
+	upper := strings.ToUpper(num)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			num, unit = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size like 512MiB, got %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"1024", 1024},
+		{"512MiB", 512 << 20},
+		{"2GiB", 2 << 30},
+		{"1.5 GiB", 3 << 29},
+		{"2GB", 2e9},
+		{"64kb", 64e3},
+		{"100B", 100},
+	} {
+		got, err := parseByteSize(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "GiB", "-1GiB", "2XB"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q): expected an error", in)
+		}
+	}
+}
+
+func TestSetGC(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(100))
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	defer func() { ballast = nil }()
+
+	if err := setGC("off", "1GiB", "1MiB"); err != nil {
+		t.Fatal(err)
+	}
+	if p := debug.SetGCPercent(100); p != -1 {
+		t.Errorf("expected GC to be off, got %d%%", p)
+	}
+	if l := debug.SetMemoryLimit(-1); l != 1<<30 {
+		t.Errorf("expected a 1GiB memory limit, got %d", l)
+	}
+	if len(ballast) != 1<<20 {
+		t.Errorf("expected a 1MiB ballast, got %d bytes", len(ballast))
+	}
+
+	if err := setGC("50", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if p := debug.SetGCPercent(100); p != 50 {
+		t.Errorf("expected GOGC 50, got %d", p)
+	}
+	if l := debug.SetMemoryLimit(-1); l != 1<<30 {
+		t.Errorf("expected the memory limit to be left alone, got %d", l)
+	}
+
+	for _, args := range [][3]string{{"sometimes", "", ""}, {"", "lots", ""}, {"", "", "-1"}} {
+		if err := setGC(args[0], args[1], args[2]); err == nil {
+			t.Errorf("setGC(%q): expected an error", args)
+		}
+	}
+}
@@ -3,9 +3,8 @@ module github.com/bpowers/hithere
 require (
 	github.com/paulbellamy/ratecounter v0.2.0
 	github.com/stretchr/testify v1.4.0 // indirect
-	github.com/stripe/stripe-go v68.20.0+incompatible
 	go.starlark.net v0.0.0-20200203144150-6677ee5c7211
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 )
 
-go 1.13
+go 1.21
@@ -0,0 +1,363 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+// Package grpc is a minimal gRPC client built directly on HTTP/2.
+//
+// It implements just enough of the gRPC wire protocol (length-prefixed
+// message framing, status trailers and timeouts) for hithere to talk to
+// gRPC services without pulling in the full grpc-go runtime.  Message
+// payloads are opaque bytes; see wire.go for protobuf encoding helpers.
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const userAgent = "hithere-grpc/0.0.1"
+
+// Codes are the canonical gRPC status codes.
+const (
+	OK               = 0
+	Canceled         = 1
+	Unknown          = 2
+	DeadlineExceeded = 4
+	Unimplemented    = 12
+	Internal         = 13
+	Unavailable      = 14
+)
+
+// Status is the error returned when a call completes with a non-OK
+// gRPC status.
+type Status struct {
+	Code    int
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: code = %d desc = %s", s.Code, s.Message)
+}
+
+// Conn is a connection to a single gRPC server.  It is safe for
+// concurrent use by multiple goroutines.
+type Conn struct {
+	base *url.URL
+	rt   http.RoundTripper
+	// web is set for gRPC-Web servers, see DialWeb.
+	web bool
+}
+
+// Dial returns a Conn for target.  Targets of the form "host:port" or
+// "http://host:port" use cleartext HTTP/2 (h2c); "https://host:port"
+// uses TLS.  No network I/O happens until the first call.
+func Dial(target string) (*Conn, error) {
+	u, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var rt http.RoundTripper
+	switch u.Scheme {
+	case "http":
+		rt = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+	case "https":
+		rt = &http2.Transport{}
+	default:
+		return nil, fmt.Errorf("grpc: unsupported scheme %q", u.Scheme)
+	}
+
+	return &Conn{
+		base: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		rt:   rt,
+	}, nil
+}
+
+// DialWeb returns a Conn for a gRPC-Web server, like an Envoy proxy
+// with the grpc_web filter, at target.  Calls are made the way
+// browsers make them: over HTTP/1.1, or HTTP/2 if an https:// server
+// negotiates it, with the status sent in the response body rather than
+// in HTTP trailers.  gRPC-Web has no bidirectional streaming, so server
+// reflection isn't available.
+func DialWeb(target string) (*Conn, error) {
+	u, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("grpc: unsupported scheme %q", u.Scheme)
+	}
+
+	return &Conn{
+		base: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		rt:   &http.Transport{ForceAttemptHTTP2: true},
+		web:  true,
+	}, nil
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("grpc: missing host in target %q", target)
+	}
+	return u, nil
+}
+
+// ClientStream is a single in-flight call.  Send and CloseSend may be
+// called concurrently with Recv, but not with each other.
+type ClientStream struct {
+	cancel context.CancelFunc
+	pw     *io.PipeWriter
+	web    bool
+
+	respOnce sync.Once
+	respCh   chan *http.Response
+	errCh    chan error
+	resp     *http.Response
+	respErr  error
+}
+
+// NewStream starts a call to method, which has the form
+// "/package.Service/Method".  md is sent as request metadata and may be
+// nil.
+func (c *Conn) NewStream(ctx context.Context, method string, md http.Header) (*ClientStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	u := *c.base
+	u.Path = method
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	for k, v := range md {
+		req.Header[k] = v
+	}
+	if c.web {
+		req.Header.Set("content-type", "application/grpc-web+proto")
+		req.Header.Set("x-grpc-web", "1")
+	} else {
+		req.Header.Set("content-type", "application/grpc+proto")
+		req.Header.Set("te", "trailers")
+	}
+	req.Header.Set("user-agent", userAgent)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("grpc-timeout", encodeTimeout(time.Until(deadline)))
+	}
+
+	s := &ClientStream{
+		cancel: cancel,
+		pw:     pw,
+		web:    c.web,
+		respCh: make(chan *http.Response, 1),
+		errCh:  make(chan error, 1),
+	}
+	// RoundTrip doesn't return until the server sends response
+	// headers, which for client-streaming calls may not happen until
+	// we've finished sending.
+	go func() {
+		resp, err := c.rt.RoundTrip(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			s.errCh <- err
+			return
+		}
+		s.respCh <- resp
+	}()
+	return s, nil
+}
+
+// Send writes msg to the stream as a single gRPC message.
+func (s *ClientStream) Send(msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := s.pw.Write(append(hdr[:], msg...)); err != nil {
+		return fmt.Errorf("grpc: send: %w", err)
+	}
+	return nil
+}
+
+// CloseSend signals that no more messages will be sent.
+func (s *ClientStream) CloseSend() error {
+	return s.pw.Close()
+}
+
+// Close aborts the call, releasing its resources.
+func (s *ClientStream) Close() {
+	s.cancel()
+	s.pw.Close()
+}
+
+func (s *ClientStream) response() (*http.Response, error) {
+	s.respOnce.Do(func() {
+		select {
+		case s.resp = <-s.respCh:
+		case s.respErr = <-s.errCh:
+		}
+		if s.respErr != nil {
+			return
+		}
+		if s.resp.StatusCode != http.StatusOK {
+			s.respErr = &Status{Code: Unknown, Message: fmt.Sprintf("unexpected HTTP status %s", s.resp.Status)}
+			return
+		}
+		// a trailers-only response carries the status in the headers
+		if st := statusFrom(s.resp.Header); st != nil && st.Code != OK {
+			s.respErr = st
+		}
+	})
+	return s.resp, s.respErr
+}
+
+// Recv reads the next message from the stream.  It returns io.EOF
+// once the server has finished the call with an OK status, and a
+// *Status if it finished with any other.
+func (s *ClientStream) Recv() ([]byte, error) {
+	resp, err := s.response()
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(resp.Body, hdr[:]); err != nil {
+		if err != io.EOF {
+			return nil, fmt.Errorf("grpc: recv: %w", err)
+		}
+		resp.Body.Close()
+		st := statusFrom(resp.Trailer)
+		if st == nil {
+			st = statusFrom(resp.Header)
+		}
+		if st == nil {
+			return nil, &Status{Code: Internal, Message: "server closed the stream without sending a status"}
+		} else if st.Code != OK {
+			return nil, st
+		}
+		return nil, io.EOF
+	}
+	trailers := s.web && hdr[0]&webTrailersFlag != 0
+	if hdr[0]&^webTrailersFlag != 0 {
+		return nil, &Status{Code: Internal, Message: "compressed messages are not supported"}
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(resp.Body, msg); err != nil {
+		return nil, fmt.Errorf("grpc: recv: %w", err)
+	}
+	if trailers {
+		resp.Body.Close()
+		st := statusFrom(parseWebTrailers(msg))
+		if st == nil {
+			return nil, &Status{Code: Internal, Message: "server sent trailers without a status"}
+		} else if st.Code != OK {
+			return nil, st
+		}
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+// webTrailersFlag marks the gRPC-Web frame carrying the trailers, as
+// an HTTP/1-style header block, at the end of the response body.
+const webTrailersFlag = 0x80
+
+func parseWebTrailers(b []byte) http.Header {
+	h := make(http.Header)
+	for _, line := range strings.Split(string(b), "\r\n") {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		h.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	return h
+}
+
+// Invoke performs a unary call, returning the single response message.
+func (c *Conn) Invoke(ctx context.Context, method string, md http.Header, req []byte) ([]byte, error) {
+	s, err := c.NewStream(ctx, method, md)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if err := s.Send(req); err != nil {
+		return nil, err
+	}
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+	resp, err := s.Recv()
+	if err != nil {
+		if err == io.EOF {
+			return nil, &Status{Code: Internal, Message: "no response message for unary call"}
+		}
+		return nil, err
+	}
+	// drain to pick up the final status
+	if _, err := s.Recv(); err != io.EOF {
+		if err == nil {
+			return nil, &Status{Code: Internal, Message: "too many response messages for unary call"}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func statusFrom(h http.Header) *Status {
+	code := h.Get("grpc-status")
+	if code == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return &Status{Code: Unknown, Message: fmt.Sprintf("malformed grpc-status %q", code)}
+	}
+	msg, err := url.PathUnescape(h.Get("grpc-message"))
+	if err != nil {
+		msg = h.Get("grpc-message")
+	}
+	return &Status{Code: n, Message: msg}
+}
+
+// encodeTimeout formats d in the grpc-timeout header format.
+func encodeTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "1n"
+	}
+	// the value is limited to 8 digits
+	if ms := d.Milliseconds(); ms < 1e8 {
+		return fmt.Sprintf("%dm", max(ms, 1))
+	}
+	return fmt.Sprintf("%dS", int64(d.Seconds()))
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
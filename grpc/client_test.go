@@ -0,0 +1,200 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// frame returns msg with the gRPC message prefix.
+func frame(flags byte, msg []byte) []byte {
+	b := []byte{flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readFrame reads a message with the gRPC message prefix from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// echoServer serves gRPC over h2c, answering each message of a call
+// with the same in upper case, then the status in the path, e.g.
+// /test.Echo/14.
+func echoServer(t *testing.T) *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("content-type") != "application/grpc+proto" || r.Header.Get("te") != "trailers" {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		code := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		if code == "trailers-only" {
+			w.Header().Set("grpc-status", "5")
+			w.Header().Set("grpc-message", "not%20found")
+			return
+		}
+		w.Header().Set("content-type", "application/grpc+proto")
+		for {
+			msg, err := readFrame(r.Body)
+			if err != nil {
+				break
+			}
+			w.Write(frame(0, []byte(strings.ToUpper(string(msg)))))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"grpc-status", code)
+		if code != "0" {
+			w.Header().Set(http.TrailerPrefix+"grpc-message", "try%20later")
+		}
+	}
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+}
+
+func TestInvoke(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+	c, err := Dial(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Invoke(context.Background(), "/test.Echo/0", nil, []byte("hello"))
+	if err != nil || string(resp) != "HELLO" {
+		t.Errorf("Invoke: got %q, %v", resp, err)
+	}
+
+	_, err = c.Invoke(context.Background(), "/test.Echo/14", nil, []byte("hello"))
+	var st *Status
+	if !errors.As(err, &st) || st.Code != Unavailable || st.Message != "try later" {
+		t.Errorf("expected the trailers' status, got %v", err)
+	}
+
+	_, err = c.Invoke(context.Background(), "/test.Echo/trailers-only", nil, []byte("hello"))
+	if !errors.As(err, &st) || st.Code != 5 || st.Message != "not found" {
+		t.Errorf("expected the headers' status, got %v", err)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+	c, err := Dial(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.NewStream(context.Background(), "/test.Echo/0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the messages are framed one by one, whatever their size
+	msgs := []string{"a", "", strings.Repeat("b", 70000)}
+	for _, msg := range msgs {
+		if err := s.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: %s", err)
+		}
+		got, err := s.Recv()
+		if err != nil || string(got) != strings.ToUpper(msg) {
+			t.Fatalf("Recv: got %d bytes, %v; want %d", len(got), err, len(msg))
+		}
+	}
+	if err := s.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("expected io.EOF once the call is done, got %v", err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}), &http2.Server{}))
+	defer server.Close()
+	c, err := Dial(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Invoke(context.Background(), "/test.Echo/0", nil, nil)
+	var st *Status
+	if !errors.As(err, &st) || st.Code != Unknown || !strings.Contains(st.Message, "502") {
+		t.Errorf("expected an Unknown status for the HTTP error, got %v", err)
+	}
+}
+
+func TestInvokeWeb(t *testing.T) {
+	var timeout string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout = r.Header.Get("grpc-timeout")
+		if r.Header.Get("content-type") != "application/grpc-web+proto" || r.Header.Get("x-grpc-web") != "1" {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		msg, err := readFrame(r.Body)
+		if err != nil {
+			t.Errorf("reading the request: %s", err)
+		}
+		w.Write(frame(0, []byte(strings.ToUpper(string(msg)))))
+		w.Write(frame(webTrailersFlag, []byte("grpc-status: 0\r\ngrpc-message: \r\n")))
+	}))
+	defer server.Close()
+	c, err := DialWeb(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := c.Invoke(ctx, "/test.Echo/Call", nil, []byte("web"))
+	if err != nil || string(resp) != "WEB" {
+		t.Errorf("Invoke: got %q, %v", resp, err)
+	}
+	if !strings.HasSuffix(timeout, "m") {
+		t.Errorf("expected a timeout in milliseconds, got %q", timeout)
+	}
+}
+
+func TestEncodeTimeout(t *testing.T) {
+	for _, test := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Second, "1n"},
+		{time.Microsecond, "1m"},
+		{1500 * time.Millisecond, "1500m"},
+		{200 * time.Hour, "720000S"},
+	} {
+		if got := encodeTimeout(test.d); got != test.want {
+			t.Errorf("encodeTimeout(%s) = %q; want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	for _, target := range []string{"ftp://host:1", "http://"} {
+		if _, err := Dial(target); err == nil {
+			t.Errorf("Dial(%q): expected an error", target)
+		}
+	}
+}
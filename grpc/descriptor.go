@@ -0,0 +1,415 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Field types, from google.protobuf.FieldDescriptorProto.Type.
+const (
+	TypeDouble   = 1
+	TypeFloat    = 2
+	TypeInt64    = 3
+	TypeUint64   = 4
+	TypeInt32    = 5
+	TypeFixed64  = 6
+	TypeFixed32  = 7
+	TypeBool     = 8
+	TypeString   = 9
+	TypeGroup    = 10
+	TypeMessage  = 11
+	TypeBytes    = 12
+	TypeUint32   = 13
+	TypeEnum     = 14
+	TypeSfixed32 = 15
+	TypeSfixed64 = 16
+	TypeSint32   = 17
+	TypeSint64   = 18
+)
+
+const labelRepeated = 3
+
+// A Registry holds the message, enum and service definitions from a
+// set of .proto files, decoded from their FileDescriptorProtos.  Names
+// are fully qualified, without a leading dot.
+type Registry struct {
+	files    map[string]bool
+	deps     []string
+	messages map[string]*MessageDesc
+	enums    map[string]*EnumDesc
+	services map[string]*ServiceDesc
+}
+
+// MessageDesc describes a message type.
+type MessageDesc struct {
+	Name   string
+	Fields []*FieldDesc
+	// MapEntry is set for the synthetic entry types of map fields,
+	// which have a key (1) and value (2) field.
+	MapEntry bool
+
+	byName map[string]*FieldDesc
+	byNum  map[int]*FieldDesc
+}
+
+// FieldDesc describes a single field of a message.
+type FieldDesc struct {
+	Name     string
+	Number   int
+	Type     int
+	Repeated bool
+	// Packed is whether repeated scalars are encoded packed, the
+	// default in proto3.
+	Packed bool
+	// TypeName is the message or enum type of the field.
+	TypeName string
+}
+
+// EnumDesc describes an enum type.
+type EnumDesc struct {
+	Name   string
+	Values map[string]int32
+	Names  map[int32]string
+}
+
+// ServiceDesc describes a service.
+type ServiceDesc struct {
+	Name    string
+	Methods []*MethodDesc
+}
+
+// MethodDesc describes a single RPC.
+type MethodDesc struct {
+	// Name is the full method name, "/package.Service/Method".
+	Name            string
+	Input           string
+	Output          string
+	ClientStreaming bool
+	ServerStreaming bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		files:    make(map[string]bool),
+		messages: make(map[string]*MessageDesc),
+		enums:    make(map[string]*EnumDesc),
+		services: make(map[string]*ServiceDesc),
+	}
+}
+
+// AddFileSet adds the files in an encoded FileDescriptorSet, as written
+// by protoc --descriptor_set_out.
+func (r *Registry) AddFileSet(b []byte) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.Num == 1 && f.WireType == WireBytes {
+			if err := r.AddFile(f.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddFile adds the definitions in an encoded FileDescriptorProto.
+// Files that have already been added are ignored.
+func (r *Registry) AddFile(b []byte) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	var name, pkg string
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			name = string(f.Bytes)
+		case 2:
+			pkg = string(f.Bytes)
+		}
+	}
+	if r.files[name] {
+		return nil
+	}
+	r.files[name] = true
+
+	proto3 := false
+	for _, f := range fields {
+		if f.Num == 12 && string(f.Bytes) == "proto3" {
+			proto3 = true
+		}
+	}
+	for _, f := range fields {
+		var err error
+		switch f.Num {
+		case 3:
+			r.deps = append(r.deps, string(f.Bytes))
+		case 4:
+			err = r.addMessage(pkg, f.Bytes, proto3)
+		case 5:
+			err = r.addEnum(pkg, f.Bytes)
+		case 6:
+			err = r.addService(pkg, f.Bytes)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// missingDeps returns the files imported by added files that haven't
+// been added themselves.
+func (r *Registry) missingDeps() []string {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, dep := range r.deps {
+		if !r.files[dep] && !seen[dep] {
+			seen[dep] = true
+			missing = append(missing, dep)
+		}
+	}
+	return missing
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (r *Registry) addMessage(scope string, b []byte, proto3 bool) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	m := &MessageDesc{
+		byName: make(map[string]*FieldDesc),
+		byNum:  make(map[int]*FieldDesc),
+	}
+	for _, f := range fields {
+		if f.Num == 1 {
+			m.Name = qualify(scope, string(f.Bytes))
+		}
+	}
+	for _, f := range fields {
+		var err error
+		switch f.Num {
+		case 2:
+			var fd *FieldDesc
+			fd, err = parseField(f.Bytes, proto3)
+			if err == nil {
+				m.Fields = append(m.Fields, fd)
+				m.byName[fd.Name] = fd
+				m.byNum[fd.Number] = fd
+			}
+		case 3:
+			err = r.addMessage(m.Name, f.Bytes, proto3)
+		case 4:
+			err = r.addEnum(m.Name, f.Bytes)
+		case 7:
+			// MessageOptions.map_entry
+			var opts []Field
+			opts, err = ParseFields(f.Bytes)
+			for _, o := range opts {
+				if o.Num == 7 && o.Scalar != 0 {
+					m.MapEntry = true
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("message %s: %w", m.Name, err)
+		}
+	}
+	r.messages[m.Name] = m
+	return nil
+}
+
+func parseField(b []byte, proto3 bool) (*FieldDesc, error) {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return nil, err
+	}
+	fd := &FieldDesc{}
+	packedOpt := -1
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			fd.Name = string(f.Bytes)
+		case 3:
+			fd.Number = int(f.Scalar)
+		case 4:
+			fd.Repeated = f.Scalar == labelRepeated
+		case 5:
+			fd.Type = int(f.Scalar)
+		case 6:
+			fd.TypeName = strings.TrimPrefix(string(f.Bytes), ".")
+		case 8:
+			// FieldOptions.packed
+			opts, err := ParseFields(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range opts {
+				if o.Num == 2 {
+					packedOpt = int(o.Scalar)
+				}
+			}
+		}
+	}
+	if fd.Type == TypeGroup {
+		return nil, fmt.Errorf("field %s: groups are not supported", fd.Name)
+	}
+	if fd.Repeated && IsScalar(fd.Type) {
+		fd.Packed = packedOpt == 1 || (proto3 && packedOpt != 0)
+	}
+	return fd, nil
+}
+
+// IsScalar reports whether fields of type t are numeric, bool or enum,
+// which are the types repeated fields can be packed for.
+func IsScalar(t int) bool {
+	switch t {
+	case TypeString, TypeBytes, TypeMessage, TypeGroup:
+		return false
+	}
+	return true
+}
+
+func (r *Registry) addEnum(scope string, b []byte) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	e := &EnumDesc{
+		Values: make(map[string]int32),
+		Names:  make(map[int32]string),
+	}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			e.Name = qualify(scope, string(f.Bytes))
+		case 2:
+			vals, err := ParseFields(f.Bytes)
+			if err != nil {
+				return err
+			}
+			var name string
+			var num int32
+			for _, v := range vals {
+				switch v.Num {
+				case 1:
+					name = string(v.Bytes)
+				case 2:
+					num = int32(v.Scalar)
+				}
+			}
+			e.Values[name] = num
+			if _, ok := e.Names[num]; !ok {
+				e.Names[num] = name
+			}
+		}
+	}
+	r.enums[e.Name] = e
+	return nil
+}
+
+func (r *Registry) addService(pkg string, b []byte) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	s := &ServiceDesc{}
+	for _, f := range fields {
+		if f.Num == 1 {
+			s.Name = qualify(pkg, string(f.Bytes))
+		}
+	}
+	for _, f := range fields {
+		if f.Num != 2 {
+			continue
+		}
+		mfields, err := ParseFields(f.Bytes)
+		if err != nil {
+			return err
+		}
+		m := &MethodDesc{}
+		for _, mf := range mfields {
+			switch mf.Num {
+			case 1:
+				m.Name = "/" + s.Name + "/" + string(mf.Bytes)
+			case 2:
+				m.Input = strings.TrimPrefix(string(mf.Bytes), ".")
+			case 3:
+				m.Output = strings.TrimPrefix(string(mf.Bytes), ".")
+			case 5:
+				m.ClientStreaming = mf.Scalar != 0
+			case 6:
+				m.ServerStreaming = mf.Scalar != 0
+			}
+		}
+		s.Methods = append(s.Methods, m)
+	}
+	r.services[s.Name] = s
+	return nil
+}
+
+// Message returns the named message type.
+func (r *Registry) Message(name string) (*MessageDesc, error) {
+	m, ok := r.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", name)
+	}
+	return m, nil
+}
+
+// Enum returns the named enum type.
+func (r *Registry) Enum(name string) (*EnumDesc, error) {
+	e, ok := r.enums[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown enum type %q", name)
+	}
+	return e, nil
+}
+
+// Method looks up an RPC by name, written as "package.Service/Method",
+// "/package.Service/Method" or "package.Service.Method".
+func (r *Registry) Method(name string) (*MethodDesc, error) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		i = strings.LastIndex(name, ".")
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("malformed method name %q", name)
+	}
+	svc, ok := r.services[name[:i]]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", name[:i])
+	}
+	full := "/" + name[:i] + "/" + name[i+1:]
+	for _, m := range svc.Methods {
+		if m.Name == full {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("service %s has no method %q", svc.Name, name[i+1:])
+}
+
+// FieldByName returns the named field, or nil.
+func (m *MessageDesc) FieldByName(name string) *FieldDesc {
+	return m.byName[name]
+}
+
+// FieldByNumber returns the field numbered num, or nil.
+func (m *MessageDesc) FieldByNumber(num int) *FieldDesc {
+	return m.byNum[num]
+}
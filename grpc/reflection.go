@@ -0,0 +1,144 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const reflectionMethod = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+
+// Reflect builds a Registry of the services the server exposes using
+// the server reflection protocol, fetching each service's file and
+// everything it imports.
+func (c *Conn) Reflect(ctx context.Context) (*Registry, error) {
+	s, err := c.NewStream(ctx, reflectionMethod, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// roundTrip sends a ServerReflectionRequest with the given field set
+	// and returns the response's fields.
+	roundTrip := func(num int, v string) ([]Field, error) {
+		if err := s.Send(AppendBytesField(nil, num, []byte(v))); err != nil {
+			return nil, err
+		}
+		msg, err := s.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("reflection: %w", err)
+		}
+		fields, err := ParseFields(msg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			if f.Num == 7 {
+				return nil, reflectionError(f.Bytes)
+			}
+		}
+		return fields, nil
+	}
+
+	reg := NewRegistry()
+	addFiles := func(fields []Field) error {
+		for _, f := range fields {
+			if f.Num != 4 {
+				continue
+			}
+			files, err := ParseFields(f.Bytes)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if file.Num != 1 {
+					continue
+				}
+				if err := reg.AddFile(file.Bytes); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	fields, err := roundTrip(7, "*")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, f := range fields {
+		if f.Num != 6 {
+			continue
+		}
+		list, err := ParseFields(f.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		for _, svc := range list {
+			names, err := ParseFields(svc.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				if n.Num == 1 {
+					services = append(services, string(n.Bytes))
+				}
+			}
+		}
+	}
+
+	for _, svc := range services {
+		if strings.HasPrefix(svc, "grpc.reflection.") {
+			continue
+		}
+		fields, err := roundTrip(4, svc)
+		if err != nil {
+			return nil, err
+		}
+		if err := addFiles(fields); err != nil {
+			return nil, err
+		}
+	}
+	// servers usually send a file's imports along with it, but aren't
+	// required to
+	for missing := reg.missingDeps(); len(missing) > 0; missing = reg.missingDeps() {
+		for _, name := range missing {
+			fields, err := roundTrip(3, name)
+			if err != nil {
+				return nil, err
+			}
+			if err := addFiles(fields); err != nil {
+				return nil, err
+			}
+			// don't ask again if the server didn't include it
+			reg.files[name] = true
+		}
+	}
+
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+func reflectionError(b []byte) error {
+	fields, err := ParseFields(b)
+	if err != nil {
+		return err
+	}
+	st := &Status{Code: Unknown}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			st.Code = int(int32(f.Scalar))
+		case 2:
+			st.Message = string(f.Bytes)
+		}
+	}
+	return fmt.Errorf("reflection: %w", st)
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+// AppendVarint appends v to b as a base-128 varint.
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendTag appends the key for field num with the given wire type.
+func AppendTag(b []byte, num int, wireType int) []byte {
+	return AppendVarint(b, uint64(num)<<3|uint64(wireType))
+}
+
+// AppendVarintField appends an int32, int64, uint32, uint64 or bool
+// field.  Zero values are omitted, as in proto3.
+func AppendVarintField(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = AppendTag(b, num, WireVarint)
+	return AppendVarint(b, v)
+}
+
+// AppendDoubleField appends a double field, omitting zero values.
+func AppendDoubleField(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = AppendTag(b, num, WireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+// AppendBytesField appends a string, bytes or embedded message field.
+// Unlike the scalar helpers it always emits the field, since an empty
+// embedded message is still significant in a repeated field.
+func AppendBytesField(b []byte, num int, v []byte) []byte {
+	b = AppendTag(b, num, WireBytes)
+	b = AppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// AppendStringField appends a string field, omitting empty strings.
+func AppendStringField(b []byte, num int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return AppendBytesField(b, num, []byte(v))
+}
+
+// AppendFixed32 appends v as a little-endian 32-bit value.
+func AppendFixed32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AppendFixed64 appends v as a little-endian 64-bit value.
+func AppendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// ConsumeVarint parses a varint at the start of b, returning its value
+// and length.  The length is 0 if b doesn't start with a valid varint.
+func ConsumeVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// A Field is a single encoded field of a protobuf message.
+type Field struct {
+	Num      int
+	WireType int
+	// Scalar is the value of varint and fixed-width fields.
+	Scalar uint64
+	// Bytes is the value of length-delimited fields.
+	Bytes []byte
+}
+
+// ParseFields splits an encoded message into its fields, in the order
+// they appear.  Groups are not supported.
+func ParseFields(b []byte) ([]Field, error) {
+	var fields []Field
+	for len(b) > 0 {
+		key, n := ConsumeVarint(b)
+		if n == 0 {
+			return nil, errTruncated
+		}
+		b = b[n:]
+		f := Field{Num: int(key >> 3), WireType: int(key & 7)}
+		switch f.WireType {
+		case WireVarint:
+			f.Scalar, n = ConsumeVarint(b)
+			if n == 0 {
+				return nil, errTruncated
+			}
+		case WireFixed64:
+			if len(b) < 8 {
+				return nil, errTruncated
+			}
+			f.Scalar, n = binary.LittleEndian.Uint64(b), 8
+		case WireFixed32:
+			if len(b) < 4 {
+				return nil, errTruncated
+			}
+			f.Scalar, n = uint64(binary.LittleEndian.Uint32(b)), 4
+		case WireBytes:
+			l, m := ConsumeVarint(b)
+			if m == 0 || uint64(len(b)-m) < l {
+				return nil, errTruncated
+			}
+			f.Bytes, n = b[m:m+int(l)], m+int(l)
+		default:
+			return nil, fmt.Errorf("proto: unsupported wire type %d for field %d", f.WireType, f.Num)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+var errTruncated = errors.New("proto: truncated message")
@@ -0,0 +1,103 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package grpc
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAppendVarint(t *testing.T) {
+	for _, test := range []struct {
+		v    uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+		{math.MaxUint64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	} {
+		got := AppendVarint(nil, test.v)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("AppendVarint(%d) = % x; want % x", test.v, got, test.want)
+		}
+		if v, n := ConsumeVarint(got); v != test.v || n != len(got) {
+			t.Errorf("ConsumeVarint(% x) = %d, %d; want %d, %d", got, v, n, test.v, len(got))
+		}
+	}
+	for _, b := range [][]byte{nil, {0x80}, bytes.Repeat([]byte{0xff}, 11)} {
+		if _, n := ConsumeVarint(b); n != 0 {
+			t.Errorf("ConsumeVarint(% x): expected an invalid varint, got length %d", b, n)
+		}
+	}
+}
+
+func TestAppendFields(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		// the examples of the protobuf encoding guide
+		{"varint", AppendVarintField(nil, 1, 150), []byte{0x08, 0x96, 0x01}},
+		{"string", AppendStringField(nil, 2, "testing"), []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{"double", AppendDoubleField(nil, 3, 1.5), []byte{0x19, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"bytes", AppendBytesField(nil, 4, []byte{1, 2}), []byte{0x22, 0x02, 1, 2}},
+		{"large field number", AppendVarintField(nil, 16, 1), []byte{0x80, 0x01, 0x01}},
+		// proto3 omits zero scalars, but not empty messages
+		{"zero varint", AppendVarintField(nil, 1, 0), nil},
+		{"zero double", AppendDoubleField(nil, 1, 0), nil},
+		{"empty string", AppendStringField(nil, 1, ""), nil},
+		{"empty bytes", AppendBytesField(nil, 1, nil), []byte{0x0a, 0x00}},
+		{"fixed32", AppendFixed32(nil, 0x01020304), []byte{4, 3, 2, 1}},
+		{"fixed64", AppendFixed64(nil, 0x0102030405060708), []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+	} {
+		if !bytes.Equal(test.got, test.want) {
+			t.Errorf("%s: got % x; want % x", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	var b []byte
+	b = AppendVarintField(b, 1, 150)
+	b = AppendDoubleField(b, 2, -2.25)
+	b = AppendStringField(b, 3, "hi")
+	b = AppendTag(b, 4, WireFixed32)
+	b = AppendFixed32(b, 7)
+	b = AppendBytesField(b, 3, nil)
+
+	fields, err := ParseFields(b)
+	if err != nil {
+		t.Fatalf("ParseFields: %s", err)
+	}
+	want := []Field{
+		{Num: 1, WireType: WireVarint, Scalar: 150},
+		{Num: 2, WireType: WireFixed64, Scalar: math.Float64bits(-2.25)},
+		{Num: 3, WireType: WireBytes, Bytes: []byte("hi")},
+		{Num: 4, WireType: WireFixed32, Scalar: 7},
+		{Num: 3, WireType: WireBytes, Bytes: []byte{}},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got %+v; want %+v", fields, want)
+	}
+
+	for _, b := range [][]byte{
+		{0x08},             // a varint without its value
+		{0x11, 0, 0},       // a short fixed64
+		{0x12, 0x05, 'a'},  // a string longer than the message
+		{0x1b, 0x00},       // a group
+		{0x80},             // a truncated key
+		{0x0d, 0x01, 0x02}, // a short fixed32
+	} {
+		if _, err := ParseFields(b); err == nil {
+			t.Errorf("ParseFields(% x): expected an error", b)
+		}
+	}
+}
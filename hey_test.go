@@ -15,6 +15,8 @@
 package main
 
 import (
+	"flag"
+	"reflect"
 	"testing"
 )
 
@@ -64,3 +66,53 @@ func TestParseAuthMetaCharacters(t *testing.T) {
 		t.Errorf("Auth header with a plus sign in the user name errored: %v", err)
 	}
 }
+
+func TestScriptFlags(t *testing.T) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.String("e", "", "")
+	fs.Int64("max-body-bytes", 0, "")
+	fs.Bool("compress-requests", false, "")
+	fs.String("env-file", "", "")
+	fs.Var(&headerSlice{}, "plugin", "")
+	fs.String("requester", "script", "")
+	fs.Int("n", 200, "")
+
+	if err := fs.Parse([]string{"-requester", "url", "-n", "10", "https://example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	if names := scriptFlags(fs); len(names) != 0 {
+		t.Errorf("expected no script flags, got %v", names)
+	}
+	if err := fs.Parse([]string{"-plugin", "x.so", "-compress-requests", "-max-body-bytes", "10", "https://example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+	if names, want := scriptFlags(fs), []string{"-compress-requests", "-max-body-bytes", "-plugin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v; want %v", names, want)
+	}
+}
+
+func TestOutputList(t *testing.T) {
+	var o outputList
+	for _, v := range []string{"csv=results.csv", "html=out/report.html", "json", "statsd=localhost:8125", "remote_write=http://localhost:9009/api/v1/push?a=b", "{{ if eq 1 1 }}x={{ .Rps }}{{ end }}"} {
+		if err := o.Set(v); err != nil {
+			t.Fatalf("Set(%q): %s", v, err)
+		}
+	}
+	want := outputList{
+		{Format: "csv", Path: "results.csv"},
+		{Format: "html", Path: "out/report.html"},
+		{Format: "json"},
+		{Format: "statsd", Path: "localhost:8125"},
+		{Format: "remote_write", Path: "http://localhost:9009/api/v1/push?a=b"},
+		{Format: "{{ if eq 1 1 }}x={{ .Rps }}{{ end }}"},
+	}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("got %v; want %v", o, want)
+	}
+	if err := o.Set("csv="); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	if err := o.Set("prometheus"); err == nil {
+		t.Errorf("expected an error for a missing address")
+	}
+}
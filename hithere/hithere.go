@@ -0,0 +1,483 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+// Package hithere embeds the load generator in other Go programs, such
+// as test harnesses and operators:
+//
+//	run, err := hithere.NewRun(
+//		hithere.WithScript("checkout.star"),
+//		hithere.WithDuration(time.Minute),
+//		hithere.WithRPS(100),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	report, err := run.Run(ctx)
+//
+// A Run wraps a requester.Work, which it configures, starts and stops,
+// so that callers needn't follow the Init/Run/Stop protocol themselves.
+package hithere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bpowers/hithere/requester"
+	"github.com/bpowers/hithere/script"
+)
+
+// UserAgent is sent with requests unless WithUserAgent is given.
+const UserAgent = "hithere/0.0.1"
+
+// An Option configures a Run.
+type Option func(*options)
+
+type options struct {
+	requester  requester.Requester
+	scriptPath string
+	source     []byte
+	env        map[string]string
+
+	n        int
+	duration time.Duration
+	rps      int
+	timeout  time.Duration
+
+	writer  io.Writer
+	outputs []requester.Output
+
+	runID     string
+	seed      int64
+	tags      map[string]string
+	host      string
+	baseURL   string
+	h2        bool
+	h2c       bool
+	userAgent string
+
+	transport func(*http.Transport) http.RoundTripper
+	sinks     []requester.Sink
+	metrics   []requester.MetricsSink
+	logger    *slog.Logger
+	hooks     []requester.Hook
+	configure []func(*requester.Work)
+
+	maxBodyBytes     int64
+	compressRequests bool
+}
+
+// WithScript runs the Starlark script at path, which may be a URI, see
+// script.New.
+func WithScript(path string) Option {
+	return func(o *options) {
+		o.scriptPath = path
+		o.source = nil
+	}
+}
+
+// WithScriptSource runs the Starlark script src, which name identifies
+// in errors and as the base for its load() calls.
+func WithScriptSource(name string, src []byte) Option {
+	return func(o *options) {
+		o.scriptPath = name
+		o.source = src
+	}
+}
+
+// WithEnv makes env available to the script, see script.WithEnv.
+func WithEnv(env map[string]string) Option {
+	return func(o *options) {
+		o.env = env
+	}
+}
+
+// WithRequester runs r instead of a script.
+func WithRequester(r requester.Requester) Option {
+	return func(o *options) {
+		o.requester = r
+	}
+}
+
+// WithRequests makes n calls to the script's main, or the Requester.
+func WithRequests(n int) Option {
+	return func(o *options) {
+		o.n = n
+	}
+}
+
+// WithDuration stops the run after d, rather than after a number of
+// requests.
+func WithDuration(d time.Duration) Option {
+	return func(o *options) {
+		o.duration = d
+	}
+}
+
+// WithRPS sets the requests per second targeted when neither
+// WithRequests nor WithDuration is given.  The default is 5.
+func WithRPS(rps int) Option {
+	return func(o *options) {
+		o.rps = rps
+	}
+}
+
+// WithTimeout sets the timeout of each request, rounded up to the
+// second.  The default is 20s.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithOutput writes the report in format, as for requester.Output, to
+// w.  Without any outputs nothing is written; the report is returned
+// from Run.
+func WithOutput(format string, w io.Writer) Option {
+	return func(o *options) {
+		o.writer = w
+		o.outputs = append(o.outputs, requester.Output{Format: format})
+	}
+}
+
+// WithOutputFile writes the report in format to the file at path.
+func WithOutputFile(format, path string) Option {
+	return func(o *options) {
+		o.outputs = append(o.outputs, requester.Output{Format: format, Path: path})
+	}
+}
+
+// WithRunID sets the ID of the run, instead of generating one.
+func WithRunID(id string) Option {
+	return func(o *options) {
+		o.runID = id
+	}
+}
+
+// WithSeed seeds the workers' random numbers, to repeat the random
+// choices of a run, instead of picking a seed.
+func WithSeed(seed int64) Option {
+	return func(o *options) {
+		o.seed = seed
+	}
+}
+
+// WithTags labels the run's results and metrics.
+func WithTags(tags map[string]string) Option {
+	return func(o *options) {
+		o.tags = tags
+	}
+}
+
+// WithHost overrides the Host header and TLS server name of requests.
+func WithHost(host string) Option {
+	return func(o *options) {
+		o.host = host
+	}
+}
+
+// WithBaseURL sends every request to the absolute URL base instead,
+// keeping its path.
+func WithBaseURL(base string) Option {
+	return func(o *options) {
+		o.baseURL = base
+	}
+}
+
+// WithHTTP2 makes requests over HTTP/2.
+func WithHTTP2() Option {
+	return func(o *options) {
+		o.h2 = true
+	}
+}
+
+// WithH2C makes requests to http:// URLs over HTTP/2 without TLS.
+func WithH2C() Option {
+	return func(o *options) {
+		o.h2c = true
+	}
+}
+
+// WithUserAgent sets the User-Agent of requests.
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
+}
+
+// WithTransport sets the RoundTripper requests are made with, given
+// the configured transport; see requester.Work.Transport.
+func WithTransport(f func(*http.Transport) http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = f
+	}
+}
+
+// WithSink sends every result of the run to s as it is reported, see
+// requester.Sink.
+func WithSink(s requester.Sink) Option {
+	return func(o *options) {
+		o.sinks = append(o.sinks, s)
+	}
+}
+
+// WithMetricsSink sends the metrics of the run to s, see
+// requester.MetricsSink.
+func WithMetricsSink(s requester.MetricsSink) Option {
+	return func(o *options) {
+		o.metrics = append(o.metrics, s)
+	}
+}
+
+// WithMaxBodyBytes reads at most n bytes of each response body, see
+// script.WithMaxBodyBytes.
+func WithMaxBodyBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBodyBytes = n
+	}
+}
+
+// WithCompressRequests gzips the bodies of the script's requests, see
+// script.WithCompressRequests.
+func WithCompressRequests() Option {
+	return func(o *options) {
+		o.compressRequests = true
+	}
+}
+
+// WithHook intercepts the HTTP requests of the run with h, see
+// requester.Hook.
+func WithHook(h requester.Hook) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, h)
+	}
+}
+
+// WithLogger sends the diagnostics of the run, and the script's
+// print() output, to logger rather than slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithWork calls f with the underlying Work before the run starts, for
+// settings without an Option of their own.
+func WithWork(f func(*requester.Work)) Option {
+	return func(o *options) {
+		o.configure = append(o.configure, f)
+	}
+}
+
+// A Run is a configured load test.  It can be run more than once, one
+// run at a time, e.g. for each step of a ramp; each run gets a new ID
+// unless WithRunID was given.
+type Run struct {
+	work     *requester.Work
+	duration time.Duration
+
+	mu      sync.Mutex
+	running bool
+	// runs counts the calls to Run, numbering each run.
+	runs int
+	// done is whether work has finished a run, and needs resetting
+	// before the next.
+	done bool
+}
+
+// ready resets the Work if it has finished a run.  r.mu must be held.
+func (r *Run) ready() {
+	if r.done {
+		r.work.Reset()
+		r.work.Init()
+		r.done = false
+	}
+}
+
+// NewRun returns a Run configured by opts, which must include
+// WithScript, WithScriptSource or WithRequester.  Scripts are loaded
+// here, so that errors in them are returned before anything runs.
+func NewRun(opts ...Option) (*Run, error) {
+	o := options{
+		rps:       5,
+		timeout:   20 * time.Second,
+		userAgent: UserAgent,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	req := o.requester
+	if req == nil {
+		if o.scriptPath == "" {
+			return nil, errors.New("hithere: no script or Requester given")
+		}
+		var scriptOpts []script.Option
+		if o.env != nil {
+			scriptOpts = append(scriptOpts, script.WithEnv(o.env))
+		}
+		if o.logger != nil {
+			scriptOpts = append(scriptOpts, script.WithLogger(o.logger))
+		}
+		if o.maxBodyBytes > 0 {
+			scriptOpts = append(scriptOpts, script.WithMaxBodyBytes(o.maxBodyBytes))
+		}
+		if o.compressRequests {
+			scriptOpts = append(scriptOpts, script.WithCompressRequests())
+		}
+		if o.source != nil {
+			scriptOpts = append(scriptOpts, script.WithSource(o.source))
+		}
+		s, err := script.New(o.scriptPath, scriptOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("script.New: %w", err)
+		}
+		if err := s.Validate(); err != nil {
+			return nil, err
+		}
+		req = s
+	}
+
+	if o.n < 0 {
+		return nil, errors.New("hithere: the number of requests can't be negative")
+	}
+	if o.rps <= 0 {
+		return nil, errors.New("hithere: the RPS must be at least 1")
+	}
+	n := o.n
+	if o.duration > 0 {
+		n = math.MaxInt32
+	}
+
+	var base *url.URL
+	if o.baseURL != "" {
+		var err error
+		base, err = url.Parse(o.baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse: %w", err)
+		}
+		if base.Scheme == "" || base.Host == "" {
+			return nil, fmt.Errorf("hithere: base URL %q isn't absolute", o.baseURL)
+		}
+	}
+
+	w := o.writer
+	if w == nil {
+		w = ioutil.Discard
+	}
+	outputs := o.outputs
+	if len(outputs) == 0 {
+		// the summary, to nowhere
+		outputs = []requester.Output{{}}
+	}
+
+	work := &requester.Work{
+		Requester: req,
+		N:         n,
+		RPS:       o.rps,
+		Timeout:   int((o.timeout + time.Second - 1) / time.Second),
+		UserAgent: o.userAgent,
+		H2:        o.h2,
+		H2C:       o.h2c,
+		Host:      o.host,
+		BaseURL:   base,
+		Writer:    w,
+		Outputs:   outputs,
+		RunID:     o.runID,
+		Seed:      o.seed,
+		Tags:      o.tags,
+		Transport: o.transport,
+		Sinks:     o.sinks,
+
+		MetricsSinks: o.metrics,
+		Logger:       o.logger,
+		Hooks:        o.hooks,
+	}
+	for _, f := range o.configure {
+		f(work)
+	}
+	work.Init()
+
+	return &Run{work: work, duration: o.duration}, nil
+}
+
+// ID returns the ID of the current run, or the last one if none is
+// running.
+func (r *Run) ID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.work.RunID
+}
+
+// Run runs the load test, blocking until it has made its requests, its
+// duration has passed, ctx is done or Stop is called, and returns its
+// report.  If ctx is done the report so far is returned with ctx's
+// error.
+func (r *Run) Run(ctx context.Context) (*requester.Report, error) {
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return nil, errors.New("hithere: Run called while already running")
+	}
+	r.ready()
+	r.running = true
+	r.runs++
+	run := r.runs
+	r.mu.Unlock()
+
+	if r.duration > 0 {
+		// the timer may fire as the run ends, and must not stop the
+		// next
+		t := time.AfterFunc(r.duration, func() { r.stopRun(run) })
+		defer t.Stop()
+	}
+	r.work.Run(ctx)
+	report := r.work.Report()
+
+	r.mu.Lock()
+	r.running = false
+	r.done = true
+	r.mu.Unlock()
+	return report, ctx.Err()
+}
+
+// Results returns a subscription to the results of the run as they
+// are reported, with a buffer of size results; see
+// requester.Subscription.  It may be called before or during Run;
+// between runs it subscribes to the next.
+func (r *Run) Results(size int) *requester.Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready()
+	return r.work.Subscribe(size)
+}
+
+// Stop stops the run early, as if its duration had passed.  It is safe
+// to call at any time, from any goroutine, and more than once.  Called
+// before Run, the run stops as soon as it starts; between runs it does
+// nothing.
+func (r *Run) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.done {
+		r.work.Stop()
+	}
+}
+
+// stopRun stops the run numbered run, if it is still running.
+func (r *Run) stopRun(run int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.runs == run && !r.done {
+		r.work.Stop()
+	}
+}
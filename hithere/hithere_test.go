@@ -0,0 +1,129 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package hithere
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}))
+	defer server.Close()
+
+	src := `
+def main(ctx):
+    requests.get(ctx.vars["URL"], data=None, headers={})
+`
+	var buf bytes.Buffer
+	run, err := NewRun(
+		WithScriptSource("inline.star", []byte(src)),
+		WithEnv(map[string]string{"URL": server.URL}),
+		WithRequests(3),
+		WithOutput("csv", &buf),
+		WithTags(map[string]string{"suite": "embed"}),
+	)
+	if err != nil {
+		t.Fatalf("NewRun: %s", err)
+	}
+	results := run.Results(10)
+	report, err := run.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	var streamed int
+	for range results.C {
+		streamed++
+	}
+	if streamed != 3 {
+		t.Errorf("expected 3 streamed results, got %d", streamed)
+	}
+	if report.NumRes != 3 || atomic.LoadInt64(&count) != 3 {
+		t.Errorf("expected 3 requests, got %d (%d served)", report.NumRes, count)
+	}
+	if report.RunID != run.ID() || report.Tags["suite"] != "embed" {
+		t.Errorf("unexpected run ID %q and tags %v", report.RunID, report.Tags)
+	}
+	if !strings.HasPrefix(buf.String(), "response-time,") {
+		t.Errorf("expected CSV output, got:\n%s", buf.String())
+	}
+
+	// run it again, as for the next step of a ramp
+	firstID := run.ID()
+	results = run.Results(10)
+	report, err = run.Run(context.Background())
+	if err != nil {
+		t.Fatalf("second Run: %s", err)
+	}
+	streamed = 0
+	for range results.C {
+		streamed++
+	}
+	if report.NumRes != 3 || streamed != 3 || atomic.LoadInt64(&count) != 6 {
+		t.Errorf("expected 3 more requests, got %d (%d streamed, %d served)", report.NumRes, streamed, count)
+	}
+	if report.RunID == firstID || report.RunID != run.ID() {
+		t.Errorf("expected a new run ID, got %q after %q", report.RunID, firstID)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	run, err := NewRun(
+		WithScriptSource("inline.star", []byte(`def main(ctx): requests.get("`+server.URL+`", data=None, headers={})`)),
+		WithDuration(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("NewRun: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := run.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if report == nil || report.NumRes == 0 {
+		t.Errorf("expected the report so far, got %+v", report)
+	}
+	// stopping a finished run is harmless
+	run.Stop()
+
+	// as is the timer of the last run firing late, during the next
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		run.stopRun(1)
+	}()
+	if _, err := run.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the second run to go on until the context's deadline, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestNewRunErrors(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithScriptSource("bad.star", []byte(`def main(ctx)`))},
+		{WithScriptSource("nomain.star", []byte(`x = 1`))},
+		{WithScriptSource("ok.star", []byte(`def main(ctx): pass`)), WithBaseURL("/relative")},
+		{WithScriptSource("ok.star", []byte(`def main(ctx): pass`)), WithRequests(-1)},
+	} {
+		if _, err := NewRun(opts...); err == nil {
+			t.Errorf("NewRun(%d options): expected an error", len(opts))
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+// Package kafka is a minimal Kafka producer.
+//
+// It implements just enough of the Kafka protocol (Metadata v4 to find
+// partition leaders, and Produce v3 with v2 record batches) for hithere
+// to load test brokers without pulling in a full client.  Compression,
+// idempotent producers and transactions are not supported.
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const clientID = "hithere"
+
+// defaultProduceTimeout is how long brokers wait for replicas to
+// acknowledge a write when acks is -1 and no timeout is given.
+const defaultProduceTimeout = 30 * time.Second
+
+// API keys and the versions of them we speak.
+const (
+	apiProduce      = 0
+	apiMetadata     = 3
+	produceVersion  = 3
+	metadataVersion = 4
+)
+
+// Error is a non-zero error code returned by a broker.
+type Error int16
+
+// Error codes that mean the client's metadata is out of date.
+const (
+	UnknownTopicOrPartition Error = 3
+	LeaderNotAvailable      Error = 5
+	NotLeaderForPartition   Error = 6
+)
+
+var errorNames = map[Error]string{
+	-1: "unknown server error",
+	1:  "offset out of range",
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+	87: "invalid record",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// Client produces records to a Kafka cluster.  It is safe for
+// concurrent use by multiple goroutines, each request using its own
+// connection from a pool.
+type Client struct {
+	bootstrap     []string
+	correlationID int32
+
+	mu      sync.Mutex
+	addrs   map[int32]string
+	leaders map[string][]int32
+	idle    map[string][]net.Conn
+}
+
+// NewClient returns a Client for the cluster with the given bootstrap
+// brokers, each "host:port".  No network I/O happens until the first
+// request.
+func NewClient(brokers []string) *Client {
+	return &Client{
+		bootstrap: brokers,
+		addrs:     make(map[int32]string),
+		leaders:   make(map[string][]int32),
+		idle:      make(map[string][]net.Conn),
+	}
+}
+
+// Partitions returns the number of partitions of topic, fetching the
+// cluster's metadata if it isn't already known.
+func (c *Client) Partitions(ctx context.Context, topic string) (int, error) {
+	leaders, err := c.topicLeaders(ctx, topic)
+	if err != nil {
+		return 0, err
+	}
+	return len(leaders), nil
+}
+
+// Partition returns the partition of n a keyed record belongs in,
+// matching the Java client's default partitioner.
+func Partition(key []byte, n int) int32 {
+	return int32(int(murmur2(key)&0x7fffffff) % n)
+}
+
+// Produce writes records to a partition of topic, returning the offset
+// of the first.  acks is the number of acknowledgements the leader
+// waits for: 0 for none (in which case the offset is -1), 1 for its
+// own, or -1 for all in-sync replicas within timeout.
+func (c *Client) Produce(ctx context.Context, topic string, partition int32, records []Record, acks int16, timeout time.Duration) (int64, error) {
+	leaders, err := c.topicLeaders(ctx, topic)
+	if err != nil {
+		return -1, err
+	}
+	if partition < 0 || int(partition) >= len(leaders) {
+		return -1, fmt.Errorf("kafka: topic %s has no partition %d", topic, partition)
+	}
+	c.mu.Lock()
+	addr, ok := c.addrs[leaders[partition]]
+	c.mu.Unlock()
+	if !ok {
+		c.invalidate(topic)
+		return -1, LeaderNotAvailable
+	}
+	if timeout <= 0 {
+		timeout = defaultProduceTimeout
+	}
+
+	e := &encoder{}
+	e.nullString() // transactional ID
+	e.int16(acks)
+	e.int32(int32(timeout / time.Millisecond))
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(partition)
+	batch := appendRecordBatch(nil, records, time.Now().UnixNano()/int64(time.Millisecond))
+	e.bytes(batch)
+
+	resp, err := c.roundTrip(ctx, addr, apiProduce, produceVersion, e.b, acks != 0)
+	if err != nil || acks == 0 {
+		return -1, err
+	}
+
+	d := &decoder{b: resp}
+	offset := int64(-1)
+	var code Error
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		d.string()
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			d.int32()
+			code = Error(d.int16())
+			offset = d.int64()
+			d.int64() // log append time
+		}
+	}
+	if d.err != nil {
+		return -1, d.err
+	}
+	if code != 0 {
+		switch code {
+		case UnknownTopicOrPartition, LeaderNotAvailable, NotLeaderForPartition:
+			c.invalidate(topic)
+		}
+		return -1, code
+	}
+	return offset, nil
+}
+
+// Close closes idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, conns := range c.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(c.idle, addr)
+	}
+	return nil
+}
+
+func (c *Client) invalidate(topic string) {
+	c.mu.Lock()
+	delete(c.leaders, topic)
+	c.mu.Unlock()
+}
+
+// topicLeaders returns the broker ID leading each partition of topic.
+func (c *Client) topicLeaders(ctx context.Context, topic string) ([]int32, error) {
+	c.mu.Lock()
+	leaders, ok := c.leaders[topic]
+	c.mu.Unlock()
+	if ok {
+		return leaders, nil
+	}
+
+	e := &encoder{}
+	e.int32(1)
+	e.string(topic)
+	e.int8(1) // allow auto topic creation
+
+	var err error
+	for _, addr := range c.bootstrap {
+		var resp []byte
+		resp, err = c.roundTrip(ctx, addr, apiMetadata, metadataVersion, e.b, true)
+		if err != nil {
+			continue
+		}
+		return c.updateMetadata(topic, resp)
+	}
+	if err == nil {
+		err = fmt.Errorf("kafka: no brokers")
+	}
+	return nil, err
+}
+
+func (c *Client) updateMetadata(topic string, resp []byte) ([]int32, error) {
+	d := &decoder{b: resp}
+	d.int32() // throttle time
+	addrs := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster ID
+	d.int32()  // controller ID
+
+	var leaders []int32
+	var code Error
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		code = Error(d.int16())
+		name := d.string()
+		d.int8() // is internal
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			d.int16()
+			index := d.int32()
+			leader := d.int32()
+			for k, l := 0, d.arrayLen(); k < l && d.err == nil; k++ {
+				d.int32() // replicas
+			}
+			for k, l := 0, d.arrayLen(); k < l && d.err == nil; k++ {
+				d.int32() // in-sync replicas
+			}
+			if name != topic {
+				continue
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[index] = leader
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if code != 0 {
+		return nil, code
+	}
+	if len(leaders) == 0 {
+		return nil, UnknownTopicOrPartition
+	}
+
+	c.mu.Lock()
+	for id, addr := range addrs {
+		c.addrs[id] = addr
+	}
+	c.leaders[topic] = leaders
+	c.mu.Unlock()
+	return leaders, nil
+}
+
+// roundTrip sends a request to addr and, if a response is expected,
+// returns its body after the header.
+func (c *Client) roundTrip(ctx context.Context, addr string, apiKey, version int16, body []byte, expectResponse bool) ([]byte, error) {
+	conn, err := c.get(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	d, _ := ctx.Deadline()
+	conn.SetDeadline(d)
+
+	id := atomic.AddInt32(&c.correlationID, 1)
+	e := &encoder{}
+	e.int32(0) // size, filled in below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(id)
+	e.string(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	resp, err := func() ([]byte, error) {
+		if _, err := conn.Write(e.b); err != nil {
+			return nil, err
+		}
+		if !expectResponse {
+			return nil, nil
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != id {
+			return nil, fmt.Errorf("kafka: mismatched correlation ID")
+		}
+		return resp[4:], nil
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.put(addr, conn)
+	return resp, nil
+}
+
+func (c *Client) get(ctx context.Context, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	if conns := c.idle[addr]; len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		c.idle[addr] = conns[:len(conns)-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (c *Client) put(addr string, conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	c.idle[addr] = append(c.idle[addr], conn)
+	c.mu.Unlock()
+}
@@ -0,0 +1,286 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRequest is a request a testBroker received.
+type testRequest struct {
+	apiKey, version int16
+	clientID        string
+	body            []byte
+}
+
+// testBroker is a cluster of one broker, with ID 7, answering each
+// request with what respond returns for it, or nothing if nil.
+type testBroker struct {
+	ln      net.Listener
+	respond func(req testRequest) []byte
+
+	mu       sync.Mutex
+	requests []testRequest
+}
+
+func newTestBroker(t *testing.T, respond func(req testRequest) []byte) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, respond: respond}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		d := &decoder{b: buf}
+		req := testRequest{apiKey: d.int16(), version: d.int16()}
+		correlationID := d.int32()
+		req.clientID = d.string()
+		req.body = d.b
+		b.mu.Lock()
+		b.requests = append(b.requests, req)
+		b.mu.Unlock()
+
+		resp := b.respond(req)
+		if resp == nil {
+			continue
+		}
+		e := &encoder{}
+		e.int32(int32(4 + len(resp)))
+		e.int32(correlationID)
+		c.Write(append(e.b, resp...))
+	}
+}
+
+// count returns the number of requests for apiKey received.
+func (b *testBroker) count(apiKey int16) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, req := range b.requests {
+		if req.apiKey == apiKey {
+			n++
+		}
+	}
+	return n
+}
+
+// last returns the last request received.
+func (b *testBroker) last() testRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests[len(b.requests)-1]
+}
+
+// metadataResponse is a Metadata v4 response for topic, led by broker
+// 7 at addr.
+func metadataResponse(addr, topic string, code Error, partitions int) []byte {
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	e := &encoder{}
+	e.int32(0) // throttle time
+	e.int32(1)
+	e.int32(7)
+	e.string(host)
+	e.int32(int32(portNum))
+	e.nullString() // rack
+	e.nullString() // cluster ID
+	e.int32(7)     // controller ID
+	e.int32(1)
+	e.int16(int16(code))
+	e.string(topic)
+	e.int8(0) // is internal
+	e.int32(int32(partitions))
+	for i := 0; i < partitions; i++ {
+		e.int16(0)
+		e.int32(int32(i))
+		e.int32(7) // leader
+		e.int32(1)
+		e.int32(7) // replicas
+		e.int32(1)
+		e.int32(7) // in-sync replicas
+	}
+	return e.b
+}
+
+// produceResponse is a Produce v3 response for a single partition.
+func produceResponse(topic string, partition int32, code Error, offset int64) []byte {
+	e := &encoder{}
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(partition)
+	e.int16(int16(code))
+	e.int64(offset)
+	e.int64(-1) // log append time
+	e.int32(0)  // throttle time
+	return e.b
+}
+
+func TestProduce(t *testing.T) {
+	var b *testBroker
+	b = newTestBroker(t, func(req testRequest) []byte {
+		switch req.apiKey {
+		case apiMetadata:
+			return metadataResponse(b.ln.Addr().String(), "events", 0, 3)
+		case apiProduce:
+			if binary.BigEndian.Uint16(req.body[2:]) == 0 {
+				// acks=0 gets no response
+				return nil
+			}
+			return produceResponse("events", 2, 0, 42)
+		}
+		return nil
+	})
+	defer b.ln.Close()
+	c := NewClient([]string{b.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if n, err := c.Partitions(ctx, "events"); n != 3 || err != nil {
+		t.Fatalf("Partitions: got %d, %v", n, err)
+	}
+	req := b.last()
+	if req.apiKey != apiMetadata || req.version != metadataVersion || req.clientID != clientID {
+		t.Errorf("unexpected metadata request header: %+v", req)
+	}
+	d := &decoder{b: req.body}
+	if n, topic, autoCreate := d.int32(), d.string(), d.int8(); n != 1 || topic != "events" || autoCreate != 1 || d.err != nil || len(d.b) != 0 {
+		t.Errorf("unexpected metadata request: % x", req.body)
+	}
+
+	records := []Record{{Key: []byte("k"), Value: []byte("v")}, {Value: []byte("w")}}
+	offset, err := c.Produce(ctx, "events", 2, records, -1, 5*time.Second)
+	if offset != 42 || err != nil {
+		t.Fatalf("Produce: got %d, %v", offset, err)
+	}
+	req = b.last()
+	if req.apiKey != apiProduce || req.version != produceVersion || req.clientID != clientID {
+		t.Errorf("unexpected produce request header: %+v", req)
+	}
+	d = &decoder{b: req.body}
+	transactionalID := d.int16()
+	acks, timeout := d.int16(), d.int32()
+	topics, topic := d.int32(), d.string()
+	partitions, partition := d.int32(), d.int32()
+	batch := d.take(int(d.int32()))
+	if transactionalID != -1 || acks != -1 || timeout != 5000 || topics != 1 || topic != "events" || partitions != 1 || partition != 2 || d.err != nil || len(d.b) != 0 {
+		t.Errorf("unexpected produce request: % x", req.body)
+	}
+	// the record count, after the batch's header
+	if len(batch) < 61 || binary.BigEndian.Uint32(batch[57:]) != 2 {
+		t.Errorf("expected a batch of 2 records, got % x", batch)
+	}
+	if n := b.count(apiMetadata); n != 1 {
+		t.Errorf("expected the metadata to be cached, got %d requests for it", n)
+	}
+
+	// without acks there is no response to wait for, or offset
+	if offset, err := c.Produce(ctx, "events", 0, records, 0, 0); offset != -1 || err != nil {
+		t.Errorf("Produce without acks: got %d, %v", offset, err)
+	}
+	if offset, err := c.Produce(ctx, "events", 2, records, 1, 0); offset != 42 || err != nil {
+		t.Errorf("Produce after one without acks: got %d, %v", offset, err)
+	}
+	if _, err := c.Produce(ctx, "events", 3, records, 1, 0); err == nil {
+		t.Errorf("expected an error for a partition the topic doesn't have")
+	}
+}
+
+func TestProduceErrors(t *testing.T) {
+	var mu sync.Mutex
+	var metadataCode, produceCode Error
+	var b *testBroker
+	b = newTestBroker(t, func(req testRequest) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.apiKey {
+		case apiMetadata:
+			return metadataResponse(b.ln.Addr().String(), "events", metadataCode, 1)
+		case apiProduce:
+			return produceResponse("events", 0, produceCode, 0)
+		}
+		return nil
+	})
+	defer b.ln.Close()
+	c := NewClient([]string{b.ln.Addr().String()})
+	defer c.Close()
+	ctx := context.Background()
+	records := []Record{{Value: []byte("v")}}
+	setCodes := func(metadata, produce Error) {
+		mu.Lock()
+		metadataCode, produceCode = metadata, produce
+		mu.Unlock()
+	}
+
+	setCodes(UnknownTopicOrPartition, 0)
+	if _, err := c.Partitions(ctx, "events"); err != UnknownTopicOrPartition {
+		t.Errorf("expected the topic's error, got %v", err)
+	}
+
+	// a stale leader makes the client fetch the metadata again
+	setCodes(0, NotLeaderForPartition)
+	if _, err := c.Produce(ctx, "events", 0, records, 1, 0); err != NotLeaderForPartition {
+		t.Errorf("expected %v, got %v", NotLeaderForPartition, err)
+	}
+	metadata := b.count(apiMetadata)
+	setCodes(0, 87)
+	_, err := c.Produce(ctx, "events", 0, records, 1, 0)
+	if err != Error(87) || err.Error() != "kafka: invalid record" {
+		t.Errorf("expected an invalid record error, got %v", err)
+	}
+	if n := b.count(apiMetadata); n != metadata+1 {
+		t.Errorf("expected the metadata to be fetched again, got %d requests for it after %d", n, metadata)
+	}
+	// other errors don't
+	if _, err := c.Produce(ctx, "events", 0, records, 1, 0); err != Error(87) {
+		t.Errorf("expected an invalid record error, got %v", err)
+	}
+	if n := b.count(apiMetadata); n != metadata+1 {
+		t.Errorf("expected the metadata to stay cached, got %d requests for it", n)
+	}
+
+	if got := Error(99).Error(); got != "kafka: error code 99" {
+		t.Errorf("unknown error code: got %q", got)
+	}
+
+	// with no broker to ask
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := NewClient([]string{addr}).Partitions(ctx, "events"); err == nil {
+		t.Errorf("expected an error without a broker")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	e := &encoder{}
+	e.int8(-2)
+	e.int16(0x0102)
+	e.int32(-1)
+	e.int64(0x0102030405060708)
+	e.string("ab")
+	e.nullString()
+	e.bytes([]byte{9})
+	e.varint(-1)
+	e.varint(150)
+	e.varbytes(nil)
+	e.varbytes([]byte("x"))
+	want := []byte{
+		0xfe,
+		0x01, 0x02,
+		0xff, 0xff, 0xff, 0xff,
+		1, 2, 3, 4, 5, 6, 7, 8,
+		0, 2, 'a', 'b',
+		0xff, 0xff,
+		0, 0, 0, 1, 9,
+		// zig-zag varints: -1 is 1, 150 is 300
+		0x01,
+		0xac, 0x02,
+		0x01,
+		0x02, 'x',
+	}
+	if !bytes.Equal(e.b, want) {
+		t.Errorf("got  % x\nwant % x", e.b, want)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	d := &decoder{b: []byte{
+		0xfe,
+		0x01, 0x02,
+		0xff, 0xff, 0xff, 0xff,
+		1, 2, 3, 4, 5, 6, 7, 8,
+		0, 2, 'a', 'b',
+		0xff, 0xff,
+		0, 0, 0, 2,
+		0xff, 0xff, 0xff, 0xff,
+	}}
+	if v := d.int8(); v != -2 {
+		t.Errorf("int8: got %d", v)
+	}
+	if v := d.int16(); v != 0x0102 {
+		t.Errorf("int16: got %#x", v)
+	}
+	if v := d.int32(); v != -1 {
+		t.Errorf("int32: got %d", v)
+	}
+	if v := d.int64(); v != 0x0102030405060708 {
+		t.Errorf("int64: got %#x", v)
+	}
+	if v := d.string(); v != "ab" {
+		t.Errorf("string: got %q", v)
+	}
+	if v := d.string(); v != "" {
+		t.Errorf("null string: got %q", v)
+	}
+	// an array of 2 needs at least 2 more bytes, which there are
+	if n := d.arrayLen(); n != 2 || d.err != nil {
+		t.Errorf("arrayLen: got %d, %v", n, d.err)
+	}
+	if n := d.arrayLen(); n != 0 || d.err != nil {
+		t.Errorf("null array: got %d, %v", n, d.err)
+	}
+
+	// errors are sticky, and what follows them zero
+	d = &decoder{b: []byte{0, 5, 'a'}}
+	if v := d.string(); v != "" || d.err != errTruncated {
+		t.Errorf("truncated string: got %q, %v", v, d.err)
+	}
+	if v := d.int8(); v != 0 || d.err != errTruncated {
+		t.Errorf("after an error: got %d, %v", v, d.err)
+	}
+	d = &decoder{b: []byte{0, 0, 0, 100, 1}}
+	if d.arrayLen(); d.err != errTruncated {
+		t.Errorf("expected an array longer than the response to be truncated, got %v", d.err)
+	}
+}
+
+func TestAppendRecordBatch(t *testing.T) {
+	records := []Record{{Key: []byte("k"), Value: []byte("one")}, {Value: []byte("two")}}
+	b := appendRecordBatch([]byte{0xaa}, records, 1000)
+	if b[0] != 0xaa {
+		t.Fatalf("expected the batch to be appended")
+	}
+	b = b[1:]
+
+	d := &decoder{b: b}
+	if offset := d.int64(); offset != 0 {
+		t.Errorf("base offset: got %d", offset)
+	}
+	if n := d.int32(); int(n) != len(b)-12 {
+		t.Errorf("batch length: got %d, want %d", n, len(b)-12)
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != 2 {
+		t.Errorf("magic: got %d", magic)
+	}
+	crc := uint32(d.int32())
+	if want := crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)); crc != want {
+		t.Errorf("CRC: got %#x, want %#x", crc, want)
+	}
+	attributes, lastOffsetDelta := d.int16(), d.int32()
+	first, maxTimestamp := d.int64(), d.int64()
+	producerID, producerEpoch, baseSequence := d.int64(), d.int16(), d.int32()
+	if attributes != 0 || lastOffsetDelta != 1 || first != 1000 || maxTimestamp != 1000 || producerID != -1 || producerEpoch != -1 || baseSequence != -1 {
+		t.Errorf("unexpected batch header: %d %d %d %d %d %d %d", attributes, lastOffsetDelta, first, maxTimestamp, producerID, producerEpoch, baseSequence)
+	}
+	if n := d.int32(); n != 2 {
+		t.Fatalf("records: got %d", n)
+	}
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+
+	rest := d.b
+	varint := func() int64 {
+		v, n := binary.Varint(rest)
+		if n <= 0 {
+			t.Fatalf("bad varint in % x", rest)
+		}
+		rest = rest[n:]
+		return v
+	}
+	varbytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		v := rest[:n]
+		rest = rest[n:]
+		return v
+	}
+	for i, r := range records {
+		length := varint()
+		start := len(rest)
+		if attributes := rest[0]; attributes != 0 {
+			t.Errorf("record %d: attributes %d", i, attributes)
+		}
+		rest = rest[1:]
+		timestampDelta, offsetDelta := varint(), varint()
+		key, value := varbytes(), varbytes()
+		headers := varint()
+		if timestampDelta != 0 || offsetDelta != int64(i) || !bytes.Equal(key, r.Key) || (key == nil) != (r.Key == nil) || !bytes.Equal(value, r.Value) || headers != 0 {
+			t.Errorf("record %d: got %d %d %q %q %d", i, timestampDelta, offsetDelta, key, value, headers)
+		}
+		if int(length) != start-len(rest) {
+			t.Errorf("record %d: length %d, but took %d bytes", i, length, start-len(rest))
+		}
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left over", len(rest))
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// the Java client's test vectors
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d; want %d", key, got, want)
+		}
+	}
+	if p := Partition([]byte("foobar"), 3); p != int32((-790332482&0x7fffffff)%3) {
+		t.Errorf("Partition: got %d", p)
+	}
+}
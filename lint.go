@@ -0,0 +1,69 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bpowers/hithere/script"
+)
+
+var lintUsage = `Usage: hey lint [-env-file file] [-plugin file]... <script>...
+
+Checks that each script loads, running its top level, and defines a
+main() function, without making any requests from main().
+`
+
+func lintMain(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, lintUsage)
+	}
+	envFile := fs.String("env-file", "", "")
+	var plugins headerSlice
+	fs.Var(&plugins, "plugin", "")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var opts []script.Option
+	if *envFile != "" {
+		env, err := script.ReadEnvFile(*envFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lint: %s\n", err)
+			return 1
+		}
+		opts = append(opts, script.WithEnv(env))
+	}
+	for _, path := range plugins {
+		modules, err := script.LoadPlugin(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lint: %s\n", err)
+			return 1
+		}
+		opts = append(opts, script.WithModules(modules))
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		if err := lint(path, opts...); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func lint(path string, opts ...script.Option) error {
+	s, err := script.New(path, opts...)
+	if err != nil {
+		return err
+	}
+	return s.Validate()
+}
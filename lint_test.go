@@ -0,0 +1,35 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for src, ok := range map[string]bool{
+		"def main(ctx):\n    pass\n": true,
+		"main = 1\n":                 false,
+		"def run(ctx):\n    pass\n":  false,
+		"def main(ctx)\n":            false,
+	} {
+		path := filepath.Join(dir, "lint.star")
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := lint(path); (err == nil) != ok {
+			t.Errorf("lint(%q): got error %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+)
+
+// setLogFormat makes the default slog.Logger, which the requester and
+// scripts log to, and through it the log package, write in the given
+// format.  "text", the default, leaves log's output as it is.
+func setLogFormat(format string) error {
+	h, err := newLogHandler(format, log.Writer())
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		slog.SetDefault(slog.New(h))
+	}
+	return nil
+}
+
+// newLogHandler returns the handler writing format to w, or nil for
+// "text".
+func newLogHandler(format string, w io.Writer) (slog.Handler, error) {
+	switch format {
+	case "", "text":
+		return nil, nil
+	case "json":
+		return slog.NewJSONHandler(w, nil), nil
+	case "logfmt":
+		return slog.NewTextHandler(w, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q; expected text, json or logfmt", format)
+	}
+}
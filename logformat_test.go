@@ -0,0 +1,61 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := newLogHandler("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).With("run_id", "r1").Info("[a.star:3:10] hi", "worker", 2)
+	slog.NewLogLogger(h, slog.LevelInfo).Printf("collector: %q failed", "x")
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%q isn't JSON: %s", line, err)
+		}
+		if m["time"] == nil {
+			t.Errorf("expected a time in %q", line)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	if lines[0]["msg"] != "[a.star:3:10] hi" || lines[0]["run_id"] != "r1" || lines[0]["worker"] != 2.0 {
+		t.Errorf("unexpected line %v", lines[0])
+	}
+	if lines[1]["msg"] != `collector: "x" failed` {
+		t.Errorf("unexpected line %v", lines[1])
+	}
+
+	buf.Reset()
+	h, err = newLogHandler("logfmt", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("collector failed", "run_id", "r1")
+	if got := buf.String(); !strings.Contains(got, ` level=INFO msg="collector failed" run_id=r1`) {
+		t.Errorf("unexpected logfmt line %q", got)
+	}
+
+	if h, err := newLogHandler("text", &buf); h != nil || err != nil {
+		t.Errorf("expected text to keep the log package's output")
+	}
+	if err := setLogFormat("xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// recordMain is the record command, which is to write a script from
+// recorded traffic.  It isn't implemented yet.
+func recordMain(args []string) int {
+	fmt.Fprintln(os.Stderr, "record: not implemented yet; use hey convert --curl for single requests")
+	return 1
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+var reportUsage = `Usage: hey report [-o format[=file]]... <checkpoint>
+
+Writes the report of a run from its -checkpoint file, as if the run
+had finished when the checkpoint was written: for a run that was
+killed, or in other formats than the run wrote.  -o is as for run,
+except for the exporters.  Default is the summary, to stdout.
+`
+
+func reportMain(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, reportUsage)
+	}
+	var outputs outputList
+	fs.Var(&outputs, "o", "")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := renderCheckpoint(fs.Arg(0), outputs, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "report: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// renderCheckpoint writes the report of the checkpoint at path in each
+// of outputs, or the summary, to w unless they have a file.
+func renderCheckpoint(path string, outputs []requester.Output, w io.Writer) error {
+	if len(outputs) == 0 {
+		outputs = []requester.Output{{}}
+	}
+	for _, o := range outputs {
+		switch o.Format {
+		case "prometheus", "statsd", "remote_write":
+			return fmt.Errorf("-o %s: only exports a run in progress", o.Format)
+		}
+	}
+	cp, err := requester.ReadCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	r := cp.Report()
+	for _, o := range outputs {
+		s := requester.NewWriterSink(o.Format, w)
+		if o.Path != "" {
+			s = requester.NewFileSink(o.Format, o.Path)
+		}
+		if err := s.Report(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
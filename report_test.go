@@ -0,0 +1,78 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+func TestRenderCheckpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.checkpoint")
+
+	req, err := requester.New("url", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &requester.Work{
+		Requester:      req,
+		N:              3,
+		Writer:         ioutil.Discard,
+		RunID:          "r1",
+		CheckpointPath: path,
+	}
+	w.Run(context.Background())
+
+	var buf bytes.Buffer
+	csvPath := filepath.Join(dir, "out.csv")
+	if err := renderCheckpoint(path, []requester.Output{{Format: "json"}, {Format: "csv", Path: csvPath}}, &buf); err != nil {
+		t.Fatalf("renderCheckpoint: %s", err)
+	}
+	var summary requester.Summary
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.RunID != "r1" || summary.Requests != 3 || summary.StatusCodeDist[http.StatusTeapot] != 3 {
+		t.Errorf("expected the checkpointed run's results, got %+v", summary)
+	}
+	csv, err := ioutil.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(csv)), "\n"); len(lines) != 4 {
+		t.Errorf("expected a header and 3 requests, got:\n%s", csv)
+	}
+
+	buf.Reset()
+	if err := renderCheckpoint(path, nil, &buf); err != nil || !strings.Contains(buf.String(), "Summary:") {
+		t.Errorf("expected the summary by default, got %v:\n%s", err, buf.String())
+	}
+	if err := renderCheckpoint(path, []requester.Output{{Format: "statsd", Path: "localhost:8125"}}, &buf); err == nil {
+		t.Errorf("expected an error exporting a finished run")
+	}
+	if err := renderCheckpoint(filepath.Join(dir, "missing"), nil, &buf); err == nil {
+		t.Errorf("expected an error for a missing checkpoint")
+	}
+}
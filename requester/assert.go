@@ -0,0 +1,301 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Assertion is a Hook failing the results of the requests it
+// applies to that don't meet its condition, so that gates can be added
+// to a run without editing its script.  Assertions are written as
+//
+//	[PATTERN =>] CONDITION
+//
+// where PATTERN matches the names of the results to check, like
+// "GET http://host/path", with * matching anything, and CONDITION is
+// one of:
+//
+//	status 200          status 2xx          status 200-299,304
+//	latency < 500ms
+//	body contains TEXT
+//	json PATH == VALUE  json PATH != VALUE  json PATH exists
+//
+// PATH is a JSONPath, like $.items[0].id, and VALUE is JSON.  Without
+// a PATTERN the assertion applies to every request.  A result that
+// fails an assertion is reported with an error naming it; results that
+// already failed aren't checked.
+type Assertion struct {
+	src     string
+	pattern *regexp.Regexp
+	check   func(resp *http.Response, res *Result) bool
+}
+
+var _ Hook = (*Assertion)(nil)
+
+// ParseAssertion parses an assertion, see Assertion.
+func ParseAssertion(s string) (*Assertion, error) {
+	a := &Assertion{src: strings.TrimSpace(s)}
+	cond := a.src
+	if i := strings.Index(cond, "=>"); i >= 0 {
+		pattern := strings.TrimSpace(cond[:i])
+		if pattern == "" {
+			return nil, fmt.Errorf("assertion %q: empty pattern", s)
+		}
+		a.pattern = globRegexp(pattern)
+		cond = strings.TrimSpace(cond[i+2:])
+	}
+	kind, arg := cut(cond)
+	var err error
+	switch kind {
+	case "status":
+		a.check, err = statusCheck(arg)
+	case "latency":
+		a.check, err = latencyCheck(arg)
+	case "body":
+		a.check, err = bodyCheck(arg)
+	case "json":
+		a.check, err = jsonCheck(arg)
+	default:
+		err = fmt.Errorf("unknown condition %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("assertion %q: %w", s, err)
+	}
+	return a, nil
+}
+
+func (a *Assertion) String() string {
+	return a.src
+}
+
+// BeforeRequest lets every request through.
+func (a *Assertion) BeforeRequest(*http.Request) error {
+	return nil
+}
+
+// AfterResponse fails res if it doesn't meet the condition.  The error
+// is the same for every failure, so that they are counted together.
+func (a *Assertion) AfterResponse(req *http.Request, resp *http.Response, res *Result) {
+	if res.Err != nil || resp == nil {
+		return
+	}
+	if a.pattern != nil && !a.pattern.MatchString(res.Name) {
+		return
+	}
+	if !a.check(resp, res) {
+		res.Err = fmt.Errorf("assertion failed: %s", a.src)
+	}
+}
+
+// globRegexp returns a regexp matching all of s, with * matching any
+// run of characters.
+func globRegexp(s string) *regexp.Regexp {
+	parts := strings.Split(s, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// cut splits s at its first space.
+func cut(s string) (first, rest string) {
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// statusCheck checks the status code is one of a comma separated list
+// of codes, ranges like 200-299, or classes like 2xx.
+func statusCheck(arg string) (func(*http.Response, *Result) bool, error) {
+	type span struct{ lo, hi int }
+	var spans []span
+	for _, s := range strings.Split(arg, ",") {
+		s = strings.TrimSpace(s)
+		lo, hi := s, s
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			lo, hi = s[:i], s[i+1:]
+		} else if len(s) == 3 && strings.HasSuffix(s, "xx") {
+			lo, hi = s[:1]+"00", s[:1]+"99"
+		}
+		l, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+		h, err := strconv.Atoi(hi)
+		if err != nil || h < l {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+		spans = append(spans, span{l, h})
+	}
+	return func(_ *http.Response, res *Result) bool {
+		for _, s := range spans {
+			if s.lo <= res.StatusCode && res.StatusCode <= s.hi {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// latencyCheck checks the duration of the request is below a maximum,
+// given as "< 500ms", or "<= 500ms".
+func latencyCheck(arg string) (func(*http.Response, *Result) bool, error) {
+	op, arg := cut(arg)
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return nil, fmt.Errorf("time.ParseDuration: %w", err)
+	}
+	switch op {
+	case "<":
+		return func(_ *http.Response, res *Result) bool { return res.Duration < d }, nil
+	case "<=":
+		return func(_ *http.Response, res *Result) bool { return res.Duration <= d }, nil
+	}
+	return nil, fmt.Errorf("expected latency < DURATION, got %q", op)
+}
+
+// bodyCheck checks the response body contains some text, which may be
+// quoted, as a Go string.
+func bodyCheck(arg string) (func(*http.Response, *Result) bool, error) {
+	op, text := cut(arg)
+	if op != "contains" || text == "" {
+		return nil, errors.New("expected body contains TEXT")
+	}
+	if len(text) > 1 && strings.HasPrefix(text, `"`) && strings.HasSuffix(text, `"`) {
+		unquoted, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("malformed string %s", text)
+		}
+		text = unquoted
+	}
+	return func(resp *http.Response, _ *Result) bool {
+		body, err := readHookBody(resp)
+		return err == nil && bytes.Contains(body, []byte(text))
+	}, nil
+}
+
+// jsonCheck checks a value in the response body, decoded as JSON.
+func jsonCheck(arg string) (func(*http.Response, *Result) bool, error) {
+	path, arg := cut(arg)
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	op, arg := cut(arg)
+	if op == "exists" && arg == "" {
+		return func(resp *http.Response, _ *Result) bool {
+			_, ok := jsonAt(resp, steps)
+			return ok
+		}, nil
+	}
+	if op != "==" && op != "!=" {
+		return nil, fmt.Errorf("expected json PATH == VALUE, != VALUE or exists, got %q", op)
+	}
+	var want interface{}
+	if err := json.Unmarshal([]byte(arg), &want); err != nil {
+		return nil, fmt.Errorf("invalid JSON value %q: %w", arg, err)
+	}
+	equal := op == "=="
+	return func(resp *http.Response, _ *Result) bool {
+		got, ok := jsonAt(resp, steps)
+		return ok && reflect.DeepEqual(got, want) == equal
+	}, nil
+}
+
+// parseJSONPath parses the subset of JSONPath made of keys and indexes,
+// like $.items[0].id, into its steps: strings for keys and ints for
+// indexes.
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+	var steps []interface{}
+	for s := path[1:]; s != ""; {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[") + 1
+			if end == 0 {
+				end = len(s)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("JSONPath %q: empty key", path)
+			}
+			steps = append(steps, s[1:end])
+			s = s[end:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: unterminated [", path)
+			}
+			if key, err := strconv.Unquote(strings.Replace(s[1:end], "'", `"`, -1)); err == nil {
+				steps = append(steps, key)
+			} else if i, err := strconv.Atoi(s[1:end]); err == nil && i >= 0 {
+				steps = append(steps, i)
+			} else {
+				return nil, fmt.Errorf("JSONPath %q: invalid index %s", path, s[:end+1])
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", path, s[0])
+		}
+	}
+	return steps, nil
+}
+
+// jsonAt returns the value at steps in the response body, and whether
+// there is one.
+func jsonAt(resp *http.Response, steps []interface{}) (interface{}, bool) {
+	body, err := readHookBody(resp)
+	if err != nil {
+		return nil, false
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, false
+	}
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = obj[step]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || step >= len(arr) {
+				return nil, false
+			}
+			v = arr[step]
+		}
+	}
+	return v, true
+}
+
+// readHookBody returns the body of a response passed to a Hook,
+// leaving it to be read again by the next.
+func readHookBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
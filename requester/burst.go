@@ -0,0 +1,154 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultBurstInterval is the time between bursts if BurstInterval
+// isn't set.
+const defaultBurstInterval = 10 * time.Second
+
+// A burstGate releases waiting workers together, once per burst.
+// Bursts are numbered from 1; ch is closed, and replaced, when one is
+// released.
+type burstGate struct {
+	mu    sync.Mutex
+	burst int
+	ch    chan struct{}
+	done  chan struct{}
+}
+
+func newBurstGate() *burstGate {
+	return &burstGate{ch: make(chan struct{}), done: make(chan struct{})}
+}
+
+// release releases the next burst.
+func (g *burstGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.burst++
+	close(g.ch)
+	g.ch = make(chan struct{})
+}
+
+// current returns the number of the last burst released.
+func (g *burstGate) current() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.burst
+}
+
+// finish lets workers go once they've made the bursts released so far.
+func (g *burstGate) finish() {
+	close(g.done)
+}
+
+// wait waits for a burst after last, returning its number, or false if
+// there won't be one, or stop is closed first.
+func (g *burstGate) wait(last int, stop <-chan struct{}) (int, bool) {
+	for {
+		g.mu.Lock()
+		burst, ch := g.burst, g.ch
+		g.mu.Unlock()
+		if burst > last {
+			return burst, true
+		}
+		select {
+		case <-ch:
+		case <-g.done:
+			return 0, false
+		case <-stop:
+			return 0, false
+		}
+	}
+}
+
+// runBursts makes requests in bursts of BurstSize, one request per
+// worker, every BurstInterval, until n requests have been made, rounded
+// up to a whole burst, or forever if n is 0.  A worker still busy with
+// one burst when the next is released sits that one out, so that the
+// bursts stay synchronized; how many were missed is logged.
+func (b *Work) runBursts(client *http.Client, n int) {
+	interval := b.BurstInterval
+	if interval <= 0 {
+		interval = defaultBurstInterval
+	}
+	bursts := -1
+	if n > 0 {
+		bursts = (n + b.BurstSize - 1) / b.BurstSize
+	}
+
+	gate := newBurstGate()
+	var missed int64
+	var wg, ready sync.WaitGroup
+	for i := 0; i < b.BurstSize; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			b.incWorkerCount()
+			defer b.decWorkerCount()
+			worker, rng := b.nextWorker()
+			ready.Done()
+			atomic.AddInt64(&missed, int64(b.runBurstWorker(client, worker, rng, gate)))
+		}()
+	}
+	ready.Wait()
+	b.log.Info("starting bursts", "workers", b.BurstSize, "interval", interval, "bursts", bursts)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for released := 0; bursts < 0 || released < bursts; {
+		gate.release()
+		released++
+		if released == bursts {
+			break
+		}
+		select {
+		case <-b.stopCh:
+			bursts = released
+		case <-ticker.C:
+		}
+	}
+	gate.finish()
+	wg.Wait()
+	if missed > 0 {
+		b.log.Warn("workers missed bursts, still busy with the one before",
+			"missed", missed, "interval", interval)
+	}
+}
+
+// runBurstWorker calls the Requester once per burst released by gate,
+// until it finishes, returning how many bursts it missed.
+func (b *Work) runBurstWorker(client *http.Client, worker int, rng *rand.Rand, gate *burstGate) int {
+	reporter := b.newWorkReporter(worker, rng)
+	stop := b.startWorker(worker)
+	defer b.stopWorker(worker)
+
+	missed := 0
+	last := 0
+	for {
+		burst, ok := gate.wait(last, stop)
+		if !ok {
+			return missed
+		}
+		select {
+		case <-b.stopCh:
+			return missed
+		default:
+		}
+		b.makeRequests(client, reporter)
+		atomic.AddInt64(&b.iterations, 1)
+		// the bursts released meanwhile have gone without it
+		last = gate.current()
+		missed += last - burst
+	}
+}
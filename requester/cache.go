@@ -0,0 +1,427 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatus is how a request fared with the HTTP cache, see
+// Work.Cache.
+type CacheStatus int
+
+const (
+	// CacheNone is a request the cache didn't handle: not a GET, or
+	// made with the cache disabled or bypassed.
+	CacheNone CacheStatus = iota
+	// CacheMiss is a request sent to the server for want of a
+	// usable cached response.
+	CacheMiss
+	// CacheHit is a request answered from the cache, without
+	// touching the network.
+	CacheHit
+	// CacheRevalidated is a request answered from the cache after
+	// the server confirmed, with a 304, that it was still current.
+	CacheRevalidated
+)
+
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheMiss:
+		return "miss"
+	case CacheHit:
+		return "hit"
+	case CacheRevalidated:
+		return "revalidated"
+	}
+	return "none"
+}
+
+// CacheStats count the requests the HTTP cache handled, by outcome.
+type CacheStats struct {
+	Hits        int64 `json:"hits"`
+	Revalidated int64 `json:"revalidated"`
+	Misses      int64 `json:"misses"`
+}
+
+func (s *CacheStats) add(res *Result) {
+	switch res.Cache {
+	case CacheHit:
+		s.Hits++
+	case CacheRevalidated:
+		s.Revalidated++
+	case CacheMiss:
+		s.Misses++
+	}
+}
+
+// Total returns the number of requests the cache handled.
+func (s CacheStats) Total() int64 {
+	return s.Hits + s.Revalidated + s.Misses
+}
+
+// HitRate returns the fraction of the requests the cache handled that
+// were answered without the network, or 0 if there were none.
+func (s CacheStats) HitRate() float64 {
+	if s.Total() == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Total())
+}
+
+// ResponseCacheStatus returns how the request resp answers fared with
+// the HTTP cache, for Requesters to report as their Result's Cache.
+func ResponseCacheStatus(resp *http.Response) CacheStatus {
+	if resp == nil || resp.Request == nil {
+		return CacheNone
+	}
+	status, _ := resp.Request.Context().Value(cacheStatusKey{}).(CacheStatus)
+	return status
+}
+
+type (
+	cacheKey       struct{}
+	cacheStatusKey struct{}
+)
+
+// withCache returns a context whose requests use c.
+func withCache(ctx context.Context, c *httpCache) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cacheKey{}, c)
+}
+
+const (
+	// maxCacheBytes bounds the bodies each worker's cache holds, the
+	// least recently used being evicted first.
+	maxCacheBytes = 16 << 20
+	// maxCacheEntryBytes is the largest body that is cached.
+	maxCacheEntryBytes = 1 << 20
+)
+
+// cacheableStatus are the status codes whose responses are cached, as
+// they are by browsers, given explicit freshness or a validator.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// An httpCache is a worker's private cache of responses, like a
+// browser's: it honors Cache-Control, Expires, ETag, Last-Modified and
+// Vary, but not heuristic freshness, or anything only shared caches
+// do.  Workers don't share their caches, as users don't.
+type httpCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List // of *cacheEntry, most recently used first
+	size    int
+}
+
+func newHTTPCache() *httpCache {
+	return &httpCache{
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	// vary are the values of the request headers named by Vary
+	vary map[string]string
+
+	// date is when the response was stored, or last revalidated, and
+	// age its Age then.
+	date     time.Time
+	age      time.Duration
+	lifetime time.Duration
+	noCache  bool
+
+	elem *list.Element
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return !e.noCache && now.Sub(e.date)+e.age < e.lifetime
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, v := range e.vary {
+		if req.Header.Get(name) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns the cached response to req.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int((now.Sub(e.date)+e.age)/time.Second)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// get returns the entry for req, if there is one.
+func (c *httpCache) get(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[req.URL.String()]
+	if e == nil || !e.matches(req) {
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (c *httpCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[e.key]; old != nil {
+		c.remove(old)
+	}
+	c.entries[e.key] = e
+	e.elem = c.lru.PushFront(e)
+	c.size += len(e.body)
+	for c.size > maxCacheBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *httpCache) remove(e *cacheEntry) {
+	delete(c.entries, e.key)
+	c.lru.Remove(e.elem)
+	c.size -= len(e.body)
+}
+
+// revalidated updates e from the headers of the 304 confirming it.
+func (c *httpCache) revalidated(e *cacheEntry, header http.Header, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range header {
+		if k != "Content-Length" {
+			e.header[k] = v
+		}
+	}
+	e.date = now
+	e.age = headerAge(header)
+	e.lifetime, e.noCache = freshness(e.header, now)
+}
+
+// cacheTransport answers requests from the cache of the worker making
+// them, found in their context, if they have one.
+type cacheTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, _ := req.Context().Value(cacheKey{}).(*httpCache)
+	if c == nil || req.Method != "GET" || req.Header.Get("Range") != "" ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		// conditional and partial requests are the Requester's own
+		return t.rt.RoundTrip(req)
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") {
+		return t.rt.RoundTrip(req)
+	}
+
+	now := time.Now()
+	e := c.get(req)
+	if e != nil && e.fresh(now) && !reqCC.has("no-cache") {
+		return e.response(markCache(req, CacheHit), now), nil
+	}
+	sent := req
+	if e != nil && e.validators() {
+		sent = req.Clone(req.Context())
+		if etag := e.header.Get("ETag"); etag != "" {
+			sent.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.header.Get("Last-Modified"); lm != "" {
+			sent.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	resp, err := t.rt.RoundTrip(sent)
+	if err != nil {
+		return nil, err
+	}
+	now = time.Now()
+	if sent != req && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		c.revalidated(e, resp.Header, now)
+		return e.response(markCache(req, CacheRevalidated), now), nil
+	}
+	resp.Request = markCache(req, CacheMiss)
+	if e := newCacheEntry(req, resp, now); e != nil {
+		resp.Body = &cachingBody{ReadCloser: resp.Body, cache: c, entry: e}
+	}
+	return resp, nil
+}
+
+// Unwrap returns the underlying transport.
+func (t *cacheTransport) Unwrap() http.RoundTripper {
+	return t.rt
+}
+
+// markCache returns req with its cache status in its context, for
+// ResponseCacheStatus.
+func markCache(req *http.Request, status CacheStatus) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheStatusKey{}, status))
+}
+
+// newCacheEntry returns the entry to cache resp to req as, without its
+// body, or nil if it can't be cached.
+func newCacheEntry(req *http.Request, resp *http.Response, now time.Time) *cacheEntry {
+	if !cacheableStatus[resp.StatusCode] || resp.ContentLength > maxCacheEntryBytes {
+		return nil
+	}
+	if parseCacheControl(resp.Header).has("no-store") {
+		return nil
+	}
+	e := &cacheEntry{
+		key:    req.URL.String(),
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+		date:   now,
+		age:    headerAge(resp.Header),
+	}
+	e.lifetime, e.noCache = freshness(resp.Header, now)
+	if (e.lifetime <= 0 || e.noCache) && !e.validators() {
+		return nil
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name == "" {
+				continue
+			}
+			if e.vary == nil {
+				e.vary = make(map[string]string)
+			}
+			e.vary[name] = req.Header.Get(name)
+		}
+	}
+	return e
+}
+
+// cachingBody stores its entry in the cache with the body once it has
+// been read to the end.
+type cachingBody struct {
+	io.ReadCloser
+	cache *httpCache
+	entry *cacheEntry
+	buf   bytes.Buffer
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.entry == nil {
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if b.buf.Len() > maxCacheEntryBytes {
+		b.entry = nil
+	} else if err == io.EOF {
+		b.entry.body = b.buf.Bytes()
+		b.cache.put(b.entry)
+		b.entry = nil
+	}
+	return n, err
+}
+
+// freshness returns how long a response with header is fresh for, and
+// whether it must be revalidated regardless.
+func freshness(header http.Header, now time.Time) (lifetime time.Duration, noCache bool) {
+	cc := parseCacheControl(header)
+	noCache = cc.has("no-cache")
+	if v, ok := cc["max-age"]; ok {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, noCache
+		}
+		return time.Duration(secs) * time.Second, noCache
+	}
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0, noCache
+	}
+	exp, err := http.ParseTime(expires)
+	if err != nil {
+		// invalid dates, like 0, mean already expired
+		return 0, noCache
+	}
+	date := now
+	if d, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = d
+	}
+	return exp.Sub(date), noCache
+}
+
+func headerAge(header http.Header) time.Duration {
+	secs, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// cacheControl are the directives of Cache-Control headers, by
+// lower-cased name, with their values, if any.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Chaos makes the client misbehave, to see how the server under test
+// copes with flaky clients: that its timeouts fire and it cleans up
+// after requests that go away.  The zero Chaos is a well-behaved
+// client.
+type Chaos struct {
+	// Latency delays each request by a random duration up to it
+	// before it is sent.
+	Latency time.Duration
+
+	// Abort is the fraction of responses, from 0 to 1, whose body
+	// is cut off after the first read, closing the connection if the
+	// server is still sending it.
+	Abort float64
+
+	// Drop is the fraction of requests, from 0 to 1, whose
+	// connection is closed as soon as the request has been sent,
+	// before the server has responded.
+	Drop float64
+}
+
+// Enabled reports whether c changes anything.
+func (c Chaos) Enabled() bool {
+	return c.Latency > 0 || c.Abort > 0 || c.Drop > 0
+}
+
+var (
+	// ErrChaosAbort is the error of reads from a response body that
+	// Chaos aborted.
+	ErrChaosAbort = errors.New("chaos: response aborted")
+	// ErrChaosDrop is the error of requests whose connection Chaos
+	// dropped.
+	ErrChaosDrop = errors.New("chaos: connection dropped")
+)
+
+// chaosTransport injects Chaos into the requests made through it.  Its
+// random number generator is shared by every worker, so that the
+// fractions hold across them, under mu.
+type chaosTransport struct {
+	rt    http.RoundTripper
+	chaos Chaos
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// roll returns a random number in [0, 1).
+func (t *chaosTransport) roll() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Float64()
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.chaos.Latency > 0 {
+		delay := time.Duration(t.roll() * float64(t.chaos.Latency))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	drop := t.chaos.Drop > 0 && t.roll() < t.chaos.Drop
+	if drop {
+		req = req.WithContext(dropConn(req.Context()))
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if drop {
+		if err == nil {
+			// the response beat the close
+			resp.Body.Close()
+		}
+		// rather than the error of the closed connection, which
+		// names its ports, so that drops are counted together
+		return nil, ErrChaosDrop
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.chaos.Abort > 0 && t.roll() < t.chaos.Abort {
+		resp.Body = &abortBody{ReadCloser: resp.Body}
+	}
+	return resp, nil
+}
+
+// Unwrap returns the underlying transport.
+func (t *chaosTransport) Unwrap() http.RoundTripper {
+	return t.rt
+}
+
+// dropConn returns a context tracing requests to close their
+// connection once they've been written.
+func dropConn(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	var conn net.Conn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn = info.Conn
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+		},
+	})
+}
+
+// abortBody returns what the first read of a body gets, and then
+// ErrChaosAbort.  Closing the body before it has been read to the end
+// closes its connection.
+type abortBody struct {
+	io.ReadCloser
+	read bool
+}
+
+func (b *abortBody) Read(p []byte) (int, error) {
+	if b.read {
+		return 0, ErrChaosAbort
+	}
+	b.read = true
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// the whole body came in one read; abort it anyway
+		err = nil
+	}
+	return n, err
+}
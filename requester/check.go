@@ -0,0 +1,71 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"sort"
+	"sync"
+)
+
+// A CheckReporter records the outcome of named checks: assertions a
+// Requester makes about the responses it gets, like a script's
+// check().  The Reporter passed to Requester.Do implements it.
+type CheckReporter interface {
+	Check(name string, passed bool)
+}
+
+// CheckStats are the outcomes of a single named check.
+type CheckStats struct {
+	Name   string
+	Passes int64
+	Fails  int64
+	// Rate is the fraction of the checks that passed, from 0 to 1.
+	Rate float64
+}
+
+// checkStats aggregates check outcomes.  Checks are recorded directly
+// from the workers rather than through the results channel, so all
+// access is under mu.
+type checkStats struct {
+	mu     sync.Mutex
+	checks map[string]*CheckStats
+}
+
+func newCheckStats() *checkStats {
+	return &checkStats{
+		checks: make(map[string]*CheckStats),
+	}
+}
+
+func (s *checkStats) add(name string, passed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.checks[name]
+	if !ok {
+		cs = &CheckStats{Name: name}
+		s.checks[name] = cs
+	}
+	if passed {
+		cs.Passes++
+	} else {
+		cs.Fails++
+	}
+}
+
+// stats returns the per-check breakdown, ordered by name.
+func (s *checkStats) stats() []CheckStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]CheckStats, 0, len(s.checks))
+	for _, cs := range s.checks {
+		c := *cs
+		c.Rate = float64(c.Passes) / float64(c.Passes+c.Fails)
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// checkpointInterval is how often the checkpoint of a run in progress
+// is written, at most.
+const checkpointInterval = 10 * time.Second
+
+// A Checkpoint is the progress of a run, written periodically to
+// Work.CheckpointPath so that a run that is killed can be resumed with
+// Work.Resume rather than started over.
+type Checkpoint struct {
+	RunID string
+	Tags  map[string]string
+	// Elapsed is how long the run had been going.
+	Elapsed time.Duration
+	// Iterations is the number of calls to the Requester that had
+	// completed, which Work.N counts, and Requests the number of
+	// results they reported.
+	Iterations int64
+	Requests   int64
+
+	state reportState
+}
+
+// Report returns the report of the run as of the checkpoint, as if it
+// had finished then.
+func (cp *Checkpoint) Report() *Report {
+	r := newReport(nil)
+	r.samples = true
+	r.verbose = len(cp.state.Workers) > 0
+	r.runID = cp.RunID
+	r.tags = cp.Tags
+	r.restore(cp)
+	snapshot := r.finalize(cp.Elapsed)
+	return &snapshot
+}
+
+// lastWorker returns the largest ID of the workers in cp.
+func (cp *Checkpoint) lastWorker() int {
+	last := 0
+	for id := range cp.state.Workers {
+		last = max(last, id)
+	}
+	return last
+}
+
+// checkpointFile is the encoding of a Checkpoint.
+type checkpointFile struct {
+	RunID      string
+	Tags       map[string]string
+	Elapsed    time.Duration
+	Iterations int64
+	State      reportState
+}
+
+// reportState is everything a report has aggregated so far.
+type reportState struct {
+	AvgTotal, AvgConn, AvgDNS, AvgTLS, AvgReq, AvgRes, AvgDelay float64
+
+	Lats, ConnLats, DNSLats, TLSLats, ReqLats, ResLats, DelayLats, Offsets []float64
+	StatusCodes                                                            []int
+
+	// Hists are the histograms of Lats and so on, and StatusCodeDist
+	// the status codes, of every result rather than only the samples.
+	Hists          []*latencyHistogram
+	StatusCodeDist map[int]int
+
+	ErrorDist    map[string]int
+	SizeTotal    int64
+	NumRes       int64
+	ForcedCloses int64
+	Conns        ConnStats
+	Cache        CacheStats
+
+	Workers   map[int]*WorkerStats
+	Endpoints map[string]*EndpointStats
+	Checks    []CheckStats
+}
+
+// ReadCheckpoint reads the checkpoint at path.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	var cf checkpointFile
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil {
+		return nil, fmt.Errorf("%s: malformed checkpoint: %w", path, err)
+	}
+	if n := len(new(report).hists()); len(cf.State.Hists) != n {
+		return nil, fmt.Errorf("%s: malformed checkpoint: expected %d histograms, got %d", path, n, len(cf.State.Hists))
+	}
+	return &Checkpoint{
+		RunID:      cf.RunID,
+		Tags:       cf.Tags,
+		Elapsed:    cf.Elapsed,
+		Iterations: cf.Iterations,
+		Requests:   cf.State.NumRes,
+		state:      cf.State,
+	}, nil
+}
+
+// writeCheckpoint replaces the checkpoint at path, atomically so that
+// a run killed part way through writing it can still be resumed.
+func writeCheckpoint(path string, cf *checkpointFile) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %w", err)
+	}
+	if err := gob.NewEncoder(f).Encode(cf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("gob.Encode: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("f.Close: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkpoint writes the report's progress, if a checkpoint was
+// requested, once any checkpoint being written in the background is
+// done.  It must be called once the reporter goroutine is done.
+func (r *report) checkpoint() {
+	if r.checkpointPath == "" {
+		return
+	}
+	r.checkpointing <- struct{}{}
+	defer func() { <-r.checkpointing }()
+	r.writeCheckpoint(r.checkpointState())
+}
+
+// checkpointAsync writes the report's progress in the background, so
+// that the reporter goroutine, which must call it, can get on with the
+// results.  It is skipped if the last checkpoint is still being
+// written.
+func (r *report) checkpointAsync() {
+	select {
+	case r.checkpointing <- struct{}{}:
+	default:
+		return
+	}
+	cf := r.checkpointState()
+	go func() {
+		defer func() { <-r.checkpointing }()
+		r.writeCheckpoint(cf)
+	}()
+}
+
+func (r *report) writeCheckpoint(cf *checkpointFile) {
+	if err := writeCheckpoint(r.checkpointPath, cf); err != nil {
+		r.log.Error("writing checkpoint", "path", r.checkpointPath, "err", err)
+	}
+}
+
+// checkpointState returns a copy of the report's progress, which the
+// reporter goroutine can go on adding to while it is encoded.  The
+// samples are only ever appended to, so they are shared, up to their
+// current length, rather than copied.
+func (r *report) checkpointState() *checkpointFile {
+	r.lastCheckpoint = now()
+	hists := r.hists()
+	for i, h := range hists {
+		c := *h
+		c.Counts = append([]int64(nil), h.Counts...)
+		hists[i] = &c
+	}
+	workers := make(map[int]*WorkerStats, len(r.workers))
+	for id, ws := range r.workers {
+		c := *ws
+		workers[id] = &c
+	}
+	endpoints := make(map[string]*EndpointStats, len(r.endpoints))
+	for name, es := range r.endpoints {
+		c := *es
+		endpoints[name] = &c
+	}
+	errorDist := make(map[string]int, len(r.errorDist))
+	for err, n := range r.errorDist {
+		errorDist[err] = n
+	}
+	statusCodeDist := make(map[int]int, len(r.statusCodeDist))
+	for code, n := range r.statusCodeDist {
+		statusCodeDist[code] = n
+	}
+	return &checkpointFile{
+		RunID:      r.runID,
+		Tags:       r.tags,
+		Elapsed:    r.lastCheckpoint - r.start,
+		Iterations: atomic.LoadInt64(r.iterations),
+		State: reportState{
+			AvgTotal:    r.avgTotal,
+			AvgConn:     r.avgConn,
+			AvgDNS:      r.avgDNS,
+			AvgTLS:      r.avgTLS,
+			AvgReq:      r.avgReq,
+			AvgRes:      r.avgRes,
+			AvgDelay:    r.avgDelay,
+			Lats:        r.lats[:len(r.lats):len(r.lats)],
+			ConnLats:    r.connLats[:len(r.connLats):len(r.connLats)],
+			DNSLats:     r.dnsLats[:len(r.dnsLats):len(r.dnsLats)],
+			TLSLats:     r.tlsLats[:len(r.tlsLats):len(r.tlsLats)],
+			ReqLats:     r.reqLats[:len(r.reqLats):len(r.reqLats)],
+			ResLats:     r.resLats[:len(r.resLats):len(r.resLats)],
+			DelayLats:   r.delayLats[:len(r.delayLats):len(r.delayLats)],
+			Offsets:     r.offsets[:len(r.offsets):len(r.offsets)],
+			StatusCodes: r.statusCodes[:len(r.statusCodes):len(r.statusCodes)],
+			Hists:       hists,
+			ErrorDist:   errorDist,
+			SizeTotal:   r.sizeTotal,
+			NumRes:      r.numRes,
+			Workers:     workers,
+			Endpoints:   endpoints,
+			Checks:      r.checks.stats(),
+
+			StatusCodeDist: statusCodeDist,
+			ForcedCloses:   r.forcedCloses,
+			Conns:          r.conns,
+			Cache:          r.cache,
+		},
+	}
+}
+
+// restore merges the state of a previous run into the report, which
+// must not have any results yet.
+func (r *report) restore(cp *Checkpoint) {
+	s := cp.state
+	r.avgTotal = s.AvgTotal
+	r.avgConn = s.AvgConn
+	r.avgDNS = s.AvgDNS
+	r.avgTLS = s.AvgTLS
+	r.avgReq = s.AvgReq
+	r.avgRes = s.AvgRes
+	r.avgDelay = s.AvgDelay
+	if r.samples {
+		r.lats = append(r.lats, s.Lats...)
+		r.connLats = append(r.connLats, s.ConnLats...)
+		r.dnsLats = append(r.dnsLats, s.DNSLats...)
+		r.tlsLats = append(r.tlsLats, s.TLSLats...)
+		r.reqLats = append(r.reqLats, s.ReqLats...)
+		r.resLats = append(r.resLats, s.ResLats...)
+		r.delayLats = append(r.delayLats, s.DelayLats...)
+		r.offsets = append(r.offsets, s.Offsets...)
+		r.statusCodes = append(r.statusCodes, s.StatusCodes...)
+	}
+	for i, h := range r.hists() {
+		*h = *s.Hists[i]
+	}
+	for code, n := range s.StatusCodeDist {
+		r.statusCodeDist[code] += n
+	}
+	for k, v := range s.ErrorDist {
+		r.errorDist[k] += v
+	}
+	r.sizeTotal = s.SizeTotal
+	r.numRes = s.NumRes
+	r.forcedCloses = s.ForcedCloses
+	r.conns = s.Conns
+	r.cache = s.Cache
+	for id, ws := range s.Workers {
+		r.workers[id] = ws
+	}
+	for name, es := range s.Endpoints {
+		r.endpoints[name] = es
+	}
+	for _, cs := range s.Checks {
+		r.checks.checks[cs.Name] = &CheckStats{Name: cs.Name, Passes: cs.Passes, Fails: cs.Fails}
+	}
+}
+
+// hists returns the report's histograms, in the order of the samples
+// in reportState.
+func (r *report) hists() []*latencyHistogram {
+	return []*latencyHistogram{&r.latHist, &r.connHist, &r.dnsHist, &r.tlsHist, &r.reqHist, &r.resHist, &r.delayHist}
+}
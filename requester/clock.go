@@ -0,0 +1,32 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import "time"
+
+// A Clock is a monotonic clock measuring the time since the start of a
+// run, which is what the Offset of a Result is relative to.  It is
+// safe for concurrent use.
+type Clock struct {
+	start time.Duration
+}
+
+// NewClock returns a Clock started now.
+func NewClock() *Clock {
+	return &Clock{start: now()}
+}
+
+// Now returns the time since c was started.
+func (c *Clock) Now() time.Duration {
+	return now() - c.start
+}
+
+// A ClockReporter is a Reporter with the clock of its run, which
+// Requesters time their Results with.  Work's reporters are
+// ClockReporters.
+type ClockReporter interface {
+	Reporter
+	Clock() *Clock
+}
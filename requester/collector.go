@@ -0,0 +1,151 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/bpowers/hithere/grpc"
+)
+
+// collectorMethod is the client-streaming RPC intervals are sent on;
+// see collector.proto for the service and message definitions.
+const collectorMethod = "/hithere.metrics.v1.MetricsCollector/Stream"
+
+// collector streams interval aggregates to a remote gRPC endpoint for
+// the duration of a run.
+type collector struct {
+	stream *grpc.ClientStream
+	ivs    chan *Interval
+	done   chan struct{}
+	log    *slog.Logger
+}
+
+var _ intervalSink = (*collector)(nil)
+
+func startCollector(addr string, logger *slog.Logger) (*collector, error) {
+	conn, err := grpc.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.NewStream(context.Background(), collectorMethod, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &collector{
+		stream: stream,
+		ivs:    make(chan *Interval, 64),
+		done:   make(chan struct{}),
+		log:    logger.With("collector", addr),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *collector) sendInterval(iv *Interval) {
+	select {
+	case c.ivs <- iv:
+	default:
+		c.log.Warn("collector falling behind, dropping interval")
+	}
+}
+
+func (c *collector) run() {
+	defer close(c.done)
+
+	healthy := true
+	for iv := range c.ivs {
+		if !healthy {
+			continue
+		}
+		if err := c.stream.Send(iv.marshal()); err != nil {
+			c.log.Error("collector", "err", err)
+			healthy = false
+			c.stream.Close()
+		}
+	}
+	if !healthy {
+		return
+	}
+
+	if err := c.stream.CloseSend(); err != nil {
+		c.log.Error("collector CloseSend", "err", err)
+		return
+	}
+	for {
+		if _, err := c.stream.Recv(); err != nil {
+			if err != io.EOF {
+				c.log.Error("collector", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// close waits for the collector to acknowledge the end of the stream.
+func (c *collector) close() {
+	close(c.ivs)
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		c.log.Warn("collector timed out waiting for the stream to finish")
+		c.stream.Close()
+	}
+}
+
+// marshal encodes iv as a hithere.metrics.v1.Interval message.
+func (iv *Interval) marshal() []byte {
+	var errors int64
+	for _, n := range iv.ErrorDist {
+		errors += int64(n)
+	}
+
+	var b []byte
+	b = grpc.AppendVarintField(b, 1, uint64(iv.Start))
+	b = grpc.AppendVarintField(b, 2, uint64(iv.Duration))
+	b = grpc.AppendVarintField(b, 3, uint64(iv.NumRes))
+	b = grpc.AppendVarintField(b, 4, uint64(errors))
+	b = grpc.AppendDoubleField(b, 5, iv.Rps)
+	b = grpc.AppendDoubleField(b, 6, iv.Average)
+	b = grpc.AppendDoubleField(b, 7, iv.Fastest)
+	b = grpc.AppendDoubleField(b, 8, iv.Slowest)
+	for _, l := range iv.LatencyDistribution {
+		var p []byte
+		p = grpc.AppendVarintField(p, 1, uint64(l.Percentage))
+		p = grpc.AppendDoubleField(p, 2, l.Latency)
+		b = grpc.AppendBytesField(b, 9, p)
+	}
+	codes := make([]int, 0, len(iv.StatusCodeDist))
+	for code := range iv.StatusCodeDist {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		var e []byte
+		e = grpc.AppendVarintField(e, 1, uint64(code))
+		e = grpc.AppendVarintField(e, 2, uint64(iv.StatusCodeDist[code]))
+		b = grpc.AppendBytesField(b, 10, e)
+	}
+	b = grpc.AppendVarintField(b, 11, uint64(iv.SizeTotal))
+	if iv.RunID != "" {
+		b = grpc.AppendStringField(b, 12, iv.RunID)
+	}
+	keys := make([]string, 0, len(iv.Tags))
+	for k := range iv.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var e []byte
+		e = grpc.AppendStringField(e, 1, k)
+		e = grpc.AppendStringField(e, 2, iv.Tags[k])
+		b = grpc.AppendBytesField(b, 13, e)
+	}
+	return b
+}
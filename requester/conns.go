@@ -0,0 +1,45 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+// ConnStats count how requests got their connections, so that a run
+// spending its time on connection setup, rather than on the server's
+// responses, can be told apart: New connections each cost a dial, and
+// usually DNSLookups and TLSHandshakes, which Reused ones don't.
+type ConnStats struct {
+	New           int64 `json:"new"`
+	Reused        int64 `json:"reused"`
+	DNSLookups    int64 `json:"dns_lookups"`
+	TLSHandshakes int64 `json:"tls_handshakes"`
+}
+
+func (s *ConnStats) add(res *Result) {
+	if res.NewConn {
+		s.New++
+	}
+	if res.ConnReused {
+		s.Reused++
+	}
+	if res.DNSLookup {
+		s.DNSLookups++
+	}
+	if res.TLSHandshake {
+		s.TLSHandshakes++
+	}
+}
+
+// Total returns the number of requests whose connections were counted.
+func (s ConnStats) Total() int64 {
+	return s.New + s.Reused
+}
+
+// ReuseRate returns the fraction of requests made on reused
+// connections, or 0 if none were counted.
+func (s ConnStats) ReuseRate() float64 {
+	if s.Total() == 0 {
+		return 0
+	}
+	return float64(s.Reused) / float64(s.Total())
+}
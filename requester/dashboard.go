@@ -0,0 +1,236 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxPoints bounds how much history the dashboard keeps; at the
+// default interval that's an hour.
+const maxPoints = 3600
+
+// dashboardLinger is how long the dashboard keeps serving once the run
+// is done, for open pages, which poll every second, to get the final
+// interval.
+var dashboardLinger = 3 * time.Second
+
+// dashboardPoint is the per-interval data the dashboard charts.
+// Times are in seconds.
+type dashboardPoint struct {
+	T          float64 `json:"t"`
+	Rps        float64 `json:"rps"`
+	Throughput float64 `json:"throughput"`
+	Errors     int     `json:"errors"`
+	Average    float64 `json:"average"`
+	P50        float64 `json:"p50"`
+	P90        float64 `json:"p90"`
+	P99        float64 `json:"p99"`
+}
+
+// dashboard serves a small page with live charts of a run.
+type dashboard struct {
+	srv  *http.Server
+	addr string
+
+	mu       sync.Mutex
+	points   []dashboardPoint
+	requests int64
+	errors   int64
+	done     bool
+	// polled is whether a page has polled for intervals, and final is
+	// closed once one has been sent the final interval.
+	polled    bool
+	final     chan struct{}
+	finalSent bool
+}
+
+var _ intervalSink = (*dashboard)(nil)
+
+func startDashboard(addr string) (*dashboard, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := &dashboard{addr: ln.Addr().String(), final: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveIndex)
+	mux.HandleFunc("/intervals", d.serveIntervals)
+	d.srv = &http.Server{Handler: mux}
+	go d.srv.Serve(ln)
+
+	return d, nil
+}
+
+func (d *dashboard) sendInterval(iv *Interval) {
+	p := dashboardPoint{
+		T:          (iv.Start + iv.Duration).Seconds(),
+		Rps:        iv.Rps,
+		Throughput: iv.Throughput,
+		Average:    iv.Average,
+	}
+	for _, n := range iv.ErrorDist {
+		p.Errors += n
+	}
+	for _, l := range iv.LatencyDistribution {
+		switch l.Percentage {
+		case 50:
+			p.P50 = l.Latency
+		case 90:
+			p.P90 = l.Latency
+		case 99:
+			p.P99 = l.Latency
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests += iv.NumRes
+	d.errors += int64(p.Errors)
+	d.points = append(d.points, p)
+	if len(d.points) > maxPoints {
+		d.points = d.points[len(d.points)-maxPoints:]
+	}
+}
+
+func (d *dashboard) close() {
+	d.mu.Lock()
+	d.done = true
+	polled := d.polled
+	d.mu.Unlock()
+
+	// give open pages a chance to see the final interval
+	if polled {
+		select {
+		case <-d.final:
+		case <-time.After(dashboardLinger):
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d.srv.Shutdown(ctx)
+}
+
+func (d *dashboard) serveIntervals(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	d.polled = true
+	done := d.done
+	body, err := json.Marshal(struct {
+		Points   []dashboardPoint `json:"points"`
+		Requests int64            `json:"requests"`
+		Errors   int64            `json:"errors"`
+		Done     bool             `json:"done"`
+	}{d.points, d.requests, d.errors, done})
+	d.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("json.Marshal: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(body)
+
+	if done {
+		d.mu.Lock()
+		if !d.finalSent {
+			d.finalSent = true
+			close(d.final)
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *dashboard) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboardHTML)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hithere</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; color: #222; }
+  canvas { display: block; border: 1px solid #ddd; margin-bottom: 1.5em; }
+  h2 { font-size: 1em; margin-bottom: 0.3em; }
+  .legend span { margin-right: 1em; }
+</style>
+</head>
+<body>
+<h1>hithere</h1>
+<p id="totals">waiting for data&hellip;</p>
+<h2>Requests/sec</h2>
+<canvas id="rps" width="900" height="200"></canvas>
+<h2>Latency (secs)</h2>
+<div class="legend">
+  <span style="color:#1f77b4">p50</span><span style="color:#ff7f0e">p90</span><span style="color:#d62728">p99</span>
+</div>
+<canvas id="lat" width="900" height="200"></canvas>
+<h2>Throughput (bytes/sec)</h2>
+<canvas id="throughput" width="900" height="200"></canvas>
+<h2>Errors per interval</h2>
+<canvas id="errors" width="900" height="200"></canvas>
+<script>
+function chart(id, points, series) {
+  var c = document.getElementById(id), ctx = c.getContext('2d');
+  ctx.clearRect(0, 0, c.width, c.height);
+  if (points.length < 2) return;
+  var pad = 40, w = c.width - pad, h = c.height - 20;
+  var t0 = points[0].t, t1 = points[points.length - 1].t;
+  var max = 0;
+  series.forEach(function(s) {
+    points.forEach(function(p) { max = Math.max(max, p[s.key]); });
+  });
+  if (max === 0) max = 1;
+  ctx.fillStyle = '#666';
+  ctx.fillText(max.toPrecision(3), 0, 10);
+  ctx.fillText('0', 0, h);
+  series.forEach(function(s) {
+    ctx.strokeStyle = s.color;
+    ctx.beginPath();
+    points.forEach(function(p, i) {
+      var x = pad + (p.t - t0) / (t1 - t0 || 1) * w;
+      var y = h - p[s.key] / max * (h - 10);
+      if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  });
+}
+
+function refresh() {
+  fetch('intervals').then(function(r) { return r.json(); }).then(function(d) {
+    var pts = d.points || [];
+    var last = pts.length ? pts[pts.length - 1] : null;
+    document.getElementById('totals').textContent =
+      d.requests + ' requests, ' + d.errors + ' errors' +
+      (last ? ', ' + last.rps.toFixed(1) + ' req/sec' : '') +
+      (d.done ? ' (finished)' : '');
+    chart('rps', pts, [{key: 'rps', color: '#1f77b4'}]);
+    chart('lat', pts, [
+      {key: 'p50', color: '#1f77b4'},
+      {key: 'p90', color: '#ff7f0e'},
+      {key: 'p99', color: '#d62728'}]);
+    chart('throughput', pts, [{key: 'throughput', color: '#2ca02c'}]);
+    chart('errors', pts, [{key: 'errors', color: '#d62728'}]);
+    if (!d.done) setTimeout(refresh, 1000);
+  }).catch(function() { setTimeout(refresh, 2000); });
+}
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,78 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	publishOnce sync.Once
+	// debugWork is the *Work whose internals the "hithere" expvar
+	// reports, the most recent one run with PprofAddr set.
+	debugWork atomic.Value
+)
+
+// engineVars are the internals of the load generator itself, for
+// investigating its performance rather than the server's.
+type engineVars struct {
+	Workers         int     `json:"workers"`
+	ResultsQueued   int     `json:"results_queued"`
+	ResultsCapacity int     `json:"results_capacity"`
+	ResultsPerSec   float64 `json:"results_per_sec"`
+	Iterations      int64   `json:"iterations"`
+}
+
+func (b *Work) engineVars() engineVars {
+	return engineVars{
+		Workers:         b.getWorkerCount(),
+		ResultsQueued:   len(b.results),
+		ResultsCapacity: cap(b.results),
+		ResultsPerSec:   float64(b.counter1s.Rate()) / 2,
+		Iterations:      atomic.LoadInt64(&b.iterations),
+	}
+}
+
+// startDebug serves net/http/pprof and expvar, including the engine's
+// internals as "hithere", on PprofAddr until the run finishes.
+func (b *Work) startDebug() {
+	ln, err := net.Listen("tcp", b.PprofAddr)
+	if err != nil {
+		b.log.Error("pprof", "err", err)
+		return
+	}
+	debugWork.Store(b)
+	publishOnce.Do(func() {
+		expvar.Publish("hithere", expvar.Func(func() interface{} {
+			return debugWork.Load().(*Work).engineVars()
+		}))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	b.debugSrv = &http.Server{Handler: mux}
+	go b.debugSrv.Serve(ln)
+}
+
+func (b *Work) stopDebug() {
+	if b.debugSrv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	b.debugSrv.Shutdown(ctx)
+}
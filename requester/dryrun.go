@@ -0,0 +1,235 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DryRun runs the Requester once instead of generating load, writing a
+// trace of every HTTP request and response it makes, and every result
+// it reports, to Writer.  It is for checking a script works before
+// pointing real traffic at a server, so Chaos doesn't apply.
+func (b *Work) DryRun() error {
+	if b.log == nil {
+		b.setLogger()
+	}
+	w := b.writer()
+	client := b.newClientWith(Chaos{})
+	client.Transport = &traceTransport{rt: client.Transport, w: w}
+	reporter := &traceReporter{w: w, userAgent: b.UserAgent, hooks: b.Hooks, clock: NewClock(), rng: workerRand(b.Seed, 0)}
+
+	if err := b.Requester.Clone().Do(context.Background(), client, reporter); err != nil {
+		return fmt.Errorf("requester.Do: %w", err)
+	}
+	fmt.Fprintf(w, "%d results, %d failed\n", reporter.count, reporter.failed)
+	return nil
+}
+
+// smokeBodyBytes is how much of each response body Smoke writes.
+const smokeBodyBytes = 1024
+
+// Smoke is a pre-flight check before a real run: it runs the Requester
+// once on each of workers workers, one after the other, so at the
+// lowest rate there is, tracing as DryRun does plus the first
+// smokeBodyBytes of every response body.  Each worker has its own
+// random number generator, as in a run, so the trace covers what
+// differs between them.  Chaos doesn't apply.  It returns an error if
+// any result or check failed.
+func (b *Work) Smoke(workers int) error {
+	if b.log == nil {
+		b.setLogger()
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	w := b.writer()
+	client := b.newClientWith(Chaos{})
+	client.Transport = &traceTransport{rt: client.Transport, w: w, body: smokeBodyBytes}
+	reporter := &traceReporter{w: w, userAgent: b.UserAgent, hooks: b.Hooks, clock: NewClock()}
+
+	for worker := 1; worker <= workers; worker++ {
+		fmt.Fprintf(w, "--- worker %d\n\n", worker)
+		reporter.rng = workerRand(b.Seed, worker)
+		if err := b.Requester.Clone().Do(context.Background(), client, reporter); err != nil {
+			return fmt.Errorf("worker %d: requester.Do: %w", worker, err)
+		}
+	}
+	fmt.Fprintf(w, "%d results, %d failed; %d checks, %d failed\n",
+		reporter.count, reporter.failed, reporter.checks, reporter.failedChecks)
+	if reporter.failed > 0 || reporter.failedChecks > 0 {
+		return fmt.Errorf("smoke test failed: %d of %d results and %d of %d checks failed",
+			reporter.failed, reporter.count, reporter.failedChecks, reporter.checks)
+	}
+	return nil
+}
+
+// traceTransport writes the request line and headers of each request
+// made through it, and the status line and headers of its response.
+// If body is positive, up to that much of each response body is
+// written too, once the body is closed.
+type traceTransport struct {
+	rt   http.RoundTripper
+	w    io.Writer
+	body int
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fmt.Fprintf(t.w, "> %s %s %s\n", req.Method, req.URL, req.Proto)
+	if req.Host != "" && req.Host != req.URL.Host {
+		fmt.Fprintf(t.w, "> Host: %s\n", req.Host)
+	}
+	writeTraceHeader(t.w, ">", req.Header)
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(t.w, "! %s\n\n", err)
+		return nil, err
+	}
+	fmt.Fprintf(t.w, "< %s %s\n", resp.Proto, resp.Status)
+	writeTraceHeader(t.w, "<", resp.Header)
+	if t.body > 0 && resp.Body != nil {
+		resp.Body = &traceBody{rc: resp.Body, w: t.w, max: t.body}
+	} else {
+		fmt.Fprintln(t.w)
+	}
+	return resp, nil
+}
+
+// Unwrap returns the underlying transport.
+func (t *traceTransport) Unwrap() http.RoundTripper {
+	return t.rt
+}
+
+// traceBody keeps the first max bytes read from a response body, and
+// writes them when it is closed, by which time the Requester has read
+// what it wanted.  Bodies aren't read ahead of the Requester, so that
+// streaming responses behave as they would in a run.
+type traceBody struct {
+	rc  io.ReadCloser
+	w   io.Writer
+	max int
+	buf bytes.Buffer
+	n   int64
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if keep := b.max - b.buf.Len(); keep > 0 {
+		b.buf.Write(p[:min(n, keep)])
+	}
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	if b.w != nil {
+		writeTraceBody(b.w, b.buf.Bytes(), b.n)
+		b.w = nil
+	}
+	return b.rc.Close()
+}
+
+// writeTraceBody writes body, the start of an n byte response body, a
+// line at a time, followed by a blank line.
+func writeTraceBody(w io.Writer, body []byte, n int64) {
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		fmt.Fprintf(w, "| %s\n", bytes.TrimSuffix(line, []byte("\r")))
+	}
+	if more := n - int64(len(body)); more > 0 {
+		fmt.Fprintf(w, "| ... %d more bytes\n", more)
+	}
+	fmt.Fprintln(w)
+}
+
+func writeTraceHeader(w io.Writer, prefix string, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s %s: %s\n", prefix, k, v)
+		}
+	}
+}
+
+// traceReporter writes each result and check as it is reported.
+type traceReporter struct {
+	w         io.Writer
+	userAgent string
+	hooks     []Hook
+	clock     *Clock
+	rng       *rand.Rand
+	count     int
+	failed    int
+
+	checks       int
+	failedChecks int
+}
+
+var (
+	_ Reporter      = (*traceReporter)(nil)
+	_ CheckReporter = (*traceReporter)(nil)
+	_ HookReporter  = (*traceReporter)(nil)
+	_ ClockReporter = (*traceReporter)(nil)
+	_ RandReporter  = (*traceReporter)(nil)
+)
+
+func (r *traceReporter) Start() {}
+
+func (r *traceReporter) Finish(res *Result) {
+	r.count++
+	status := fmt.Sprintf("status %d", res.StatusCode)
+	if res.Err != nil {
+		r.failed++
+		status = fmt.Sprintf("error: %s", res.Err)
+	}
+	fmt.Fprintf(r.w, "= %s: %s, %d bytes in %s\n", res.Name, status, res.ContentLength, roundTrace(res.Duration))
+	fmt.Fprintf(r.w, "  dns %s, conn %s, tls %s, req %s, delay %s, res %s\n\n",
+		roundTrace(res.DnsDuration), roundTrace(res.ConnDuration), roundTrace(res.TLSDuration),
+		roundTrace(res.ReqDuration), roundTrace(res.DelayDuration), roundTrace(res.ResDuration))
+}
+
+func (r *traceReporter) UserAgent() string {
+	return r.userAgent
+}
+
+func (r *traceReporter) Hooks() []Hook {
+	return r.hooks
+}
+
+func (r *traceReporter) Clock() *Clock {
+	return r.clock
+}
+
+func (r *traceReporter) Rand() *rand.Rand {
+	return r.rng
+}
+
+func (r *traceReporter) Check(name string, passed bool) {
+	r.checks++
+	outcome := "passed"
+	if !passed {
+		r.failedChecks++
+		outcome = "FAILED"
+	}
+	fmt.Fprintf(r.w, "= check %s: %s\n\n", name, outcome)
+}
+
+func roundTrace(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
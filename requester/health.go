@@ -0,0 +1,86 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// HealthCheckScript is the HealthCheck that probes the target by
+// running the Requester.
+const HealthCheckScript = "script"
+
+// healthRetryInterval is how long CheckHealth waits between probes.
+var healthRetryInterval = time.Second
+
+// CheckHealth probes the target as HealthCheck says, before the run,
+// so that a run against a target that isn't up yet fails fast rather
+// than producing a report of errors.  Failed probes are retried for up
+// to HealthWait.  Probes are made without Chaos, and their results
+// aren't reported.  It returns nil if HealthCheck isn't set.
+func (b *Work) CheckHealth(ctx context.Context) error {
+	if b.HealthCheck == "" {
+		return nil
+	}
+	if b.log == nil {
+		b.setLogger()
+	}
+	client := b.newClientWith(Chaos{})
+	deadline := time.Now().Add(b.HealthWait)
+	for attempt := 1; ; attempt++ {
+		err := b.probe(ctx, client)
+		if err == nil {
+			b.log.Info("target is healthy", "check", b.HealthCheck, "attempts", attempt)
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("health check failed after %d attempts: %w", attempt, err)
+		}
+		b.log.Warn("target isn't healthy yet", "check", b.HealthCheck, "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health check: %w", ctx.Err())
+		case <-time.After(healthRetryInterval):
+		}
+	}
+}
+
+// probe makes a single health check.
+func (b *Work) probe(ctx context.Context, client *http.Client) error {
+	if b.HealthCheck == HealthCheckScript {
+		reporter := &traceReporter{w: ioutil.Discard, userAgent: b.UserAgent, hooks: b.Hooks, clock: NewClock(), rng: workerRand(b.Seed, 0)}
+		if err := b.Requester.Clone().Do(ctx, client, reporter); err != nil {
+			return fmt.Errorf("requester.Do: %w", err)
+		}
+		if reporter.failed > 0 || reporter.failedChecks > 0 {
+			return fmt.Errorf("%d of %d requests and %d of %d checks failed",
+				reporter.failed, reporter.count, reporter.failedChecks, reporter.checks)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.HealthCheck, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if b.UserAgent != "" {
+		req.Header.Set("User-Agent", b.UserAgent)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GET %s: %s", b.HealthCheck, resp.Status)
+	}
+	return nil
+}
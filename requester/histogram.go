@@ -0,0 +1,95 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"math"
+	"math/bits"
+)
+
+// histogramSubBits sets the precision of histograms: each power of two
+// nanoseconds is split into 2^(histogramSubBits-1) buckets, so values
+// are recorded to within 1/2^histogramSubBits of what they were.
+const histogramSubBits = 8
+
+const histogramHalf = 1 << (histogramSubBits - 1)
+
+// A latencyHistogram is a streaming aggregate of latencies in seconds,
+// in the style of HdrHistogram: values are counted in buckets whose
+// width grows with their magnitude, so its size depends only on the
+// range of the latencies, not on how many there are, and percentiles
+// are accurate in the tail too.  The fields are exported for
+// checkpoints.
+type latencyHistogram struct {
+	Counts   []int64
+	N        int64
+	Min, Max float64
+}
+
+// histogramIndex returns the index of the bucket v seconds is in.
+// Values below 2^histogramSubBits ns have a bucket each; above that,
+// the bucket width doubles with each power of two.
+func histogramIndex(v float64) int {
+	ns := uint64(0)
+	if v > 0 {
+		ns = uint64(math.Round(v * 1e9))
+	}
+	shift := bits.Len64(ns) - histogramSubBits
+	if shift <= 0 {
+		return int(ns)
+	}
+	return shift*histogramHalf + int(ns>>uint(shift))
+}
+
+// histogramValue returns the midpoint of bucket i, in seconds.
+func histogramValue(i int) float64 {
+	if i < 2*histogramHalf {
+		return float64(i) / 1e9
+	}
+	shift := uint(i/histogramHalf - 1)
+	lower := uint64(i-int(shift)*histogramHalf) << shift
+	return float64(lower+(1<<shift)/2) / 1e9
+}
+
+func (h *latencyHistogram) add(v float64) {
+	i := histogramIndex(v)
+	if i >= len(h.Counts) {
+		h.Counts = append(h.Counts, make([]int64, i+1-len(h.Counts))...)
+	}
+	h.Counts[i]++
+	if h.N == 0 || v < h.Min {
+		h.Min = v
+	}
+	if h.N == 0 || v > h.Max {
+		h.Max = v
+	}
+	h.N++
+}
+
+// valueAt returns the rank'th smallest value, counting from 1, to
+// within the precision of the histogram, which must not be empty.  The
+// smallest and largest values are exact.
+func (h *latencyHistogram) valueAt(rank int64) float64 {
+	if rank <= 1 {
+		return h.Min
+	}
+	if rank >= h.N {
+		return h.Max
+	}
+	var seen int64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			return h.clamp(histogramValue(i))
+		}
+	}
+	return h.Max
+}
+
+// clamp returns v within the range of the values added, which the
+// midpoints of the first and last buckets may be outside of.
+func (h *latencyHistogram) clamp(v float64) float64 {
+	return math.Max(h.Min, math.Min(h.Max, v))
+}
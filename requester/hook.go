@@ -0,0 +1,39 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import "net/http"
+
+// A Hook intercepts the HTTP requests Requesters make, to change them
+// centrally, e.g. to add authentication, or to veto them.
+//
+// BeforeRequest is called before req is sent, and may modify it.  If
+// it returns an error the request isn't sent, and is reported as
+// failed with that error.  AfterResponse is called with the response,
+// whose Body reads what the Requester read of the body, or nil if the
+// request failed, and the result before it is reported, which it may
+// amend.  Hooks are called from the workers' goroutines concurrently;
+// BeforeRequest in the order they're given, AfterResponse in the
+// reverse order.
+type Hook interface {
+	BeforeRequest(req *http.Request) error
+	AfterResponse(req *http.Request, resp *http.Response, res *Result)
+}
+
+// BeforeRequestFunc adapts a function to a Hook that only intercepts
+// requests before they're sent.
+type BeforeRequestFunc func(req *http.Request) error
+
+func (f BeforeRequestFunc) BeforeRequest(req *http.Request) error {
+	return f(req)
+}
+
+func (f BeforeRequestFunc) AfterResponse(*http.Request, *http.Response, *Result) {}
+
+// A HookReporter provides the hooks that Requesters making HTTP
+// requests call.  The Reporter passed to Requester.Do implements it.
+type HookReporter interface {
+	Hooks() []Hook
+}
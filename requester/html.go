@@ -0,0 +1,125 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"html/template"
+)
+
+// htmlBar is a bucket of a histogram, with the width of its bar as a
+// percentage of the largest one.
+type htmlBar struct {
+	Mark  float64
+	Count int
+	Width float64
+}
+
+func htmlBars(buckets []Bucket) []htmlBar {
+	max := 0
+	for _, b := range buckets {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	bars := make([]htmlBar, 0, len(buckets))
+	for _, b := range buckets {
+		bar := htmlBar{Mark: b.Mark, Count: b.Count}
+		if max > 0 {
+			bar.Width = float64(b.Count) * 100 / float64(max)
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+var htmlTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"formatNumber":  formatNumber,
+	"formatPercent": formatPercent,
+	"bars":          htmlBars,
+	"reached":       reached,
+}).Parse(htmlTmpl))
+
+// renderHTML renders snapshot as a standalone HTML page.
+func renderHTML(snapshot Report) (string, error) {
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, snapshot); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+const htmlTmpl = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hithere report{{ if .RunID }} {{ .RunID }}{{ end }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.num { text-align: right; font-family: monospace; }
+.bar { background: #4a7ebb; height: 0.9em; }
+</style>
+</head>
+<body>
+<h1>hithere report</h1>
+{{ if or .RunID .Tags }}<table>{{ if .RunID }}
+<tr><th>Run ID</th><td>{{ .RunID }}</td></tr>{{ end }}{{ range $k, $v := .Tags }}
+<tr><th>{{ $k }}</th><td>{{ $v }}</td></tr>{{ end }}
+</table>{{ end }}
+
+<h2>Summary</h2>
+<table>
+<tr><th>Total</th><td class="num">{{ formatNumber .Total.Seconds }} secs</td></tr>
+<tr><th>Requests</th><td class="num">{{ .NumRes }}</td></tr>
+<tr><th>Requests/sec</th><td class="num">{{ formatNumber .Rps }}</td></tr>
+<tr><th>Slowest</th><td class="num">{{ formatNumber .Slowest }} secs</td></tr>
+<tr><th>Fastest</th><td class="num">{{ formatNumber .Fastest }} secs</td></tr>
+<tr><th>Average</th><td class="num">{{ formatNumber .Average }} secs</td></tr>{{ if gt .SizeTotal 0 }}
+<tr><th>Total data</th><td class="num">{{ .SizeTotal }} bytes</td></tr>
+<tr><th>Size/request</th><td class="num">{{ .SizeReq }} bytes</td></tr>
+<tr><th>Throughput</th><td class="num">{{ formatNumber .Throughput }} bytes/sec</td></tr>{{ end }}
+</table>
+
+<h2>Response time histogram</h2>
+<table>{{ range bars .Histogram }}
+<tr><td class="num">{{ formatNumber .Mark }}</td><td class="num">{{ .Count }}</td><td style="width: 20em"><div class="bar" style="width: {{ .Width }}%"></div></td></tr>{{ end }}
+</table>
+
+<h2>Latency distribution</h2>
+<table>{{ range reached .LatencyDistribution }}
+<tr><th>{{ .Percentage }}%</th><td class="num">{{ formatNumber .Latency }} secs</td></tr>{{ end }}
+</table>
+
+<h2>Time to first byte distribution</h2>
+<table>{{ range reached .TTFBDistribution }}
+<tr><th>{{ .Percentage }}%</th><td class="num">{{ formatNumber .Latency }} secs</td></tr>{{ end }}
+</table>
+
+<h2>Status codes</h2>
+<table>{{ range $code, $num := .StatusCodeDist }}
+<tr><th>{{ $code }}</th><td class="num">{{ $num }}</td></tr>{{ end }}
+</table>
+{{ if .ErrorDist }}
+<h2>Errors</h2>
+<table>{{ range $err, $num := .ErrorDist }}
+<tr><td class="num">{{ $num }}</td><td>{{ $err }}</td></tr>{{ end }}
+</table>
+{{ end }}{{ if .Endpoints }}
+<h2>Endpoints</h2>
+<table>
+<tr><th>Endpoint</th><th>Requests</th><th>Total bytes</th><th>Bytes/request</th></tr>{{ range .Endpoints }}
+<tr><td>{{ .Name }}</td><td class="num">{{ .NumRes }}</td><td class="num">{{ .SizeTotal }}</td><td class="num">{{ .SizeReq }}</td></tr>{{ end }}
+</table>
+{{ end }}{{ if .Checks }}
+<h2>Checks</h2>
+<table>
+<tr><th>Check</th><th>Passes</th><th>Fails</th><th>Pass rate</th></tr>{{ range .Checks }}
+<tr><td>{{ .Name }}</td><td class="num">{{ .Passes }}</td><td class="num">{{ .Fails }}</td><td class="num">{{ formatPercent .Rate }}%</td></tr>{{ end }}
+</table>
+{{ end }}</body>
+</html>
+`
@@ -0,0 +1,142 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// InterimSummary is the JSON form of an Interval, written as one line
+// per interval when interim summaries are requested as JSON.
+// Durations are in seconds.
+type InterimSummary struct {
+	RunID string            `json:"run_id,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+
+	Requests  int64   `json:"requests"`
+	Rps       float64 `json:"rps"`
+	Fastest   float64 `json:"fastest"`
+	Slowest   float64 `json:"slowest"`
+	Average   float64 `json:"average"`
+	SizeTotal int64   `json:"size_total"`
+	// Throughput is in bytes/sec.
+	Throughput float64 `json:"throughput"`
+
+	LatencyDistribution []LatencyDistribution `json:"latency_distribution"`
+	StatusCodeDist      map[int]int           `json:"status_code_dist"`
+	ErrorDist           map[string]int        `json:"error_dist"`
+	// Connections is missing if no connections were counted.
+	Connections *ConnStats `json:"connections,omitempty"`
+	// Cache is missing if the HTTP cache handled no requests.
+	Cache *CacheStats `json:"cache,omitempty"`
+}
+
+// interim writes a short summary of each interval while a run is in
+// progress.
+type interim struct {
+	w    io.Writer
+	json bool
+}
+
+var _ intervalSink = (*interim)(nil)
+
+func newInterim(w io.Writer, asJSON bool) *interim {
+	if w == nil {
+		w = os.Stderr
+	}
+	return &interim{w: w, json: asJSON}
+}
+
+func (s *interim) sendInterval(iv *Interval) {
+	if s.json {
+		s.writeJSON(iv)
+	} else {
+		s.writeText(iv)
+	}
+}
+
+func (s *interim) writeJSON(iv *Interval) {
+	var conns *ConnStats
+	if iv.Conns.Total() > 0 {
+		conns = &iv.Conns
+	}
+	var cache *CacheStats
+	if iv.Cache.Total() > 0 {
+		cache = &iv.Cache
+	}
+	body, err := json.Marshal(&InterimSummary{
+		RunID:               iv.RunID,
+		Tags:                iv.Tags,
+		Start:               iv.Start.Seconds(),
+		Duration:            iv.Duration.Seconds(),
+		Requests:            iv.NumRes,
+		Rps:                 iv.Rps,
+		Fastest:             iv.Fastest,
+		Slowest:             iv.Slowest,
+		Average:             iv.Average,
+		SizeTotal:           iv.SizeTotal,
+		Throughput:          iv.Throughput,
+		LatencyDistribution: reached(iv.LatencyDistribution),
+		StatusCodeDist:      iv.StatusCodeDist,
+		ErrorDist:           iv.ErrorDist,
+		Connections:         conns,
+		Cache:               cache,
+	})
+	if err != nil {
+		fmt.Fprintf(s.w, "interim: json.Marshal: %s\n", err)
+		return
+	}
+	body = append(body, '\n')
+	s.w.Write(body)
+}
+
+func (s *interim) writeText(iv *Interval) {
+	var errors int
+	for _, n := range iv.ErrorDist {
+		errors += n
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%6.1fs] %d requests, %.1f req/sec, %d errors",
+		(iv.Start + iv.Duration).Seconds(), iv.NumRes, iv.Rps, errors)
+	if iv.NumRes > int64(errors) {
+		fmt.Fprintf(&b, ", avg %.4f secs", iv.Average)
+		for _, l := range iv.LatencyDistribution {
+			switch l.Percentage {
+			case 50, 90, 99:
+				fmt.Fprintf(&b, ", p%d %.4f", l.Percentage, l.Latency)
+			}
+		}
+	}
+	if len(iv.StatusCodeDist) > 0 {
+		codes := make([]int, 0, len(iv.StatusCodeDist))
+		for code := range iv.StatusCodeDist {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		b.WriteString(", status")
+		for _, code := range codes {
+			fmt.Fprintf(&b, " [%d]x%d", code, iv.StatusCodeDist[code])
+		}
+	}
+	if iv.Conns.Total() > 0 {
+		fmt.Fprintf(&b, ", conns %d new, %d reused", iv.Conns.New, iv.Conns.Reused)
+	}
+	if iv.Cache.Total() > 0 {
+		fmt.Fprintf(&b, ", cache %.0f%% hits", 100*iv.Cache.HitRate())
+	}
+	b.WriteByte('\n')
+	io.WriteString(s.w, b.String())
+}
+
+func (s *interim) close() {}
@@ -0,0 +1,217 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"sync"
+	"time"
+)
+
+// Interval is an aggregate of the results that completed during one
+// slice of a run, used for live reporting while the run is in progress.
+type Interval struct {
+	// Start is the offset of the interval from the start of the run.
+	Start    time.Duration
+	Duration time.Duration
+
+	NumRes    int64
+	Rps       float64
+	Average   float64
+	Fastest   float64
+	Slowest   float64
+	SizeTotal int64
+	// Throughput is in bytes/sec.
+	Throughput float64
+	// ForcedCloses counts the responses whose connections couldn't
+	// be reused because their bodies weren't read to the end.
+	ForcedCloses int64
+	// Conns count the new and reused connections of the requests.
+	Conns ConnStats
+	// Cache counts the outcomes of the requests the HTTP cache
+	// handled.
+	Cache CacheStats
+
+	ErrorDist      map[string]int
+	StatusCodeDist map[int]int
+
+	LatencyDistribution []LatencyDistribution
+
+	// RunID and Tags identify the run, see Work.
+	RunID string
+	Tags  map[string]string
+}
+
+// intervalStats accumulates results until flushed.  It is written to
+// by the reporter goroutine and flushed from whoever consumes
+// intervals, so all access is under mu.
+type intervalStats struct {
+	mu sync.Mutex
+
+	runStart time.Duration
+	start    time.Duration
+
+	lats         *latencyHistogram
+	latTotal     float64
+	errorDist    map[string]int
+	statusCodes  map[int]int
+	sizeTotal    int64
+	numRes       int64
+	forcedCloses int64
+	conns        ConnStats
+	cache        CacheStats
+}
+
+func newIntervalStats(runStart time.Duration) *intervalStats {
+	return &intervalStats{
+		runStart:    runStart,
+		start:       runStart,
+		lats:        &latencyHistogram{},
+		errorDist:   make(map[string]int),
+		statusCodes: make(map[int]int),
+	}
+}
+
+func (s *intervalStats) add(res *Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.numRes++
+	if res.ForcedClose {
+		s.forcedCloses++
+	}
+	s.conns.add(res)
+	s.cache.add(res)
+	if res.Err != nil {
+		s.errorDist[res.Err.Error()]++
+		return
+	}
+	s.lats.add(res.Duration.Seconds())
+	s.latTotal += res.Duration.Seconds()
+	s.statusCodes[res.StatusCode]++
+	if res.ContentLength > 0 {
+		s.sizeTotal += res.ContentLength
+	}
+}
+
+// flush returns the aggregate of everything added since the previous
+// flush, and starts a new interval at end.
+func (s *intervalStats) flush(end time.Duration) *Interval {
+	s.mu.Lock()
+	lats, latTotal := s.lats, s.latTotal
+	iv := &Interval{
+		Start:          s.start - s.runStart,
+		Duration:       end - s.start,
+		NumRes:         s.numRes,
+		SizeTotal:      s.sizeTotal,
+		ForcedCloses:   s.forcedCloses,
+		Conns:          s.conns,
+		Cache:          s.cache,
+		ErrorDist:      s.errorDist,
+		StatusCodeDist: s.statusCodes,
+	}
+	s.start = end
+	s.lats = &latencyHistogram{}
+	s.latTotal = 0
+	s.errorDist = make(map[string]int)
+	s.statusCodes = make(map[int]int)
+	s.sizeTotal = 0
+	s.numRes = 0
+	s.forcedCloses = 0
+	s.conns = ConnStats{}
+	s.cache = CacheStats{}
+	s.mu.Unlock()
+
+	if iv.Duration > 0 {
+		iv.Rps = float64(iv.NumRes) / iv.Duration.Seconds()
+		iv.Throughput = float64(iv.SizeTotal) / iv.Duration.Seconds()
+	}
+	if lats.N == 0 {
+		return iv
+	}
+	iv.Average = latTotal / float64(lats.N)
+	iv.Fastest = lats.Min
+	iv.Slowest = lats.Max
+	iv.LatencyDistribution = latencies(lats)
+	return iv
+}
+
+// An intervalSink consumes live interval aggregates.  sendInterval is
+// called from a single goroutine and must not block for long.
+type intervalSink interface {
+	sendInterval(iv *Interval)
+	// close is called after the final interval has been sent.
+	close()
+}
+
+// startIntervals starts the configured live consumers of interval
+// aggregates, if any, each fed by its own goroutine at its own period.
+func (b *Work) startIntervals() {
+	interval := b.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	b.intervalsStop = make(chan struct{})
+	if b.CollectorAddr != "" {
+		c, err := startCollector(b.CollectorAddr, b.log)
+		if err != nil {
+			b.log.Error("collector", "err", err)
+		} else {
+			b.startIntervalSink(c, interval)
+		}
+	}
+	if b.WebAddr != "" {
+		d, err := startDashboard(b.WebAddr)
+		if err != nil {
+			b.log.Error("web", "err", err)
+		} else {
+			b.startIntervalSink(d, interval)
+		}
+	}
+	if b.Interim > 0 {
+		b.startIntervalSink(newInterim(b.InterimWriter, b.InterimJSON), b.Interim)
+	}
+	for _, s := range b.metrics {
+		if s, ok := s.(LiveMetricsSink); ok {
+			b.startIntervalSink(liveSink{s}, interval)
+		}
+	}
+}
+
+func (b *Work) startIntervalSink(sink intervalSink, period time.Duration) {
+	stats := newIntervalStats(b.start)
+	b.report.intervals = append(b.report.intervals, stats)
+
+	b.intervalsWg.Add(1)
+	go func() {
+		defer b.intervalsWg.Done()
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sink.sendInterval(b.labelInterval(stats.flush(now())))
+			case <-b.intervalsStop:
+				sink.sendInterval(b.labelInterval(stats.flush(now())))
+				sink.close()
+				return
+			}
+		}
+	}()
+}
+
+func (b *Work) labelInterval(iv *Interval) *Interval {
+	iv.RunID = b.RunID
+	iv.Tags = b.Tags
+	return iv
+}
+
+// stopIntervals sends the final intervals and shuts the consumers down.
+func (b *Work) stopIntervals() {
+	close(b.intervalsStop)
+	b.intervalsWg.Wait()
+}
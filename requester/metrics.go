@@ -0,0 +1,150 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// A MetricsSink consumes the metrics of a run: the output formats,
+// and exporters to monitoring systems.  Report is called with the
+// final report once the run is done, and should flush anything
+// buffered and release any resources.
+type MetricsSink interface {
+	Report(r *Report) error
+}
+
+// A LiveMetricsSink is also sent the aggregate of each Work.Interval
+// of the run while it is in progress, from a single goroutine.
+type LiveMetricsSink interface {
+	MetricsSink
+	Interval(iv *Interval)
+}
+
+// formatSink renders the report in an output format.
+type formatSink struct {
+	format string
+	w      io.Writer
+	path   string
+}
+
+// NewWriterSink returns a MetricsSink writing the report to w in
+// format, one of those of Output.
+func NewWriterSink(format string, w io.Writer) MetricsSink {
+	return &formatSink{format: format, w: w}
+}
+
+// NewFileSink returns a MetricsSink writing the report to the file at
+// path in format, one of those of Output.
+func NewFileSink(format, path string) MetricsSink {
+	return &formatSink{format: format, path: path}
+}
+
+func (s *formatSink) Report(r *Report) error {
+	out, err := render(s.format, *r)
+	if err != nil {
+		return err
+	}
+	out += "\n"
+	if s.path != "" {
+		return ioutil.WriteFile(s.path, []byte(out), 0644)
+	}
+	_, err = io.WriteString(s.w, out)
+	return err
+}
+
+// newOutputSink returns the MetricsSink for o, writing to w if it has
+// no path.
+func newOutputSink(o Output, w io.Writer) (MetricsSink, error) {
+	switch o.Format {
+	case "prometheus":
+		return NewPrometheusSink(o.Path)
+	case "statsd":
+		return NewStatsDSink(o.Path, "hithere")
+	case "remote_write":
+		return NewRemoteWriteSink(o.Path)
+	}
+	if o.Path == "" {
+		return NewWriterSink(o.Format, w), nil
+	}
+	return NewFileSink(o.Format, o.Path), nil
+}
+
+// metricsSinks returns the sinks for Outputs, or Output, followed by
+// MetricsSinks.  Outputs that fail to start are logged and skipped.
+func (b *Work) metricsSinks() []MetricsSink {
+	outputs := b.Outputs
+	if len(outputs) == 0 {
+		outputs = []Output{{Format: b.Output}}
+	}
+	var sinks []MetricsSink
+	for _, o := range outputs {
+		s, err := newOutputSink(o, b.writer())
+		if err != nil {
+			b.log.Error("starting output", "format", o.Format, "err", err)
+			continue
+		}
+		sinks = append(sinks, s)
+	}
+	return append(sinks, b.MetricsSinks...)
+}
+
+// wantSamples reports whether the report needs to keep the samples of
+// each request: for outputs listing every request, and for checkpoints
+// and uploaded reports, which include them.
+func (b *Work) wantSamples() bool {
+	if b.CheckpointPath != "" || b.ReportDest != "" {
+		return true
+	}
+	outputs := b.Outputs
+	if len(outputs) == 0 {
+		outputs = []Output{{Format: b.Output}}
+	}
+	for _, o := range outputs {
+		if formatNeedsSamples(o.Format) {
+			return true
+		}
+	}
+	for _, s := range b.MetricsSinks {
+		if s, ok := s.(*formatSink); ok && formatNeedsSamples(s.format) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatNeedsSamples reports whether an output format lists every
+// request.  Templates might.
+func formatNeedsSamples(format string) bool {
+	switch format {
+	case "", "summary", "json", "html", "prometheus", "statsd", "remote_write":
+		return false
+	}
+	return true
+}
+
+// liveSink feeds a LiveMetricsSink intervals.  It is closed with the
+// rest of the interval consumers, before the sink gets the report.
+type liveSink struct {
+	s LiveMetricsSink
+}
+
+var _ intervalSink = liveSink{}
+
+func (l liveSink) sendInterval(iv *Interval) {
+	l.s.Interval(iv)
+}
+
+func (l liveSink) close() {}
+
+// reportMetrics sends the final report to each sink.
+func (b *Work) reportMetrics(snapshot *Report) {
+	for _, s := range b.metrics {
+		if err := s.Report(snapshot); err != nil {
+			b.log.Error("output", "err", err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import "sync"
+
+var resultPool = sync.Pool{
+	New: func() interface{} {
+		return new(Result)
+	},
+}
+
+// NewResult returns a zeroed Result, reused from a previous request
+// where possible to save allocating one for every request.  A Result
+// from NewResult must not be used by the Requester once it has been
+// passed to Reporter.Finish: the reporter may reuse it as soon as it
+// has been aggregated.  Results that are allocated otherwise are never
+// reused.
+func NewResult() *Result {
+	res := resultPool.Get().(*Result)
+	res.pooled = true
+	return res
+}
+
+// release returns res to the pool if it came from NewResult.
+func (res *Result) release() {
+	if !res.pooled {
+		return
+	}
+	*res = Result{}
+	resultPool.Put(res)
+}
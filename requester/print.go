@@ -13,7 +13,7 @@
 // limitations under the License.
 
 /*
-Hey supports two output formats: summary and CSV
+Hey supports four output formats: summary, CSV, JSON and HTML
 
 The summary output presents a number of statistics about the requests in a
 human-readable format, including:
@@ -31,6 +31,10 @@ The comma-separated CSV format is proceeded by a header, and consists of the fol
 6. Response-read:	Time taken to read full response (in seconds)
 7. status-code:		HTTP status code of the response (e.g. 200)
 8. offset:			The time since the start of the benchmark when the request was started. (in seconds)
+9. run-id:			The ID of the run.
+
+The JSON format is the Summary of the run, and the HTML format a standalone
+page with the summary statistics and a response time histogram.
 */
 package requester
 
@@ -42,10 +46,21 @@ import (
 	"text/template"
 )
 
+// An Output is a report of a run: its Format, one of "" for the summary,
+// "csv", "json", "html" or a template, and the Path of the file to write
+// it to.  An empty Path means Work.Writer.  The "prometheus", "statsd"
+// and "remote_write" formats export metrics during the run instead,
+// and their Path is the address to serve them on or send them to; see
+// NewPrometheusSink, NewStatsDSink and NewRemoteWriteSink.
+type Output struct {
+	Format string
+	Path   string
+}
+
 func newTemplate(output string) *template.Template {
 	outputTmpl := output
 	switch outputTmpl {
-	case "":
+	case "", "summary":
 		outputTmpl = defaultTmpl
 	case "csv":
 		outputTmpl = csvTmpl
@@ -56,6 +71,7 @@ func newTemplate(output string) *template.Template {
 var tmplFuncMap = template.FuncMap{
 	"formatNumber":    formatNumber,
 	"formatNumberInt": formatNumberInt,
+	"formatPercent":   formatPercent,
 	"histogram":       histogram,
 	"jsonify":         jsonify,
 }
@@ -73,6 +89,12 @@ func formatNumberInt(duration int) string {
 	return fmt.Sprintf("%d", duration)
 }
 
+// formatPercent formats a fraction as a percentage, without the %
+// sign, which has to be escaped in the default template.
+func formatPercent(frac float64) string {
+	return fmt.Sprintf("%.2f", frac*100)
+}
+
 func histogram(buckets []Bucket) string {
 	max := 0
 	for _, b := range buckets {
@@ -94,7 +116,9 @@ func histogram(buckets []Bucket) string {
 
 var (
 	defaultTmpl = `
-Summary:
+Summary:{{ if .RunID }}
+  Run ID:	{{ .RunID }}{{ end }}{{ range $k, $v := .Tags }}
+  Tag:	{{ $k }}={{ $v }}{{ end }}
   Total:	{{ formatNumber .Total.Seconds }} secs
   Slowest:	{{ formatNumber .Slowest }} secs
   Fastest:	{{ formatNumber .Fastest }} secs
@@ -102,7 +126,9 @@ Summary:
   Requests/sec:	{{ formatNumber .Rps }}
   {{ if gt .SizeTotal 0 }}
   Total data:	{{ .SizeTotal }} bytes
-  Size/request:	{{ .SizeReq }} bytes{{ end }}
+  Size/request:	{{ .SizeReq }} bytes
+  Throughput:	{{ formatNumber .Throughput }} bytes/sec{{ end }}{{ if gt .ForcedCloses 0 }}
+  Forced closes:	{{ .ForcedCloses }}{{ end }}
 
 Response time histogram:
 {{ histogram .Histogram }}
@@ -110,19 +136,47 @@ Response time histogram:
 Latency distribution:{{ range .LatencyDistribution }}
   {{ .Percentage }}%% in {{ formatNumber .Latency }} secs{{ end }}
 
+Time to first byte histogram:
+{{ histogram .TTFBHistogram }}
+
+Time to first byte distribution:{{ range .TTFBDistribution }}
+  {{ .Percentage }}%% in {{ formatNumber .Latency }} secs{{ end }}
+
 Details (average, fastest, slowest):
-  DNS+dialup:	{{ formatNumber .AvgConn }} secs, {{ formatNumber .Fastest }} secs, {{ formatNumber .Slowest }} secs
+  DNS+dialup:	{{ formatNumber .AvgConn }} secs, {{ formatNumber .ConnMax }} secs, {{ formatNumber .ConnMin }} secs
   DNS-lookup:	{{ formatNumber .AvgDNS }} secs, {{ formatNumber .DnsMax }} secs, {{ formatNumber .DnsMin }} secs
+  TLS handshake:	{{ formatNumber .AvgTLS }} secs, {{ formatNumber .TLSMax }} secs, {{ formatNumber .TLSMin }} secs
   req write:	{{ formatNumber .AvgReq }} secs, {{ formatNumber .ReqMax }} secs, {{ formatNumber .ReqMin }} secs
   resp wait:	{{ formatNumber .AvgDelay }} secs, {{ formatNumber .DelayMax }} secs, {{ formatNumber .DelayMin }} secs
   resp read:	{{ formatNumber .AvgRes }} secs, {{ formatNumber .ResMax }} secs, {{ formatNumber .ResMin }} secs
-
-Status code distribution:{{ range $code, $num := .StatusCodeDist }}
+{{ if .PhaseDistributions }}
+Details (percentiles):
+ {{ range (index .PhaseDistributions 0).Percentiles }}	{{ .Percentage }}%%{{ end }}{{ range .PhaseDistributions }}
+  {{ .Phase }}:{{ range .Percentiles }}	{{ formatNumber .Latency }}{{ end }}{{ end }}
+{{ end }}
+{{ if .Conns.Total }}Connections:
+  New:	{{ .Conns.New }}, with {{ .Conns.DNSLookups }} DNS lookups and {{ .Conns.TLSHandshakes }} TLS handshakes
+  Reused:	{{ .Conns.Reused }} ({{ formatPercent .Conns.ReuseRate }}%% of requests)
+
+{{ end }}{{ if .Cache.Total }}HTTP cache:
+  Hits:	{{ .Cache.Hits }} ({{ formatPercent .Cache.HitRate }}%% of cacheable requests)
+  Revalidated:	{{ .Cache.Revalidated }}
+  Misses:	{{ .Cache.Misses }}
+
+{{ end }}Status code distribution:{{ range $code, $num := .StatusCodeDist }}
   [{{ $code }}]	{{ $num }} responses{{ end }}
 
 {{ if gt (len .ErrorDist) 0 }}Error distribution:{{ range $err, $num := .ErrorDist }}
   [{{ $num }}]	{{ $err }}{{ end }}{{ end }}
-`
-	csvTmpl = `{{ $connLats := .ConnLats }}{{ $dnsLats := .DnsLats }}{{ $dnsLats := .DnsLats }}{{ $reqLats := .ReqLats }}{{ $delayLats := .DelayLats }}{{ $resLats := .ResLats }}{{ $statusCodeLats := .StatusCodes }}{{ $offsets := .Offsets}}response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,status-code,offset{{ range $i, $v := .Lats }}
-{{ formatNumber $v }},{{ formatNumber (index $connLats $i) }},{{ formatNumber (index $dnsLats $i) }},{{ formatNumber (index $reqLats $i) }},{{ formatNumber (index $delayLats $i) }},{{ formatNumber (index $resLats $i) }},{{ formatNumberInt (index $statusCodeLats $i) }},{{ formatNumber (index $offsets $i) }}{{ end }}`
+{{ if .Endpoints }}Endpoints (requests, total bytes, bytes/request):{{ range .Endpoints }}
+  {{ .Name }}	{{ .NumRes }}, {{ .SizeTotal }}, {{ .SizeReq }}{{ end }}
+
+{{ end }}{{ if .Checks }}Checks (passes, fails, pass rate):{{ range .Checks }}
+  {{ .Name }}	{{ .Passes }}, {{ .Fails }}, {{ formatPercent .Rate }}%%{{ end }}
+
+{{ end }}{{ if .Workers }}Workers (requests, errors, average, fastest, slowest):{{ range .Workers }}
+  [{{ .ID }}]	{{ .NumRes }}, {{ .Errors }}, {{ formatNumber .Average }} secs, {{ formatNumber .Fastest }} secs, {{ formatNumber .Slowest }} secs{{ end }}
+{{ end }}`
+	csvTmpl = `{{ $connLats := .ConnLats }}{{ $dnsLats := .DnsLats }}{{ $dnsLats := .DnsLats }}{{ $reqLats := .ReqLats }}{{ $delayLats := .DelayLats }}{{ $resLats := .ResLats }}{{ $statusCodeLats := .StatusCodes }}{{ $offsets := .Offsets}}{{ $runID := .RunID }}response-time,DNS+dialup,DNS,Request-write,Response-delay,Response-read,status-code,offset,run-id{{ range $i, $v := .Lats }}
+{{ formatNumber $v }},{{ formatNumber (index $connLats $i) }},{{ formatNumber (index $dnsLats $i) }},{{ formatNumber (index $reqLats $i) }},{{ formatNumber (index $delayLats $i) }},{{ formatNumber (index $resLats $i) }},{{ formatNumberInt (index $statusCodeLats $i) }},{{ formatNumber (index $offsets $i) }},{{ $runID }}{{ end }}`
 )
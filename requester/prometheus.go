@@ -0,0 +1,227 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusSink serves the metrics of a run in the Prometheus text
+// exposition format on /metrics while it is in progress.  Counters
+// accumulate over the run; the gauges are of the latest interval.
+type prometheusSink struct {
+	srv  *http.Server
+	addr string
+
+	mu sync.Mutex
+	m  promMetrics
+}
+
+// promMetrics accumulates the Prometheus metrics of a run from its
+// intervals.
+type promMetrics struct {
+	runID     string
+	tags      map[string]string
+	requests  int64
+	errors    int64
+	bytes     int64
+	forced    int64
+	conns     ConnStats
+	cache     CacheStats
+	responses map[int]int64
+	rps       float64
+	latencies []LatencyDistribution
+}
+
+var _ LiveMetricsSink = (*prometheusSink)(nil)
+
+// NewPrometheusSink returns a MetricsSink serving metrics for
+// Prometheus to scrape at http://addr/metrics during the run.
+func NewPrometheusSink(addr string) (MetricsSink, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &prometheusSink{addr: ln.Addr().String()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	s.srv = &http.Server{Handler: mux}
+	go s.srv.Serve(ln)
+	return s, nil
+}
+
+func (s *prometheusSink) Interval(iv *Interval) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.add(iv)
+}
+
+// add accumulates iv: the counters are over the run, and the gauges
+// are of the latest interval.
+func (m *promMetrics) add(iv *Interval) {
+	m.runID, m.tags = iv.RunID, iv.Tags
+	m.requests += iv.NumRes
+	for _, n := range iv.ErrorDist {
+		m.errors += int64(n)
+	}
+	m.bytes += iv.SizeTotal
+	m.forced += iv.ForcedCloses
+	m.conns.New += iv.Conns.New
+	m.conns.Reused += iv.Conns.Reused
+	m.conns.DNSLookups += iv.Conns.DNSLookups
+	m.conns.TLSHandshakes += iv.Conns.TLSHandshakes
+	m.cache.Hits += iv.Cache.Hits
+	m.cache.Revalidated += iv.Cache.Revalidated
+	m.cache.Misses += iv.Cache.Misses
+	if m.responses == nil {
+		m.responses = make(map[int]int64)
+	}
+	for code, n := range iv.StatusCodeDist {
+		m.responses[code] += int64(n)
+	}
+	m.rps = iv.Rps
+	m.latencies = reached(iv.LatencyDistribution)
+}
+
+// codes returns the status codes of the responses, in order.
+func (m *promMetrics) codes() []int {
+	codes := make([]int, 0, len(m.responses))
+	for code := range m.responses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// Report stops serving metrics.
+func (s *prometheusSink) Report(r *Report) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *prometheusSink) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	s.mu.Lock()
+	m := &s.m
+	labels := promLabels(m.runID, m.tags)
+	writePromMetric(&buf, "hithere_requests_total", "counter", "Requests made.", labels, m.requests)
+	writePromMetric(&buf, "hithere_errors_total", "counter", "Requests that failed.", labels, m.errors)
+	writePromMetric(&buf, "hithere_response_bytes_total", "counter", "Bytes of responses received.", labels, m.bytes)
+	fmt.Fprintf(&buf, "# HELP hithere_connections_total Requests by whether their connection was new or reused.\n# TYPE hithere_connections_total counter\n")
+	fmt.Fprintf(&buf, "hithere_connections_total%s %d\n", promWith(labels, `reused="false"`), m.conns.New)
+	fmt.Fprintf(&buf, "hithere_connections_total%s %d\n", promWith(labels, `reused="true"`), m.conns.Reused)
+	writePromMetric(&buf, "hithere_dns_lookups_total", "counter", "DNS lookups made for new connections.", labels, m.conns.DNSLookups)
+	writePromMetric(&buf, "hithere_tls_handshakes_total", "counter", "TLS handshakes made for new connections.", labels, m.conns.TLSHandshakes)
+	if m.cache.Total() > 0 {
+		fmt.Fprintf(&buf, "# HELP hithere_cache_requests_total Requests handled by the HTTP cache, by outcome.\n# TYPE hithere_cache_requests_total counter\n")
+		fmt.Fprintf(&buf, "hithere_cache_requests_total%s %d\n", promWith(labels, `cache="hit"`), m.cache.Hits)
+		fmt.Fprintf(&buf, "hithere_cache_requests_total%s %d\n", promWith(labels, `cache="revalidated"`), m.cache.Revalidated)
+		fmt.Fprintf(&buf, "hithere_cache_requests_total%s %d\n", promWith(labels, `cache="miss"`), m.cache.Misses)
+	}
+	writePromMetric(&buf, "hithere_forced_closes_total", "counter", "Responses whose connections were closed because their bodies weren't read to the end.", labels, m.forced)
+
+	fmt.Fprintf(&buf, "# HELP hithere_responses_total Responses by status code.\n# TYPE hithere_responses_total counter\n")
+	for _, code := range m.codes() {
+		fmt.Fprintf(&buf, "hithere_responses_total%s %d\n", promWith(labels, fmt.Sprintf("code=\"%d\"", code)), m.responses[code])
+	}
+
+	writePromMetric(&buf, "hithere_requests_per_second", "gauge", "Requests per second over the latest interval.", labels, m.rps)
+	fmt.Fprintf(&buf, "# HELP hithere_latency_seconds Latency percentiles over the latest interval.\n# TYPE hithere_latency_seconds gauge\n")
+	for _, l := range m.latencies {
+		q := fmt.Sprintf("quantile=\"%g\"", float64(l.Percentage)/100)
+		fmt.Fprintf(&buf, "hithere_latency_seconds%s %g\n", promWith(labels, q), l.Latency)
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writePromMetric(buf *bytes.Buffer, name, typ, help, labels string, v interface{}) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	if f, ok := v.(float64); ok {
+		fmt.Fprintf(buf, "%s%s %g\n", name, promWith(labels, ""), f)
+	} else {
+		fmt.Fprintf(buf, "%s%s %d\n", name, promWith(labels, ""), v)
+	}
+}
+
+var promInvalidLabelRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// A promLabel is a Prometheus label.
+type promLabel struct {
+	name, value string
+}
+
+// promLabels returns the run ID and tags as Prometheus labels, without
+// the braces.
+func promLabels(runID string, tags map[string]string) string {
+	var labels []string
+	for _, l := range promRunLabels(runID, tags) {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", l.name, promEscape(l.value)))
+	}
+	return strings.Join(labels, ",")
+}
+
+// promRunLabels returns the run ID and tags as Prometheus labels, with
+// the names of the tags made valid, and kept clear of those hithere
+// uses.
+func promRunLabels(runID string, tags map[string]string) []promLabel {
+	var labels []promLabel
+	if runID != "" {
+		labels = append(labels, promLabel{"run_id", runID})
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := promInvalidLabelRe.ReplaceAllString(k, "_")
+		if name == "" || name[0] >= '0' && name[0] <= '9' || strings.HasPrefix(name, "__") || promReservedLabels[name] {
+			name = "tag_" + name
+		}
+		labels = append(labels, promLabel{name, tags[k]})
+	}
+	return labels
+}
+
+// promReservedLabels are the labels hithere gives its metrics.
+var promReservedLabels = map[string]bool{
+	"run_id":   true,
+	"code":     true,
+	"quantile": true,
+	"reused":   true,
+	"cache":    true,
+	"job":      true,
+}
+
+// promWith returns labels, plus extra, in braces.
+func promWith(labels, extra string) string {
+	if labels != "" && extra != "" {
+		labels += ","
+	}
+	labels += extra
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// A RandReporter is a Reporter with a random number generator of its
+// own, seeded from the Seed of the run and the ID of the worker, which
+// Requesters draw on for anything random, so that workers don't
+// contend on the global source, and a run with the same Seed makes the
+// same choices.  It is only for the requests of the worker it belongs
+// to, and isn't safe for concurrent use.  Work's workers' reporters are
+// RandReporters.
+type RandReporter interface {
+	Reporter
+	Rand() *rand.Rand
+}
+
+// workerRand returns the random number generator of worker.  Its seed
+// is mixed from seed and the worker's ID with SplitMix64, so that the
+// streams of neighbouring workers, or seeds, are unrelated.
+func workerRand(seed int64, worker int) *rand.Rand {
+	z := uint64(seed) + uint64(worker)*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return rand.New(rand.NewSource(int64(z ^ z>>31)))
+}
+
+// newSeed returns a random, positive seed for a run that wasn't given
+// one.
+func newSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:])>>1) | 1
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Factory returns a Requester for target, whose meaning is up to the
+// implementation: a script path, a URL, a log file to replay, etc.
+type Factory func(target string) (Requester, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a Requester implementation available by name to New,
+// and so to the command line and config files.  It is meant to be
+// called from init functions, and panics if name is already registered.
+func Register(name string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if f == nil {
+		panic("requester: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("requester: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// New returns a Requester for target from the implementation
+// registered as name.
+func New(name, target string) (Requester, error) {
+	factoriesMu.RLock()
+	f, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown requester %q (have %v)", name, Registered())
+	}
+	return f(target)
+}
+
+// Registered returns the sorted names of the registered Requester
+// implementations.
+func Registered() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bpowers/hithere/grpc"
+)
+
+const (
+	// remoteWriteTimeout bounds each push, and how long Report waits
+	// for the pushes still queued.
+	remoteWriteTimeout = 10 * time.Second
+	// remoteWriteAttempts is how many times a push is tried, if the
+	// endpoint fails in a way worth retrying.
+	remoteWriteAttempts = 3
+)
+
+// remoteWriteBackoff is the wait before the first retry of a push,
+// doubling after each.
+var remoteWriteBackoff = 500 * time.Millisecond
+
+// remoteWriteSink pushes the metrics of each interval to a Prometheus
+// remote_write endpoint, like those of Mimir, Thanos Receive or Grafana
+// Cloud, so that runs on short-lived machines land in long-term
+// storage without anything scraping them.  The metrics are those the
+// "prometheus" output serves, with a job="hithere" label.  Pushes are
+// made from a goroutine of their own, so that a slow endpoint doesn't
+// hold up the run; intervals it falls too far behind on are dropped.
+// The sink can be used for one run after another, as by a Work that is
+// Reset.
+type remoteWriteSink struct {
+	url    string
+	client *http.Client
+
+	// run is the current run's, from its first interval until Report.
+	run *remoteWriteRun
+}
+
+// remoteWriteRun is the metrics and pushes of a single run.
+type remoteWriteRun struct {
+	m       promMetrics
+	pushes  chan []byte
+	done    chan struct{}
+	dropped int
+
+	mu  sync.Mutex
+	err error
+}
+
+var _ LiveMetricsSink = (*remoteWriteSink)(nil)
+
+// NewRemoteWriteSink returns a MetricsSink pushing metrics to the
+// Prometheus remote_write endpoint at rawURL every interval.  User info
+// in the URL is sent as basic auth.
+func NewRemoteWriteSink(rawURL string) (MetricsSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("remote_write: expected an http or https URL, got %q", rawURL)
+	}
+	return &remoteWriteSink{
+		url:    rawURL,
+		client: &http.Client{Timeout: remoteWriteTimeout},
+	}, nil
+}
+
+func (s *remoteWriteSink) Interval(iv *Interval) {
+	if s.run == nil {
+		// the first interval of a run: its counters start from zero
+		s.run = &remoteWriteRun{
+			pushes: make(chan []byte, 64),
+			done:   make(chan struct{}),
+		}
+		go s.pushAll(s.run)
+	}
+	run := s.run
+	run.m.add(iv)
+	select {
+	case run.pushes <- run.m.writeRequest(time.Now()):
+	default:
+		run.dropped++
+	}
+}
+
+// Report waits for the pushes of the run still queued, and returns the
+// first error pushing its metrics, if any.
+func (s *remoteWriteSink) Report(r *Report) error {
+	run := s.run
+	if run == nil {
+		return nil
+	}
+	s.run = nil
+	close(run.pushes)
+	select {
+	case <-run.done:
+	case <-time.After(remoteWriteTimeout):
+		return errors.New("remote_write: timed out pushing the last intervals")
+	}
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.err == nil && run.dropped > 0 {
+		return fmt.Errorf("remote_write: dropped %d intervals, the endpoint fell behind", run.dropped)
+	}
+	return run.err
+}
+
+// pushAll pushes the metrics of run until Report.
+func (s *remoteWriteSink) pushAll(run *remoteWriteRun) {
+	defer close(run.done)
+	for req := range run.pushes {
+		if err := s.push(req); err != nil {
+			run.mu.Lock()
+			if run.err == nil {
+				run.err = fmt.Errorf("remote_write: %w", err)
+			}
+			run.mu.Unlock()
+		}
+	}
+}
+
+// push sends a WriteRequest, retrying if the endpoint can't be reached,
+// or fails with a 5xx or 429 status, as Prometheus does.
+func (s *remoteWriteSink) push(req []byte) error {
+	body := snappyEncode(req)
+	backoff := remoteWriteBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = s.post(body)
+		if err == nil || !retry || attempt == remoteWriteAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single push, returning whether it is worth retrying if
+// it fails.
+func (s *remoteWriteSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "hithere")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// writeRequest encodes the metrics as a prometheus.WriteRequest, each
+// series with a single sample at t.
+func (m *promMetrics) writeRequest(t time.Time) []byte {
+	ts := t.UnixNano() / int64(time.Millisecond)
+	run := promRunLabels(m.runID, m.tags)
+
+	var b []byte
+	add := func(name string, v float64, extra ...promLabel) {
+		labels := append([]promLabel{{"__name__", name}, {"job", "hithere"}}, run...)
+		labels = append(labels, extra...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		var series []byte
+		for _, l := range labels {
+			if l.value == "" {
+				// the same as no label to Prometheus
+				continue
+			}
+			var e []byte
+			e = grpc.AppendStringField(e, 1, l.name)
+			e = grpc.AppendStringField(e, 2, l.value)
+			series = grpc.AppendBytesField(series, 1, e)
+		}
+		var sample []byte
+		sample = grpc.AppendDoubleField(sample, 1, v)
+		sample = grpc.AppendVarintField(sample, 2, uint64(ts))
+		series = grpc.AppendBytesField(series, 2, sample)
+		b = grpc.AppendBytesField(b, 1, series)
+	}
+
+	add("hithere_requests_total", float64(m.requests))
+	add("hithere_errors_total", float64(m.errors))
+	add("hithere_response_bytes_total", float64(m.bytes))
+	add("hithere_connections_total", float64(m.conns.New), promLabel{"reused", "false"})
+	add("hithere_connections_total", float64(m.conns.Reused), promLabel{"reused", "true"})
+	add("hithere_dns_lookups_total", float64(m.conns.DNSLookups))
+	add("hithere_tls_handshakes_total", float64(m.conns.TLSHandshakes))
+	if m.cache.Total() > 0 {
+		add("hithere_cache_requests_total", float64(m.cache.Hits), promLabel{"cache", "hit"})
+		add("hithere_cache_requests_total", float64(m.cache.Revalidated), promLabel{"cache", "revalidated"})
+		add("hithere_cache_requests_total", float64(m.cache.Misses), promLabel{"cache", "miss"})
+	}
+	add("hithere_forced_closes_total", float64(m.forced))
+	for _, code := range m.codes() {
+		add("hithere_responses_total", float64(m.responses[code]), promLabel{"code", strconv.Itoa(code)})
+	}
+	add("hithere_requests_per_second", m.rps)
+	for _, l := range m.latencies {
+		q := strconv.FormatFloat(float64(l.Percentage)/100, 'g', -1, 64)
+		add("hithere_latency_seconds", l.Latency, promLabel{"quantile", q})
+	}
+	return b
+}
+
+// snappyEncode encodes b in the snappy block format remote_write
+// requires.  It stores b as literals, without compressing it, which
+// every decoder accepts; the requests are small, and it saves a
+// dependency.
+func snappyEncode(b []byte) []byte {
+	out := grpc.AppendVarint(nil, uint64(len(b)))
+	for len(b) > 0 {
+		n := min(len(b), math.MaxUint16+1)
+		if n <= 60 {
+			out = append(out, byte(n-1)<<2)
+		} else {
+			// tag 61: the length, less one, in the next two bytes
+			out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		out = append(out, b[:n]...)
+		b = b[n:]
+	}
+	return out
+}
@@ -16,9 +16,10 @@ package requester
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math"
 	"sort"
 	"time"
 )
@@ -27,9 +28,17 @@ const (
 	barChar = "■"
 )
 
-// We report for max 1M results.
+// We keep the latencies of each request, for per-request output like
+// CSV, for max 1M results.  The summary covers every result.
 const maxRes = 1000000
 
+// Beyond maxEndpoints distinct endpoint names, results are grouped
+// under otherEndpoint, to bound memory if names include IDs.
+const (
+	maxEndpoints  = 100
+	otherEndpoint = "(other)"
+)
+
 type report struct {
 	avgTotal float64
 	fastest  float64
@@ -37,54 +46,106 @@ type report struct {
 	average  float64
 	rps      float64
 
-	avgConn     float64
-	avgDNS      float64
-	avgReq      float64
-	avgRes      float64
-	avgDelay    float64
+	avgConn  float64
+	avgDNS   float64
+	avgTLS   float64
+	avgReq   float64
+	avgRes   float64
+	avgDelay float64
+	// connLats and so on are the samples kept for per-request output,
+	// if samples is set; the statistics of the summary come from the
+	// histograms, which aggregate every result in constant memory.
+	samples     bool
 	connLats    []float64
 	dnsLats     []float64
+	tlsLats     []float64
 	reqLats     []float64
 	resLats     []float64
 	delayLats   []float64
 	offsets     []float64
 	statusCodes []int
 
+	latHist, connHist, dnsHist, tlsHist, reqHist, resHist, delayHist latencyHistogram
+	statusCodeDist                                                   map[int]int
+
 	results chan *Result
 	done    chan bool
 	total   time.Duration
 
-	errorDist map[string]int
-	lats      []float64
-	sizeTotal int64
-	numRes    int64
-	output    string
-
-	w io.Writer
+	// intervals additionally aggregate results for live consumers like
+	// the metrics collector.
+	intervals []*intervalStats
+
+	errorDist    map[string]int
+	lats         []float64
+	sizeTotal    int64
+	numRes       int64
+	forcedCloses int64
+	conns        ConnStats
+	cache        CacheStats
+
+	verbose bool
+	workers map[int]*WorkerStats
+
+	runID string
+	tags  map[string]string
+	log   *slog.Logger
+
+	// start is when the run started, and checkpointPath, if set, where
+	// its progress is written every checkpointInterval.
+	start          time.Duration
+	checkpointPath string
+	lastCheckpoint time.Duration
+	iterations     *int64
+	// checkpointing is full while a checkpoint is being written.
+	checkpointing chan struct{}
+
+	endpoints map[string]*EndpointStats
+
+	// checks are recorded by the workers, not from the results.
+	checks *checkStats
+
+	sinks []Sink
+	subs  *subscriptions
 }
 
-func newReport(w io.Writer, results chan *Result, output string, n int) *report {
-	cap := min(n, maxRes)
+func newReport(results chan *Result) *report {
 	return &report{
-		output:      output,
-		results:     results,
-		done:        make(chan bool, 1),
-		errorDist:   make(map[string]int),
-		w:           w,
-		connLats:    make([]float64, 0, cap),
-		dnsLats:     make([]float64, 0, cap),
-		reqLats:     make([]float64, 0, cap),
-		resLats:     make([]float64, 0, cap),
-		delayLats:   make([]float64, 0, cap),
-		lats:        make([]float64, 0, cap),
-		statusCodes: make([]int, 0, cap),
+		results:   results,
+		log:       slog.Default(),
+		done:      make(chan bool, 1),
+		errorDist: make(map[string]int),
+		workers:   make(map[int]*WorkerStats),
+
+		statusCodeDist: make(map[int]int),
+		endpoints:      make(map[string]*EndpointStats),
+		checks:         newCheckStats(),
+		checkpointing:  make(chan struct{}, 1),
 	}
 }
 
 func runReporter(r *report) {
 	// Loop will continue until channel is closed
 	for res := range r.results {
+		for _, iv := range r.intervals {
+			iv.add(res)
+		}
+		for _, s := range r.sinks {
+			s.Result(res)
+		}
+		// sinks and subscribers may keep the result
+		retained := len(r.sinks) > 0
+		if r.subs != nil && r.subs.publish(res) {
+			retained = true
+		}
 		r.numRes++
+		if res.ForcedClose {
+			r.forcedCloses++
+		}
+		r.conns.add(res)
+		r.cache.add(res)
+		r.addWorkerResult(res)
+		r.addEndpointResult(res)
 		if res.Err != nil {
 			r.errorDist[res.Err.Error()]++
 		} else {
@@ -92,12 +153,22 @@ func runReporter(r *report) {
 			r.avgConn += res.ConnDuration.Seconds()
 			r.avgDelay += res.DelayDuration.Seconds()
 			r.avgDNS += res.DnsDuration.Seconds()
+			r.avgTLS += res.TLSDuration.Seconds()
 			r.avgReq += res.ReqDuration.Seconds()
 			r.avgRes += res.ResDuration.Seconds()
-			if len(r.resLats) < maxRes {
+			r.latHist.add(res.Duration.Seconds())
+			r.connHist.add(res.ConnDuration.Seconds())
+			r.dnsHist.add(res.DnsDuration.Seconds())
+			r.tlsHist.add(res.TLSDuration.Seconds())
+			r.reqHist.add(res.ReqDuration.Seconds())
+			r.delayHist.add(res.DelayDuration.Seconds())
+			r.resHist.add(res.ResDuration.Seconds())
+			r.statusCodeDist[res.StatusCode]++
+			if r.samples && len(r.resLats) < maxRes {
 				r.lats = append(r.lats, res.Duration.Seconds())
 				r.connLats = append(r.connLats, res.ConnDuration.Seconds())
 				r.dnsLats = append(r.dnsLats, res.DnsDuration.Seconds())
+				r.tlsLats = append(r.tlsLats, res.TLSDuration.Seconds())
 				r.reqLats = append(r.reqLats, res.ReqDuration.Seconds())
 				r.delayLats = append(r.delayLats, res.DelayDuration.Seconds())
 				r.resLats = append(r.resLats, res.ResDuration.Seconds())
@@ -108,36 +179,123 @@ func runReporter(r *report) {
 				r.sizeTotal += res.ContentLength
 			}
 		}
+		if r.checkpointPath != "" && now()-r.lastCheckpoint >= checkpointInterval {
+			r.checkpointAsync()
+		}
+		if !retained {
+			res.release()
+		}
 	}
 	// Signal reporter is done.
 	r.done <- true
 }
 
-func (r *report) finalize(total time.Duration) {
-	r.total = total
-	r.rps = float64(r.numRes) / r.total.Seconds()
-	r.average = r.avgTotal / float64(len(r.lats))
-	r.avgConn = r.avgConn / float64(len(r.lats))
-	r.avgDelay = r.avgDelay / float64(len(r.lats))
-	r.avgDNS = r.avgDNS / float64(len(r.lats))
-	r.avgReq = r.avgReq / float64(len(r.lats))
-	r.avgRes = r.avgRes / float64(len(r.lats))
-	r.print()
+func (r *report) addWorkerResult(res *Result) {
+	ws, ok := r.workers[res.Worker]
+	if !ok {
+		ws = &WorkerStats{ID: res.Worker}
+		r.workers[res.Worker] = ws
+	}
+	ws.NumRes++
+	if res.Err != nil {
+		ws.Errors++
+		return
+	}
+	lat := res.Duration.Seconds()
+	// Average holds the running total until the snapshot is taken
+	ws.Average += lat
+	if ws.Fastest == 0 || lat < ws.Fastest {
+		ws.Fastest = lat
+	}
+	if lat > ws.Slowest {
+		ws.Slowest = lat
+	}
 }
 
-func (r *report) print() {
-	buf := &bytes.Buffer{}
-	if err := newTemplate(r.output).Execute(buf, r.snapshot()); err != nil {
-		log.Println("error:", err.Error())
+func (r *report) addEndpointResult(res *Result) {
+	if res.Name == "" {
 		return
 	}
-	r.printf(buf.String())
+	es, ok := r.endpoints[res.Name]
+	if !ok {
+		name := res.Name
+		if len(r.endpoints) >= maxEndpoints {
+			name = otherEndpoint
+			es = r.endpoints[name]
+		}
+		if es == nil {
+			es = &EndpointStats{Name: name}
+			r.endpoints[name] = es
+		}
+	}
+	es.NumRes++
+	if res.Err == nil && res.ContentLength > 0 {
+		es.SizeTotal += res.ContentLength
+	}
+}
+
+// endpointStats returns the per-endpoint breakdown, ordered by name.
+func (r *report) endpointStats() []EndpointStats {
+	stats := make([]EndpointStats, 0, len(r.endpoints))
+	for _, es := range r.endpoints {
+		s := *es
+		s.SizeReq = s.SizeTotal / s.NumRes
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
 
-	r.printf("\n")
+// workerStats returns the per-worker breakdown, ordered by worker ID.
+func (r *report) workerStats() []WorkerStats {
+	stats := make([]WorkerStats, 0, len(r.workers))
+	for _, ws := range r.workers {
+		s := *ws
+		if n := s.NumRes - s.Errors; n > 0 {
+			s.Average /= float64(n)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
 }
 
-func (r *report) printf(s string, v ...interface{}) {
-	fmt.Fprintf(r.w, s, v...)
+func (r *report) finalize(total time.Duration) Report {
+	r.total = total
+	r.rps = float64(r.numRes) / r.total.Seconds()
+	// without latencies the averages stay 0, rather than NaN, which
+	// JSON can't encode
+	if n := float64(r.latHist.N); n > 0 {
+		r.average = r.avgTotal / n
+		r.avgConn = r.avgConn / n
+		r.avgDelay = r.avgDelay / n
+		r.avgDNS = r.avgDNS / n
+		r.avgTLS = r.avgTLS / n
+		r.avgReq = r.avgReq / n
+		r.avgRes = r.avgRes / n
+	}
+	return r.snapshot()
+}
+
+// render renders snapshot in the given output format.  Anything other
+// than "json" and "html" is a template, whose result is treated as a
+// format string, which turns the %% in the default template into %.
+func render(output string, snapshot Report) (string, error) {
+	switch output {
+	case "json":
+		js, err := json.MarshalIndent(snapshot.Summary(), "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("json.Marshal: %w", err)
+		}
+		return string(js), nil
+	case "html":
+		return renderHTML(snapshot)
+	}
+	buf := &bytes.Buffer{}
+	if err := newTemplate(output).Execute(buf, snapshot); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(buf.String()), nil
 }
 
 func (r *report) snapshot() Report {
@@ -148,10 +306,13 @@ func (r *report) snapshot() Report {
 		SizeTotal:   r.sizeTotal,
 		AvgConn:     r.avgConn,
 		AvgDNS:      r.avgDNS,
+		AvgTLS:      r.avgTLS,
 		AvgReq:      r.avgReq,
 		AvgRes:      r.avgRes,
 		AvgDelay:    r.avgDelay,
 		Total:       r.total,
+		RunID:       r.runID,
+		Tags:        r.tags,
 		ErrorDist:   r.errorDist,
 		NumRes:      r.numRes,
 		Lats:        make([]float64, len(r.lats)),
@@ -162,13 +323,25 @@ func (r *report) snapshot() Report {
 		DelayLats:   make([]float64, len(r.lats)),
 		Offsets:     make([]float64, len(r.lats)),
 		StatusCodes: make([]int, len(r.lats)),
+
+		ForcedCloses: r.forcedCloses,
+		Conns:        r.conns,
+		Cache:        r.cache,
+	}
+	if r.verbose {
+		snapshot.Workers = r.workerStats()
+	}
+	snapshot.Endpoints = r.endpointStats()
+	snapshot.Checks = r.checks.stats()
+	if r.total > 0 {
+		snapshot.Throughput = float64(r.sizeTotal) / r.total.Seconds()
 	}
 
-	if len(r.lats) == 0 {
+	if r.latHist.N == 0 {
 		return snapshot
 	}
 
-	snapshot.SizeReq = r.sizeTotal / int64(len(r.lats))
+	snapshot.SizeReq = r.sizeTotal / r.latHist.N
 
 	copy(snapshot.Lats, r.lats)
 	copy(snapshot.ConnLats, r.connLats)
@@ -179,50 +352,55 @@ func (r *report) snapshot() Report {
 	copy(snapshot.StatusCodes, r.statusCodes)
 	copy(snapshot.Offsets, r.offsets)
 
-	sort.Float64s(r.lats)
-	r.fastest = r.lats[0]
-	r.slowest = r.lats[len(r.lats)-1]
-
-	sort.Float64s(r.connLats)
-	sort.Float64s(r.dnsLats)
-	sort.Float64s(r.reqLats)
-	sort.Float64s(r.resLats)
-	sort.Float64s(r.delayLats)
-
-	snapshot.Histogram = r.histogram()
-	snapshot.LatencyDistribution = r.latencies()
+	r.fastest = r.latHist.Min
+	r.slowest = r.latHist.Max
+
+	snapshot.Histogram = buckets(&r.latHist)
+	snapshot.LatencyDistribution = latencies(&r.latHist)
+	snapshot.TTFBHistogram = buckets(&r.delayHist)
+	snapshot.TTFBDistribution = latencies(&r.delayHist)
+	snapshot.PhaseDistributions = []PhaseDistribution{
+		{"DNS+dialup", percentiles(&r.connHist)},
+		{"DNS-lookup", percentiles(&r.dnsHist)},
+		{"TLS handshake", percentiles(&r.tlsHist)},
+		{"req write", percentiles(&r.reqHist)},
+		{"resp wait", percentiles(&r.delayHist)},
+		{"resp read", percentiles(&r.resHist)},
+	}
 
 	snapshot.Fastest = r.fastest
 	snapshot.Slowest = r.slowest
-	snapshot.ConnMax = r.connLats[0]
-	snapshot.ConnMin = r.connLats[len(r.connLats)-1]
-	snapshot.DnsMax = r.dnsLats[0]
-	snapshot.DnsMin = r.dnsLats[len(r.dnsLats)-1]
-	snapshot.ReqMax = r.reqLats[0]
-	snapshot.ReqMin = r.reqLats[len(r.reqLats)-1]
-	snapshot.DelayMax = r.delayLats[0]
-	snapshot.DelayMin = r.delayLats[len(r.delayLats)-1]
-	snapshot.ResMax = r.resLats[0]
-	snapshot.ResMin = r.resLats[len(r.resLats)-1]
-
-	statusCodeDist := make(map[int]int, len(snapshot.StatusCodes))
-	for _, statusCode := range snapshot.StatusCodes {
-		statusCodeDist[statusCode]++
+	snapshot.ConnMax = r.connHist.Min
+	snapshot.ConnMin = r.connHist.Max
+	snapshot.DnsMax = r.dnsHist.Min
+	snapshot.DnsMin = r.dnsHist.Max
+	snapshot.TLSMax = r.tlsHist.Min
+	snapshot.TLSMin = r.tlsHist.Max
+	snapshot.ReqMax = r.reqHist.Min
+	snapshot.ReqMin = r.reqHist.Max
+	snapshot.DelayMax = r.delayHist.Min
+	snapshot.DelayMin = r.delayHist.Max
+	snapshot.ResMax = r.resHist.Min
+	snapshot.ResMin = r.resHist.Max
+
+	statusCodeDist := make(map[int]int, len(r.statusCodeDist))
+	for code, n := range r.statusCodeDist {
+		statusCodeDist[code] = n
 	}
 	snapshot.StatusCodeDist = statusCodeDist
 
 	return snapshot
 }
 
-func (r *report) latencies() []LatencyDistribution {
+// latencies returns the latency percentiles of h, leaving out those
+// that too few latencies were recorded to reach.
+func latencies(h *latencyHistogram) []LatencyDistribution {
 	pctls := []int{10, 25, 50, 75, 90, 95, 99}
 	data := make([]float64, len(pctls))
-	j := 0
-	for i := 0; i < len(r.lats) && j < len(pctls); i++ {
-		current := i * 100 / len(r.lats)
-		if current >= pctls[j] {
-			data[j] = r.lats[i]
-			j++
+	for j, p := range pctls {
+		// the first index i of the sorted latencies with i*100/N >= p
+		if i := (int64(p)*h.N + 99) / 100; i < h.N {
+			data[j] = h.valueAt(i + 1)
 		}
 	}
 	res := make([]LatencyDistribution, len(pctls))
@@ -234,34 +412,50 @@ func (r *report) latencies() []LatencyDistribution {
 	return res
 }
 
-func (r *report) histogram() []Bucket {
+// phasePercentiles are reported for every phase of a request.
+var phasePercentiles = []int{50, 75, 90, 95, 99}
+
+// percentiles returns the nearest-rank phasePercentiles of h, which
+// must not be empty.  Unlike latencies every percentile is filled in,
+// so that phase tables line up.
+func percentiles(h *latencyHistogram) []LatencyDistribution {
+	res := make([]LatencyDistribution, len(phasePercentiles))
+	for i, p := range phasePercentiles {
+		rank := int64(math.Ceil(float64(p) / 100 * float64(h.N)))
+		res[i] = LatencyDistribution{Percentage: p, Latency: h.valueAt(rank)}
+	}
+	return res
+}
+
+// buckets returns a histogram of the latencies in h, which must not be
+// empty, in ten buckets between the fastest and the slowest.
+func buckets(h *latencyHistogram) []Bucket {
+	fastest, slowest := h.Min, h.Max
 	bc := 10
 	buckets := make([]float64, bc+1)
 	counts := make([]int, bc+1)
-	bs := (r.slowest - r.fastest) / float64(bc)
+	bs := (slowest - fastest) / float64(bc)
 	for i := 0; i < bc; i++ {
-		buckets[i] = r.fastest + bs*float64(i)
+		buckets[i] = fastest + bs*float64(i)
 	}
-	buckets[bc] = r.slowest
+	buckets[bc] = slowest
 	var bi int
-	var max int
-	for i := 0; i < len(r.lats); {
-		if r.lats[i] <= buckets[bi] {
-			i++
-			counts[bi]++
-			if max < counts[bi] {
-				max = counts[bi]
-			}
-		} else if bi < len(buckets)-1 {
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		v := h.clamp(histogramValue(i))
+		for v > buckets[bi] && bi < len(buckets)-1 {
 			bi++
 		}
+		counts[bi] += int(n)
 	}
 	res := make([]Bucket, len(buckets))
 	for i := 0; i < len(buckets); i++ {
 		res[i] = Bucket{
 			Mark:      buckets[i],
 			Count:     counts[i],
-			Frequency: float64(counts[i]) / float64(len(r.lats)),
+			Frequency: float64(counts[i]) / float64(h.N),
 		}
 	}
 	return res
@@ -276,6 +470,7 @@ type Report struct {
 
 	AvgConn  float64
 	AvgDNS   float64
+	AvgTLS   float64
 	AvgReq   float64
 	AvgRes   float64
 	AvgDelay float64
@@ -283,6 +478,8 @@ type Report struct {
 	ConnMin  float64
 	DnsMax   float64
 	DnsMin   float64
+	TLSMax   float64
+	TLSMin   float64
 	ReqMax   float64
 	ReqMin   float64
 	ResMax   float64
@@ -290,6 +487,9 @@ type Report struct {
 	DelayMax float64
 	DelayMin float64
 
+	// Lats and so on are the samples of the first maxRes successful
+	// requests, for outputs listing every request, like csv.  They are
+	// only kept if an output, CheckpointPath or ReportDest needs them.
 	Lats        []float64
 	ConnLats    []float64
 	DnsLats     []float64
@@ -301,19 +501,77 @@ type Report struct {
 
 	Total time.Duration
 
+	// RunID and Tags identify the run, see Work.
+	RunID string
+	Tags  map[string]string
+
 	ErrorDist      map[string]int
 	StatusCodeDist map[int]int
 	SizeTotal      int64
 	SizeReq        int64
 	NumRes         int64
+	Throughput     float64 // bytes/sec
+
+	// ForcedCloses counts the responses whose bodies were closed
+	// before being read to the end, forcing their connections closed.
+	ForcedCloses int64
+
+	// Conns count the new and reused connections of the requests.
+	Conns ConnStats
+
+	// Cache counts the outcomes of the requests the HTTP cache
+	// handled, see Work.Cache.
+	Cache CacheStats
 
 	LatencyDistribution []LatencyDistribution
 	Histogram           []Bucket
+
+	// TTFB (time to first byte) is the time from finishing writing the
+	// request to the first byte of the response, i.e. DelayDuration.
+	TTFBDistribution []LatencyDistribution
+	TTFBHistogram    []Bucket
+
+	// PhaseDistributions are percentiles of the time spent in each
+	// phase of a request.
+	PhaseDistributions []PhaseDistribution
+
+	Endpoints []EndpointStats
+
+	// Checks are the pass counts of named checks, if the Requester
+	// made any.
+	Checks []CheckStats
+
+	// Workers is only populated for verbose runs.
+	Workers []WorkerStats
+}
+
+// EndpointStats are the results for requests to a single endpoint.
+type EndpointStats struct {
+	Name      string
+	NumRes    int64
+	SizeTotal int64
+	SizeReq   int64
+}
+
+// WorkerStats are the results of a single worker.  Latencies only
+// cover successful requests.
+type WorkerStats struct {
+	ID      int
+	NumRes  int64
+	Errors  int64
+	Average float64
+	Fastest float64
+	Slowest float64
 }
 
 type LatencyDistribution struct {
-	Percentage int
-	Latency    float64
+	Percentage int     `json:"percentage"`
+	Latency    float64 `json:"latency"`
+}
+
+type PhaseDistribution struct {
+	Phase       string
+	Percentiles []LatencyDistribution
 }
 
 type Bucket struct {
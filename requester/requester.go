@@ -17,15 +17,19 @@ package requester
 
 import (
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -36,9 +40,8 @@ import (
 
 // Max size of the buffer of result channel.
 const (
-	maxResult      = 1000000
-	maxConcurrency = 1000000
-	maxIdleConn    = 500
+	maxResult   = 1000000
+	maxIdleConn = 500
 )
 
 type Reporter interface {
@@ -47,6 +50,14 @@ type Reporter interface {
 	UserAgent() string
 }
 
+// A LoggingReporter is a Reporter with a logger for the diagnostics of
+// Requesters, with the attributes of the run and worker.  Work's
+// reporters are LoggingReporters.
+type LoggingReporter interface {
+	Reporter
+	Logger() *slog.Logger
+}
+
 type Requester interface {
 	Do(ctx context.Context, c *http.Client, reporter Reporter) (err error)
 	Clone() Requester
@@ -59,10 +70,35 @@ type Result struct {
 	Duration      time.Duration
 	ConnDuration  time.Duration // connection setup(DNS lookup + Dial up) duration
 	DnsDuration   time.Duration // dns lookup duration
+	TLSDuration   time.Duration // TLS handshake duration
 	ReqDuration   time.Duration // request "write" duration
 	ResDuration   time.Duration // response "read" duration
 	DelayDuration time.Duration // delay between response and request
 	ContentLength int64
+	Worker        int    // ID of the worker that made the request
+	Name          string // endpoint the request was made to, e.g. "GET http://host/path"
+
+	// ForcedClose is whether the response body was closed before it
+	// was read to the end, which keeps its connection from being
+	// reused, so that connection churn can be told apart from the
+	// server's doing.
+	ForcedClose bool
+
+	// NewConn is whether the request had to open a connection, and
+	// ConnReused whether it was made on one kept alive from an earlier
+	// request; neither is set by Requesters that don't trace their
+	// connections.  DNSLookup and TLSHandshake are whether opening the
+	// connection took one.
+	NewConn, ConnReused     bool
+	DNSLookup, TLSHandshake bool
+
+	// Cache is how the request fared with the HTTP cache, see
+	// Work.Cache and ResponseCacheStatus.
+	Cache CacheStatus
+
+	// pooled is whether the Result came from NewResult, and can be
+	// reused once it has been reported.
+	pooled bool
 }
 
 type Work struct {
@@ -78,9 +114,35 @@ type Work struct {
 	// H2 is an option to make HTTP/2 requests
 	H2 bool
 
+	// H2C makes requests to http:// URLs over HTTP/2 without TLS,
+	// assuming prior knowledge that the server supports it, and
+	// implies H2 for https:// URLs.  Proxies aren't used for h2c.
+	H2C bool
+
+	// Host, if set, overrides the Host header of every request, and
+	// the server name sent for TLS (SNI), so that servers can be
+	// targeted by IP address or through a staging load balancer while
+	// presenting the production hostname.
+	Host string
+
+	// BaseURL, if set, replaces the scheme and host of every request's
+	// URL, with its path prepended to the request's, so that the same
+	// script can be run against different environments.
+	BaseURL *url.URL
+
 	// Timeout in seconds.
 	Timeout int
 
+	// Transport, if set, is given the configured transport and returns
+	// the RoundTripper to make requests with instead: the transport
+	// itself after changing its settings, like its dialer, a wrapper
+	// around it, e.g. adding auth or recording requests, or a
+	// replacement.  Wrappers should implement
+	// Unwrap() http.RoundTripper, so that modules making other kinds of
+	// connections, like websockets, can find the transport's TLS
+	// settings.  It sees requests after Host and BaseURL apply.
+	Transport func(*http.Transport) http.RoundTripper
+
 	UserAgent string
 
 	// DisableCompression is an option to disable compression in response
@@ -89,10 +151,53 @@ type Work struct {
 	// DisableKeepAlives is an option to prevents re-use of TCP connections between different HTTP requests
 	DisableKeepAlives bool
 
+	// HealthCheck, if set, is how CheckHealth probes the target
+	// before the run: a URL to GET, which must respond with a 2xx
+	// status, or HealthCheckScript to run the Requester once, which
+	// must make no failed requests or checks.  Requests to the URL
+	// are made like the Requester's, so Host and BaseURL apply.
+	HealthCheck string
+
+	// HealthWait is how long CheckHealth retries a failing probe for,
+	// waiting for the target to come up.  Zero probes once.
+	HealthWait time.Duration
+
+	// BurstSize, if positive, makes requests in bursts instead of at
+	// a steady rate: every BurstInterval, BurstSize workers call the
+	// Requester at once, as clients aligned on a cron schedule, or
+	// waiting on an expired cache entry, do.  N is rounded up to a
+	// whole number of bursts, and RPS is ignored.
+	BurstSize     int
+	BurstInterval time.Duration
+
+	// Cache gives each worker a private HTTP cache, like a browser's,
+	// honoring Cache-Control and revalidating with ETag and
+	// Last-Modified, so that the run models real users' traffic
+	// rather than every request missing.  The outcomes are counted in
+	// the report, see CacheStats.
+	Cache bool
+
+	// Chaos, if enabled, makes the client misbehave, delaying,
+	// aborting or dropping requests, see Chaos.
+	Chaos Chaos
+
+	// MaxConnsPerHost, if positive, limits the connections made to
+	// each host, with requests beyond it waiting for one to be free.
+	// Tune finds a good value.
+	MaxConnsPerHost int
+
 	// Output represents the output type. If "csv" is provided, the
 	// output will be dumped as a csv stream.
 	Output string
 
+	// Outputs, if set, are the reports to produce instead of Output,
+	// each written to its own file or to Writer.
+	Outputs []Output
+
+	// MetricsSinks receive the metrics of the run in addition to
+	// Outputs, see MetricsSink.
+	MetricsSinks []MetricsSink
+
 	// ProxyAddr is the address of HTTP proxy server in the format on "host:port".
 	// Optional.
 	ProxyAddr *url.URL
@@ -100,15 +205,118 @@ type Work struct {
 	// Writer is where results will be written. If nil, results are written to stdout.
 	Writer io.Writer
 
-	initOnce     sync.Once
-	results      chan *Result
-	stopCh       chan struct{}
-	workerStopCh chan struct{}
-	start        time.Duration
-
-	report *report
-
-	workerCount int32
+	// Logger receives the diagnostics of the run, with its run_id and,
+	// from workers, their worker attributes.  If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+
+	// Verbose adds a per-worker breakdown to the summary.
+	Verbose bool
+
+	// CollectorAddr is the address of a gRPC metrics collector that
+	// interval aggregates are streamed to during the run, see
+	// collector.proto.  Optional.
+	CollectorAddr string
+
+	// WebAddr, if set, is the address to serve a live dashboard of the
+	// run on, like ":8080".
+	WebAddr string
+
+	// PprofAddr, if set, is the address to serve net/http/pprof and
+	// expvar on during the run, like ":6060".  The "hithere" expvar
+	// has the worker count, result channel depth and results/sec.
+	PprofAddr string
+
+	// Interval is how often live interval aggregates are produced.
+	// Defaults to one second.
+	Interval time.Duration
+
+	// Interim, if positive, is how often a summary of the preceding
+	// interval is written to InterimWriter while the run is in progress.
+	Interim time.Duration
+
+	// InterimWriter is where interim summaries are written.  If nil,
+	// they are written to stderr.
+	InterimWriter io.Writer
+
+	// InterimJSON writes interim summaries as JSON lines rather than
+	// human-readable text.
+	InterimJSON bool
+
+	// NotifyURL, if set, is sent a POST with the JSON Summary of the
+	// run once it completes.
+	NotifyURL string
+
+	// RunID identifies the run in exported metrics, result rows and
+	// report artifacts, so that data from many runs can be told apart
+	// in shared backends.  Init generates one if it is empty.
+	RunID string
+
+	// Tags are labels, like the environment or build under test,
+	// attached alongside RunID.
+	Tags map[string]string
+
+	// Seed seeds the random number generators of the workers, see
+	// RandReporter, so that a run can be repeated with the same random
+	// choices.  Init picks one, and logs it, if it is zero.
+	Seed int64
+
+	// CheckpointPath, if set, is where the progress of the run is
+	// written periodically and once it finishes, see Checkpoint.
+	CheckpointPath string
+
+	// Resume, if set, continues the run the checkpoint is from: its
+	// results are merged into this run's, which keeps its RunID, and
+	// the requests it made count towards N.
+	Resume *Checkpoint
+
+	// Sinks receive every result as it is reported, in addition to the
+	// built in report, see Sink.
+	Sinks []Sink
+
+	// Hooks intercept the HTTP requests of the Requester, see Hook.
+	Hooks []Hook
+
+	// ReportDest, if set, is where report artifacts are uploaded once
+	// the run completes: an s3:// or gs:// bucket prefix, or a local
+	// directory.  See package upload.
+	ReportDest string
+
+	initOnce sync.Once
+	stopOnce sync.Once
+	// generatedRunID is the RunID Init generated, if it wasn't set,
+	// and generatedSeed the Seed.
+	generatedRunID string
+	generatedSeed  int64
+	// log is Logger with the run's attributes.
+	log     *slog.Logger
+	ctx     context.Context
+	subs    *subscriptions
+	results chan *Result
+	// stopCh is closed by Stop to stop all the workers, and
+	// workerStops are closed to stop individual ones, by worker ID.
+	stopCh      chan struct{}
+	workersMu   sync.Mutex
+	workerStops map[int]chan struct{}
+	start       time.Duration
+	// clock is the run's clock, which results' offsets are relative to.
+	clock *Clock
+
+	report  *report
+	metrics []MetricsSink
+	// snapshot is the final report, once Finish has run.
+	snapshot *Report
+
+	intervalsStop chan struct{}
+	intervalsWg   sync.WaitGroup
+
+	workerCount  int32
+	lastWorkerID int32
+	// iterations is the number of calls to the Requester that have
+	// completed, for checkpoints.
+	iterations int64
+
+	debugSrv *http.Server
 
 	counter1s *ratecounter.RateCounter
 	counter5s *ratecounter.RateCounter
@@ -120,11 +328,29 @@ type workReporter struct {
 	results   chan<- *Result
 	count     uint32
 	userAgent string
+	worker    int
+	checks    *checkStats
+	log       *slog.Logger
+	hooks     []Hook
+	clock     *Clock
+	rng       *rand.Rand
+	// cache is the worker's HTTP cache, if Work.Cache is set.
+	cache *httpCache
+	// checkSinks are the sinks told about checks.
+	checkSinks []CheckReporter
 }
 
-var _ Reporter = (*workReporter)(nil)
+var (
+	_ Reporter        = (*workReporter)(nil)
+	_ CheckReporter   = (*workReporter)(nil)
+	_ LoggingReporter = (*workReporter)(nil)
+	_ HookReporter    = (*workReporter)(nil)
+	_ ClockReporter   = (*workReporter)(nil)
+	_ RandReporter    = (*workReporter)(nil)
+)
 
 func (w *workReporter) Finish(r *Result) {
+	r.Worker = w.worker
 	w.results <- r
 }
 
@@ -142,6 +368,32 @@ func (w *workReporter) UserAgent() string {
 	return w.userAgent
 }
 
+func (w *workReporter) Hooks() []Hook {
+	return w.hooks
+}
+
+// Clock returns the run's clock.
+func (w *workReporter) Clock() *Clock {
+	return w.clock
+}
+
+// Rand returns the worker's random number generator.
+func (w *workReporter) Rand() *rand.Rand {
+	return w.rng
+}
+
+// Logger returns the run's logger, with the worker's attributes.
+func (w *workReporter) Logger() *slog.Logger {
+	return w.log
+}
+
+func (w *workReporter) Check(name string, passed bool) {
+	w.checks.add(name, passed)
+	for _, s := range w.checkSinks {
+		s.Check(name, passed)
+	}
+}
+
 func (b *Work) writer() io.Writer {
 	if b.Writer == nil {
 		return os.Stdout
@@ -152,32 +404,178 @@ func (b *Work) writer() io.Writer {
 // Init initializes internal data-structures
 func (b *Work) Init() {
 	b.initOnce.Do(func() {
+		b.subs = &subscriptions{}
 		b.results = make(chan *Result, maxResult)
-		b.stopCh = make(chan struct{}, maxConcurrency)
-		b.workerStopCh = make(chan struct{}, maxConcurrency)
+		b.stopCh = make(chan struct{})
+		b.workerStops = make(map[int]chan struct{})
 		b.counter1s = ratecounter.NewRateCounter(2 * time.Second)
 		b.counter5s = ratecounter.NewRateCounter(5 * time.Second)
+		if b.RunID == "" {
+			b.RunID = newRunID()
+			b.generatedRunID = b.RunID
+		}
+		b.setLogger()
+		if b.Seed == 0 {
+			b.Seed = newSeed()
+			b.generatedSeed = b.Seed
+			b.log.Info("seeded workers", "seed", b.Seed)
+		}
 	})
 }
 
+// setLogger sets log to Logger, with the run's attributes.
+func (b *Work) setLogger() {
+	l := b.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	b.log = l.With("run_id", b.RunID)
+}
+
+// Reset readies the Work to Run again, with the same configuration,
+// once Run has returned, e.g. to run each step of a ramp from one Work.
+// A new RunID is generated unless one was set.  Resume is kept, so
+// clear it if the next run shouldn't continue from the checkpoint too.
+func (b *Work) Reset() {
+	if b.RunID == b.generatedRunID {
+		b.RunID = ""
+	}
+	b.generatedRunID = ""
+	if b.Seed == b.generatedSeed {
+		b.Seed = 0
+	}
+	b.generatedSeed = 0
+	b.log = nil
+	b.initOnce = sync.Once{}
+	b.stopOnce = sync.Once{}
+	b.ctx = nil
+	b.subs = nil
+	b.results = nil
+	b.stopCh = nil
+	b.workerStops = nil
+	b.start = 0
+	b.clock = nil
+	b.report = nil
+	b.metrics = nil
+	b.snapshot = nil
+	b.intervalsStop = nil
+	b.workerCount = 0
+	b.lastWorkerID = 0
+	b.iterations = 0
+	b.debugSrv = nil
+	b.counter1s = nil
+	b.counter5s = nil
+}
+
 // Run makes all the requests, prints the summary. It blocks until
-// all work is done.
-func (b *Work) Run() {
+// all work is done, or ctx is done, which stops the workers as Stop
+// does and cancels their outstanding requests.  The summary of the
+// requests made is printed either way.
+func (b *Work) Run(ctx context.Context) {
 	b.Init()
+	b.ctx = ctx
+	done := make(chan struct{})
+	// the watcher must be done with b before Run returns, so that
+	// Reset doesn't race with it
+	watched := make(chan struct{})
+	defer func() {
+		close(done)
+		<-watched
+	}()
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			b.Stop()
+		case <-done:
+		}
+	}()
+
 	b.start = now()
-	b.report = newReport(b.writer(), b.results, b.Output, b.N)
+	b.report = newReport(b.results)
+	b.report.samples = b.wantSamples()
+	b.report.verbose = b.Verbose
+	b.report.checkpointPath = b.CheckpointPath
+	b.report.sinks = b.Sinks
+	b.report.subs = b.subs
+	if b.Resume != nil {
+		b.RunID = b.Resume.RunID
+		if len(b.Tags) == 0 {
+			b.Tags = b.Resume.Tags
+		}
+		b.start -= b.Resume.Elapsed
+		b.iterations = b.Resume.Iterations
+		// new workers' stats are kept apart from the restored ones
+		b.lastWorkerID = int32(b.Resume.lastWorker())
+		b.report.restore(b.Resume)
+		b.setLogger()
+	}
+	// a resumed run's clock continues from where it left off
+	b.clock = &Clock{start: b.start}
+	var runWorkers func()
+	if b.Resume == nil || b.N <= 0 {
+		runWorkers = b.workers(b.N)
+	} else if n := b.N - int(b.Resume.Iterations); n > 0 {
+		runWorkers = b.workers(n)
+	}
+	b.report.runID = b.RunID
+	b.report.tags = b.Tags
+	b.report.start = b.start
+	b.report.lastCheckpoint = now()
+	b.report.iterations = &b.iterations
+	b.report.log = b.log
+	b.metrics = b.metricsSinks()
+	b.startIntervals()
+	if b.PprofAddr != "" {
+		b.startDebug()
+	}
 	// Run the reporter first, it polls the result channel until it is closed.
 	go func() {
 		runReporter(b.report)
 	}()
-	b.runWorkers()
+	if runWorkers != nil {
+		runWorkers()
+	}
 	b.Finish()
 }
 
+// Stop stops the workers once their current requests are done.  It
+// may be called more than once.
 func (b *Work) Stop() {
-	// Send stop signal so that workers can stop gracefully.
-	for i := 0; i < maxConcurrency; i++ {
-		b.stopCh <- struct{}{}
+	b.Init()
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
+}
+
+// startWorker returns the channel closed to stop the worker with ID
+// worker, which must call stopWorker when it is done.
+func (b *Work) startWorker(worker int) <-chan struct{} {
+	stop := make(chan struct{})
+	b.workersMu.Lock()
+	b.workerStops[worker] = stop
+	b.workersMu.Unlock()
+	return stop
+}
+
+func (b *Work) stopWorker(worker int) {
+	b.workersMu.Lock()
+	delete(b.workerStops, worker)
+	b.workersMu.Unlock()
+}
+
+// stopWorkers stops up to n of the running workers once their current
+// requests are done, e.g. to shed load when targeting RPS.
+func (b *Work) stopWorkers(n int) {
+	b.workersMu.Lock()
+	defer b.workersMu.Unlock()
+	for worker, stop := range b.workerStops {
+		if n <= 0 {
+			break
+		}
+		close(stop)
+		delete(b.workerStops, worker)
+		n--
 	}
 }
 
@@ -186,15 +584,45 @@ func (b *Work) Finish() {
 	total := now() - b.start
 	// Wait until the reporter is done.
 	<-b.report.done
-	b.report.finalize(total)
+	b.subs.close()
+	for _, s := range b.Sinks {
+		if err := s.Close(); err != nil {
+			b.log.Error("closing sink", "err", err)
+		}
+	}
+	b.stopIntervals()
+	b.stopDebug()
+	b.report.checkpoint()
+	snapshot := b.report.finalize(total)
+	b.snapshot = &snapshot
+	b.reportMetrics(b.snapshot)
+	if b.ReportDest != "" {
+		if err := uploadReports(b.ReportDest, snapshot); err != nil {
+			b.log.Error("uploading reports", "dest", b.ReportDest, "err", err)
+		}
+	}
+	if b.NotifyURL != "" {
+		if err := notify(b.NotifyURL, snapshot.Summary()); err != nil {
+			b.log.Error("notifying", "url", b.NotifyURL, "err", err)
+		}
+	}
+}
+
+// Report returns the final report of the run, or nil if it hasn't
+// finished.
+func (b *Work) Report() *Report {
+	return b.snapshot
 }
 
 func (b *Work) makeRequests(c *http.Client, r *workReporter) {
-	ctx := context.Background()
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	err := b.Requester.Clone().Do(ctx, c, r)
+	err := b.Requester.Clone().Do(withCache(ctx, r.cache), c, r)
 	if err != nil {
-		log.Printf("requester.Do: %s", err)
+		r.log.Error("requester.Do", "err", err)
 	}
 }
 
@@ -210,14 +638,40 @@ func (b *Work) getWorkerCount() int {
 	return int(atomic.LoadInt32(&b.workerCount))
 }
 
-func (b *Work) runWorker(client *http.Client, n int) int {
+// nextWorker returns the ID of a new worker, and its random number
+// generator.
+func (b *Work) nextWorker() (int, *rand.Rand) {
+	worker := int(atomic.AddInt32(&b.lastWorkerID, 1))
+	return worker, workerRand(b.Seed, worker)
+}
+
+// newWorkReporter returns the reporter of worker.
+func (b *Work) newWorkReporter(worker int, rng *rand.Rand) *workReporter {
 	reporter := &workReporter{
 		counter1s: b.counter1s,
 		counter5s: b.counter5s,
 		results:   b.results,
 		count:     0,
 		userAgent: b.UserAgent,
+		worker:    worker,
+		checks:    b.report.checks,
+		log:       b.log.With("worker", worker),
+		hooks:     b.Hooks,
+		clock:     b.clock,
+		rng:       rng,
+
+		checkSinks: checkSinks(b.Sinks),
+	}
+	if b.Cache {
+		reporter.cache = newHTTPCache()
 	}
+	return reporter
+}
+
+func (b *Work) runWorker(client *http.Client, n int, worker int, rng *rand.Rand) int {
+	reporter := b.newWorkReporter(worker, rng)
+	stop := b.startWorker(worker)
+	defer b.stopWorker(worker)
 
 	// if n == 0, run forever
 	i := -1
@@ -229,10 +683,11 @@ func (b *Work) runWorker(client *http.Client, n int) int {
 		select {
 		case <-b.stopCh:
 			return reporter.Count()
-		case <-b.workerStopCh:
+		case <-stop:
 			return reporter.Count()
 		default:
 			b.makeRequests(client, reporter)
+			atomic.AddInt64(&b.iterations, 1)
 		}
 		if n > 0 {
 			i++
@@ -242,14 +697,17 @@ func (b *Work) runWorker(client *http.Client, n int) int {
 	return reporter.Count()
 }
 
-func (b *Work) runN(client *http.Client) {
+func (b *Work) runN(client *http.Client, n int) {
 
 	var wg sync.WaitGroup
 	// Ignore the case where b.N % b.C != 0.
 	for i := 0; i < 1; i++ {
 		wg.Add(1)
 		go func() {
-			b.runWorker(client, b.N)
+			b.incWorkerCount()
+			worker, rng := b.nextWorker()
+			b.runWorker(client, n, worker, rng)
+			b.decWorkerCount()
 			wg.Done()
 		}()
 	}
@@ -263,6 +721,11 @@ func (b *Work) timeOne(client *http.Client) (int, time.Duration) {
 		results:   make(chan *Result, maxResult),
 		count:     0,
 		userAgent: b.UserAgent,
+		checks:    newCheckStats(),
+		log:       b.log,
+		hooks:     b.Hooks,
+		clock:     b.clock,
+		rng:       workerRand(b.Seed, 0),
 	}
 	defer func() {
 		close(reporter.results)
@@ -282,29 +745,29 @@ func (b *Work) runRPSWorker(origDeltaMs float64, wg *sync.WaitGroup, client *htt
 		defer b.decWorkerCount()
 
 		// ensure we don't end up with all these workers in lock-step
+		worker, rng := b.nextWorker()
 		maxSleep := math.Ceil(origDeltaMs * 1.2)
-		randSleep := rand.Float64() * maxSleep
+		randSleep := rng.Float64() * maxSleep
 		sleep := time.Duration(int64(math.Ceil(randSleep))) * time.Millisecond
 		time.Sleep(sleep)
 
-		b.runWorker(client, 0)
+		b.runWorker(client, 0, worker, rng)
 
 		wg.Done()
 	}()
 }
 
-func (b *Work) runRPS(client *http.Client) {
-	n, origDelta := b.timeOne(client)
+// runRPS targets RPS, from n results of a request that took
+// origDelta.
+func (b *Work) runRPS(client *http.Client, n int, origDelta time.Duration) {
 	origDeltaMs := float64(origDelta.Milliseconds())
 	rpsMeasured := float64(n) / origDelta.Seconds()
 	rpsTarget := float64(b.RPS)
 
-	b.start = now()
-
 	// target rps / n workers = measured rps / 1 worker
 
 	nWorkers := max(int(math.Ceil(rpsTarget/rpsMeasured)), 1)
-	fmt.Printf("%d workers for %f RPS (%d / %f sec)\n", nWorkers, rpsTarget, n, origDelta.Seconds())
+	b.log.Info("starting workers", "workers", nWorkers, "rps", rpsTarget, "measured", rpsMeasured)
 
 	var wg sync.WaitGroup
 	for i := 0; i < nWorkers; i++ {
@@ -319,15 +782,20 @@ func (b *Work) consoleReport(origDeltaMs float64, wg *sync.WaitGroup, client *ht
 	const Kp = 5
 	const Ki = 3
 	const Kd = 3
-	time.Sleep(5 * time.Second)
 
-	ticker := time.NewTicker(dt * time.Second)
 	defer func() {
-		ticker.Stop()
+		wg.Wait()
 	}()
 
+	select {
+	case <-b.stopCh:
+		return
+	case <-time.After(5 * time.Second):
+	}
+
+	ticker := time.NewTicker(dt * time.Second)
 	defer func() {
-		wg.Wait()
+		ticker.Stop()
 	}()
 
 	prevError := float64(0)
@@ -349,7 +817,6 @@ func (b *Work) consoleReport(origDeltaMs float64, wg *sync.WaitGroup, client *ht
 			workers := b.getWorkerCount()
 			workerGoalFloat := float64(workers) * rpsTarget / rpsMeasured
 			workerGoal := max(int(math.Ceil(workerGoalFloat)), 1)
-			fmt.Printf("\tgoal %d (%.1f)\n", workerGoal, workerGoalFloat)
 
 			error := float64(workerGoal - workers)
 			integral = integral + error*dt
@@ -360,7 +827,8 @@ func (b *Work) consoleReport(origDeltaMs float64, wg *sync.WaitGroup, client *ht
 			newWorkers := float64(workers) * (1 + output/100)
 			workerDiff := int(math.Round(newWorkers)) - workers
 
-			fmt.Printf("current: %.1f rps (%d workers) (error: %.1f out: %.1f, newWorkers: %.1f)\n", rpsMeasured, b.getWorkerCount(), error, output, newWorkers)
+			b.log.Info("rate", "rps", rpsMeasured, "workers", b.getWorkerCount(), "goal", workerGoalFloat,
+				"error", error, "output", output, "new_workers", newWorkers)
 
 			// avoid flip flopping around by ignoring 1 worker diffs
 			if workerDiff > 1 {
@@ -370,38 +838,148 @@ func (b *Work) consoleReport(origDeltaMs float64, wg *sync.WaitGroup, client *ht
 				//}
 			} else if workerDiff < -1 {
 				//fmt.Printf("killing %d workers\n", -workerDiff)
-				//for i := 0; i < -workerDiff; i++ {
-				//	b.workerStopCh <- struct{}{}
-				//}
+				//b.stopWorkers(-workerDiff)
 			}
 		}
 	}
 }
 
-func (b *Work) runWorkers() {
+// workers returns the function running the workers, which make n
+// calls to the Requester, or target RPS if n is 0, unless requests are
+// made in bursts.  Targeting RPS, a request is timed first, which
+// isn't part of the run: the run starts once it is done.
+func (b *Work) workers(n int) func() {
+	client := b.newClient()
+
+	if b.BurstSize > 0 {
+		return func() { b.runBursts(client, n) }
+	} else if n > 0 {
+		return func() { b.runN(client, n) }
+	}
+	calibration := now()
+	calN, calDelta := b.timeOne(client)
+	// the time a resumed run had already been going is still part of
+	// it, though
+	b.start += now() - calibration
+	b.clock.start = b.start
+	return func() { b.runRPS(client, calN, calDelta) }
+}
+
+// newRunID returns a unique ID for a run, starting with its start time
+// so that IDs sort chronologically.
+func newRunID() string {
+	var b [4]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint32(b[:], rand.Uint32())
+	}
+	return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405Z"), b)
+}
+
+// newClient returns the client the Requester makes requests with.
+func (b *Work) newClient() *http.Client {
+	return b.newClientWith(b.Chaos)
+}
+
+// newClientWith returns the client the Requester makes requests with,
+// misbehaving as chaos says rather than as b.Chaos does.
+func (b *Work) newClientWith(chaos Chaos) *http.Client {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
 		MaxIdleConnsPerHost: maxIdleConn,
+		MaxConnsPerHost:     b.MaxConnsPerHost,
 		DisableCompression:  b.DisableCompression,
 		DisableKeepAlives:   b.DisableKeepAlives,
 		Proxy:               http.ProxyURL(b.ProxyAddr),
 	}
-	if b.H2 {
+	if b.H2 || b.H2C {
 		if err := http2.ConfigureTransport(tr); err != nil {
-			log.Fatalf("http2.ConfigureTransport: %s", err)
+			b.log.Error("http2.ConfigureTransport", "err", err)
 		}
 	} else {
 		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
-	client := &http.Client{Transport: tr, Timeout: time.Duration(b.Timeout) * time.Second}
+	if b.H2C {
+		tr.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP:          true,
+			DisableCompression: b.DisableCompression,
+			// http2.Transport always dials with TLS; for h2c that
+			// must be a plain connection instead.
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, time.Duration(b.Timeout)*time.Second)
+			},
+		})
+	}
+	if b.Host != "" {
+		serverName := b.Host
+		if h, _, err := net.SplitHostPort(b.Host); err == nil {
+			serverName = h
+		}
+		tr.TLSClientConfig.ServerName = serverName
+	}
+	var rt http.RoundTripper = tr
+	if b.Transport != nil {
+		rt = b.Transport(tr)
+	}
+	if chaos.Enabled() {
+		rt = &chaosTransport{rt: rt, chaos: chaos, rng: workerRand(b.Seed, -1)}
+	}
+	if b.Host != "" {
+		rt = &hostTransport{rt: rt, host: b.Host}
+	}
+	if b.BaseURL != nil {
+		rt = &baseURLTransport{rt: rt, base: b.BaseURL}
+	}
+	if b.Cache {
+		rt = &cacheTransport{rt: rt}
+	}
+	return &http.Client{Transport: rt, Timeout: time.Duration(b.Timeout) * time.Second}
+}
 
-	if b.N > 0 {
-		b.runN(client)
-	} else {
-		b.runRPS(client)
+// hostTransport sets the Host header of every request.
+type hostTransport struct {
+	rt   http.RoundTripper
+	host string
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = t.host
+	return t.rt.RoundTrip(req)
+}
+
+// Unwrap returns the underlying transport, for requesters that need
+// its TLS configuration.
+func (t *hostTransport) Unwrap() http.RoundTripper {
+	return t.rt
+}
+
+// baseURLTransport rewrites the URL of every request to be relative
+// to a base URL.
+type baseURLTransport struct {
+	rt   http.RoundTripper
+	base *url.URL
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.base.Scheme
+	req.URL.Host = t.base.Host
+	if p := strings.TrimSuffix(t.base.Path, "/"); p != "" {
+		req.URL.Path = p + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimSuffix(t.base.EscapedPath(), "/") + req.URL.RawPath
+		}
 	}
+	// the Host header follows the new URL
+	req.Host = ""
+	return t.rt.RoundTrip(req)
+}
+
+// Unwrap returns the underlying transport.
+func (t *baseURLTransport) Unwrap() http.RoundTripper {
+	return t.rt
 }
 
 func min(a, b int) int {
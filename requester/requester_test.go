@@ -17,13 +17,33 @@ package requester
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/bpowers/hithere/grpc"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type testRequester struct {
@@ -80,7 +100,7 @@ func TestN(t *testing.T) {
 		Requester: &testRequester{req, nil},
 		N:         20,
 	}
-	w.Run()
+	w.Run(context.Background())
 	if count != 20 {
 		t.Errorf("Expected to send 20 requests, found %v", count)
 	}
@@ -108,7 +128,7 @@ func TestRequest(t *testing.T) {
 		Requester: &testRequester{req, nil},
 		N:         1,
 	}
-	w.Run()
+	w.Run(context.Background())
 	if uri != "/" {
 		t.Errorf("Uri is expected to be /, %v is found", uri)
 	}
@@ -126,6 +146,34 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestH2C(t *testing.T) {
+	var protos []string
+	var mu sync.Mutex
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos = append(protos, r.Proto)
+		mu.Unlock()
+	}
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requester: &testRequester{req, nil},
+		N:         5,
+		H2C:       true,
+	}
+	w.Run(context.Background())
+	if len(protos) != 5 {
+		t.Fatalf("expected 5 requests, found %d", len(protos))
+	}
+	for _, proto := range protos {
+		if proto != "HTTP/2.0" {
+			t.Errorf("expected an HTTP/2 request, got %s", proto)
+		}
+	}
+}
+
 func TestBody(t *testing.T) {
 	var count int64
 	handler := func(w http.ResponseWriter, r *http.Request) {
@@ -144,8 +192,2210 @@ func TestBody(t *testing.T) {
 		Requester: &testRequester{req, []byte("Body")},
 		N:         10,
 	}
-	w.Run()
+	w.Run(context.Background())
 	if count != 10 {
 		t.Errorf("Expected to work 10 times, found %v", count)
 	}
 }
+
+func TestCollector(t *testing.T) {
+	var count int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, int64(1))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var contentType, method string
+	var frames int
+	collector := func(w http.ResponseWriter, r *http.Request) {
+		method = r.URL.Path
+		contentType = r.Header.Get("content-type")
+		for {
+			var hdr [5]byte
+			if _, err := io.ReadFull(r.Body, hdr[:]); err != nil {
+				break
+			}
+			io.CopyN(ioutil.Discard, r.Body, int64(binary.BigEndian.Uint32(hdr[1:])))
+			frames++
+		}
+		w.Header().Set("trailer", "grpc-status")
+		w.Header().Set("content-type", "application/grpc")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("grpc-status", "0")
+	}
+	collectorServer := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(collector), &http2.Server{}))
+	defer collectorServer.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requester:     &testRequester{req, nil},
+		N:             20,
+		CollectorAddr: collectorServer.URL,
+		Writer:        ioutil.Discard,
+	}
+	w.Run(context.Background())
+	if count != 20 {
+		t.Errorf("Expected to send 20 requests, found %v", count)
+	}
+	if method != "/hithere.metrics.v1.MetricsCollector/Stream" {
+		t.Errorf("unexpected collector method %q", method)
+	}
+	if contentType != "application/grpc+proto" {
+		t.Errorf("unexpected content-type %q", contentType)
+	}
+	if frames < 1 {
+		t.Errorf("expected at least the final interval to be streamed")
+	}
+}
+
+// histogramError is the most a latencyHistogram may be off by,
+// relative to the latency.
+const histogramError = 1.0 / (1 << histogramSubBits)
+
+func TestPercentiles(t *testing.T) {
+	var lats latencyHistogram
+	for i := 0; i < 200; i++ {
+		lats.add(float64(i + 1))
+	}
+	want := map[int]float64{50: 100, 75: 150, 90: 180, 95: 190, 99: 198}
+	for _, l := range percentiles(&lats) {
+		if math.Abs(l.Latency-want[l.Percentage]) > histogramError*want[l.Percentage] {
+			t.Errorf("p%d: got %v, want %v", l.Percentage, l.Latency, want[l.Percentage])
+		}
+	}
+
+	// with a single sample every percentile is that sample
+	single := &latencyHistogram{}
+	single.add(0.5)
+	for _, l := range percentiles(single) {
+		if l.Latency != 0.5 {
+			t.Errorf("p%d: got %v, want 0.5", l.Percentage, l.Latency)
+		}
+	}
+}
+
+// reportOf returns the report of results, as if a run had made them in
+// a second.
+func reportOf(verbose bool, results ...*Result) Report {
+	ch := make(chan *Result, len(results))
+	r := newReport(ch)
+	r.verbose = verbose
+	for _, res := range results {
+		ch <- res
+	}
+	close(ch)
+	runReporter(r)
+	return r.finalize(time.Second)
+}
+
+func TestWorkerStats(t *testing.T) {
+	results := []*Result{
+		{Worker: 3, StatusCode: 200, Duration: 300 * time.Millisecond},
+		{Worker: 1, StatusCode: 200, Duration: 100 * time.Millisecond},
+		{Worker: 1, StatusCode: 200, Duration: 300 * time.Millisecond},
+		{Worker: 3, Err: errors.New("boom")},
+		{Worker: 2, StatusCode: 200, Duration: 200 * time.Millisecond},
+		{Worker: 1, StatusCode: 200, Duration: 200 * time.Millisecond},
+	}
+	if r := reportOf(false, results...); r.Workers != nil {
+		t.Errorf("expected no workers unless verbose, got %+v", r.Workers)
+	}
+
+	r := reportOf(true, results...)
+	// ordered by ID, and the latencies are of successes only
+	want := []WorkerStats{
+		{ID: 1, NumRes: 3, Average: 0.2, Fastest: 0.1, Slowest: 0.3},
+		{ID: 2, NumRes: 1, Average: 0.2, Fastest: 0.2, Slowest: 0.2},
+		{ID: 3, NumRes: 2, Errors: 1, Average: 0.3, Fastest: 0.3, Slowest: 0.3},
+	}
+	if len(r.Workers) != len(want) {
+		t.Fatalf("got %+v, want %+v", r.Workers, want)
+	}
+	for i, w := range want {
+		got := r.Workers[i]
+		if got.ID != w.ID || got.NumRes != w.NumRes || got.Errors != w.Errors ||
+			math.Abs(got.Average-w.Average) > 1e-9 || got.Fastest != w.Fastest || got.Slowest != w.Slowest {
+			t.Errorf("worker %d: got %+v, want %+v", i, got, w)
+		}
+	}
+
+	out, err := render("", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "  [3]\t2, 1, 0.3000 secs, 0.3000 secs, 0.3000 secs") {
+		t.Errorf("expected worker 3 in the summary:\n%s", out)
+	}
+}
+
+func TestTTFB(t *testing.T) {
+	var results []*Result
+	for i := 1; i <= 100; i++ {
+		// the bodies take the rest of the second to read
+		results = append(results, &Result{
+			StatusCode:    200,
+			Duration:      time.Second,
+			DelayDuration: time.Duration(i) * time.Millisecond,
+		})
+	}
+	// failures have no first byte to count
+	results = append(results, &Result{Err: errors.New("boom"), DelayDuration: time.Minute})
+	r := reportOf(false, results...)
+
+	// p is the first sample with at least p% before it
+	want := map[int]float64{10: 0.011, 25: 0.026, 50: 0.051, 75: 0.076, 90: 0.091, 95: 0.096, 99: 0.1}
+	if len(r.TTFBDistribution) != len(want) {
+		t.Fatalf("unexpected TTFB distribution %+v", r.TTFBDistribution)
+	}
+	for _, l := range r.TTFBDistribution {
+		if math.Abs(l.Latency-want[l.Percentage]) > histogramError*want[l.Percentage] {
+			t.Errorf("p%d: got %v, want %v", l.Percentage, l.Latency, want[l.Percentage])
+		}
+	}
+	// independent of the total latency
+	for _, l := range r.LatencyDistribution {
+		if math.Abs(l.Latency-1) > histogramError {
+			t.Errorf("latency p%d: got %v, want 1", l.Percentage, l.Latency)
+		}
+	}
+	var n int
+	for _, b := range r.TTFBHistogram {
+		n += b.Count
+	}
+	if n != 100 {
+		t.Errorf("expected 100 responses in the TTFB histogram, got %d", n)
+	}
+	if first, last := r.TTFBHistogram[0].Mark, r.TTFBHistogram[len(r.TTFBHistogram)-1].Mark; math.Abs(first-0.001) > histogramError*0.001 || math.Abs(last-0.1) > histogramError*0.1 {
+		t.Errorf("expected the TTFB histogram to span 1ms to 100ms, got %v to %v", first, last)
+	}
+
+	out, err := render("", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Time to first byte distribution:\n  10% in 0.0110 secs\n") {
+		t.Errorf("expected the TTFB distribution in the summary:\n%s", out)
+	}
+}
+
+func TestEndpointStats(t *testing.T) {
+	results := []*Result{
+		{Name: "GET /b", StatusCode: 200, Duration: time.Millisecond, ContentLength: 100},
+		{Name: "GET /a", StatusCode: 200, Duration: time.Millisecond, ContentLength: 1000},
+		{Name: "GET /b", StatusCode: 200, Duration: time.Millisecond, ContentLength: 300},
+		// counted, but without a size
+		{Name: "GET /b", Err: errors.New("boom"), ContentLength: 5000},
+		{Name: "GET /a", StatusCode: 204, Duration: time.Millisecond, ContentLength: -1},
+		// unnamed results are only in the totals
+		{StatusCode: 200, Duration: time.Millisecond, ContentLength: 600},
+	}
+	r := reportOf(false, results...)
+
+	want := []EndpointStats{
+		{Name: "GET /a", NumRes: 2, SizeTotal: 1000, SizeReq: 500},
+		{Name: "GET /b", NumRes: 3, SizeTotal: 400, SizeReq: 133},
+	}
+	if !reflect.DeepEqual(r.Endpoints, want) {
+		t.Errorf("got %+v, want %+v", r.Endpoints, want)
+	}
+	if r.SizeTotal != 2000 || r.SizeReq != 400 || r.Throughput != 2000 {
+		t.Errorf("expected 2000 bytes, 400 a request, at 2000 bytes/sec, got %d, %d, %v", r.SizeTotal, r.SizeReq, r.Throughput)
+	}
+
+	out, err := render("", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  Throughput:\t2000.0000 bytes/sec\n",
+		"Endpoints (requests, total bytes, bytes/request):\n  GET /a\t2, 1000, 500\n  GET /b\t3, 400, 133\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the summary:\n%s", want, out)
+		}
+	}
+}
+
+func TestEndpointOverflow(t *testing.T) {
+	var results []*Result
+	for i := 0; i < maxEndpoints+10; i++ {
+		results = append(results, &Result{
+			Name:          fmt.Sprintf("GET /items/%03d", i),
+			StatusCode:    200,
+			Duration:      time.Millisecond,
+			ContentLength: 10,
+		})
+	}
+	// names already seen keep their own stats
+	results = append(results, &Result{Name: "GET /items/000", StatusCode: 200, Duration: time.Millisecond, ContentLength: 30})
+	r := reportOf(false, results...)
+
+	if len(r.Endpoints) != maxEndpoints+1 {
+		t.Fatalf("expected %d endpoints, got %d", maxEndpoints+1, len(r.Endpoints))
+	}
+	if e := r.Endpoints[0]; e.Name != otherEndpoint || e.NumRes != 10 || e.SizeTotal != 100 {
+		t.Errorf("expected the last 10 endpoints under %s, got %+v", otherEndpoint, e)
+	}
+	if e := r.Endpoints[1]; e.Name != "GET /items/000" || e.NumRes != 2 || e.SizeReq != 20 {
+		t.Errorf("unexpected stats %+v", e)
+	}
+	if e := r.Endpoints[maxEndpoints]; e.Name != fmt.Sprintf("GET /items/%03d", maxEndpoints-1) {
+		t.Errorf("expected the last endpoint with stats of its own last, got %+v", e)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	// a long tail, over nine orders of magnitude
+	rng := rand.New(rand.NewSource(1))
+	var h latencyHistogram
+	lats := make([]float64, 100000)
+	for i := range lats {
+		lats[i] = math.Exp(rng.NormFloat64()*3) / 1000
+		h.add(lats[i])
+	}
+	sort.Float64s(lats)
+	for _, p := range []float64{0.5, 0.9, 0.99, 0.999, 0.9999} {
+		rank := int64(math.Ceil(p * float64(len(lats))))
+		want := lats[rank-1]
+		if got := h.valueAt(rank); math.Abs(got-want) > histogramError*want {
+			t.Errorf("p%g: got %v, want %v", p*100, got, want)
+		}
+	}
+	if h.Min != lats[0] || h.Max != lats[len(lats)-1] || h.N != int64(len(lats)) {
+		t.Errorf("expected exact min, max and count, got %v, %v, %d", h.Min, h.Max, h.N)
+	}
+
+	// its size depends on the range of latencies, not how many
+	size := len(h.Counts)
+	for i := 0; i < 100000; i++ {
+		h.add(lats[i%len(lats)])
+	}
+	if len(h.Counts) != size {
+		t.Errorf("expected the histogram to stay at %d buckets, got %d", size, len(h.Counts))
+	}
+}
+
+func TestInterimJSON(t *testing.T) {
+	var buf bytes.Buffer
+	s := newInterim(&buf, true)
+	s.sendInterval(&Interval{
+		Start:          time.Second,
+		Duration:       time.Second,
+		NumRes:         3,
+		Rps:            3,
+		StatusCodeDist: map[int]int{200: 2},
+		ErrorDist:      map[string]int{"boom": 1},
+	})
+	s.close()
+
+	var got InterimSummary
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %s", buf.String(), err)
+	}
+	if got.Start != 1 || got.Requests != 3 || got.StatusCodeDist[200] != 2 || got.ErrorDist["boom"] != 1 {
+		t.Errorf("unexpected interim summary %+v", got)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	defer func(d time.Duration) { dashboardLinger = d }(dashboardLinger)
+	dashboardLinger = time.Minute
+
+	d, err := startDashboard("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + d.addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	type intervals struct {
+		Points   []dashboardPoint
+		Requests int64
+		Errors   int64
+		Done     bool
+	}
+	poll := func() intervals {
+		var got intervals
+		if _, body := get("/intervals"); json.Unmarshal([]byte(body), &got) != nil {
+			t.Fatalf("unexpected intervals %q", body)
+		}
+		return got
+	}
+
+	if code, body := get("/"); code != 200 || !strings.Contains(body, "fetch('intervals')") {
+		t.Errorf("unexpected page %d:\n%s", code, body)
+	}
+	if code, _ := get("/nope"); code != 404 {
+		t.Errorf("expected 404, got %d", code)
+	}
+
+	d.sendInterval(&Interval{
+		Start:               time.Second,
+		Duration:            time.Second,
+		NumRes:              3,
+		Rps:                 3,
+		ErrorDist:           map[string]int{"boom": 1},
+		LatencyDistribution: []LatencyDistribution{{Percentage: 50, Latency: 0.1}, {Percentage: 99, Latency: 0.3}},
+	})
+	want := intervals{
+		Points:   []dashboardPoint{{T: 2, Rps: 3, Errors: 1, P50: 0.1, P99: 0.3}},
+		Requests: 3,
+		Errors:   1,
+	}
+	if got := poll(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// close keeps serving until the open page has seen the end
+	closed := make(chan struct{})
+	go func() {
+		d.close()
+		close(closed)
+	}()
+	for !poll().Done {
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected close to return once the final interval was polled")
+	}
+	if _, err := http.Get("http://" + d.addr + "/intervals"); err == nil {
+		t.Errorf("expected the server to be stopped")
+	}
+}
+
+type checkRequester struct {
+	count *int64
+}
+
+func (c *checkRequester) Do(ctx context.Context, _ *http.Client, r Reporter) error {
+	n := atomic.AddInt64(c.count, 1)
+	r.(CheckReporter).Check("even", n%2 == 0)
+	return nil
+}
+
+func (c *checkRequester) Clone() Requester {
+	return c
+}
+
+func TestChecks(t *testing.T) {
+	var count int64
+	w := &Work{
+		Requester: &checkRequester{&count},
+		N:         20,
+		Writer:    ioutil.Discard,
+	}
+	w.Run(context.Background())
+
+	checks := w.report.checks.stats()
+	if len(checks) != 1 {
+		t.Fatalf("expected 1 check, got %+v", checks)
+	}
+	if c := checks[0]; c.Name != "even" || c.Passes != 10 || c.Fails != 10 || c.Rate != 0.5 {
+		t.Errorf("unexpected check stats %+v", c)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var mu sync.Mutex
+	var got []Summary
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var s Summary
+		if r.Method != "POST" || r.Header.Get("content-type") != "application/json" {
+			t.Errorf("unexpected %s with content-type %q", r.Method, r.Header.Get("content-type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Errorf("json.Decode: %s", err)
+		}
+		got = append(got, s)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	var count int64
+	var logs bytes.Buffer
+	w := &Work{
+		Requester: &checkRequester{&count},
+		N:         20,
+		Writer:    ioutil.Discard,
+		RunID:     "r1",
+		NotifyURL: server.URL,
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	w.Run(context.Background())
+
+	if len(got) != 1 {
+		t.Fatalf("expected a single notification, got %d", len(got))
+	}
+	// the verdicts of the checks come with the summary
+	want := []CheckSummary{{Name: "even", Passes: 10, Fails: 10, Rate: 0.5}}
+	if got[0].RunID != "r1" || !reflect.DeepEqual(got[0].Checks, want) {
+		t.Errorf("unexpected summary %+v", got[0])
+	}
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("expected no errors, got:\n%s", logs.String())
+	}
+
+	// a webhook that fails is logged, and doesn't fail the run
+	status = http.StatusBadGateway
+	if err := notify(server.URL, &Summary{}); err == nil || !strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Errorf("expected the status in the error, got %v", err)
+	}
+	w.Reset()
+	w.Run(context.Background())
+	if !strings.Contains(logs.String(), `level=ERROR msg=notifying`) || !strings.Contains(logs.String(), "502 Bad Gateway") {
+		t.Errorf("expected the failure logged, got:\n%s", logs.String())
+	}
+	if len(got) != 3 {
+		t.Errorf("expected 3 notifications, got %d", len(got))
+	}
+}
+
+type forcedRequester struct {
+	count *int64
+}
+
+func (f *forcedRequester) Do(ctx context.Context, _ *http.Client, r Reporter) error {
+	n := atomic.AddInt64(f.count, 1)
+	r.Start()
+	r.Finish(&Result{
+		StatusCode:   200,
+		Duration:     time.Millisecond,
+		ForcedClose:  n%4 == 0,
+		NewConn:      n%4 == 1,
+		ConnReused:   n%4 != 1,
+		DNSLookup:    n == 1,
+		TLSHandshake: n%4 == 1,
+	})
+	return nil
+}
+
+func (f *forcedRequester) Clone() Requester {
+	return f
+}
+
+func TestForcedCloses(t *testing.T) {
+	var count int64
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &forcedRequester{&count},
+		N:         20,
+		Writer:    &buf,
+	}
+	w.Run(context.Background())
+
+	if n := w.Report().ForcedCloses; n != 5 {
+		t.Errorf("expected 5 forced closes, got %d", n)
+	}
+	if !strings.Contains(buf.String(), "Forced closes:\t5\n") {
+		t.Errorf("expected the forced closes in the summary:\n%s", buf.String())
+	}
+}
+
+func TestAssertion(t *testing.T) {
+	res := &Result{Name: "GET http://host/api/items", StatusCode: 201, Duration: 300 * time.Millisecond}
+	body := `{"items": [{"id": 7, "tags": ["a"]}], "next": null}`
+	for _, tt := range []struct {
+		src  string
+		pass bool
+	}{
+		{"status 201", true},
+		{"status 2xx", true},
+		{"status 200,300-399", false},
+		{"GET */api/* => status 200", false},
+		{"POST * => status 200", true},
+		{"latency < 500ms", true},
+		{"latency <= 300ms", true},
+		{"latency < 300ms", false},
+		{"body contains \"id\": 7", true},
+		{`body contains "tags\": [\"a"`, true},
+		{"body contains missing", false},
+		{"json $.items[0].id == 7", true},
+		{"json $.items[0]['tags'] == [\"a\"]", true},
+		{"json $.items[0].id != 7", false},
+		{"json $.next exists", true},
+		{"json $.items[1] exists", false},
+		{"json $.items[1].id != 7", false},
+	} {
+		a, err := ParseAssertion(tt.src)
+		if err != nil {
+			t.Errorf("ParseAssertion(%q): %s", tt.src, err)
+			continue
+		}
+		r := *res
+		resp := &http.Response{StatusCode: r.StatusCode, Body: ioutil.NopCloser(strings.NewReader(body))}
+		a.AfterResponse(nil, resp, &r)
+		if passed := r.Err == nil; passed != tt.pass {
+			t.Errorf("%q: got passed %t, want %t (%v)", tt.src, passed, tt.pass, r.Err)
+		}
+		// the body is left for the next hook
+		if b, _ := ioutil.ReadAll(resp.Body); string(b) != body {
+			t.Errorf("%q: body not readable again, got %q", tt.src, b)
+		}
+	}
+
+	for _, src := range []string{
+		"",
+		"=> status 200",
+		"status ok",
+		"status 299-200",
+		"latency 5s",
+		"latency < soon",
+		"body has x",
+		"json items == 1",
+		"json $.items[x] == 1",
+		"json $.ok = true",
+		"json $.ok == yes",
+	} {
+		if _, err := ParseAssertion(src); err == nil {
+			t.Errorf("ParseAssertion(%q): expected an error", src)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1<<20))
+	}))
+	defer server.Close()
+
+	client := (&Work{Chaos: Chaos{Abort: 1}}).newClient()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrChaosAbort) || n == 0 || n == 1<<20 {
+		t.Errorf("expected the body to be aborted partway, got %d bytes, %v", n, err)
+	}
+
+	client = (&Work{Chaos: Chaos{Drop: 1}}).newClient()
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrChaosDrop) {
+		t.Errorf("expected the connection to be dropped, got %v", err)
+	}
+
+	client = (&Work{Chaos: Chaos{Latency: time.Hour}}).newClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the delay to end with the request's context, got %v", err)
+	}
+
+	client = (&Work{Chaos: Chaos{Abort: 0.5, Drop: 0.5}}).newClient()
+	var ok, failed int
+	for i := 0; i < 40; i++ {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			failed++
+		} else {
+			ok++
+		}
+	}
+	if ok == 0 || failed == 0 {
+		t.Errorf("expected some requests to succeed and some to fail, got %d and %d", ok, failed)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	var count int64
+	var buf, interim bytes.Buffer
+	w := &Work{
+		Requester:     &forcedRequester{&count},
+		N:             20,
+		Writer:        &buf,
+		Interim:       time.Hour,
+		InterimWriter: &interim,
+		InterimJSON:   true,
+	}
+	w.Run(context.Background())
+
+	want := ConnStats{New: 5, Reused: 15, DNSLookups: 1, TLSHandshakes: 5}
+	if got := w.Report().Conns; got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if c := w.Report().Summary().Connections; c == nil || *c != want {
+		t.Errorf("expected %+v in the JSON summary, got %+v", want, c)
+	}
+	for _, s := range []string{
+		"  New:\t5, with 1 DNS lookups and 5 TLS handshakes\n",
+		"  Reused:\t15 (75.00% of requests)\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in the summary:\n%s", s, buf.String())
+		}
+	}
+	var iv InterimSummary
+	if err := json.Unmarshal(interim.Bytes(), &iv); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %s", interim.String(), err)
+	}
+	if iv.Connections == nil || *iv.Connections != want {
+		t.Errorf("expected %+v in the interim summary, got %+v", want, iv.Connections)
+	}
+}
+
+// cacheRequester gets each of paths, checking the bodies, and reports
+// how the cache handled them.
+type cacheRequester struct {
+	url   string
+	paths []string
+}
+
+func (cr *cacheRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	for _, path := range cr.paths {
+		req, _ := http.NewRequestWithContext(ctx, "GET", cr.url+path, nil)
+		r.Start()
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && string(body) != path {
+			err = fmt.Errorf("got body %q for %s", body, path)
+		}
+		r.Finish(&Result{Err: err, StatusCode: resp.StatusCode, Cache: ResponseCacheStatus(resp)})
+	}
+	return nil
+}
+
+func (cr *cacheRequester) Clone() Requester {
+	return cr
+}
+
+func TestHTTPCache(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		served[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/expired":
+			w.Header().Set("Expires", "0")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &cacheRequester{server.URL, []string{"/fresh", "/etag", "/expired", "/nostore"}},
+		N:         5,
+		Cache:     true,
+		Writer:    &buf,
+	}
+	w.Run(context.Background())
+
+	if errs := w.Report().ErrorDist; len(errs) > 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	want := CacheStats{Hits: 4, Revalidated: 4, Misses: 12}
+	if got := w.Report().Cache; got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if c := w.Report().Summary().Cache; c == nil || *c != want {
+		t.Errorf("expected %+v in the JSON summary, got %+v", want, c)
+	}
+	wantServed := map[string]int{"/fresh": 1, "/etag": 5, "/expired": 5, "/nostore": 5}
+	if !reflect.DeepEqual(served, wantServed) {
+		t.Errorf("expected the server to see %v, got %v", wantServed, served)
+	}
+	if s := "  Hits:\t4 (20.00% of cacheable requests)\n"; !strings.Contains(buf.String(), s) {
+		t.Errorf("expected %q in the summary:\n%s", s, buf.String())
+	}
+
+	// without the cache, every request goes to the server
+	buf.Reset()
+	w.Cache = false
+	w.Reset()
+	w.Run(context.Background())
+	if got := w.Report().Cache; got != (CacheStats{}) {
+		t.Errorf("expected no cache stats without the cache, got %+v", got)
+	}
+}
+
+// burstRequester records when it is called, taking delay each time.
+type burstRequester struct {
+	mu    sync.Mutex
+	calls []time.Time
+	delay time.Duration
+}
+
+func (br *burstRequester) Do(ctx context.Context, _ *http.Client, r Reporter) error {
+	br.mu.Lock()
+	br.calls = append(br.calls, time.Now())
+	br.mu.Unlock()
+	time.Sleep(br.delay)
+	r.Start()
+	r.Finish(&Result{StatusCode: http.StatusOK})
+	return nil
+}
+
+func (br *burstRequester) Clone() Requester {
+	return br
+}
+
+func TestBursts(t *testing.T) {
+	br := &burstRequester{}
+	w := &Work{
+		Requester:     br,
+		N:             12,
+		BurstSize:     5,
+		BurstInterval: 100 * time.Millisecond,
+		Writer:        ioutil.Discard,
+	}
+	start := time.Now()
+	w.Run(context.Background())
+	if len(br.calls) != 15 {
+		t.Fatalf("expected 3 bursts of 5 calls, got %d calls", len(br.calls))
+	}
+	if n := w.Report().NumRes; n != 15 {
+		t.Errorf("expected 15 results, got %d", n)
+	}
+	sort.Slice(br.calls, func(i, j int) bool { return br.calls[i].Before(br.calls[j]) })
+	for i := 0; i < 3; i++ {
+		burst := br.calls[i*5 : i*5+5]
+		if spread := burst[4].Sub(burst[0]); spread > 50*time.Millisecond {
+			t.Errorf("burst %d: expected its calls together, got them over %s", i, spread)
+		}
+		if at := burst[0].Sub(start); at < time.Duration(i)*100*time.Millisecond {
+			t.Errorf("burst %d: expected it after %s, got %s", i, time.Duration(i)*100*time.Millisecond, at)
+		}
+	}
+
+	// a worker busy with one burst sits out the next
+	br = &burstRequester{delay: 150 * time.Millisecond}
+	w = &Work{
+		Requester:     br,
+		N:             4,
+		BurstSize:     1,
+		BurstInterval: 100 * time.Millisecond,
+		Writer:        ioutil.Discard,
+	}
+	w.Run(context.Background())
+	if len(br.calls) != 2 {
+		t.Errorf("expected the worker to miss every other burst, got %d calls", len(br.calls))
+	}
+}
+
+// randRequester records the random numbers its worker draws.
+type randRequester struct {
+	mu    sync.Mutex
+	drawn []int64
+}
+
+func (rr *randRequester) Do(ctx context.Context, _ *http.Client, r Reporter) error {
+	n := r.(RandReporter).Rand().Int63()
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.drawn = append(rr.drawn, n)
+	return nil
+}
+
+func (rr *randRequester) Clone() Requester {
+	return rr
+}
+
+func TestSeed(t *testing.T) {
+	run := func(w *Work) []int64 {
+		rr := &randRequester{}
+		w.Requester = rr
+		w.Run(context.Background())
+		return rr.drawn
+	}
+	w := &Work{N: 3, Seed: 42, Writer: ioutil.Discard}
+	a := run(w)
+	w.Reset()
+	if b := run(w); len(a) != 3 || !reflect.DeepEqual(a, b) {
+		t.Errorf("expected runs with the same seed to draw the same numbers, got %v and %v", a, b)
+	}
+	w.Reset()
+	w.Seed = 43
+	if c := run(w); reflect.DeepEqual(a, c) {
+		t.Errorf("expected a different seed to draw different numbers, got %v", c)
+	}
+
+	w = &Work{N: 3, Writer: ioutil.Discard}
+	run(w)
+	seed := w.Seed
+	if seed == 0 {
+		t.Fatalf("expected Init to pick a seed")
+	}
+	w.Reset()
+	if w.Seed != 0 {
+		t.Errorf("expected Reset to clear the generated seed, got %d", w.Seed)
+	}
+
+	if workerRand(1, 1).Int63() == workerRand(1, 2).Int63() {
+		t.Errorf("expected workers' streams to differ")
+	}
+}
+
+type traceRequester struct {
+	url string
+}
+
+func (tr *traceRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", tr.url, nil)
+	req.Header.Set("X-Trace", "1")
+	r.Start()
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	r.Finish(&Result{StatusCode: resp.StatusCode, Name: "GET " + tr.url})
+	r.(CheckReporter).Check("ok", resp.StatusCode == http.StatusTeapot)
+	return nil
+}
+
+func (tr *traceRequester) Clone() Requester {
+	return tr
+}
+
+func TestDryRun(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		w.Header().Set("X-Served-By", "test")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         20,
+		Writer:    &buf,
+		// which would fail every request of a run
+		Chaos: Chaos{Drop: 1},
+	}
+	if err := w.DryRun(); err != nil {
+		t.Fatalf("DryRun: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 request, got %d", count)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"> GET " + server.URL + " HTTP/1.1\n",
+		"> X-Trace: 1\n",
+		"< HTTP/1.1 418 I'm a teapot\n",
+		"< X-Served-By: test\n",
+		"= GET " + server.URL + ": status 418",
+		"= check ok: passed\n",
+		"1 results, 0 failed\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in trace:\n%s", want, out)
+		}
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&count, 1) == 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and\r\nstout\n"+strings.Repeat("x", 2*smokeBodyBytes))
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		Writer:    &buf,
+		Chaos:     Chaos{Drop: 1},
+	}
+	if err := w.Smoke(2); err != nil {
+		t.Fatalf("Smoke: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 requests, got %d", count)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"--- worker 1\n",
+		"--- worker 2\n",
+		"< HTTP/1.1 418 I'm a teapot\n",
+		"| short and\n| stout\n| xxx",
+		fmt.Sprintf("| ... %d more bytes\n", len("short and\r\nstout\n")+smokeBodyBytes),
+		"= check ok: passed\n",
+		"2 results, 0 failed; 2 checks, 0 failed\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in trace:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	if err := w.Smoke(1); err == nil {
+		t.Errorf("expected a failed check to fail Smoke:\n%s", buf.String())
+	} else if !strings.Contains(buf.String(), "= check ok: FAILED\n") {
+		t.Errorf("expected the failed check in trace:\n%s", buf.String())
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	defer func(d time.Duration) { healthRetryInterval = d }(healthRetryInterval)
+	healthRetryInterval = 10 * time.Millisecond
+
+	var probes int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// up from the third probe
+		if atomic.AddInt64(&probes, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	w := &Work{Requester: &traceRequester{server.URL}, HealthCheck: HealthCheckScript}
+	if err := w.CheckHealth(context.Background()); err == nil || !strings.Contains(err.Error(), "after 1 attempts") {
+		t.Errorf("expected a single failed probe, got %v", err)
+	}
+	w.HealthWait = time.Second
+	if err := w.CheckHealth(context.Background()); err != nil {
+		t.Errorf("expected the target to come up, got %s", err)
+	}
+	if n := atomic.LoadInt64(&probes); n != 3 {
+		t.Errorf("expected 3 probes, got %d", n)
+	}
+
+	// a URL must return 2xx, which the teapot doesn't
+	w = &Work{HealthCheck: server.URL + "/healthz", HealthWait: 50 * time.Millisecond}
+	err := w.CheckHealth(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "418 I'm a teapot") {
+		t.Errorf("expected the probe to fail with the status, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.HealthWait = time.Hour
+	if err := w.CheckHealth(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to end with the context, got %v", err)
+	}
+	if err := (&Work{}).CheckHealth(context.Background()); err != nil {
+		t.Errorf("expected no check without HealthCheck, got %s", err)
+	}
+}
+
+func TestTune(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		Writer:    &buf,
+	}
+	results, err := w.Tune(context.Background(), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Tune: %s", err)
+	}
+	if len(results) != 12 {
+		t.Fatalf("expected 12 configurations, got %d", len(results))
+	}
+	seen := make(map[TuneConfig]bool)
+	for i, r := range results {
+		seen[r.Config] = true
+		if r.NumRes == 0 || r.Errors != 0 {
+			t.Errorf("%s: expected successful requests, got %+v", r.Config, r)
+		}
+		if i > 0 && r.Rps > results[i-1].Rps {
+			t.Errorf("expected results fastest first, got %s after %s", r.Config, results[i-1].Config)
+		}
+	}
+	if len(seen) != 12 {
+		t.Errorf("expected every configuration to be tried once, got %v", seen)
+	}
+	for _, want := range []string{
+		"Configuration",
+		"-max-conns-per-host 1 -h2 -disable-compression",
+		"Fastest: " + results[0].Config.String() + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	var host, serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	w := &Work{
+		Requester: &testRequester{req, nil},
+		N:         1,
+		Host:      "www.example.com:8443",
+		Writer:    ioutil.Discard,
+	}
+	w.Run(context.Background())
+	if host != "www.example.com:8443" {
+		t.Errorf("expected Host www.example.com:8443, got %q", host)
+	}
+	if serverName != "www.example.com" {
+		t.Errorf("expected SNI www.example.com, got %q", serverName)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	var host, uri string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		uri = r.RequestURI
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL + "/staging/")
+	req, _ := http.NewRequest("GET", "https://www.example.com/v1/items?page=2", nil)
+	w := &Work{
+		Requester: &testRequester{req, nil},
+		N:         1,
+		BaseURL:   base,
+		Writer:    ioutil.Discard,
+	}
+	w.Run(context.Background())
+	if host != base.Host {
+		t.Errorf("expected Host %s, got %q", base.Host, host)
+	}
+	if uri != "/staging/v1/items?page=2" {
+		t.Errorf("expected /staging/v1/items?page=2, got %q", uri)
+	}
+}
+
+func TestRunID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester:  &traceRequester{server.URL},
+		N:          2,
+		Output:     "csv",
+		Writer:     &buf,
+		Tags:       map[string]string{"env": "staging"},
+		ReportDest: dir,
+	}
+	w.Run(context.Background())
+	if w.RunID == "" {
+		t.Fatalf("expected a run ID to be generated")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], ",run-id") {
+		t.Fatalf("unexpected CSV:\n%s", buf.String())
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasSuffix(line, ","+w.RunID) {
+			t.Errorf("expected row to end with the run ID: %s", line)
+		}
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.RunID != w.RunID || summary.Tags["env"] != "staging" {
+		t.Errorf("unexpected summary run ID %q and tags %v", summary.RunID, summary.Tags)
+	}
+
+	html, err := ioutil.ReadFile(filepath.Join(dir, "report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(html), "<!DOCTYPE html>") || !strings.Contains(string(html), w.RunID) {
+		t.Errorf("expected the HTML report of the run, got:\n%s", html)
+	}
+}
+
+func TestResume(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	w := &Work{
+		Requester:      &traceRequester{server.URL},
+		N:              3,
+		Writer:         ioutil.Discard,
+		CheckpointPath: path,
+	}
+	w.Run(context.Background())
+
+	cp, err := ReadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("ReadCheckpoint: %s", err)
+	}
+	if cp.RunID != w.RunID || cp.Iterations != 3 || cp.Requests != 3 {
+		t.Fatalf("unexpected checkpoint: %+v", cp)
+	}
+	malformed := filepath.Join(dir, "malformed")
+	if err := writeCheckpoint(malformed, &checkpointFile{RunID: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCheckpoint(malformed); err == nil || !strings.Contains(err.Error(), "expected 7 histograms, got 0") {
+		t.Errorf("expected a checkpoint without histograms to be rejected, got %v", err)
+	}
+
+	w = &Work{
+		Requester:      &traceRequester{server.URL},
+		N:              5,
+		Writer:         ioutil.Discard,
+		CheckpointPath: path,
+		ReportDest:     dir,
+		Resume:         cp,
+		Verbose:        true,
+	}
+	w.Run(context.Background())
+	if count := atomic.LoadInt64(&count); count != 5 {
+		t.Errorf("expected 5 requests across both runs, got %d", count)
+	}
+	if w.RunID != cp.RunID {
+		t.Errorf("expected the resumed run to keep run ID %q, got %q", cp.RunID, w.RunID)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Requests != 5 || summary.StatusCodeDist[200] != 5 {
+		t.Errorf("expected the summary to merge both runs' results: %+v", summary)
+	}
+	if len(summary.Checks) != 1 || summary.Checks[0].Fails != 5 {
+		t.Errorf("expected both runs' checks to be merged: %+v", summary.Checks)
+	}
+	// the resumed run's worker is new, rather than the first run's
+	workers := w.Report().Workers
+	if len(workers) != 2 || workers[0].ID != 1 || workers[0].NumRes != 3 || workers[1].ID != 2 || workers[1].NumRes != 2 {
+		t.Errorf("expected a worker per run, got %+v", workers)
+	}
+
+	// an RPS run goes on from the time of the checkpoint too
+	cp, err = ReadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("ReadCheckpoint: %s", err)
+	}
+	cp.Elapsed = time.Hour
+	w = &Work{
+		Requester: &traceRequester{server.URL},
+		RPS:       10,
+		Writer:    ioutil.Discard,
+		Resume:    cp,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+	r := w.Report()
+	if r.Total < time.Hour || r.Total > time.Hour+time.Minute {
+		t.Errorf("expected the run to total just over an hour, got %s", r.Total)
+	}
+	if r.NumRes <= 5 || r.Rps > float64(r.NumRes)/time.Hour.Seconds() {
+		t.Errorf("expected more requests, at a rate over the whole hour, got %d at %v", r.NumRes, r.Rps)
+	}
+}
+
+// slowStartRequester is a clockRequester taking 10ms a request, and
+// 200ms for the first, which is timed before targeting RPS.
+type slowStartRequester struct {
+	calls int64
+}
+
+func (s *slowStartRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	if atomic.AddInt64(&s.calls, 1) == 1 {
+		time.Sleep(200 * time.Millisecond)
+	} else {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return clockRequester{}.Do(ctx, c, r)
+}
+
+func (s *slowStartRequester) Clone() Requester {
+	return s
+}
+
+func TestRPSCalibration(t *testing.T) {
+	// the request timed to target RPS is before the run starts, for
+	// the clock, the results and the checkpoint alike
+	path := filepath.Join(t.TempDir(), "run.checkpoint")
+	w := &Work{
+		Requester:      &slowStartRequester{},
+		RPS:            10,
+		Output:         "csv",
+		Writer:         ioutil.Discard,
+		CheckpointPath: path,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+	r := w.Report()
+	if r.NumRes == 0 {
+		t.Fatalf("expected results")
+	}
+	for _, offset := range r.Offsets {
+		if offset < 0 || offset > r.Total.Seconds() {
+			t.Errorf("expected offsets within the run's %s, got %v", r.Total, r.Offsets)
+			break
+		}
+	}
+	cp, err := ReadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("ReadCheckpoint: %s", err)
+	}
+	if d := cp.Elapsed - r.Total; d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Errorf("expected the checkpoint to have run for %s too, got %s", r.Total, cp.Elapsed)
+	}
+}
+
+// varsRequester fetches the expvars from the pprof server of the run
+// it is part of.
+type varsRequester struct {
+	url  string
+	body []byte
+}
+
+func (vr *varsRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	resp, err := c.Get(vr.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	vr.body, err = ioutil.ReadAll(resp.Body)
+	return err
+}
+
+func (vr *varsRequester) Clone() Requester {
+	return vr
+}
+
+func TestCheckpointAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	results := make(chan *Result)
+	r := newReport(results)
+	var iterations int64
+	r.checkpointPath = path
+	r.iterations = &iterations
+	r.lastCheckpoint = now() - checkpointInterval
+	go runReporter(r)
+	// the first result is checkpointed while the rest are added
+	for i := 0; i < 1000; i++ {
+		results <- &Result{Worker: 1, Name: "GET /", StatusCode: 200, Duration: time.Millisecond}
+	}
+	close(results)
+	<-r.done
+	r.checkpoint()
+
+	cp, err := ReadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("ReadCheckpoint: %s", err)
+	}
+	if cp.Requests != 1000 || cp.state.Workers[1].NumRes != 1000 || cp.state.Hists[0].N != 1000 {
+		t.Errorf("expected the final checkpoint to have every result, got %+v", cp)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	vr := &varsRequester{url: "http://" + addr + "/debug/vars"}
+	w := &Work{
+		Requester: vr,
+		N:         1,
+		Writer:    ioutil.Discard,
+		PprofAddr: addr,
+	}
+	w.Run(context.Background())
+
+	var vars struct {
+		Hithere engineVars `json:"hithere"`
+	}
+	if err := json.Unmarshal(vr.body, &vars); err != nil {
+		t.Fatalf("json.Unmarshal: %s\n%s", err, vr.body)
+	}
+	if vars.Hithere.Workers != 1 || vars.Hithere.ResultsCapacity != maxResult {
+		t.Errorf("unexpected engine vars: %+v", vars.Hithere)
+	}
+
+	if _, err := http.Get("http://" + addr + "/debug/pprof/"); err == nil {
+		t.Errorf("expected the pprof server to be shut down with the run")
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         3,
+		Writer:    &buf,
+		Outputs: []Output{
+			{Format: "csv", Path: filepath.Join(dir, "results.csv")},
+			{Format: "json", Path: filepath.Join(dir, "summary.json")},
+			{Format: "html", Path: filepath.Join(dir, "report.html")},
+			{},
+		},
+	}
+	w.Run(context.Background())
+
+	if !strings.Contains(buf.String(), "Summary:") {
+		t.Errorf("expected the summary on Writer:\n%s", buf.String())
+	}
+	csv, err := ioutil.ReadFile(filepath.Join(dir, "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(csv)), "\n"); len(lines) != 4 {
+		t.Errorf("expected a header and 3 rows:\n%s", csv)
+	}
+	js, err := ioutil.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	if err := json.Unmarshal(js, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Requests != 3 {
+		t.Errorf("expected 3 requests in the JSON summary, got %d", summary.Requests)
+	}
+	html, err := ioutil.ReadFile(filepath.Join(dir, "report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "<h1>hithere report</h1>") || !strings.Contains(string(html), w.RunID) {
+		t.Errorf("unexpected HTML report:\n%s", html)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test-static", func(target string) (Requester, error) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &testRequester{req: req}, nil
+	})
+	r, err := New("test-static", "http://example.com/")
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if got := r.(*testRequester).req.URL.String(); got != "http://example.com/" {
+		t.Errorf("unexpected target %q", got)
+	}
+	if _, err := New("no-such-requester", ""); err == nil {
+		t.Errorf("expected an error for an unregistered requester")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a name twice to panic")
+		}
+	}()
+	Register("test-static", func(string) (Requester, error) { return nil, nil })
+}
+
+// recordingSink records the results and checks of a run.
+type recordingSink struct {
+	mu      sync.Mutex
+	results []*Result
+	checks  map[string]int
+	closed  bool
+}
+
+func (s *recordingSink) Result(res *Result) {
+	s.results = append(s.results, res)
+}
+
+func (s *recordingSink) Check(name string, passed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[name]++
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sink := &recordingSink{checks: make(map[string]int)}
+	var count int
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         4,
+		Writer:    ioutil.Discard,
+		Sinks:     []Sink{sink, SinkFunc(func(*Result) { count++ })},
+	}
+	w.Run(context.Background())
+
+	if !sink.closed {
+		t.Errorf("expected the sink to be closed")
+	}
+	if len(sink.results) != 4 || count != 4 {
+		t.Fatalf("expected 4 results in each sink, got %d and %d", len(sink.results), count)
+	}
+	for _, res := range sink.results {
+		if res.StatusCode != http.StatusOK || res.Worker == 0 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+	}
+	if sink.checks["ok"] != 4 {
+		t.Errorf("expected 4 checks, got %v", sink.checks)
+	}
+	if r := w.Report(); r == nil || r.NumRes != 4 {
+		t.Errorf("expected the built in report to still count the results")
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         1000,
+		Writer:    ioutil.Discard,
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected cancelling the context to cancel the outstanding request and end the run")
+	}
+	if w.Report() == nil {
+		t.Errorf("expected a report of the cancelled run")
+	}
+	// stopping a stopped run doesn't block
+	w.Stop()
+}
+
+// stopRequester calls stop on its nth call.
+type stopRequester struct {
+	calls *int64
+	n     int64
+	stop  func()
+}
+
+func (r stopRequester) Do(ctx context.Context, c *http.Client, reporter Reporter) error {
+	if atomic.AddInt64(r.calls, 1) == r.n {
+		r.stop()
+	}
+	return nil
+}
+
+func (r stopRequester) Clone() Requester {
+	return r
+}
+
+func TestStop(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(w *Work) func()
+	}{
+		{"Stop", func(w *Work) func() {
+			return func() {
+				// concurrent and repeated calls are safe
+				go w.Stop()
+				w.Stop()
+				w.Stop()
+			}
+		}},
+		{"stopWorkers", func(w *Work) func() {
+			return func() { w.stopWorkers(1) }
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int64
+			w := &Work{N: 1 << 30, Writer: ioutil.Discard}
+			w.Requester = stopRequester{&calls, 3, tc.stop(w)}
+			done := make(chan struct{})
+			go func() {
+				w.Run(context.Background())
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected stopping to end the run")
+			}
+			if calls != 3 {
+				t.Errorf("expected the worker to stop after its current request, made %d", calls)
+			}
+			w.Stop()
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         5,
+		Writer:    ioutil.Discard,
+	}
+	all := w.Subscribe(10)
+	small := w.Subscribe(2)
+	cancelled := w.Subscribe(10)
+	cancelled.Cancel()
+	w.Run(context.Background())
+
+	var n int
+	for res := range all.C {
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		n++
+	}
+	if n != 5 || all.Dropped() != 0 {
+		t.Errorf("expected all 5 results, got %d with %d dropped", n, all.Dropped())
+	}
+	n = 0
+	for range small.C {
+		n++
+	}
+	if n != 2 || small.Dropped() != 3 {
+		t.Errorf("expected 2 results and 3 dropped, got %d and %d", n, small.Dropped())
+	}
+	if _, ok := <-cancelled.C; ok {
+		t.Errorf("expected a cancelled subscription to be closed")
+	}
+	if _, ok := <-w.Subscribe(1).C; ok {
+		t.Errorf("expected subscribing to a finished run to be closed")
+	}
+}
+
+// recordingTransport adds a header to requests, and counts them.
+type recordingTransport struct {
+	rt    http.RoundTripper
+	count int64
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.count, 1)
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer mesh")
+	return t.rt.RoundTrip(req)
+}
+
+func (t *recordingTransport) Unwrap() http.RoundTripper {
+	return t.rt
+}
+
+func TestTransport(t *testing.T) {
+	var authorized int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer mesh" && r.Host == "api.example.com" {
+			atomic.AddInt64(&authorized, 1)
+		}
+	}))
+	defer server.Close()
+
+	rec := &recordingTransport{}
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         3,
+		Writer:    ioutil.Discard,
+		Host:      "api.example.com",
+		Transport: func(tr *http.Transport) http.RoundTripper {
+			tr.MaxConnsPerHost = 1
+			rec.rt = tr
+			return rec
+		},
+	}
+	w.Run(context.Background())
+	if rec.count != 3 || authorized != 3 {
+		t.Errorf("expected 3 requests through the transport, got %d (%d authorized)", rec.count, authorized)
+	}
+}
+
+func TestReset(t *testing.T) {
+	var count int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+	}))
+	defer server.Close()
+
+	w := &Work{
+		Requester: &traceRequester{server.URL},
+		N:         2,
+		Writer:    ioutil.Discard,
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			w.Reset()
+		}
+		w.Run(context.Background())
+		if r := w.Report(); r == nil || r.NumRes != 2 {
+			t.Fatalf("run %d: unexpected report %+v", i, r)
+		}
+		ids = append(ids, w.RunID)
+	}
+	if count := atomic.LoadInt64(&count); count != 6 {
+		t.Errorf("expected 6 requests over 3 runs, got %d", count)
+	}
+	if ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Errorf("expected each run to get a new ID: %v", ids)
+	}
+
+	w.RunID = "fixed"
+	w.Reset()
+	w.Run(context.Background())
+	if w.RunID != "fixed" {
+		t.Errorf("expected a set run ID to be kept, got %q", w.RunID)
+	}
+}
+
+// recordingMetrics records the metrics sent to a MetricsSink.
+type recordingMetrics struct {
+	intervals int64
+	requests  int64
+	report    *Report
+}
+
+func (m *recordingMetrics) Interval(iv *Interval) {
+	m.intervals++
+	m.requests += iv.NumRes
+}
+
+func (m *recordingMetrics) Report(r *Report) error {
+	m.report = r
+	return nil
+}
+
+func TestMetricsSinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	m := &recordingMetrics{}
+	w := &Work{
+		Requester:    &traceRequester{server.URL},
+		N:            5,
+		Interval:     10 * time.Millisecond,
+		Writer:       &buf,
+		Output:       "csv",
+		MetricsSinks: []MetricsSink{m},
+	}
+	w.Run(context.Background())
+
+	if m.report == nil || m.report.NumRes != 5 {
+		t.Fatalf("expected the final report, got %+v", m.report)
+	}
+	if m.intervals == 0 || m.requests != 5 {
+		t.Errorf("expected the intervals to add up to 5 requests, got %d in %d", m.requests, m.intervals)
+	}
+	if !strings.HasPrefix(buf.String(), "response-time,") {
+		t.Errorf("expected the csv output too, got %q", buf.String())
+	}
+}
+
+func TestPrometheusSink(t *testing.T) {
+	s, err := NewPrometheusSink("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.(*prometheusSink).addr
+	s.(LiveMetricsSink).Interval(&Interval{
+		NumRes:         3,
+		Rps:            1.5,
+		SizeTotal:      30,
+		ForcedCloses:   1,
+		Conns:          ConnStats{New: 1, Reused: 2, DNSLookups: 1, TLSHandshakes: 1},
+		ErrorDist:      map[string]int{"timeout": 1},
+		StatusCodeDist: map[int]int{200: 2},
+		LatencyDistribution: []LatencyDistribution{
+			{Percentage: 50, Latency: 0.25},
+			{Percentage: 99, Latency: 0.5},
+		},
+		RunID: `a"b`,
+		Tags:  map[string]string{"env-name": "ci"},
+	})
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		"# TYPE hithere_requests_total counter\n",
+		`hithere_requests_total{run_id="a\"b",env_name="ci"} 3` + "\n",
+		`hithere_errors_total{run_id="a\"b",env_name="ci"} 1` + "\n",
+		`hithere_forced_closes_total{run_id="a\"b",env_name="ci"} 1` + "\n",
+		`hithere_connections_total{run_id="a\"b",env_name="ci",reused="true"} 2` + "\n",
+		`hithere_tls_handshakes_total{run_id="a\"b",env_name="ci"} 1` + "\n",
+		`hithere_responses_total{run_id="a\"b",env_name="ci",code="200"} 2` + "\n",
+		`hithere_requests_per_second{run_id="a\"b",env_name="ci"} 1.5` + "\n",
+		`hithere_latency_seconds{run_id="a\"b",env_name="ci",quantile="0.99"} 0.5` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+
+	if err := s.Report(&Report{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Errorf("expected the server to be stopped by Report")
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewStatsDSink(conn.LocalAddr().String(), "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.(LiveMetricsSink).Interval(&Interval{
+		NumRes:              2,
+		Rps:                 2,
+		Average:             0.1,
+		StatusCodeDist:      map[int]int{200: 2},
+		LatencyDistribution: []LatencyDistribution{{Percentage: 90, Latency: 0.2}},
+		RunID:               "r1",
+	})
+	if err := s.Report(&Report{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, statsdMaxPacket)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"load.requests:2|c|#run_id:r1",
+		"load.errors:0|c|#run_id:r1",
+		"load.response_bytes:0|c|#run_id:r1",
+		"load.forced_closes:0|c|#run_id:r1",
+		"load.status.200:2|c|#run_id:r1",
+		"load.rps:2|g|#run_id:r1",
+		"load.latency.avg:100|g|#run_id:r1",
+		"load.latency.p90:200|g|#run_id:r1",
+	}, "\n")
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStatsDPackets(t *testing.T) {
+	line := strings.Repeat("x", 500)
+	packets := statsdPackets([]string{line, line, line, line})
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+	for _, p := range packets {
+		if len(p) > statsdMaxPacket {
+			t.Errorf("packet of %d bytes is too big", len(p))
+		}
+	}
+}
+
+// decodeSnappyLiterals decodes a snappy block made only of literals,
+// as snappyEncode writes them.
+func decodeSnappyLiterals(t *testing.T, block []byte) []byte {
+	t.Helper()
+	n, l := grpc.ConsumeVarint(block)
+	var out []byte
+	for b := block[l:]; len(b) > 0; {
+		tag := b[0]
+		size, rest := int(tag>>2)+1, b[1:]
+		switch {
+		case tag&3 != 0:
+			t.Fatalf("unexpected snappy tag %#x", tag)
+		case tag>>2 == 61:
+			size, rest = int(b[1])|int(b[2])<<8+1, b[3:]
+		case tag>>2 >= 60:
+			t.Fatalf("unexpected snappy literal tag %#x", tag)
+		}
+		out, b = append(out, rest[:size]...), rest[size:]
+	}
+	if uint64(len(out)) != n {
+		t.Fatalf("decoded %d bytes, expected %d", len(out), n)
+	}
+	return out
+}
+
+// decodeWriteRequest decodes the WriteRequest of a remote_write push
+// into its series, as name{labels} value@timestamp.
+func decodeWriteRequest(t *testing.T, body []byte) []string {
+	t.Helper()
+	var series []string
+	fields, err := grpc.ParseFields(decodeSnappyLiterals(t, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		ts, _ := grpc.ParseFields(f.Bytes)
+		var name string
+		var labels []string
+		var sample string
+		for _, tf := range ts {
+			// zero values are left out
+			var v [3]grpc.Field
+			sf, _ := grpc.ParseFields(tf.Bytes)
+			for _, f := range sf {
+				v[f.Num] = f
+			}
+			switch tf.Num {
+			case 1:
+				if string(v[1].Bytes) == "__name__" {
+					name = string(v[2].Bytes)
+				}
+				labels = append(labels, fmt.Sprintf("%s=%q", v[1].Bytes, v[2].Bytes))
+			case 2:
+				sample = fmt.Sprintf("%g@%d", math.Float64frombits(v[1].Scalar), v[2].Scalar)
+			}
+		}
+		series = append(series, fmt.Sprintf("%s{%s} %s", name, strings.Join(labels, ","), sample))
+	}
+	return series
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	defer func(d time.Duration) { remoteWriteBackoff = d }(remoteWriteBackoff)
+	remoteWriteBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var pushes [][]string
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		user, pass, _ := r.BasicAuth()
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" || user != "u" || pass != "key" {
+			http.Error(w, "bad headers", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes = append(pushes, decodeWriteRequest(t, body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s, err := NewRemoteWriteSink(strings.Replace(server.URL, "://", "://u:key@", 1) + "/api/v1/push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := &Interval{
+		NumRes:              2,
+		Rps:                 2,
+		StatusCodeDist:      map[int]int{200: 2},
+		LatencyDistribution: []LatencyDistribution{{Percentage: 90, Latency: 0.2}},
+		RunID:               "r1",
+		Tags:                map[string]string{"Env": "ci", "code": "x"},
+	}
+	s.(LiveMetricsSink).Interval(iv)
+	s.(LiveMetricsSink).Interval(iv)
+	if err := s.Report(&Report{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pushes) != 2 || attempts != 3 {
+		t.Fatalf("expected 2 pushes in 3 attempts, got %d in %d", len(pushes), attempts)
+	}
+	// the counters accumulate over the run
+	for i, want := range []string{
+		`hithere_requests_total{Env="ci",__name__="hithere_requests_total",job="hithere",run_id="r1",tag_code="x"} 2@`,
+		`hithere_requests_total{Env="ci",__name__="hithere_requests_total",job="hithere",run_id="r1",tag_code="x"} 4@`,
+	} {
+		if !strings.HasPrefix(pushes[i][0], want) {
+			t.Errorf("push %d: got %s, want %s", i, pushes[i][0], want)
+		}
+	}
+	got := strings.Join(pushes[1], "\n")
+	for _, want := range []string{
+		`hithere_responses_total{Env="ci",__name__="hithere_responses_total",code="200",job="hithere",run_id="r1",tag_code="x"} 4@`,
+		`hithere_requests_per_second{Env="ci",__name__="hithere_requests_per_second",job="hithere",run_id="r1",tag_code="x"} 2@`,
+		`hithere_latency_seconds{Env="ci",__name__="hithere_latency_seconds",job="hithere",quantile="0.9",run_id="r1",tag_code="x"} 0.2@`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s in:\n%s", want, got)
+		}
+	}
+
+	// a second run starts its counters again, rather than going on
+	// from the first's
+	iv.RunID = "r2"
+	s.(LiveMetricsSink).Interval(iv)
+	if err := s.Report(&Report{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushes) != 3 {
+		t.Fatalf("expected a third push, got %d", len(pushes))
+	}
+	if want := `hithere_requests_total{Env="ci",__name__="hithere_requests_total",job="hithere",run_id="r2",tag_code="x"} 2@`; !strings.HasPrefix(pushes[2][0], want) {
+		t.Errorf("second run: got %s, want %s", pushes[2][0], want)
+	}
+	if err := s.Report(&Report{}); err != nil {
+		t.Errorf("expected a run without intervals to push nothing, got %v", err)
+	}
+
+	// client errors aren't retried, and are returned by Report
+	s, err = NewRemoteWriteSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.(LiveMetricsSink).Interval(iv)
+	if err := s.Report(&Report{}); err == nil || !strings.Contains(err.Error(), "400 Bad Request: bad headers") {
+		t.Errorf("expected the push to fail, got %v", err)
+	}
+	if attempts != 5 {
+		t.Errorf("expected no retries, got %d attempts", attempts-4)
+	}
+
+	if _, err := NewRemoteWriteSink("localhost:9009"); err == nil {
+		t.Errorf("expected an error for a URL without a scheme")
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, n := range []int{0, 1, 60, 61, 70000} {
+		b := bytes.Repeat([]byte("x"), n)
+		if got := decodeSnappyLiterals(t, snappyEncode(b)); !bytes.Equal(got, b) {
+			t.Errorf("%d bytes: round trip got %d bytes", n, len(got))
+		}
+	}
+}
+
+// failRequester logs through its reporter and fails.
+type failRequester struct{}
+
+func (failRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	r.(LoggingReporter).Logger().Info("attempt")
+	return errors.New("boom")
+}
+
+func (f failRequester) Clone() Requester {
+	return f
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	w := &Work{
+		Requester: failRequester{},
+		N:         1,
+		Writer:    ioutil.Discard,
+		RunID:     "r1",
+		Logger:    slog.New(slog.NewTextHandler(&buf, nil)),
+	}
+	w.Run(context.Background())
+
+	for _, want := range []string{
+		`level=INFO msg=attempt run_id=r1 worker=1`,
+		`level=ERROR msg=requester.Do run_id=r1 worker=1 err=boom`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+// clockRequester reports a result at the time on its run's clock.
+type clockRequester struct{}
+
+func (clockRequester) Do(ctx context.Context, c *http.Client, r Reporter) error {
+	r.Start()
+	res := NewResult()
+	res.Offset = r.(ClockReporter).Clock().Now()
+	res.StatusCode = http.StatusOK
+	r.Finish(res)
+	return nil
+}
+
+func (c clockRequester) Clone() Requester {
+	return c
+}
+
+func TestClock(t *testing.T) {
+	// the offsets of each run are relative to its own start, however
+	// long after the others it runs
+	for i := 0; i < 2; i++ {
+		w := &Work{
+			Requester: clockRequester{},
+			N:         1,
+			Output:    "csv",
+			Writer:    ioutil.Discard,
+		}
+		w.Run(context.Background())
+		offsets := w.Report().Offsets
+		if len(offsets) != 1 || offsets[0] < 0 || offsets[0] >= 0.05 {
+			t.Errorf("run %d: expected an offset from the start of the run, got %v", i, offsets)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestSamples(t *testing.T) {
+	for _, test := range []struct {
+		output  string
+		outputs []Output
+		want    int
+	}{
+		{"", nil, 0},
+		{"json", nil, 0},
+		{"csv", nil, 3},
+		{"", []Output{{Format: "summary"}, {Format: "prometheus"}}, 0},
+		{"", []Output{{Format: "summary"}, {Format: "csv", Path: filepath.Join(t.TempDir(), "out.csv")}}, 3},
+	} {
+		w := &Work{
+			Requester: clockRequester{},
+			N:         3,
+			Output:    test.output,
+			Outputs:   test.outputs,
+			Writer:    ioutil.Discard,
+		}
+		w.Run(context.Background())
+		r := w.Report()
+		if r.NumRes != 3 || len(r.Lats) != test.want || len(r.Offsets) != test.want {
+			t.Errorf("%q %v: expected %d samples of 3 results, got %d of %d", test.output, test.outputs, test.want, len(r.Lats), r.NumRes)
+		}
+	}
+}
+
+// BenchmarkReporter measures the cost of aggregating a result, with
+// Results allocated for each request and reused with NewResult.
+func BenchmarkReporter(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		newResult func() *Result
+	}{
+		{"alloc", func() *Result { return &Result{} }},
+		{"pooled", NewResult},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			results := make(chan *Result, maxResult)
+			r := newReport(results)
+			go runReporter(r)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				res := bc.newResult()
+				res.StatusCode = http.StatusOK
+				res.Duration = time.Millisecond
+				res.ContentLength = 512
+				res.Worker = 1
+				res.Name = "GET http://localhost/"
+				results <- res
+			}
+			close(results)
+			<-r.done
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+// A Sink receives every result of a run alongside the built in report,
+// for custom aggregation, alternative storage or assertions in tests.
+// Result is called from a single goroutine, in the order results are
+// reported, and must not block for long or it holds up the report.
+// Close is called once the last result has been received.
+//
+// A Sink that also implements CheckReporter is told the outcome of
+// every check, from the workers' goroutines concurrently.
+type Sink interface {
+	Result(res *Result)
+	Close() error
+}
+
+// SinkFunc adapts a function to a Sink with nothing to close.
+type SinkFunc func(res *Result)
+
+func (f SinkFunc) Result(res *Result) {
+	f(res)
+}
+
+func (f SinkFunc) Close() error {
+	return nil
+}
+
+// checkSinks returns the sinks that are told about checks.
+func checkSinks(sinks []Sink) []CheckReporter {
+	var crs []CheckReporter
+	for _, s := range sinks {
+		if cr, ok := s.(CheckReporter); ok {
+			crs = append(crs, cr)
+		}
+	}
+	return crs
+}
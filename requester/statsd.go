@@ -0,0 +1,142 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// statsdMaxPacket keeps packets under the usual internet MTU.
+const statsdMaxPacket = 1432
+
+// statsdSink sends the metrics of each interval to a StatsD server.
+// The run ID and tags are sent as DogStatsD tags, which servers that
+// don't support them ignore or reject, so they're only added if set.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	// err is the first error sending metrics, returned by Report.
+	err error
+}
+
+var _ LiveMetricsSink = (*statsdSink)(nil)
+
+// NewStatsDSink returns a MetricsSink sending metrics named with
+// prefix to the StatsD server at the UDP address addr every interval.
+func NewStatsDSink(addr, prefix string) (MetricsSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, prefix: prefix}, nil
+}
+
+func (s *statsdSink) Interval(iv *Interval) {
+	tags := statsdTags(iv.RunID, iv.Tags)
+	var lines []string
+	add := func(name, value, typ string) {
+		lines = append(lines, fmt.Sprintf("%s.%s:%s|%s%s", s.prefix, name, value, typ, tags))
+	}
+
+	add("requests", fmt.Sprint(iv.NumRes), "c")
+	var errors int
+	for _, n := range iv.ErrorDist {
+		errors += n
+	}
+	add("errors", fmt.Sprint(errors), "c")
+	add("response_bytes", fmt.Sprint(iv.SizeTotal), "c")
+	add("forced_closes", fmt.Sprint(iv.ForcedCloses), "c")
+	if iv.Conns.Total() > 0 {
+		add("conns.new", fmt.Sprint(iv.Conns.New), "c")
+		add("conns.reused", fmt.Sprint(iv.Conns.Reused), "c")
+		add("dns_lookups", fmt.Sprint(iv.Conns.DNSLookups), "c")
+		add("tls_handshakes", fmt.Sprint(iv.Conns.TLSHandshakes), "c")
+	}
+	if iv.Cache.Total() > 0 {
+		add("cache.hits", fmt.Sprint(iv.Cache.Hits), "c")
+		add("cache.revalidated", fmt.Sprint(iv.Cache.Revalidated), "c")
+		add("cache.misses", fmt.Sprint(iv.Cache.Misses), "c")
+	}
+	codes := make([]int, 0, len(iv.StatusCodeDist))
+	for code := range iv.StatusCodeDist {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		add(fmt.Sprintf("status.%d", code), fmt.Sprint(iv.StatusCodeDist[code]), "c")
+	}
+	add("rps", fmt.Sprintf("%g", iv.Rps), "g")
+	if iv.NumRes > int64(errors) {
+		// in milliseconds, as StatsD timers are
+		add("latency.avg", fmt.Sprintf("%g", iv.Average*1000), "g")
+		for _, l := range reached(iv.LatencyDistribution) {
+			add(fmt.Sprintf("latency.p%d", l.Percentage), fmt.Sprintf("%g", l.Latency*1000), "g")
+		}
+	}
+
+	for _, packet := range statsdPackets(lines) {
+		if _, err := s.conn.Write(packet); err != nil {
+			if s.err == nil {
+				s.err = fmt.Errorf("statsd: %w", err)
+			}
+			return
+		}
+	}
+}
+
+// Report closes the connection, and returns the first error sending
+// metrics, if any.
+func (s *statsdSink) Report(r *Report) error {
+	if err := s.conn.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+	return s.err
+}
+
+// statsdPackets joins lines into as few packets as fit.
+func statsdPackets(lines []string) [][]byte {
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
+
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", ":", "_", "#", "_")
+
+// statsdTags returns the run ID and tags in the DogStatsD format.
+func statsdTags(runID string, tags map[string]string) string {
+	var ts []string
+	if runID != "" {
+		ts = append(ts, "run_id:"+statsdTagEscaper.Replace(runID))
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ts = append(ts, statsdTagEscaper.Replace(k)+":"+statsdTagEscaper.Replace(tags[k]))
+	}
+	if len(ts) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(ts, ",")
+}
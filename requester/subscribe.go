@@ -0,0 +1,103 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A Subscription delivers the results of a run on C as they are
+// reported, for live analysis by embedding code.  The results are
+// shared with the report, and must not be modified.  Results are never
+// waited on: if C's buffer is full they are dropped, and counted by
+// Dropped.  C is closed once the run has finished, or the
+// subscription is cancelled.
+type Subscription struct {
+	C <-chan *Result
+
+	c       chan *Result
+	subs    *subscriptions
+	dropped int64
+}
+
+// Dropped returns the number of results that C's buffer had no room
+// for.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Cancel stops delivering results, and closes C.
+func (s *Subscription) Cancel() {
+	s.subs.remove(s)
+}
+
+// Subscribe returns a subscription to the results of the run, with a
+// buffer of size results.  It may be called before or during Run.
+func (b *Work) Subscribe(size int) *Subscription {
+	b.Init()
+	return b.subs.add(size)
+}
+
+// subscriptions are the subscribers to a run's results.  publish is
+// only called from the reporter goroutine, but subscribers come and go
+// from any.
+type subscriptions struct {
+	mu     sync.Mutex
+	subs   []*Subscription
+	closed bool
+}
+
+func (ss *subscriptions) add(size int) *Subscription {
+	c := make(chan *Result, size)
+	s := &Subscription{C: c, c: c, subs: ss}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		close(c)
+	} else {
+		ss.subs = append(ss.subs, s)
+	}
+	return s
+}
+
+func (ss *subscriptions) remove(s *Subscription) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i, sub := range ss.subs {
+		if sub == s {
+			ss.subs = append(ss.subs[:i], ss.subs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// publish sends res to the subscribers, and returns whether there were
+// any.
+func (ss *subscriptions) publish(res *Result) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.subs {
+		select {
+		case s.c <- res:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+	return len(ss.subs) > 0
+}
+
+// close closes every subscription once the run is done.
+func (ss *subscriptions) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.subs {
+		close(s.c)
+	}
+	ss.subs = nil
+	ss.closed = true
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bpowers/hithere/upload"
+)
+
+// Summary is the JSON-friendly subset of a Report: its aggregate
+// statistics, without the per-request data.  Durations are in seconds.
+type Summary struct {
+	RunID string            `json:"run_id,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+
+	Total     float64 `json:"total"`
+	Requests  int64   `json:"requests"`
+	Rps       float64 `json:"rps"`
+	Fastest   float64 `json:"fastest"`
+	Slowest   float64 `json:"slowest"`
+	Average   float64 `json:"average"`
+	SizeTotal int64   `json:"size_total"`
+	SizeReq   int64   `json:"size_req"`
+	// Throughput is in bytes/sec.
+	Throughput float64 `json:"throughput"`
+	// ForcedCloses counts responses whose connections couldn't be
+	// reused because their bodies weren't read to the end.
+	ForcedCloses int64 `json:"forced_closes,omitempty"`
+	// Connections is missing if the Requester doesn't trace its
+	// connections.
+	Connections *ConnStats `json:"connections,omitempty"`
+	// Cache is missing if the HTTP cache wasn't used, see Work.Cache.
+	Cache *CacheStats `json:"cache,omitempty"`
+
+	LatencyDistribution []LatencyDistribution `json:"latency_distribution"`
+	TTFBDistribution    []LatencyDistribution `json:"ttfb_distribution"`
+	// Phases maps each phase of a request to its percentiles.
+	Phases         map[string][]LatencyDistribution `json:"phases,omitempty"`
+	StatusCodeDist map[int]int                      `json:"status_code_dist"`
+	ErrorDist      map[string]int                   `json:"error_dist"`
+
+	Endpoints []EndpointSummary `json:"endpoints,omitempty"`
+	Checks    []CheckSummary    `json:"checks,omitempty"`
+}
+
+// EndpointSummary is the JSON form of EndpointStats.
+type EndpointSummary struct {
+	Name      string `json:"name"`
+	Requests  int64  `json:"requests"`
+	SizeTotal int64  `json:"size_total"`
+	SizeReq   int64  `json:"size_req"`
+}
+
+// CheckSummary is the JSON form of CheckStats.
+type CheckSummary struct {
+	Name   string  `json:"name"`
+	Passes int64   `json:"passes"`
+	Fails  int64   `json:"fails"`
+	Rate   float64 `json:"rate"`
+}
+
+// Summary returns the aggregate statistics of r.
+func (r *Report) Summary() *Summary {
+	var endpoints []EndpointSummary
+	for _, e := range r.Endpoints {
+		endpoints = append(endpoints, EndpointSummary{
+			Name:      e.Name,
+			Requests:  e.NumRes,
+			SizeTotal: e.SizeTotal,
+			SizeReq:   e.SizeReq,
+		})
+	}
+	var checks []CheckSummary
+	for _, c := range r.Checks {
+		checks = append(checks, CheckSummary{
+			Name:   c.Name,
+			Passes: c.Passes,
+			Fails:  c.Fails,
+			Rate:   c.Rate,
+		})
+	}
+	var phases map[string][]LatencyDistribution
+	if len(r.PhaseDistributions) > 0 {
+		phases = make(map[string][]LatencyDistribution, len(r.PhaseDistributions))
+		for _, p := range r.PhaseDistributions {
+			phases[p.Phase] = p.Percentiles
+		}
+	}
+	var conns *ConnStats
+	if r.Conns.Total() > 0 {
+		conns = &r.Conns
+	}
+	var cache *CacheStats
+	if r.Cache.Total() > 0 {
+		cache = &r.Cache
+	}
+	return &Summary{
+		RunID:               r.RunID,
+		Tags:                r.Tags,
+		Total:               r.Total.Seconds(),
+		Requests:            r.NumRes,
+		Rps:                 r.Rps,
+		Fastest:             r.Fastest,
+		Slowest:             r.Slowest,
+		Average:             r.Average,
+		SizeTotal:           r.SizeTotal,
+		SizeReq:             r.SizeReq,
+		Throughput:          r.Throughput,
+		ForcedCloses:        r.ForcedCloses,
+		Connections:         conns,
+		Cache:               cache,
+		LatencyDistribution: reached(r.LatencyDistribution),
+		TTFBDistribution:    reached(r.TTFBDistribution),
+		Phases:              phases,
+		StatusCodeDist:      r.StatusCodeDist,
+		ErrorDist:           r.ErrorDist,
+		Endpoints:           endpoints,
+		Checks:              checks,
+	}
+}
+
+// reached filters out the percentiles that weren't reached, which
+// latencies leaves zeroed.
+func reached(dist []LatencyDistribution) []LatencyDistribution {
+	var res []LatencyDistribution
+	for _, l := range dist {
+		if l.Percentage > 0 {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// uploadReports stores the artifacts of a finished run at dest: the
+// human-readable summary, the JSON summary, the HTML report and the raw
+// per-request CSV.
+func uploadReports(dest string, snapshot Report) error {
+	u, err := upload.New(dest)
+	if err != nil {
+		return err
+	}
+
+	summary, err := render("", snapshot)
+	if err != nil {
+		return fmt.Errorf("render summary: %w", err)
+	}
+	csv, err := render("csv", snapshot)
+	if err != nil {
+		return fmt.Errorf("render csv: %w", err)
+	}
+	js, err := render("json", snapshot)
+	if err != nil {
+		return fmt.Errorf("render json: %w", err)
+	}
+	html, err := render("html", snapshot)
+	if err != nil {
+		return fmt.Errorf("render html: %w", err)
+	}
+
+	artifacts := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"summary.txt", "text/plain; charset=utf-8", []byte(summary)},
+		{"summary.json", "application/json", []byte(js)},
+		{"report.html", "text/html; charset=utf-8", []byte(html)},
+		{"results.csv", "text/csv", []byte(csv)},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, a := range artifacts {
+		if err := u.Put(ctx, a.name, a.body, a.contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify POSTs the JSON summary of a finished run to url.
+func notify(url string, s *Summary) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Do: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package requester
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// tuneWorkers is how many requests Tune keeps in flight, which bounds
+// how many connections per host are worth trying.
+const tuneWorkers = 64
+
+// tuneConnsPerHost are the connection limits Tune tries.
+var tuneConnsPerHost = []int{1, 8, tuneWorkers}
+
+// A TuneConfig is one configuration of the client tried by Tune.
+type TuneConfig struct {
+	MaxConnsPerHost    int
+	H2                 bool
+	DisableCompression bool
+}
+
+// String returns the hey flags that select c.
+func (c TuneConfig) String() string {
+	flags := []string{fmt.Sprintf("-max-conns-per-host %d", c.MaxConnsPerHost)}
+	if c.H2 {
+		flags = append(flags, "-h2")
+	}
+	if c.DisableCompression {
+		flags = append(flags, "-disable-compression")
+	}
+	return strings.Join(flags, " ")
+}
+
+// A TuneResult is the throughput the Requester achieved with one
+// client configuration.
+type TuneResult struct {
+	Config TuneConfig
+	NumRes int64
+	Errors int64
+	Rps    float64
+	// Average is the mean latency of successful requests, in seconds.
+	Average float64
+}
+
+// Tune runs the Requester for d with each of a sweep of client
+// configurations (connections per host, HTTP/1.1 or HTTP/2, and
+// compression) instead of generating load, to find which lets this
+// machine generate the most throughput against the target.  It writes
+// a table of the results to Writer, and returns them fastest first.
+// The other settings of the run, like Host and Timeout, apply to every
+// configuration.
+func (b *Work) Tune(ctx context.Context, d time.Duration) ([]TuneResult, error) {
+	if b.log == nil {
+		b.setLogger()
+	}
+	var results []TuneResult
+	for _, conns := range tuneConnsPerHost {
+		for _, h2 := range []bool{false, true} {
+			for _, disableCompression := range []bool{false, true} {
+				cfg := TuneConfig{MaxConnsPerHost: conns, H2: h2, DisableCompression: disableCompression}
+				results = append(results, b.tuneOne(ctx, cfg, d))
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rps > results[j].Rps })
+
+	tw := tabwriter.NewWriter(b.writer(), 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Configuration\tRequests/sec\tAverage\tErrors\n")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%.1f\t%.4f secs\t%d\n", r.Config, r.Rps, r.Average, r.Errors)
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if len(results) > 0 && results[0].NumRes > results[0].Errors {
+		fmt.Fprintf(b.writer(), "\nFastest: %s\n", results[0].Config)
+	}
+	return results, nil
+}
+
+// tuneOne runs the Requester for d with cfg from tuneWorkers workers.
+func (b *Work) tuneOne(ctx context.Context, cfg TuneConfig, d time.Duration) TuneResult {
+	w := &Work{
+		Requester:          b.Requester,
+		Timeout:            b.Timeout,
+		UserAgent:          b.UserAgent,
+		Host:               b.Host,
+		BaseURL:            b.BaseURL,
+		ProxyAddr:          b.ProxyAddr,
+		Transport:          b.Transport,
+		H2:                 cfg.H2,
+		H2C:                b.H2C,
+		DisableCompression: cfg.DisableCompression,
+		DisableKeepAlives:  b.DisableKeepAlives,
+		MaxConnsPerHost:    cfg.MaxConnsPerHost,
+		log:                b.log.With("config", cfg.String()),
+	}
+	client := w.newClient()
+	defer client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	reporter := &tuneReporter{ctx: ctx, userAgent: b.UserAgent, hooks: b.Hooks, clock: NewClock()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < tuneWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := w.Requester.Clone().Do(ctx, client, reporter); err != nil && ctx.Err() == nil {
+					w.log.Error("requester.Do", "err", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	r := reporter.result()
+	r.Config = cfg
+	r.Rps = float64(r.NumRes) / d.Seconds()
+	return r
+}
+
+// tuneReporter counts the results that complete before its context is
+// done; requests cut short by the end of a configuration's turn aren't
+// counted against it.
+type tuneReporter struct {
+	ctx       context.Context
+	userAgent string
+	hooks     []Hook
+	clock     *Clock
+
+	mu       sync.Mutex
+	numRes   int64
+	errors   int64
+	latTotal time.Duration
+}
+
+var (
+	_ Reporter      = (*tuneReporter)(nil)
+	_ CheckReporter = (*tuneReporter)(nil)
+	_ HookReporter  = (*tuneReporter)(nil)
+	_ ClockReporter = (*tuneReporter)(nil)
+)
+
+func (r *tuneReporter) Start() {}
+
+func (r *tuneReporter) Finish(res *Result) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.numRes++
+	if res.Err != nil {
+		r.errors++
+	} else {
+		r.latTotal += res.Duration
+	}
+}
+
+func (r *tuneReporter) UserAgent() string {
+	return r.userAgent
+}
+
+func (r *tuneReporter) Hooks() []Hook {
+	return r.hooks
+}
+
+func (r *tuneReporter) Clock() *Clock {
+	return r.clock
+}
+
+// Check ignores checks, which have no bearing on throughput.
+func (r *tuneReporter) Check(name string, passed bool) {}
+
+func (r *tuneReporter) result() TuneResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := TuneResult{NumRes: r.numRes, Errors: r.errors}
+	if n := r.numRes - r.errors; n > 0 {
+		res.Average = r.latTotal.Seconds() / float64(n)
+	}
+	return res
+}
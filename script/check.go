@@ -0,0 +1,36 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// fnCheck implements check(name, condition), which records whether
+// condition is true under name and returns it.  Unlike
+// raise_for_status, a failed check doesn't end the request; failures
+// are tallied in the report's pass rates instead.
+func fnCheck(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	tls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || tls == nil {
+		return starlark.None, fmt.Errorf("check can't be used at top level, only in function bodies")
+	}
+
+	var name string
+	var cond starlark.Value
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "condition", &cond); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	passed := cond.Truth()
+	if cr, ok := tls.reporter.(requester.CheckReporter); ok {
+		cr.Check(name, bool(passed))
+	}
+	return passed, nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// dnsMaxUDPSize is the largest UDP response we accept; anything
+// bigger should come back truncated and be retried over TCP.
+const dnsMaxUDPSize = 4096
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+var dnsRCodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+var dnsResponseAttrs = []string{
+	"rcode",     // str, e.g. "NOERROR" or "NXDOMAIN"
+	"ok",        // bool
+	"answers",   // List[str]
+	"truncated", // bool
+}
+
+type dnsModule struct {
+	Module
+}
+
+// DNSModule returns the dns module.  dns.query(server, name, type="A",
+// tcp=False) sends a single query to server, a resolver's host:port,
+// and reports it as a result whose status code is the response's
+// RCODE.  The request rate is controlled like any other script's, with
+// -rps.
+func DNSModule() *dnsModule {
+	m := &dnsModule{
+		Module: Module{
+			Name:  "dns",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["query"] = starlark.NewBuiltin("dns.query", m.fnQuery)
+
+	return m
+}
+
+func (m *dnsModule) fnQuery(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("dns can't be used at top level, only in function bodies")
+	}
+
+	var server, name string
+	typ := "A"
+	var useTCP bool
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "server", &server, "name", &name, "type?", &typ, "tcp?", &useTCP); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	qtype, ok := dnsTypes[strings.ToUpper(typ)]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported query type %q", fn.Name(), typ)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	id := uint16(stls.rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	stls.count++
+	stls.reporter.Start()
+	s := stls.clock.Now()
+	resp, hdr, err := dnsExchange(stls, server, query, id, useTCP)
+	if err == nil && hdr.Truncated && !useTCP {
+		resp, hdr, err = dnsExchange(stls, server, query, id, true)
+	}
+	var answers []starlark.Value
+	if err == nil {
+		answers, err = dnsAnswers(resp)
+	}
+	code := 0
+	if err == nil {
+		code = int(hdr.RCode)
+	}
+	stls.reporter.Finish(&requester.Result{
+		Offset:        s,
+		StatusCode:    code,
+		Duration:      stls.clock.Now() - s,
+		Err:           err,
+		ContentLength: int64(len(resp)),
+		Name:          "DNS " + strings.ToUpper(typ) + " @" + server,
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	return &dnsResponse{hdr: hdr, answers: starlark.NewList(answers)}, nil
+}
+
+// dnsExchange sends query and waits for the matching response.
+func dnsExchange(stls *scriptTls, server string, query []byte, id uint16, useTCP bool) ([]byte, dnsmessage.Header, error) {
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{Timeout: stls.client.Timeout}
+	conn, err := dialer.DialContext(stls.ctx, network, server)
+	if err != nil {
+		return nil, dnsmessage.Header{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline(stls.ctx, stls.client.Timeout))
+
+	var resp []byte
+	if useTCP {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(query)))
+		if _, err := conn.Write(append(l[:], query...)); err != nil {
+			return nil, dnsmessage.Header{}, err
+		}
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, dnsmessage.Header{}, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, dnsmessage.Header{}, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, dnsmessage.Header{}, err
+		}
+		buf := make([]byte, dnsMaxUDPSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, dnsmessage.Header{}, err
+			}
+			// ignore stray datagrams, e.g. late responses to an
+			// earlier query on a reused port
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				resp = buf[:n]
+				break
+			}
+		}
+	}
+
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return nil, dnsmessage.Header{}, err
+	}
+	if hdr.ID != id || !hdr.Response {
+		return nil, dnsmessage.Header{}, fmt.Errorf("mismatched DNS response")
+	}
+	return resp, hdr, nil
+}
+
+// dnsAnswers returns the answer records of resp as strings: addresses
+// for A and AAAA, "priority weight port target" for SRV, and so on.
+func dnsAnswers(resp []byte) ([]starlark.Value, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	var answers []starlark.Value
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return answers, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var answer string
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = net.IP(r.A[:]).String()
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = net.IP(r.AAAA[:]).String()
+		case dnsmessage.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = r.CNAME.String()
+		case dnsmessage.TypeMX:
+			r, err := p.MXResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = fmt.Sprintf("%d %s", r.Pref, r.MX)
+		case dnsmessage.TypeNS:
+			r, err := p.NSResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = r.NS.String()
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+		case dnsmessage.TypeTXT:
+			r, err := p.TXTResource()
+			if err != nil {
+				return nil, err
+			}
+			answer = strings.Join(r.TXT, "")
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		answers = append(answers, starlark.String(answer))
+	}
+}
+
+type dnsResponse struct {
+	hdr     dnsmessage.Header
+	answers *starlark.List
+}
+
+var _ starlark.HasAttrs = (*dnsResponse)(nil)
+
+func (r *dnsResponse) String() string        { return fmt.Sprintf("<dns.response %s>", r.rcode()) }
+func (r *dnsResponse) Type() string          { return "dns.response" }
+func (r *dnsResponse) Freeze()               { r.answers.Freeze() }
+func (r *dnsResponse) Truth() starlark.Bool  { return starlark.True }
+func (r *dnsResponse) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", r.Type()) }
+func (r *dnsResponse) AttrNames() []string   { return dnsResponseAttrs }
+
+func (r *dnsResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "rcode":
+		return starlark.String(r.rcode()), nil
+	case "ok":
+		return starlark.Bool(r.hdr.RCode == dnsmessage.RCodeSuccess), nil
+	case "answers":
+		return r.answers, nil
+	case "truncated":
+		return starlark.Bool(r.hdr.Truncated), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (r *dnsResponse) rcode() string {
+	if s, ok := dnsRCodes[r.hdr.RCode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", r.hdr.RCode)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+type envModule struct {
+	Module
+	env map[string]string
+}
+
+// EnvModule returns the env module, for reading settings that differ
+// between environments, like base URLs and credentials.
+// env.get(name, default=None) returns a variable from the process
+// environment or, failing that, from env, typically read from a .env
+// file with ReadEnvFile.  Unlike most modules it can be used at the top
+// level of a script.
+func EnvModule(env map[string]string) *envModule {
+	m := &envModule{
+		Module: Module{
+			Name:  "env",
+			Attrs: starlark.StringDict{},
+		},
+		env: env,
+	}
+
+	m.Attrs["get"] = starlark.NewBuiltin("env.get", m.fnGet)
+
+	return m
+}
+
+func (m *envModule) lookup(name string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := m.env[name]
+	return v, ok
+}
+
+func (m *envModule) fnGet(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "default?", &def); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if v, ok := m.lookup(name); ok {
+		return starlark.String(v), nil
+	}
+	return def, nil
+}
+
+// vars returns the variables from the env file, with values from the
+// process environment taking precedence, as a dict for ctx.vars.
+func (m *envModule) vars() *starlark.Dict {
+	names := make([]string, 0, len(m.env))
+	for name := range m.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := starlark.NewDict(len(names))
+	for _, name := range names {
+		v, _ := m.lookup(name)
+		d.SetKey(starlark.String(name), starlark.String(v))
+	}
+	return d
+}
+
+// ReadEnvFile reads the variables in a .env file: "NAME=value" lines,
+// optionally prefixed with "export", with "#" comments.  Values may be
+// double-quoted, with Go escapes, or single-quoted to be taken
+// literally.
+func ReadEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			// drop a comment after the closing quote
+			if j := strings.LastIndexByte(value, '"'); j > 0 {
+				value = value[:j+1]
+			}
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: malformed value for %s", path, n, name)
+			}
+			value = v
+		case strings.HasPrefix(value, "'"):
+			j := strings.IndexByte(value[1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("%s:%d: malformed value for %s", path, n, name)
+			}
+			value = value[1 : j+1]
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		env[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	return env, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithFileReader reads the script, and the modules it loads, with r
+// rather than from the local filesystem, in which case the filename
+// given to New is the path of the script within r.
+func WithFileReader(r FileReader) Option {
+	return func(o *options) {
+		o.fileReader = r
+	}
+}
+
+type fsFileReader struct {
+	fsys fs.FS
+	root string
+}
+
+// FSFileReader returns a FileReader that reads files from fsys, such
+// as an embed.FS bundled into a program, resolving the modules scripts
+// load relative to root.
+func FSFileReader(fsys fs.FS, root string) FileReader {
+	return &fsFileReader{fsys, root}
+}
+
+func (r *fsFileReader) Resolve(ctx context.Context, name, fromPath string) (string, error) {
+	if fromPath == "" {
+		return path.Clean(name), nil
+	}
+	return path.Join(r.root, path.Clean("/" + name)[1:]), nil
+}
+
+func (r *fsFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, path)
+}
+
+var (
+	registeredFSMu sync.Mutex
+	registeredFS   = make(map[string]fs.FS)
+)
+
+// RegisterFS makes the scripts in fsys available to New, and so to the
+// command line, as scheme:path, e.g. for a bundle embedded into a
+// custom build.  It panics if scheme is already registered, or is one
+// of the built in "file", "zip" or "git+..." schemes.
+func RegisterFS(scheme string, fsys fs.FS) {
+	if scheme == "file" || scheme == "zip" || strings.HasPrefix(scheme, "git+") {
+		panic(fmt.Sprintf("script: RegisterFS of built in scheme %q", scheme))
+	}
+	registeredFSMu.Lock()
+	defer registeredFSMu.Unlock()
+	if _, ok := registeredFS[scheme]; ok {
+		panic(fmt.Sprintf("script: RegisterFS called twice for %q", scheme))
+	}
+	registeredFS[scheme] = fsys
+}
+
+// uriScheme returns the scheme of name if it is a URI rather than a
+// path.  Single letters are Windows drives, not schemes.
+func uriScheme(name string) string {
+	i := strings.IndexByte(name, ':')
+	if i < 2 {
+		return ""
+	}
+	for _, c := range name[:i] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return ""
+		}
+	}
+	return name[:i]
+}
+
+// openFileReader returns the FileReader for the script named by name,
+// selected by its scheme, and the script's path within it:
+//
+//	main.star, file:///abs/main.star    the local filesystem
+//	zip://bundle.zip//main.star         a zip archive of scripts
+//	git+https://host/repo.git//main.star?ref=v1
+//	                                    a (shallow) clone of a git repo
+//	scheme:main.star                    an FS given to RegisterFS
+//
+// close releases whatever was opened, once the script is loaded.
+func openFileReader(name string) (r FileReader, filename string, close func() error, err error) {
+	nop := func() error { return nil }
+	scheme := uriScheme(name)
+	switch {
+	case scheme == "":
+		return LocalFileReader(filepath.Dir(name)), name, nop, nil
+	case scheme == "file":
+		u, err := url.Parse(name)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("url.Parse: %w", err)
+		}
+		filename := filepath.FromSlash(u.Path)
+		return LocalFileReader(filepath.Dir(filename)), filename, nop, nil
+	case scheme == "zip":
+		archive, filename, err := splitSubpath(strings.TrimPrefix(name, "zip://"))
+		if err != nil {
+			return nil, "", nil, err
+		}
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("zip.OpenReader: %w", err)
+		}
+		return FSFileReader(zr, path.Dir(filename)), filename, zr.Close, nil
+	case strings.HasPrefix(scheme, "git+"):
+		return openGit(name)
+	}
+
+	registeredFSMu.Lock()
+	fsys, ok := registeredFS[scheme]
+	registeredFSMu.Unlock()
+	if !ok {
+		return nil, "", nil, fmt.Errorf("no FileReader for scheme %q", scheme)
+	}
+	filename = path.Clean(strings.TrimPrefix(strings.TrimPrefix(name, scheme+":"), "//"))
+	return FSFileReader(fsys, path.Dir(filename)), filename, nop, nil
+}
+
+// splitSubpath splits location//path into the location and the path
+// of the script within it, which mustn't lead out of it.
+func splitSubpath(s string) (location, subpath string, err error) {
+	i := strings.Index(s, "//")
+	if i <= 0 || i+2 == len(s) {
+		return "", "", fmt.Errorf("expected location//path/to/script.star, got %q", s)
+	}
+	subpath = path.Clean(s[i+2:])
+	if subpath == ".." || strings.HasPrefix(subpath, "../") {
+		return "", "", fmt.Errorf("%q is outside %s", s[i+2:], s[:i])
+	}
+	return s[:i], subpath, nil
+}
+
+// openGit clones the repository of a git+<transport>://repo//path?ref=
+// URI into a temporary directory, removed by close.
+func openGit(name string) (r FileReader, filename string, close func() error, err error) {
+	repo := strings.TrimPrefix(name, "git+")
+	var ref string
+	if i := strings.LastIndexByte(repo, '?'); i >= 0 {
+		q, err := url.ParseQuery(repo[i+1:])
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("url.ParseQuery: %w", err)
+		}
+		ref = q.Get("ref")
+		repo = repo[:i]
+	}
+	i := strings.Index(repo, "://")
+	if i < 0 {
+		return nil, "", nil, fmt.Errorf("expected git+<transport>://, got %q", name)
+	}
+	location, subpath, err := splitSubpath(repo[i+3:])
+	if err != nil {
+		return nil, "", nil, err
+	}
+	repo = repo[:i+3] + location
+
+	dir, err := ioutil.TempDir("", "hithere-git")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", repo, dir)
+	if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, fmt.Errorf("git clone %s: %w: %s", repo, err, strings.TrimSpace(string(out)))
+	}
+	filename = filepath.Join(dir, filepath.FromSlash(subpath))
+	return LocalFileReader(filepath.Dir(filename)), filename, func() error { return os.RemoveAll(dir) }, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+	"github.com/bpowers/hithere/script/starlarkjson"
+)
+
+// operationNameRe matches the name of the first named operation in a
+// GraphQL document.
+var operationNameRe = regexp.MustCompile(`(?m)^\s*(?:query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+
+// fnRequestsGraphQL implements requests.graphql(url, query,
+// variables=None, operation_name=None, headers=None).  Results are
+// named after the operation so each query gets its own latency
+// breakdown, and a 200 response that carries GraphQL errors is
+// reported as a failure.
+func (r *requestsModule) fnRequestsGraphQL(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	tls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || tls == nil {
+		return starlark.None, fmt.Errorf("requests can't be used at top level, only in function bodies")
+	}
+
+	var url, query, operationName string
+	var variables starlark.Value = starlark.None
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &url, "query", &query, "variables?", &variables, "operation_name?", &operationName, "headers?", &headers); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	payload := struct {
+		Query         string          `json:"query"`
+		OperationName string          `json:"operationName,omitempty"`
+		Variables     json.RawMessage `json:"variables,omitempty"`
+	}{
+		Query:         query,
+		OperationName: operationName,
+	}
+	if variables != starlark.None {
+		encode := starlarkjson.Module.Members["encode"].(*starlark.Builtin)
+		v, err := starlarkjson.Encode(t, encode, starlark.Tuple{variables}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: variables: %w", fn.Name(), err)
+		}
+		payload.Variables = json.RawMessage(v.(starlark.String))
+	}
+	body, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	req, err := newRequest(tls.ctx, "POST", url, body, tls.compressRequests)
+	if err != nil {
+		return starlark.None, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if headers != nil {
+		if err := setHeaders(req, headers); err != nil {
+			return nil, err
+		}
+	}
+	if req.Header.Get("content-type") == "" {
+		req.Header.Set("content-type", "application/json")
+	}
+	req.Header.Set("user-agent", tls.reporter.UserAgent())
+
+	name := operationName
+	if name == "" {
+		if m := operationNameRe.FindStringSubmatch(query); m != nil {
+			name = m[1]
+		} else {
+			name = "(anonymous)"
+		}
+	}
+
+	tls.count++
+	resp, err := instrument(tls.client, req, tls.reporter, tls.clock, tls.maxBodyBytes, func(resp *response, res *requester.Result) {
+		res.Name = "GRAPHQL " + name
+		if resp.resp.StatusCode == http.StatusOK {
+			res.Err = graphqlError(resp.body)
+		}
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("r.c.Do: %w", err)
+	}
+
+	return resp, nil
+}
+
+// graphqlError returns the errors in a GraphQL response body, if any.
+func graphqlError(body []byte) error {
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("graphql: malformed response: %w", err)
+	}
+	switch len(result.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("graphql: %s", result.Errors[0].Message)
+	}
+	return fmt.Errorf("graphql: %s (and %d more errors)", result.Errors[0].Message, len(result.Errors)-1)
+}
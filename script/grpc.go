@@ -0,0 +1,369 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/grpc"
+	"github.com/bpowers/hithere/requester"
+)
+
+// reflectionTimeout bounds how long grpc.connect waits for the
+// server's descriptors.
+const reflectionTimeout = 10 * time.Second
+
+var grpcResponseAttrs = []string{
+	"code",     // int
+	"details",  // str
+	"ok",       // bool
+	"response", // dict, or a list of dicts for server-streaming calls
+
+	"raise_for_status", // def raise_for_status(self) -> None: ...
+}
+
+type grpcModule struct {
+	Module
+}
+
+// GRPCModule returns the grpc module.  grpc.connect(target,
+// descriptors=None, web=False) returns a connection to a gRPC server,
+// using the service definitions in the descriptors file (a
+// FileDescriptorSet from protoc --include_imports --descriptor_set_out)
+// or, without one, from server reflection.  With web=True calls use the
+// gRPC-Web protocol, for testing browser-facing gateways, and
+// descriptors are required.  Each call is reported as a result whose
+// status code is the gRPC status.
+func GRPCModule() *grpcModule {
+	m := &grpcModule{
+		Module: Module{
+			Name:  "grpc",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["connect"] = starlark.NewBuiltin("grpc.connect", m.fnConnect)
+
+	return m
+}
+
+// grpcConns caches connections and their descriptors, since scripts
+// usually connect from main, which runs for every iteration of every
+// worker.
+var grpcConns = struct {
+	sync.Mutex
+	m map[string]*grpcConn
+}{m: make(map[string]*grpcConn)}
+
+func (m *grpcModule) fnConnect(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var target, descriptors string
+	var web bool
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "target", &target, "descriptors?", &descriptors, "web?", &web); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if web && descriptors == "" {
+		return nil, fmt.Errorf("%s: gRPC-Web connections need descriptors, as servers can't be reflected over it", fn.Name())
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%t", target, descriptors, web)
+
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	if c, ok := grpcConns.m[key]; ok {
+		return c, nil
+	}
+
+	dial := grpc.Dial
+	if web {
+		dial = grpc.DialWeb
+	}
+	conn, err := dial(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	var reg *grpc.Registry
+	if descriptors != "" {
+		b, err := ioutil.ReadFile(descriptors)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		reg = grpc.NewRegistry()
+		if err := reg.AddFileSet(b); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", fn.Name(), descriptors, err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), reflectionTimeout)
+		defer cancel()
+		reg, err = conn.Reflect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	}
+
+	c := &grpcConn{target: target, conn: conn, reg: reg}
+	grpcConns.m[key] = c
+	return c, nil
+}
+
+// grpcConn is a connection to a gRPC server along with its service
+// definitions.  It is immutable, and shared between workers.
+type grpcConn struct {
+	target string
+	conn   *grpc.Conn
+	reg    *grpc.Registry
+}
+
+var _ starlark.HasAttrs = (*grpcConn)(nil)
+
+func (c *grpcConn) String() string        { return fmt.Sprintf("<grpc.conn %q>", c.target) }
+func (c *grpcConn) Type() string          { return "grpc.conn" }
+func (c *grpcConn) Freeze()               {}
+func (c *grpcConn) Truth() starlark.Bool  { return starlark.True }
+func (c *grpcConn) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+func (c *grpcConn) AttrNames() []string   { return []string{"call"} }
+
+func (c *grpcConn) Attr(name string) (starlark.Value, error) {
+	if name == "call" {
+		return starlark.NewBuiltin("grpc.conn.call", c.fnCall), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+// fnCall implements conn.call(method, request, metadata=None,
+// timeout=None).  For client-streaming methods request is a list of
+// messages, all of which are sent before the stream is closed.
+func (c *grpcConn) fnCall(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("grpc can't be used at top level, only in function bodies")
+	}
+
+	var method string
+	var request starlark.Value
+	var metadata *starlark.Dict
+	var timeout starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "method", &method, "request", &request, "metadata?", &metadata, "timeout?", &timeout); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	md, err := c.reg.Method(method)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	in, err := c.reg.Message(md.Input)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	out, err := c.reg.Message(md.Output)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	reqs := []starlark.Value{request}
+	if md.ClientStreaming {
+		iterable, ok := request.(starlark.Iterable)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s is client-streaming, expected a list of requests", fn.Name(), md.Name)
+		}
+		reqs = nil
+		iter := iterable.Iterate()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			reqs = append(reqs, elem)
+		}
+		iter.Done()
+	}
+	msgs := make([][]byte, 0, len(reqs))
+	for _, r := range reqs {
+		b, err := encodeMessage(c.reg, in, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		msgs = append(msgs, b)
+	}
+
+	header := make(http.Header)
+	if metadata != nil {
+		for _, item := range metadata.Items() {
+			k, _ := starlark.AsString(item[0])
+			v, ok := starlark.AsString(item[1])
+			if !ok {
+				v = item[1].String()
+			}
+			header.Add(strings.ToLower(k), v)
+		}
+	}
+
+	ctx := stls.ctx
+	d := stls.client.Timeout
+	if timeout != starlark.None {
+		secs, ok := starlark.AsFloat(timeout)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected timeout in seconds, got %s", fn.Name(), timeout.Type())
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	stls.count++
+	resps, st, err := invoke(ctx, c.conn, md.Name, header, msgs, stls.reporter, stls.clock)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	resp := &grpcResponse{status: st}
+	if md.ServerStreaming {
+		list := make([]starlark.Value, 0, len(resps))
+		for _, b := range resps {
+			v, err := decodeMessage(c.reg, out, b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+			}
+			list = append(list, v)
+		}
+		resp.response = starlark.NewList(list)
+	} else if len(resps) > 0 {
+		v, err := decodeMessage(c.reg, out, resps[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		resp.response = v
+	} else {
+		resp.response = starlark.None
+	}
+	return resp, nil
+}
+
+// invoke makes a call, reporting its timings.  Transport failures are
+// returned as errors; calls that complete with a non-OK status are
+// not, like HTTP error statuses.
+func invoke(ctx context.Context, conn *grpc.Conn, method string, md http.Header, msgs [][]byte, reporter requester.Reporter, clock *requester.Clock) ([][]byte, *grpc.Status, error) {
+	reporter.Start()
+	s := clock.Now()
+	var size int64
+	var reqDuration, delayDuration time.Duration
+	var resps [][]byte
+
+	st, err := func() (*grpc.Status, error) {
+		stream, err := conn.NewStream(ctx, method, md)
+		if err != nil {
+			return nil, err
+		}
+
+		type sendResult struct {
+			d   time.Duration
+			err error
+		}
+		sent := make(chan sendResult, 1)
+		go func() {
+			for _, msg := range msgs {
+				if err := stream.Send(msg); err != nil {
+					sent <- sendResult{err: err}
+					return
+				}
+			}
+			err := stream.CloseSend()
+			sent <- sendResult{clock.Now() - s, err}
+		}()
+		// the server may finish the call before reading every request,
+		// so close the stream to unblock the sender before waiting
+		// for it.
+		finishSend := func() error {
+			stream.Close()
+			r := <-sent
+			reqDuration = r.d
+			return r.err
+		}
+
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if st, ok := err.(*grpc.Status); ok {
+				finishSend()
+				return st, nil
+			} else if err != nil {
+				finishSend()
+				return nil, err
+			}
+			if resps == nil {
+				delayDuration = clock.Now() - s
+			}
+			size += int64(len(msg))
+			resps = append(resps, msg)
+		}
+		if err := finishSend(); err != nil {
+			return nil, err
+		}
+		return &grpc.Status{Code: grpc.OK}, nil
+	}()
+
+	code := 0
+	if st != nil {
+		code = st.Code
+	}
+	reporter.Finish(&requester.Result{
+		Offset:        s,
+		StatusCode:    code,
+		Duration:      clock.Now() - s,
+		Err:           err,
+		ContentLength: size,
+		ReqDuration:   reqDuration,
+		DelayDuration: delayDuration,
+		Name:          "GRPC " + method,
+	})
+	return resps, st, err
+}
+
+type grpcResponse struct {
+	status   *grpc.Status
+	response starlark.Value
+}
+
+var _ starlark.HasAttrs = (*grpcResponse)(nil)
+
+func (r *grpcResponse) String() string        { return fmt.Sprintf("<grpc.response code=%d>", r.status.Code) }
+func (r *grpcResponse) Type() string          { return "grpc.response" }
+func (r *grpcResponse) Freeze()               {}
+func (r *grpcResponse) Truth() starlark.Bool  { return starlark.True }
+func (r *grpcResponse) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", r.Type()) }
+func (r *grpcResponse) AttrNames() []string   { return grpcResponseAttrs }
+
+func (r *grpcResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "code":
+		return starlark.MakeInt(r.status.Code), nil
+	case "details":
+		return starlark.String(r.status.Message), nil
+	case "ok":
+		return starlark.Bool(r.status.Code == grpc.OK), nil
+	case "response":
+		return r.response, nil
+	case "raise_for_status":
+		return starlark.NewBuiltin("grpc.response.raise_for_status", r.fnRaiseForStatus), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (r *grpcResponse) fnRaiseForStatus(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if r.status.Code != grpc.OK {
+		return nil, r.status
+	}
+	return starlark.None, nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+	"github.com/bpowers/hithere/script/starlarkjson"
+)
+
+var jsonrpcResponseAttrs = []string{
+	"method", // str
+	"result", // Any
+	"error",  // Optional[dict], with code, message and data
+	"ok",     // bool
+}
+
+// jsonrpcID is the ID of the last call made, unique across workers so
+// that IDs in logs on the server side can be told apart.
+var jsonrpcID int64
+
+type jsonrpcCall struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      int64           `json:"id"`
+}
+
+type jsonrpcReply struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	} `json:"error"`
+}
+
+// fnRequestsJSONRPC implements requests.jsonrpc(url, method=None,
+// params=None, batch=None, headers=None).  batch is a list of further
+// calls to send in the same request, each a (method, params) pair or a
+// dict with "method" and "params" keys.  A single call returns a
+// jsonrpc.response, and a batch a list of them in the order the calls
+// were made, matched up by ID.  Results are named after the method
+// called, or methods in a batch, and are reported as failures if any
+// call returned an error object.
+func (r *requestsModule) fnRequestsJSONRPC(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	tls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || tls == nil {
+		return starlark.None, fmt.Errorf("requests can't be used at top level, only in function bodies")
+	}
+
+	var url, method string
+	var params starlark.Value = starlark.None
+	var batch *starlark.List
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &url, "method?", &method, "params?", &params, "batch?", &batch, "headers?", &headers); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	var calls []*jsonrpcCall
+	addCall := func(method string, params starlark.Value) error {
+		call := &jsonrpcCall{
+			JSONRPC: "2.0",
+			Method:  method,
+			ID:      atomic.AddInt64(&jsonrpcID, 1),
+		}
+		if params != starlark.None {
+			encode := starlarkjson.Module.Members["encode"].(*starlark.Builtin)
+			v, err := starlarkjson.Encode(t, encode, starlark.Tuple{params}, nil)
+			if err != nil {
+				return fmt.Errorf("%s: params: %w", method, err)
+			}
+			call.Params = json.RawMessage(v.(starlark.String))
+		}
+		calls = append(calls, call)
+		return nil
+	}
+	if method != "" {
+		if err := addCall(method, params); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	}
+	if batch != nil {
+		for i := 0; i < batch.Len(); i++ {
+			m, p, err := jsonrpcBatchCall(batch.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("%s: batch[%d]: %w", fn.Name(), i, err)
+			}
+			if err := addCall(m, p); err != nil {
+				return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+			}
+		}
+	}
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("%s: expected a method or batch", fn.Name())
+	}
+
+	var body []byte
+	var err error
+	if batch != nil {
+		body, err = json.Marshal(calls)
+	} else {
+		body, err = json.Marshal(calls[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	req, err := newRequest(tls.ctx, "POST", url, body, tls.compressRequests)
+	if err != nil {
+		return starlark.None, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if headers != nil {
+		if err := setHeaders(req, headers); err != nil {
+			return nil, err
+		}
+	}
+	if req.Header.Get("content-type") == "" {
+		req.Header.Set("content-type", "application/json")
+	}
+	req.Header.Set("user-agent", tls.reporter.UserAgent())
+
+	methods := make([]string, len(calls))
+	for i, c := range calls {
+		methods[i] = c.Method
+	}
+	name := "JSONRPC " + methods[0]
+	if batch != nil {
+		name = "JSONRPC [" + strings.Join(methods, ", ") + "]"
+	}
+
+	var replies map[int64]*jsonrpcReply
+	var replyErr error
+	tls.count++
+	_, err = instrument(tls.client, req, tls.reporter, tls.clock, tls.maxBodyBytes, func(resp *response, res *requester.Result) {
+		res.Name = name
+		replies, replyErr = jsonrpcReplies(resp.body)
+		if replyErr != nil {
+			if resp.resp.StatusCode == http.StatusOK {
+				res.Err = replyErr
+			} else {
+				replyErr = fmt.Errorf("jsonrpc: unexpected status %d", resp.resp.StatusCode)
+			}
+			return
+		}
+		for _, c := range calls {
+			reply, ok := replies[c.ID]
+			if !ok {
+				res.Err = fmt.Errorf("jsonrpc: %s: no response", c.Method)
+				return
+			}
+			if reply.Error != nil {
+				res.Err = fmt.Errorf("jsonrpc: %s: %s (%d)", c.Method, reply.Error.Message, reply.Error.Code)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("r.c.Do: %w", err)
+	}
+	if replyErr != nil {
+		return starlark.None, fmt.Errorf("%s: %w", fn.Name(), replyErr)
+	}
+
+	decode := starlarkjson.Module.Members["decode"].(*starlark.Builtin)
+	results := make([]starlark.Value, 0, len(calls))
+	for _, c := range calls {
+		resp := &jsonrpcResponse{method: c.Method, result: starlark.None, error: starlark.None}
+		reply, ok := replies[c.ID]
+		switch {
+		case !ok:
+			resp.error = jsonrpcError(t, -32603, "no response", nil)
+		case reply.Error != nil:
+			resp.error = jsonrpcError(t, reply.Error.Code, reply.Error.Message, reply.Error.Data)
+		case len(reply.Result) > 0:
+			v, err := starlarkjson.Decode(t, decode, starlark.Tuple{starlark.String(reply.Result)}, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", fn.Name(), c.Method, err)
+			}
+			resp.result = v
+		}
+		results = append(results, resp)
+	}
+	if batch == nil {
+		return results[0], nil
+	}
+	return starlark.NewList(results), nil
+}
+
+// jsonrpcBatchCall unpacks a call in a batch.
+func jsonrpcBatchCall(v starlark.Value) (method string, params starlark.Value, err error) {
+	params = starlark.None
+	switch v := v.(type) {
+	case *starlark.Dict:
+		m, _, _ := v.Get(starlark.String("method"))
+		p, found, _ := v.Get(starlark.String("params"))
+		if found {
+			params = p
+		}
+		method, _ = starlark.AsString(m)
+	case starlark.Indexable:
+		if v.Len() != 2 {
+			return "", nil, fmt.Errorf("expected a (method, params) pair")
+		}
+		method, _ = starlark.AsString(v.Index(0))
+		params = v.Index(1)
+	default:
+		return "", nil, fmt.Errorf("expected a (method, params) pair or dict, got %s", v.Type())
+	}
+	if method == "" {
+		return "", nil, fmt.Errorf("missing method")
+	}
+	return method, params, nil
+}
+
+// jsonrpcReplies parses a response body holding a single reply or a
+// batch of them, indexed by ID.
+func jsonrpcReplies(body []byte) (map[int64]*jsonrpcReply, error) {
+	var list []*jsonrpcReply
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("jsonrpc: malformed response: %w", err)
+		}
+	} else {
+		var reply jsonrpcReply
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return nil, fmt.Errorf("jsonrpc: malformed response: %w", err)
+		}
+		list = append(list, &reply)
+	}
+
+	replies := make(map[int64]*jsonrpcReply, len(list))
+	for _, reply := range list {
+		var id int64
+		if err := json.Unmarshal(reply.ID, &id); err != nil {
+			// e.g. a null ID, for requests the server couldn't parse
+			if reply.Error != nil {
+				return nil, fmt.Errorf("jsonrpc: %s (%d)", reply.Error.Message, reply.Error.Code)
+			}
+			return nil, fmt.Errorf("jsonrpc: unexpected response ID %s", reply.ID)
+		}
+		replies[id] = reply
+	}
+	return replies, nil
+}
+
+// jsonrpcError returns an error object as a dict.
+func jsonrpcError(t *starlark.Thread, code int, message string, data json.RawMessage) starlark.Value {
+	d := new(starlark.Dict)
+	d.SetKey(starlark.String("code"), starlark.MakeInt(code))
+	d.SetKey(starlark.String("message"), starlark.String(message))
+	var v starlark.Value = starlark.None
+	if len(data) > 0 {
+		decode := starlarkjson.Module.Members["decode"].(*starlark.Builtin)
+		if dv, err := starlarkjson.Decode(t, decode, starlark.Tuple{starlark.String(data)}, nil); err == nil {
+			v = dv
+		}
+	}
+	d.SetKey(starlark.String("data"), v)
+	return d
+}
+
+type jsonrpcResponse struct {
+	method string
+	result starlark.Value
+	// error is a dict, or None; like result, it is created per call,
+	// so is never shared with another thread.
+	error starlark.Value
+}
+
+var _ starlark.HasAttrs = (*jsonrpcResponse)(nil)
+
+func (r *jsonrpcResponse) String() string       { return fmt.Sprintf("<jsonrpc.response %s>", r.method) }
+func (r *jsonrpcResponse) Type() string         { return "jsonrpc.response" }
+func (r *jsonrpcResponse) Freeze()              { r.result.Freeze() }
+func (r *jsonrpcResponse) Truth() starlark.Bool { return starlark.True }
+func (r *jsonrpcResponse) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", r.Type())
+}
+func (r *jsonrpcResponse) AttrNames() []string { return jsonrpcResponseAttrs }
+
+func (r *jsonrpcResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "method":
+		return starlark.String(r.method), nil
+	case "result":
+		return r.result, nil
+	case "error":
+		return r.error, nil
+	case "ok":
+		return starlark.Bool(r.error == starlark.None), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
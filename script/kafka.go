@@ -0,0 +1,253 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/kafka"
+	"github.com/bpowers/hithere/requester"
+)
+
+type kafkaModule struct {
+	Module
+}
+
+// KafkaModule returns the kafka module, a producer for load testing
+// event ingestion.  kafka.produce(brokers, topic, key, value) adds a
+// record to a batch for its topic and partition; once batch_size
+// records have been added the batch is sent, and reported as a result
+// lasting until the brokers acknowledge it.  Batches still pending
+// when the script returns, or calls kafka.flush(), are sent then.
+func KafkaModule() *kafkaModule {
+	m := &kafkaModule{
+		Module: Module{
+			Name:  "kafka",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["produce"] = starlark.NewBuiltin("kafka.produce", m.fnProduce)
+	m.Attrs["flush"] = starlark.NewBuiltin("kafka.flush", m.fnFlush)
+
+	return m
+}
+
+// kafkaClient is a cluster's client, shared between workers.
+type kafkaClient struct {
+	*kafka.Client
+	// next picks the partition for records without a key.
+	next uint32
+}
+
+var kafkaClients = struct {
+	sync.Mutex
+	m map[string]*kafkaClient
+}{m: make(map[string]*kafkaClient)}
+
+func getKafkaClient(brokers []string) *kafkaClient {
+	key := strings.Join(brokers, ",")
+	kafkaClients.Lock()
+	defer kafkaClients.Unlock()
+	c, ok := kafkaClients.m[key]
+	if !ok {
+		c = &kafkaClient{Client: kafka.NewClient(brokers)}
+		kafkaClients.m[key] = c
+	}
+	return c
+}
+
+// fnProduce implements kafka.produce(brokers, topic, key, value,
+// partition=None, acks=1, batch_size=1).  brokers is a list of
+// "host:port" strings or a comma-separated string of them.  It returns
+// the record's offset if it was sent (and acknowledged) right away, and
+// otherwise None.
+func (m *kafkaModule) fnProduce(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("kafka can't be used at top level, only in function bodies")
+	}
+
+	var brokersVal starlark.Value
+	var topic string
+	var key starlark.Value = starlark.None
+	var value string
+	var partitionVal starlark.Value = starlark.None
+	acks := 1
+	batchSize := 1
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "brokers", &brokersVal, "topic", &topic, "key", &key, "value", &value, "partition?", &partitionVal, "acks?", &acks, "batch_size?", &batchSize); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	brokers, err := kafkaBrokers(brokersVal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if acks < -1 || acks > 1 {
+		return nil, fmt.Errorf("%s: acks must be 0, 1 or -1", fn.Name())
+	}
+	rec := kafka.Record{Value: []byte(value)}
+	if key != starlark.None {
+		k, ok := starlark.AsString(key)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected key to be a string or None, got %s", fn.Name(), key.Type())
+		}
+		rec.Key = []byte(k)
+	}
+
+	client := getKafkaClient(brokers)
+	var partition int32
+	if partitionVal != starlark.None {
+		p, err := starlark.AsInt32(partitionVal)
+		if err != nil {
+			return nil, fmt.Errorf("%s: partition: %w", fn.Name(), err)
+		}
+		partition = int32(p)
+	} else {
+		n, err := client.Partitions(stls.ctx, topic)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		if rec.Key != nil {
+			partition = kafka.Partition(rec.Key, n)
+		} else {
+			partition = int32(atomic.AddUint32(&client.next, 1) % uint32(n))
+		}
+	}
+
+	batchKey := strings.Join([]string{strings.Join(brokers, ","), topic, strconv.Itoa(int(partition)), strconv.Itoa(acks)}, "\x00")
+	b, ok := stls.batches[batchKey]
+	if !ok {
+		b = &kafkaBatch{
+			stls:      stls,
+			client:    client,
+			topic:     topic,
+			partition: partition,
+			acks:      int16(acks),
+		}
+		if stls.batches == nil {
+			stls.batches = make(map[string]*kafkaBatch)
+		}
+		stls.batches[batchKey] = b
+		stls.closers = append(stls.closers, b)
+	}
+	b.records = append(b.records, rec)
+	if len(b.records) < batchSize {
+		return starlark.None, nil
+	}
+
+	n := len(b.records)
+	offset, err := b.flush()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if offset < 0 {
+		return starlark.None, nil
+	}
+	return starlark.MakeInt64(offset + int64(n) - 1), nil
+}
+
+// fnFlush sends every pending batch.
+func (m *kafkaModule) fnFlush(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("kafka can't be used at top level, only in function bodies")
+	}
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	for _, b := range stls.batches {
+		if _, err := b.flush(); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	}
+	return starlark.None, nil
+}
+
+func kafkaBrokers(v starlark.Value) ([]string, error) {
+	if s, ok := starlark.AsString(v); ok {
+		return strings.Split(s, ","), nil
+	}
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("expected brokers to be a string or list, got %s", v.Type())
+	}
+	var brokers []string
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		s, ok := starlark.AsString(elem)
+		if !ok {
+			return nil, fmt.Errorf("expected broker to be a string, got %s", elem.Type())
+		}
+		brokers = append(brokers, s)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no brokers")
+	}
+	return brokers, nil
+}
+
+// kafkaBatch holds records produced by a script for one partition
+// that haven't been sent yet.
+type kafkaBatch struct {
+	stls      *scriptTls
+	client    *kafkaClient
+	topic     string
+	partition int32
+	acks      int16
+	records   []kafka.Record
+}
+
+var _ io.Closer = (*kafkaBatch)(nil)
+
+// flush sends the batch, returning the offset of its first record (or
+// -1 if acks is 0), and reports it.
+func (b *kafkaBatch) flush() (int64, error) {
+	if len(b.records) == 0 {
+		return -1, nil
+	}
+	records := b.records
+	b.records = nil
+
+	var size int64
+	for _, r := range records {
+		size += int64(len(r.Key) + len(r.Value))
+	}
+	ctx := b.stls.ctx
+	if timeout := b.stls.client.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	b.stls.count++
+	b.stls.reporter.Start()
+	s := b.stls.clock.Now()
+	offset, err := b.client.Produce(ctx, b.topic, b.partition, records, b.acks, b.stls.client.Timeout)
+	b.stls.reporter.Finish(&requester.Result{
+		Offset:        s,
+		Duration:      b.stls.clock.Now() - s,
+		Err:           err,
+		ContentLength: size,
+		Name:          "KAFKA PRODUCE " + b.topic,
+	})
+	return offset, err
+}
+
+// Close sends any records left in the batch when the script returns.
+func (b *kafkaBatch) Close() error {
+	_, err := b.flush()
+	return err
+}
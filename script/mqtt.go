@@ -0,0 +1,629 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttSubackFailure is the SUBACK return code for a refused
+// subscription.
+const mqttSubackFailure = 0x80
+
+var errMQTTMalformed = errors.New("malformed MQTT packet")
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+var mqttConnAttrs = []string{
+	"publish",   // def publish(self, topic: str, payload: str, qos: int = 0, retain: bool = False) -> None: ...
+	"subscribe", // def subscribe(self, topic: str, qos: int = 0) -> None: ...
+	"recv",      // def recv(self, timeout: Optional[float] = None) -> Optional[mqtt.message]: ...
+	"close",     // def close(self) -> None: ...
+}
+
+var mqttMessageAttrs = []string{
+	"topic",   // str
+	"payload", // str
+	"qos",     // int
+	"retain",  // bool
+}
+
+type mqttModule struct {
+	Module
+}
+
+// MQTTModule returns the mqtt module, an MQTT 3.1.1 client for broker
+// capacity testing.  Connecting, publishing (until the broker
+// acknowledges it, for QoS 1 and 2) and subscribing are reported as
+// results.  When a script receives a message it published itself,
+// possibly on another connection, the delivery is reported too,
+// measured from the publish to when recv read it.
+func MQTTModule() *mqttModule {
+	m := &mqttModule{
+		Module: Module{
+			Name:  "mqtt",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["connect"] = starlark.NewBuiltin("mqtt.connect", m.fnConnect)
+
+	return m
+}
+
+// fnConnect implements mqtt.connect(host, port=1883, client_id=None,
+// username=None, password=None, tls=False, server_name=None,
+// clean_session=True).  Keep-alives are disabled, as the connection is
+// only serviced while the script is using it.
+func (m *mqttModule) fnConnect(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("mqtt can't be used at top level, only in function bodies")
+	}
+
+	var host, clientID, username, password, serverName string
+	var port int
+	var useTLS bool
+	cleanSession := true
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "host", &host, "port?", &port, "client_id?", &clientID, "username?", &username, "password?", &password, "tls?", &useTLS, "server_name?", &serverName, "clean_session?", &cleanSession); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if port == 0 {
+		port = 1883
+		if useTLS {
+			port = 8883
+		}
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	if clientID == "" {
+		clientID = fmt.Sprintf("hithere-%08x", stls.rand.Uint32())
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	timeout := stls.client.Timeout
+
+	// CONNECT: protocol name and level, flags, keep-alive, then the
+	// payload.
+	body := mqttAppendString(nil, "MQTT")
+	var flags byte
+	if cleanSession {
+		flags |= 0x02
+	}
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags, 0, 0)
+	body = mqttAppendString(body, clientID)
+	if username != "" {
+		body = mqttAppendString(body, username)
+	}
+	if password != "" {
+		body = mqttAppendString(body, password)
+	}
+
+	stls.count++
+	stls.reporter.Start()
+	s := stls.clock.Now()
+	var connDuration, tlsDuration time.Duration
+	code := 0
+	c, err := func() (*mqttConn, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		nc, err := dialer.DialContext(stls.ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		connDuration = stls.clock.Now() - s
+		if useTLS {
+			tlsStart := stls.clock.Now()
+			tc := tls.Client(nc, clientTLSConfig(stls.client, serverName))
+			tc.SetDeadline(deadline(stls.ctx, timeout))
+			if err := tc.Handshake(); err != nil {
+				nc.Close()
+				return nil, err
+			}
+			tlsDuration = stls.clock.Now() - tlsStart
+			nc = tc
+		}
+
+		c := &mqttConn{stls: stls, nc: nc, r: bufio.NewReader(nc), addr: addr}
+		if err := c.write(mqttConnect, 0, body); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		p, err := c.wait(mqttConnack, -1)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if len(p.body) != 2 {
+			nc.Close()
+			return nil, errMQTTMalformed
+		}
+		code = int(p.body[1])
+		return c, nil
+	}()
+
+	stls.reporter.Finish(&requester.Result{
+		Offset:       s,
+		StatusCode:   code,
+		Duration:     stls.clock.Now() - s,
+		Err:          err,
+		ConnDuration: connDuration,
+		TLSDuration:  tlsDuration,
+		Name:         "MQTT CONNECT " + addr,
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if code != 0 {
+		c.nc.Close()
+		reason, ok := mqttConnackErrors[byte(code)]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", code)
+		}
+		return starlark.None, fmt.Errorf("%s: connection refused: %s", fn.Name(), reason)
+	}
+
+	stls.closers = append(stls.closers, c)
+	return c, nil
+}
+
+type mqttPacket struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// mqttConn is a connection to an MQTT broker.  The connection is only
+// read from while the script is waiting on it, so messages that arrive
+// while waiting for an acknowledgement are queued for recv.
+type mqttConn struct {
+	stls   *scriptTls
+	nc     net.Conn
+	r      *bufio.Reader
+	addr   string
+	closed bool
+	lastID uint16
+	queue  []*mqttMessage
+}
+
+var (
+	_ starlark.HasAttrs = (*mqttConn)(nil)
+	_ io.Closer         = (*mqttConn)(nil)
+)
+
+func (c *mqttConn) String() string        { return fmt.Sprintf("<mqtt.conn %q>", c.addr) }
+func (c *mqttConn) Type() string          { return "mqtt.conn" }
+func (c *mqttConn) Freeze()               {}
+func (c *mqttConn) Truth() starlark.Bool  { return starlark.True }
+func (c *mqttConn) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+func (c *mqttConn) AttrNames() []string   { return mqttConnAttrs }
+
+func (c *mqttConn) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "publish":
+		return starlark.NewBuiltin("mqtt.conn.publish", c.fnPublish), nil
+	case "subscribe":
+		return starlark.NewBuiltin("mqtt.conn.subscribe", c.fnSubscribe), nil
+	case "recv":
+		return starlark.NewBuiltin("mqtt.conn.recv", c.fnRecv), nil
+	case "close":
+		return starlark.NewBuiltin("mqtt.conn.close", c.fnClose), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (c *mqttConn) fnPublish(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var topic, payload string
+	var qos int
+	var retain bool
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "topic", &topic, "payload", &payload, "qos?", &qos, "retain?", &retain); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("%s: invalid QoS %d", fn.Name(), qos)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	flags := byte(qos << 1)
+	if retain {
+		flags |= 0x01
+	}
+	body := mqttAppendString(nil, topic)
+	id := -1
+	if qos > 0 {
+		id = int(c.packetID())
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+
+	c.stls.count++
+	c.stls.reporter.Start()
+	s := c.stls.clock.Now()
+	if c.stls.published == nil {
+		c.stls.published = make(map[string]time.Duration)
+	}
+	c.stls.published[topic+"\x00"+payload] = s
+	var reqDuration time.Duration
+	err := func() error {
+		if err := c.write(mqttPublish, flags, body); err != nil {
+			return err
+		}
+		reqDuration = c.stls.clock.Now() - s
+		switch qos {
+		case 1:
+			_, err := c.wait(mqttPuback, id)
+			return err
+		case 2:
+			if _, err := c.wait(mqttPubrec, id); err != nil {
+				return err
+			}
+			if err := c.write(mqttPubrel, 0x02, []byte{byte(id >> 8), byte(id)}); err != nil {
+				return err
+			}
+			_, err := c.wait(mqttPubcomp, id)
+			return err
+		}
+		return nil
+	}()
+
+	c.stls.reporter.Finish(&requester.Result{
+		Offset:        s,
+		Duration:      c.stls.clock.Now() - s,
+		Err:           err,
+		ContentLength: int64(len(payload)),
+		ReqDuration:   reqDuration,
+		Name:          "MQTT PUBLISH " + topic,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// fnSubscribe subscribes to a topic filter, reporting the QoS the
+// broker granted as the status code.
+func (c *mqttConn) fnSubscribe(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var topic string
+	var qos int
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "topic", &topic, "qos?", &qos); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if qos < 0 || qos > 2 {
+		return nil, fmt.Errorf("%s: invalid QoS %d", fn.Name(), qos)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	id := c.packetID()
+	body := []byte{byte(id >> 8), byte(id)}
+	body = mqttAppendString(body, topic)
+	body = append(body, byte(qos))
+
+	c.stls.count++
+	c.stls.reporter.Start()
+	s := c.stls.clock.Now()
+	code := 0
+	err := func() error {
+		if err := c.write(mqttSubscribe, 0x02, body); err != nil {
+			return err
+		}
+		p, err := c.wait(mqttSuback, int(id))
+		if err != nil {
+			return err
+		}
+		if len(p.body) != 3 {
+			return errMQTTMalformed
+		}
+		code = int(p.body[2])
+		return nil
+	}()
+
+	c.stls.reporter.Finish(&requester.Result{
+		Offset:     s,
+		StatusCode: code,
+		Duration:   c.stls.clock.Now() - s,
+		Err:        err,
+		Name:       "MQTT SUBSCRIBE " + topic,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if code == mqttSubackFailure {
+		return nil, fmt.Errorf("%s: subscription to %q refused", fn.Name(), topic)
+	}
+	return starlark.None, nil
+}
+
+// fnRecv returns the next message from a subscription, or None if
+// none arrives within timeout seconds (by default, the request
+// timeout).  With a timeout of 0 it doesn't wait at all.
+func (c *mqttConn) fnRecv(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var timeout starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "timeout?", &timeout); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	first := deadline(c.stls.ctx, c.stls.client.Timeout)
+	if timeout != starlark.None {
+		secs, ok := starlark.AsFloat(timeout)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected timeout in seconds, got %s", fn.Name(), timeout.Type())
+		}
+		first = deadline(c.stls.ctx, time.Duration(secs*float64(time.Second)))
+		if secs <= 0 {
+			// only return a message that has already arrived
+			first = time.Now()
+		}
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	for len(c.queue) == 0 {
+		p, err := c.read(first)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && p == nil {
+			return starlark.None, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		if err := c.handle(p); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	}
+	msg := c.queue[0]
+	c.queue = c.queue[1:]
+	return msg, nil
+}
+
+func (c *mqttConn) fnClose(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if err := c.Close(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// Close disconnects from the broker, if the script hasn't already.
+func (c *mqttConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.write(mqttDisconnect, 0, nil)
+	return c.nc.Close()
+}
+
+// packetID returns the next non-zero packet identifier.
+func (c *mqttConn) packetID() uint16 {
+	c.lastID++
+	if c.lastID == 0 {
+		c.lastID++
+	}
+	return c.lastID
+}
+
+func (c *mqttConn) write(typ, flags byte, body []byte) error {
+	b := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	b = append(b, body...)
+	c.nc.SetWriteDeadline(deadline(c.stls.ctx, c.stls.client.Timeout))
+	_, err := c.nc.Write(b)
+	return err
+}
+
+// read reads a packet, waiting until first for it to start.  If
+// nothing at all was read, the returned packet is nil.
+func (c *mqttConn) read(first time.Time) (*mqttPacket, error) {
+	c.nc.SetReadDeadline(first)
+	h, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p := &mqttPacket{typ: h >> 4, flags: h & 0x0f}
+
+	// the rest of the packet should follow promptly
+	c.nc.SetReadDeadline(deadline(c.stls.ctx, c.stls.client.Timeout))
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return p, errMQTTMalformed
+		}
+		d, err := c.r.ReadByte()
+		if err != nil {
+			return p, err
+		}
+		n += int(d&0x7f) * mul
+		mul *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	p.body = make([]byte, n)
+	if _, err := io.ReadFull(c.r, p.body); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// wait reads packets until one of type typ arrives, with packet
+// identifier id if it isn't negative.
+func (c *mqttConn) wait(typ byte, id int) (*mqttPacket, error) {
+	for {
+		p, err := c.read(deadline(c.stls.ctx, c.stls.client.Timeout))
+		if err != nil {
+			return nil, err
+		}
+		if p.typ == typ {
+			if id < 0 {
+				return p, nil
+			}
+			if len(p.body) < 2 {
+				return nil, errMQTTMalformed
+			}
+			if got := int(binary.BigEndian.Uint16(p.body)); got != id {
+				return nil, fmt.Errorf("MQTT packet %d acknowledged out of order", got)
+			}
+			return p, nil
+		}
+		if err := c.handle(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handle processes a packet the script wasn't waiting for: incoming
+// messages are acknowledged and queued.
+func (c *mqttConn) handle(p *mqttPacket) error {
+	switch p.typ {
+	case mqttPublish:
+		return c.deliver(p)
+	case mqttPubrel:
+		// the second half of an incoming QoS 2 delivery
+		if len(p.body) < 2 {
+			return errMQTTMalformed
+		}
+		return c.write(mqttPubcomp, 0, p.body[:2])
+	case mqttPingresp:
+		return nil
+	}
+	return fmt.Errorf("unexpected MQTT packet type %d", p.typ)
+}
+
+func (c *mqttConn) deliver(p *mqttPacket) error {
+	t := c.stls.clock.Now()
+	if len(p.body) < 2 {
+		return errMQTTMalformed
+	}
+	n := int(binary.BigEndian.Uint16(p.body))
+	b := p.body[2:]
+	if len(b) < n {
+		return errMQTTMalformed
+	}
+	msg := &mqttMessage{
+		topic:  string(b[:n]),
+		qos:    int(p.flags>>1) & 0x03,
+		retain: p.flags&0x01 != 0,
+	}
+	b = b[n:]
+	if msg.qos > 0 {
+		if len(b) < 2 {
+			return errMQTTMalformed
+		}
+		ack := byte(mqttPuback)
+		if msg.qos == 2 {
+			ack = mqttPubrec
+		}
+		if err := c.write(ack, 0, b[:2]); err != nil {
+			return err
+		}
+		b = b[2:]
+	}
+	msg.payload = string(b)
+	c.queue = append(c.queue, msg)
+
+	key := msg.topic + "\x00" + msg.payload
+	if s, ok := c.stls.published[key]; ok {
+		delete(c.stls.published, key)
+		c.stls.reporter.Start()
+		c.stls.reporter.Finish(&requester.Result{
+			Offset:        s,
+			Duration:      t - s,
+			ContentLength: int64(len(msg.payload)),
+			Name:          "MQTT DELIVER " + msg.topic,
+		})
+	}
+	return nil
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttMessage is a message received from a subscription.
+type mqttMessage struct {
+	topic   string
+	payload string
+	qos     int
+	retain  bool
+}
+
+var _ starlark.HasAttrs = (*mqttMessage)(nil)
+
+func (m *mqttMessage) String() string        { return fmt.Sprintf("<mqtt.message %q>", m.topic) }
+func (m *mqttMessage) Type() string          { return "mqtt.message" }
+func (m *mqttMessage) Freeze()               {}
+func (m *mqttMessage) Truth() starlark.Bool  { return starlark.True }
+func (m *mqttMessage) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", m.Type()) }
+func (m *mqttMessage) AttrNames() []string   { return mqttMessageAttrs }
+
+func (m *mqttMessage) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "topic":
+		return starlark.String(m.topic), nil
+	case "payload":
+		return starlark.String(m.payload), nil
+	case "qos":
+		return starlark.MakeInt(m.qos), nil
+	case "retain":
+		return starlark.Bool(m.retain), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
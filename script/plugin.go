@@ -0,0 +1,98 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"plugin"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// pluginSymbol is the function a plugin exports to provide modules:
+//
+//	func HithereModules() starlark.StringDict
+const pluginSymbol = "HithereModules"
+
+// LoadPlugin opens the Go plugin at path, built with -buildmode=plugin
+// against the same versions of this package and go.starlark.net, and
+// returns the modules it provides for scripts, from its exported
+// HithereModules function.  Plugins are only supported on the platforms
+// Go supports them on, with cgo.
+func LoadPlugin(path string) (starlark.StringDict, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("plugin.Open: %w", err)
+	}
+	sym, err := p.Lookup(pluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	f, ok := sym.(func() starlark.StringDict)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is a %T, not a func() starlark.StringDict", path, pluginSymbol, sym)
+	}
+	return f(), nil
+}
+
+// WithModules predeclares modules, such as those from LoadPlugin, for
+// the script alongside the built in ones, which they can't replace.
+func WithModules(modules starlark.StringDict) Option {
+	return func(o *options) {
+		if o.modules == nil {
+			o.modules = make(starlark.StringDict, len(modules))
+		}
+		for name, m := range modules {
+			o.modules[name] = m
+		}
+	}
+}
+
+// ThreadContext returns the context of the call to main() that thread
+// is running, for builtins from plugins, or nil at the top level.
+func ThreadContext(thread *starlark.Thread) context.Context {
+	stls, ok := thread.Local(scriptTlsKey).(*scriptTls)
+	if !ok {
+		return nil
+	}
+	return stls.ctx
+}
+
+// ThreadClient returns the HTTP client of the call to main() that
+// thread is running, or nil at the top level.
+func ThreadClient(thread *starlark.Thread) *http.Client {
+	stls, ok := thread.Local(scriptTlsKey).(*scriptTls)
+	if !ok {
+		return nil
+	}
+	return stls.client
+}
+
+// ThreadReporter returns the Reporter that builtins from plugins report
+// their results to, as the built in modules do, or nil at the top
+// level.
+func ThreadReporter(thread *starlark.Thread) requester.Reporter {
+	stls, ok := thread.Local(scriptTlsKey).(*scriptTls)
+	if !ok {
+		return nil
+	}
+	return stls.reporter
+}
+
+// ThreadLogger returns the logger of the call to main() that thread is
+// running, with the attributes of the run and worker, for builtins
+// from plugins, or nil at the top level.
+func ThreadLogger(thread *starlark.Thread) *slog.Logger {
+	stls, ok := thread.Local(scriptTlsKey).(*scriptTls)
+	if !ok {
+		return nil
+	}
+	return stls.logger
+}
@@ -0,0 +1,378 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/grpc"
+)
+
+// encodeMessage encodes v, a dict keyed by field name, as a message of
+// type md.  Repeated fields take a list or tuple, map fields a dict,
+// and enum fields either the value's name or its number.
+func encodeMessage(reg *grpc.Registry, md *grpc.MessageDesc, v starlark.Value) ([]byte, error) {
+	if v == starlark.None {
+		return nil, nil
+	}
+	dict, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a dict, got %s", md.Name, v.Type())
+	}
+
+	var b []byte
+	for _, item := range dict.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s: expected string keys, got %s", md.Name, item[0].Type())
+		}
+		fd := md.FieldByName(name)
+		if fd == nil {
+			return nil, fmt.Errorf("%s has no field %q", md.Name, name)
+		}
+		var err error
+		b, err = encodeField(reg, b, fd, item[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", md.Name, name, err)
+		}
+	}
+	return b, nil
+}
+
+func encodeField(reg *grpc.Registry, b []byte, fd *grpc.FieldDesc, v starlark.Value) ([]byte, error) {
+	if !fd.Repeated {
+		return encodeSingle(reg, b, fd, v)
+	}
+
+	if fd.Type == grpc.TypeMessage {
+		entry, err := reg.Message(fd.TypeName)
+		if err != nil {
+			return nil, err
+		}
+		if entry.MapEntry {
+			return encodeMap(reg, b, fd, entry, v)
+		}
+	}
+
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %s", v.Type())
+	}
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	var packed []byte
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		var err error
+		if fd.Packed {
+			packed, err = appendScalar(reg, packed, fd, elem)
+		} else {
+			b, err = encodeSingle(reg, b, fd, elem)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fd.Packed && len(packed) > 0 {
+		b = grpc.AppendBytesField(b, fd.Number, packed)
+	}
+	return b, nil
+}
+
+func encodeMap(reg *grpc.Registry, b []byte, fd *grpc.FieldDesc, entry *grpc.MessageDesc, v starlark.Value) ([]byte, error) {
+	dict, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("expected a dict, got %s", v.Type())
+	}
+	keyDesc, valueDesc := entry.FieldByNumber(1), entry.FieldByNumber(2)
+	if keyDesc == nil || valueDesc == nil {
+		return nil, fmt.Errorf("malformed map entry type %s", entry.Name)
+	}
+	for _, item := range dict.Items() {
+		e, err := encodeSingle(reg, nil, keyDesc, item[0])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", item[0], err)
+		}
+		e, err = encodeSingle(reg, e, valueDesc, item[1])
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %w", item[0], err)
+		}
+		b = grpc.AppendBytesField(b, fd.Number, e)
+	}
+	return b, nil
+}
+
+// encodeSingle appends a single, tagged value of field fd.
+func encodeSingle(reg *grpc.Registry, b []byte, fd *grpc.FieldDesc, v starlark.Value) ([]byte, error) {
+	switch fd.Type {
+	case grpc.TypeMessage:
+		md, err := reg.Message(fd.TypeName)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := encodeMessage(reg, md, v)
+		if err != nil {
+			return nil, err
+		}
+		return grpc.AppendBytesField(b, fd.Number, msg), nil
+	case grpc.TypeString, grpc.TypeBytes:
+		s, ok := starlark.AsString(v)
+		if !ok {
+			return nil, fmt.Errorf("expected a string, got %s", v.Type())
+		}
+		return grpc.AppendBytesField(b, fd.Number, []byte(s)), nil
+	}
+	b = grpc.AppendTag(b, fd.Number, wireType(fd.Type))
+	return appendScalar(reg, b, fd, v)
+}
+
+func wireType(t int) int {
+	switch t {
+	case grpc.TypeDouble, grpc.TypeFixed64, grpc.TypeSfixed64:
+		return grpc.WireFixed64
+	case grpc.TypeFloat, grpc.TypeFixed32, grpc.TypeSfixed32:
+		return grpc.WireFixed32
+	case grpc.TypeString, grpc.TypeBytes, grpc.TypeMessage:
+		return grpc.WireBytes
+	}
+	return grpc.WireVarint
+}
+
+// appendScalar appends the untagged value of a numeric, bool or enum
+// field.
+func appendScalar(reg *grpc.Registry, b []byte, fd *grpc.FieldDesc, v starlark.Value) ([]byte, error) {
+	switch fd.Type {
+	case grpc.TypeBool:
+		x, ok := v.(starlark.Bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a bool, got %s", v.Type())
+		}
+		if x {
+			return grpc.AppendVarint(b, 1), nil
+		}
+		return grpc.AppendVarint(b, 0), nil
+	case grpc.TypeDouble, grpc.TypeFloat:
+		f, ok := starlark.AsFloat(v)
+		if !ok {
+			return nil, fmt.Errorf("expected a number, got %s", v.Type())
+		}
+		if fd.Type == grpc.TypeFloat {
+			return grpc.AppendFixed32(b, math.Float32bits(float32(f))), nil
+		}
+		return grpc.AppendFixed64(b, math.Float64bits(f)), nil
+	case grpc.TypeEnum:
+		if name, ok := starlark.AsString(v); ok {
+			e, err := reg.Enum(fd.TypeName)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := e.Values[name]
+			if !ok {
+				return nil, fmt.Errorf("%s has no value %q", e.Name, name)
+			}
+			return grpc.AppendVarint(b, uint64(int64(n))), nil
+		}
+	}
+
+	i, ok := v.(starlark.Int)
+	if !ok {
+		return nil, fmt.Errorf("expected an int, got %s", v.Type())
+	}
+	var u uint64
+	if n, ok := i.Int64(); ok {
+		u = uint64(n)
+	} else if n, ok := i.Uint64(); ok {
+		u = n
+	} else {
+		return nil, fmt.Errorf("%s out of range", i)
+	}
+
+	switch fd.Type {
+	case grpc.TypeSint32, grpc.TypeSint64:
+		n := int64(u)
+		return grpc.AppendVarint(b, uint64(n<<1)^uint64(n>>63)), nil
+	case grpc.TypeFixed32, grpc.TypeSfixed32:
+		return grpc.AppendFixed32(b, uint32(u)), nil
+	case grpc.TypeFixed64, grpc.TypeSfixed64:
+		return grpc.AppendFixed64(b, u), nil
+	}
+	return grpc.AppendVarint(b, u), nil
+}
+
+// decodeMessage decodes b as a message of type md into a dict.  Every
+// field is present in the result: unset scalars have their zero value,
+// unset messages are None, and unset repeated and map fields are
+// empty.  Enum values are returned by name when known.
+func decodeMessage(reg *grpc.Registry, md *grpc.MessageDesc, b []byte) (*starlark.Dict, error) {
+	fields, err := grpc.ParseFields(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", md.Name, err)
+	}
+
+	values := make(map[int]starlark.Value, len(md.Fields))
+	for _, f := range fields {
+		fd := md.FieldByNumber(f.Num)
+		if fd == nil {
+			// unknown fields are skipped
+			continue
+		}
+		if err := decodeField(reg, values, fd, f); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", md.Name, fd.Name, err)
+		}
+	}
+
+	dict := starlark.NewDict(len(md.Fields))
+	for _, fd := range md.Fields {
+		v, ok := values[fd.Number]
+		if !ok {
+			v, err = zeroValue(reg, fd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_ = dict.SetKey(starlark.String(fd.Name), v) // can't fail
+	}
+	return dict, nil
+}
+
+func decodeField(reg *grpc.Registry, values map[int]starlark.Value, fd *grpc.FieldDesc, f grpc.Field) error {
+	if fd.Type == grpc.TypeMessage {
+		md, err := reg.Message(fd.TypeName)
+		if err != nil {
+			return err
+		}
+		msg, err := decodeMessage(reg, md, f.Bytes)
+		if err != nil {
+			return err
+		}
+		switch {
+		case md.MapEntry:
+			dict, _ := values[fd.Number].(*starlark.Dict)
+			if dict == nil {
+				dict = new(starlark.Dict)
+				values[fd.Number] = dict
+			}
+			k, _, _ := msg.Get(starlark.String(md.FieldByNumber(1).Name))
+			v, _, _ := msg.Get(starlark.String(md.FieldByNumber(2).Name))
+			return dict.SetKey(k, v)
+		case fd.Repeated:
+			appendValue(values, fd, msg)
+		default:
+			values[fd.Number] = msg
+		}
+		return nil
+	}
+
+	// repeated scalars may be packed whatever the descriptor says
+	if fd.Repeated && f.WireType == grpc.WireBytes && grpc.IsScalar(fd.Type) {
+		packed := f.Bytes
+		for len(packed) > 0 {
+			var sf grpc.Field
+			switch wireType(fd.Type) {
+			case grpc.WireFixed64:
+				if len(packed) < 8 {
+					return fmt.Errorf("truncated packed field")
+				}
+				sf.Scalar = binary.LittleEndian.Uint64(packed)
+				packed = packed[8:]
+			case grpc.WireFixed32:
+				if len(packed) < 4 {
+					return fmt.Errorf("truncated packed field")
+				}
+				sf.Scalar = uint64(binary.LittleEndian.Uint32(packed))
+				packed = packed[4:]
+			default:
+				v, n := grpc.ConsumeVarint(packed)
+				if n == 0 {
+					return fmt.Errorf("truncated packed field")
+				}
+				sf.Scalar = v
+				packed = packed[n:]
+			}
+			v, err := decodeScalar(reg, fd, sf)
+			if err != nil {
+				return err
+			}
+			appendValue(values, fd, v)
+		}
+		return nil
+	}
+
+	v, err := decodeScalar(reg, fd, f)
+	if err != nil {
+		return err
+	}
+	if fd.Repeated {
+		appendValue(values, fd, v)
+	} else {
+		values[fd.Number] = v
+	}
+	return nil
+}
+
+func appendValue(values map[int]starlark.Value, fd *grpc.FieldDesc, v starlark.Value) {
+	list, _ := values[fd.Number].(*starlark.List)
+	if list == nil {
+		list = starlark.NewList(nil)
+		values[fd.Number] = list
+	}
+	_ = list.Append(v) // can't fail, the list isn't frozen
+}
+
+func decodeScalar(reg *grpc.Registry, fd *grpc.FieldDesc, f grpc.Field) (starlark.Value, error) {
+	if f.WireType != wireType(fd.Type) {
+		return nil, fmt.Errorf("wire type %d doesn't match field type %d", f.WireType, fd.Type)
+	}
+	u := f.Scalar
+	switch fd.Type {
+	case grpc.TypeString, grpc.TypeBytes:
+		return starlark.String(f.Bytes), nil
+	case grpc.TypeBool:
+		return starlark.Bool(u != 0), nil
+	case grpc.TypeDouble:
+		return starlark.Float(math.Float64frombits(u)), nil
+	case grpc.TypeFloat:
+		return starlark.Float(math.Float32frombits(uint32(u))), nil
+	case grpc.TypeInt32, grpc.TypeSfixed32:
+		return starlark.MakeInt64(int64(int32(u))), nil
+	case grpc.TypeInt64, grpc.TypeSfixed64:
+		return starlark.MakeInt64(int64(u)), nil
+	case grpc.TypeUint32, grpc.TypeFixed32:
+		return starlark.MakeUint64(uint64(uint32(u))), nil
+	case grpc.TypeUint64, grpc.TypeFixed64:
+		return starlark.MakeUint64(u), nil
+	case grpc.TypeSint32, grpc.TypeSint64:
+		return starlark.MakeInt64(int64(u>>1) ^ -int64(u&1)), nil
+	case grpc.TypeEnum:
+		n := int32(u)
+		if e, err := reg.Enum(fd.TypeName); err == nil {
+			if name, ok := e.Names[n]; ok {
+				return starlark.String(name), nil
+			}
+		}
+		return starlark.MakeInt64(int64(n)), nil
+	}
+	return nil, fmt.Errorf("unsupported field type %d", fd.Type)
+}
+
+func zeroValue(reg *grpc.Registry, fd *grpc.FieldDesc) (starlark.Value, error) {
+	if fd.Repeated {
+		if fd.Type == grpc.TypeMessage {
+			if md, err := reg.Message(fd.TypeName); err == nil && md.MapEntry {
+				return new(starlark.Dict), nil
+			}
+		}
+		return starlark.NewList(nil), nil
+	}
+	if fd.Type == grpc.TypeMessage {
+		return starlark.None, nil
+	}
+	return decodeScalar(reg, fd, grpc.Field{WireType: wireType(fd.Type)})
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+type randomModule struct {
+	Module
+}
+
+// RandomModule returns the random module, a subset of Python's, drawing
+// on the random number generator of the worker running the script, so
+// that a run with the same seed makes the same choices:
+// random.random() returns a float in [0, 1), random.randint(a, b) an
+// int in [a, b], and random.choice(seq) an element of seq.
+func RandomModule() *randomModule {
+	m := &randomModule{
+		Module: Module{
+			Name:  "random",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["random"] = starlark.NewBuiltin("random.random", m.fnRandom)
+	m.Attrs["randint"] = starlark.NewBuiltin("random.randint", m.fnRandint)
+	m.Attrs["choice"] = starlark.NewBuiltin("random.choice", m.fnChoice)
+
+	return m
+}
+
+// scriptTls returns the state of the script running on t.
+func (m *randomModule) scriptTls(t *starlark.Thread) (*scriptTls, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return nil, fmt.Errorf("random can't be used at top level, only in function bodies")
+	}
+	return stls, nil
+}
+
+func (m *randomModule) fnRandom(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, err := m.scriptTls(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.Float(stls.rand.Float64()), nil
+}
+
+func (m *randomModule) fnRandint(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, err := m.scriptTls(t)
+	if err != nil {
+		return nil, err
+	}
+	var a, b int
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "a", &a, "b", &b); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if b < a {
+		return nil, fmt.Errorf("%s: empty range [%d, %d]", fn.Name(), a, b)
+	}
+	return starlark.MakeInt64(int64(a) + stls.rand.Int63n(int64(b)-int64(a)+1)), nil
+}
+
+func (m *randomModule) fnChoice(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, err := m.scriptTls(t)
+	if err != nil {
+		return nil, err
+	}
+	var seq starlark.Indexable
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "seq", &seq); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	n := seq.Len()
+	if n == 0 {
+		return nil, fmt.Errorf("%s: empty sequence", fn.Name())
+	}
+	return seq.Index(stls.rand.Intn(n)), nil
+}
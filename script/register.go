@@ -0,0 +1,64 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// A ModuleFactory returns a new instance of a module, or any other
+// predeclared value, for each script.
+type ModuleFactory func() starlark.Value
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]ModuleFactory)
+)
+
+// RegisterModule predeclares name in every script as the value
+// newModule returns, typically a *Module of builtins, so that a program
+// embedding hithere can offer its own helpers to script authors.  It
+// is meant to be called from init functions, and panics if name is
+// already predeclared.  Unlike WithModules, registered modules are
+// available to every script, including those run from the command line
+// of a custom build.
+func RegisterModule(name string, newModule ModuleFactory) {
+	if _, ok := builtinModules(nil)[name]; ok {
+		panic(fmt.Sprintf("script: RegisterModule of built in %q", name))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("script: RegisterModule called twice for %q", name))
+	}
+	registry[name] = newModule
+}
+
+// RegisterBuiltin predeclares the function fn as name in every script,
+// like check(), see RegisterModule.
+func RegisterBuiltin(name string, fn func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)) {
+	RegisterModule(name, func() starlark.Value {
+		return starlark.NewBuiltin(name, fn)
+	})
+}
+
+// NewModule returns a module named name of the given members, for
+// RegisterModule and WithModules.
+func NewModule(name string, members starlark.StringDict) *Module {
+	return &Module{Name: name, Attrs: members}
+}
+
+// registeredModules adds new instances of the registered modules to
+// modules.
+func registeredModules(modules starlark.StringDict) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for name, newModule := range registry {
+		modules[name] = newModule()
+	}
+}
@@ -6,21 +6,26 @@ package script
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/bpowers/hithere/requester"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
+	"math/rand"
 	"net/http"
 	"net/http/httptrace"
 	"sort"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/stripe/stripe-go/form"
 	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+	"github.com/bpowers/hithere/script/starlarkjson"
 )
 
 var responseAttrs = []string{
@@ -43,28 +48,15 @@ var responseAttrs = []string{
 	"json", // def json(self, **kwargs) -> Any: ...
 
 	"raise_for_status", // def raise_for_status(self) -> None: ...
+
+	"truncated", // bool: whether the body was cut off at the size cap
 }
 
 type response struct {
 	resp *http.Response
 	body []byte
-}
-
-func newResponse(resp *http.Response) (*response, error) {
-	// fully read the body once to match Python's behavior
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ioutil.ReadAll: %w", err)
-	}
-
-	if err := resp.Body.Close(); err != nil {
-		return nil, fmt.Errorf("Body.Close(): %w", err)
-	}
-
-	return &response{
-		resp: resp,
-		body: body,
-	}, nil
+	// truncated is whether body is only the first maxBodyBytes.
+	truncated bool
 }
 
 func (r *response) Attr(name string) (starlark.Value, error) {
@@ -82,6 +74,8 @@ func (r *response) Attr(name string) (starlark.Value, error) {
 		}
 	case "text":
 		return starlark.String(string(r.body)), nil
+	case "truncated":
+		return starlark.Bool(r.truncated), nil
 	case "raise_for_status", "json":
 		return &responseAttr{r, name}, nil
 	}
@@ -132,48 +126,11 @@ func (r *responseAttr) Hash() (uint32, error) {
 	return 0, fmt.Errorf("unhashable type: %s", r.Type())
 }
 
+// json decodes the body straight to Starlark values, so that large
+// payloads aren't decoded twice and big integers like IDs keep every
+// digit.
 func (r *responseAttr) json() (starlark.Value, error) {
-	var x interface{}
-	if err := json.Unmarshal(r.r.body, &x); err != nil {
-		return nil, fmt.Errorf("response.json: %w", err)
-	}
-	var decode func(x interface{}) (starlark.Value, error)
-	decode = func(x interface{}) (starlark.Value, error) {
-		switch x := x.(type) {
-		case nil:
-			return starlark.None, nil
-		case bool:
-			return starlark.Bool(x), nil
-		case int:
-			return starlark.MakeInt(x), nil
-		case float64:
-			return starlark.Float(x), nil
-		case string:
-			return starlark.String(x), nil
-		case map[string]interface{}: // object
-			dict := new(starlark.Dict)
-			for k, v := range x {
-				vv, err := decode(v)
-				if err != nil {
-					return nil, fmt.Errorf("in object field .%s, %v", k, err)
-				}
-				_ = dict.SetKey(starlark.String(k), vv) // can't fail
-			}
-			return dict, nil
-		case []interface{}: // array
-			tuple := make(starlark.Tuple, len(x))
-			for i, v := range x {
-				vv, err := decode(v)
-				if err != nil {
-					return nil, fmt.Errorf("at array index %d, %v", i, err)
-				}
-				tuple[i] = vv
-			}
-			return tuple, nil
-		}
-		panic(x) // unreachable
-	}
-	v, err := decode(x)
+	v, err := starlarkjson.DecodeString(string(r.r.body))
 	if err != nil {
 		return nil, fmt.Errorf("response.json: %w", err)
 	}
@@ -205,14 +162,20 @@ func RequestsModule() *requestsModule {
 		Module: Module{
 			Name: "requests",
 			Attrs: starlark.StringDict{
-				"get":  starlark.None,
-				"post": starlark.None,
+				"get":     starlark.None,
+				"post":    starlark.None,
+				"graphql": starlark.None,
+				"jsonrpc": starlark.None,
+				"soap":    starlark.None,
 			},
 		},
 	}
 
 	r.Attrs["get"] = starlark.NewBuiltin("requests.get", r.fnRequestsGet)
 	r.Attrs["post"] = starlark.NewBuiltin("requests.post", r.fnRequestsPost)
+	r.Attrs["graphql"] = starlark.NewBuiltin("requests.graphql", r.fnRequestsGraphQL)
+	r.Attrs["jsonrpc"] = starlark.NewBuiltin("requests.jsonrpc", r.fnRequestsJSONRPC)
+	r.Attrs["soap"] = starlark.NewBuiltin("requests.soap", r.fnRequestsSOAP)
 
 	return r
 }
@@ -235,23 +198,33 @@ func (r *requestsModule) request(method string, t *starlark.Thread, fn *starlark
 		return starlark.None, fmt.Errorf("expected non-nil %s", scriptTlsKey)
 	}
 
-	var urlString, dataVal, headersVal starlark.Value
-	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &urlString, "data", &dataVal, "headers", &headersVal); err != nil {
+	var urlString starlark.Value
+	var dataVal, headersVal starlark.Value = starlark.None, starlark.None
+	compress := starlark.Bool(tls.compressRequests)
+	version := apiVersion(t)
+	dataParam, headersParam := "data", "headers"
+	if version >= 2 {
+		dataParam, headersParam = "data?", "headers?"
+	}
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &urlString, dataParam, &dataVal, headersParam, &headersVal, "compress_request?", &compress); err != nil {
 		return nil, fmt.Errorf("UnpackArgs: %w", err)
 	}
+	if version >= 2 && headersVal == starlark.None {
+		headersVal = new(starlark.Dict)
+	}
 
 	var isUrlEncodedBody bool
-	var body io.Reader
+	var body []byte
 
-	if method == "POST" {
+	if method == "POST" && !(version >= 2 && dataVal == starlark.None) {
 		if data, ok := dataVal.(starlark.String); ok {
-			body = bytes.NewReader([]byte(data))
+			body = []byte(data)
 		} else if data, ok := dataVal.(*starlark.Dict); ok {
 			bodyStr, err := urlencodeBody(data)
 			if err != nil {
 				return nil, fmt.Errorf("urlencodeBody: %w", err)
 			}
-			body = strings.NewReader(bodyStr)
+			body = []byte(bodyStr)
 			isUrlEncodedBody = true
 		} else {
 			return starlark.None, fmt.Errorf("expected a string or dict for data")
@@ -263,30 +236,14 @@ func (r *requestsModule) request(method string, t *starlark.Thread, fn *starlark
 		return starlark.None, fmt.Errorf("expected url to be a string")
 	}
 
-	req, err := http.NewRequestWithContext(tls.ctx, method, url.GoString(), body)
+	req, err := newRequest(tls.ctx, method, url.GoString(), body, bool(compress))
 	if err != nil {
 		return starlark.None, fmt.Errorf("http.NewRequest: %w", err)
 	}
 
 	if headers, ok := headersVal.(*starlark.Dict); ok {
-		for _, kVal := range headers.Keys() {
-			var k string
-			if kStr, ok := kVal.(starlark.String); ok {
-				k = kStr.GoString()
-			} else {
-				k = kVal.String()
-			}
-			vVal, found, err := headers.Get(kVal)
-			if !found || vVal == nil {
-				return nil, fmt.Errorf("data.Get(%v): %w", kVal, err)
-			}
-			var v string
-			if vStr, ok := vVal.(starlark.String); ok {
-				v = vStr.GoString()
-			} else {
-				v = vVal.String()
-			}
-			req.Header.Set(k, v)
+		if err := setHeaders(req, headers); err != nil {
+			return nil, err
 		}
 	} else {
 		return starlark.None, fmt.Errorf("expected a dict for headers")
@@ -299,76 +256,308 @@ func (r *requestsModule) request(method string, t *starlark.Thread, fn *starlark
 	req.Header.Set("user-agent", tls.reporter.UserAgent())
 
 	tls.count++
-	resp, err := instrument(tls.client, req, tls.reporter)
+	resp, err := instrument(tls.client, req, tls.reporter, tls.clock, tls.maxBodyBytes, nil)
 	if err != nil {
 		return starlark.None, fmt.Errorf("r.c.Do: %w", err)
 	}
 
-	return newResponse(resp)
+	return resp, nil
+}
+
+// gzipWriters are reused by newRequest, as each holds buffers far
+// larger than most bodies.
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// newRequest returns a request with body, if it isn't nil.  If
+// compress is set the body is sent gzipped, with a Content-Encoding
+// header saying so, as clients of ingestion APIs often do.
+func newRequest(ctx context.Context, method, url string, body []byte, compress bool) (*http.Request, error) {
+	if body == nil {
+		return http.NewRequestWithContext(ctx, method, url, nil)
+	}
+	if compress {
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		zw.Write(body) // can't fail writing to a bytes.Buffer
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		req.Header.Set("content-encoding", "gzip")
+	}
+	return req, nil
+}
+
+// setHeaders sets the headers in dict on req.  Non-string keys and
+// values are converted with str().
+func setHeaders(req *http.Request, headers *starlark.Dict) error {
+	for _, kVal := range headers.Keys() {
+		var k string
+		if kStr, ok := kVal.(starlark.String); ok {
+			k = kStr.GoString()
+		} else {
+			k = kVal.String()
+		}
+		vVal, found, err := headers.Get(kVal)
+		if !found || vVal == nil {
+			return fmt.Errorf("data.Get(%v): %w", kVal, err)
+		}
+		var v string
+		if vStr, ok := vVal.(starlark.String); ok {
+			v = vStr.GoString()
+		} else {
+			v = vVal.String()
+		}
+		req.Header.Set(k, v)
+	}
+	return nil
 }
 
-var startTime = time.Now()
+// processClock times the requests of Reporters that aren't
+// requester.ClockReporters, from when the package was initialized.
+var processClock = requester.NewClock()
+
+// reporterClock returns the clock of reporter's run, if it has one.
+func reporterClock(reporter requester.Reporter) *requester.Clock {
+	if r, ok := reporter.(requester.ClockReporter); ok {
+		if c := r.Clock(); c != nil {
+			return c
+		}
+	}
+	return processClock
+}
 
-// now returns time.Duration using stdlib time
-func now() time.Duration { return time.Since(startTime) }
+// processRand is the random number generator of Reporters that aren't
+// requester.RandReporters, which is safe for concurrent use.
+var processRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
 
-func instrument(c *http.Client, req *http.Request, reporter requester.Reporter) (*http.Response, error) {
-	s := now()
+// reporterRand returns the random number generator of reporter's
+// worker, if it has one.
+func reporterRand(reporter requester.Reporter) *rand.Rand {
+	if r, ok := reporter.(requester.RandReporter); ok {
+		if rng := r.Rand(); rng != nil {
+			return rng
+		}
+	}
+	return processRand
+}
+
+// lockedSource is a rand.Source64 that is safe for concurrent use, as
+// the one behind math/rand's functions is.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// instrument performs req, reporting its timings, by clock, to
+// reporter.  The response body is fully read before the result is
+// reported, so that the response read time and size cover the whole
+// body even when its length isn't known up front.  If inspect is
+// non-nil it is called with the response before the result is
+// reported, and may amend the result, e.g. to mark the request failed.
+// If reporter is a requester.HookReporter, its hooks are called around
+// the request.  If maxBodyBytes is positive, only that much of the body
+// is read, and the response is marked truncated if there was more; the
+// rest isn't downloaded, beyond what closeBody drains.
+func instrument(c *http.Client, req *http.Request, reporter requester.Reporter, clock *requester.Clock, maxBodyBytes int64, inspect func(*response, *requester.Result)) (*response, error) {
+	var hooks []requester.Hook
+	if hr, ok := reporter.(requester.HookReporter); ok {
+		hooks = hr.Hooks()
+	}
+	for _, h := range hooks {
+		if err := h.BeforeRequest(req); err != nil {
+			reporter.Start()
+			reporter.Finish(&requester.Result{
+				Offset: clock.Now(),
+				Err:    err,
+				Name:   endpointName(req),
+			})
+			return nil, err
+		}
+	}
+
+	s := clock.Now()
 	var size int64
 	var code int
-	var dnsStart, connStart, resStart, reqStart, delayStart time.Duration
-	var dnsDuration, connDuration, resDuration, reqDuration, delayDuration time.Duration
+	t := &requestTimer{clock: clock}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace()))
+	reporter.Start()
+	resp, err := c.Do(req)
+	var body []byte
+	var truncated, forced bool
+	if err == nil {
+		code = resp.StatusCode
+		body, truncated, err = readBody(resp.Body, maxBodyBytes)
+		forced = closeBody(resp.Body)
+		if err != nil {
+			err = fmt.Errorf("ioutil.ReadAll: %w", err)
+		}
+		size = int64(len(body))
+	}
+
+	end := clock.Now()
+	res := requester.NewResult()
+	res.Offset = s
+	res.StatusCode = code
+	res.Duration = end - s
+	res.Err = err
+	res.ContentLength = size
+	res.ConnDuration = t.connDuration
+	res.DnsDuration = t.dnsDuration
+	res.TLSDuration = t.tlsDuration
+	res.ReqDuration = t.reqDuration
+	res.ResDuration = end - t.resStart
+	res.DelayDuration = t.delayDuration
+	res.Name = endpointName(req)
+	res.ForcedClose = forced
+	res.NewConn = t.newConn
+	res.ConnReused = t.connReused
+	res.DNSLookup = t.dnsLookup
+	res.TLSHandshake = t.tlsHandshake
+	if resp != nil {
+		res.Cache = requester.ResponseCacheStatus(resp)
+	}
+	var r *response
+	if err == nil {
+		r = &response{resp: resp, body: body, truncated: truncated}
+		if inspect != nil {
+			inspect(r, res)
+		}
+	}
+	var hookResp *http.Response
+	if r != nil && len(hooks) > 0 {
+		// the body has been read, so hooks get a copy of the response
+		// to read it again from
+		resp := *r.resp
+		resp.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+		hookResp = &resp
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].AfterResponse(req, hookResp, res)
+	}
+	reporter.Finish(res)
+
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	trace := &httptrace.ClientTrace{
-		DNSStart: func(info httptrace.DNSStartInfo) {
-			dnsStart = now()
+// readBody reads r to the end, or only its first max bytes if max is
+// positive, reporting whether there was more.
+func readBody(r io.Reader, max int64) (body []byte, truncated bool, err error) {
+	if max <= 0 {
+		body, err = ioutil.ReadAll(r)
+		return body, false, err
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(r, max+1))
+	if int64(len(body)) > max {
+		return body[:max], true, err
+	}
+	return body, false, err
+}
+
+// maxDrainBytes is how much of the unread rest of a response body
+// closeBody reads and discards before giving up on its connection.
+const maxDrainBytes = 64 << 10
+
+// closeBody closes a response body, first draining what is left of it,
+// up to maxDrainBytes, as a keep-alive connection only goes back to the
+// pool once its body has been read to the end.  It reports whether the
+// body was closed unfinished, forcing the connection closed, as after a
+// failed read, or a truncated body with more than maxDrainBytes left.
+func closeBody(body io.ReadCloser) (forced bool) {
+	_, err := io.CopyN(ioutil.Discard, body, maxDrainBytes+1)
+	body.Close()
+	return err != io.EOF
+}
+
+// requestTimer times the phases of a request from its trace.  The
+// durations are kept together, rather than captured by each hook
+// separately, to allocate once per request.
+type requestTimer struct {
+	clock                                                              *requester.Clock
+	dnsStart, connStart, tlsStart, resStart, reqStart, delayStart      time.Duration
+	dnsDuration, connDuration, tlsDuration, reqDuration, delayDuration time.Duration
+	newConn, connReused, dnsLookup, tlsHandshake                       bool
+	trace                                                              httptrace.ClientTrace
+}
+
+func (t *requestTimer) clientTrace() *httptrace.ClientTrace {
+	t.trace = httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.dnsLookup = true
+			t.dnsStart = t.clock.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.dnsDuration = t.clock.Now() - t.dnsStart
 		},
-		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
-			dnsDuration = now() - dnsStart
+		GetConn: func(string) {
+			t.connStart = t.clock.Now()
 		},
-		GetConn: func(h string) {
-			connStart = now()
+		TLSHandshakeStart: func() {
+			t.tlsHandshake = true
+			t.tlsStart = t.clock.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.tlsDuration = t.clock.Now() - t.tlsStart
 		},
 		GotConn: func(connInfo httptrace.GotConnInfo) {
+			t.connReused = connInfo.Reused
+			t.newConn = !connInfo.Reused
 			if !connInfo.Reused {
-				connDuration = now() - connStart
+				t.connDuration = t.clock.Now() - t.connStart
 			}
-			reqStart = now()
+			t.reqStart = t.clock.Now()
 		},
-		WroteRequest: func(w httptrace.WroteRequestInfo) {
-			reqDuration = now() - reqStart
-			delayStart = now()
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.reqDuration = t.clock.Now() - t.reqStart
+			t.delayStart = t.clock.Now()
 		},
 		GotFirstResponseByte: func() {
-			delayDuration = now() - delayStart
-			resStart = now()
+			t.delayDuration = t.clock.Now() - t.delayStart
+			t.resStart = t.clock.Now()
 		},
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
-	reporter.Start()
-	resp, err := c.Do(req)
-	if err == nil {
-		size = resp.ContentLength
-		code = resp.StatusCode
-	}
-
-	t := now()
-	resDuration = t - resStart
-	finish := t - s
-	reporter.Finish(&requester.Result{
-		Offset:        s,
-		StatusCode:    code,
-		Duration:      finish,
-		Err:           err,
-		ContentLength: size,
-		ConnDuration:  connDuration,
-		DnsDuration:   dnsDuration,
-		ReqDuration:   reqDuration,
-		ResDuration:   resDuration,
-		DelayDuration: delayDuration,
-	})
+	return &t.trace
+}
 
-	return resp, err
+// endpointName identifies the endpoint req was made to, for
+// per-endpoint statistics.  The query string is left out so that
+// requests differing only in parameters are grouped together.
+func endpointName(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+	return req.Method + " " + u.String()
 }
 
 // isFinite reports whether f represents a finite rational value.
@@ -377,95 +566,179 @@ func isFinite(f float64) bool {
 	return math.Abs(f) <= math.MaxFloat64
 }
 
-func urlencodeBody(v starlark.Value) (string, error) {
+// formEncoders are reused by urlencodeBody, so that encoding a form
+// only allocates the result.
+var formEncoders = sync.Pool{
+	New: func() interface{} { return &formEncoder{} },
+}
 
-	body := form.Values{}
+// urlencodeBody encodes v, a dict, list or struct, as a form, with the
+// keys of nested values in brackets, e.g. card[number]=4242 or
+// tags[0]=a, as many APIs, like Stripe's, expect.  Scalars are
+// formatted as for JSON.
+func urlencodeBody(v starlark.Value) (string, error) {
+	e := formEncoders.Get().(*formEncoder)
+	defer formEncoders.Put(e)
+	e.buf, e.key = e.buf[:0], e.key[:0]
+	switch v.(type) {
+	case json.Marshaler, starlark.NoneType, starlark.Bool, starlark.Int, starlark.Float, starlark.String:
+		// a field needs a key
+		return "", fmt.Errorf("cannot encode %s as a form, only a dict, list or struct", v.Type())
+	}
+	if err := e.emit(v); err != nil {
+		return "", fmt.Errorf("emit: %w", err)
+	}
+	return string(e.buf), nil
+}
 
-	var emit func(x starlark.Value, keyParts []string) error
-	emit = func(x starlark.Value, keyParts []string) error {
-		switch x := x.(type) {
-		case json.Marshaler:
-			// Application-defined starlark.Value types
-			// may define their own JSON encoding.
-			data, err := x.MarshalJSON()
-			if err != nil {
-				return err
-			}
-			body.Add(form.FormatKey(keyParts), string(data))
+// formEncoder writes form fields to buf.  key is the escaped key of
+// the value being encoded, which nested values add their part to, and
+// truncate back again, so that the parts of siblings never alias.
+type formEncoder struct {
+	buf []byte
+	key []byte
+}
 
-		case starlark.NoneType:
-			body.Add(form.FormatKey(keyParts), "null")
+// push adds part to the key, returning the length to pop it back to.
+func (e *formEncoder) push(part string) int {
+	n := len(e.key)
+	if n > 0 {
+		e.key = append(e.key, '[')
+	}
+	e.key = appendQueryEscape(e.key, part, true)
+	if n > 0 {
+		e.key = append(e.key, ']')
+	}
+	return n
+}
 
-		case starlark.Bool:
-			body.Add(form.FormatKey(keyParts), fmt.Sprintf("%t", x))
+// field starts the field for the current key, for its value to be
+// appended to buf.
+func (e *formEncoder) field() {
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '&')
+	}
+	e.buf = append(e.buf, e.key...)
+	e.buf = append(e.buf, '=')
+}
 
-		case starlark.Int:
-			// JSON imposes no limit on numbers,
-			// but the standard Go decoder may switch to float.
-			body.Add(form.FormatKey(keyParts), fmt.Sprint(x))
+func (e *formEncoder) emit(x starlark.Value) error {
+	switch x := x.(type) {
+	case json.Marshaler:
+		// Application-defined starlark.Value types
+		// may define their own JSON encoding.
+		data, err := x.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		e.field()
+		e.buf = appendQueryEscape(e.buf, string(data), false)
+
+	case starlark.NoneType:
+		e.field()
+		e.buf = append(e.buf, "null"...)
+
+	case starlark.Bool:
+		e.field()
+		e.buf = strconv.AppendBool(e.buf, bool(x))
+
+	case starlark.Int:
+		// JSON imposes no limit on numbers,
+		// but the standard Go decoder may switch to float.
+		e.field()
+		if i, ok := x.Int64(); ok {
+			e.buf = strconv.AppendInt(e.buf, i, 10)
+		} else {
+			e.buf = append(e.buf, x.String()...)
+		}
 
-		case starlark.Float:
-			if !isFinite(float64(x)) {
-				return fmt.Errorf("cannot encode non-finite float %v", x)
+	case starlark.Float:
+		if !isFinite(float64(x)) {
+			return fmt.Errorf("cannot encode non-finite float %v", x)
+		}
+		e.field()
+		var f [32]byte
+		e.buf = appendQueryEscape(e.buf, string(strconv.AppendFloat(f[:0], float64(x), 'g', -1, 64)), false)
+
+	case starlark.String:
+		e.field()
+		e.buf = appendQueryEscape(e.buf, string(x), false)
+
+	case starlark.IterableMapping:
+		iter := x.Iterate()
+		defer iter.Done()
+		var k starlark.Value
+		for iter.Next(&k) {
+			s, ok := starlark.AsString(k)
+			if !ok {
+				return fmt.Errorf("%s has %s key, want string", x.Type(), k.Type())
 			}
-			body.Add(form.FormatKey(keyParts), fmt.Sprintf("%g", x))
-
-		case starlark.String:
-			body.Add(form.FormatKey(keyParts), string(x))
-
-		case starlark.IterableMapping:
-			iter := x.Iterate()
-			defer iter.Done()
-			var k starlark.Value
-			for i := 0; iter.Next(&k); i++ {
-				s, ok := starlark.AsString(k)
-				if !ok {
-					return fmt.Errorf("%s has %s key, want string", x.Type(), k.Type())
-				}
-				v, found, err := x.Get(k)
-				if err != nil || !found {
-					log.Fatalf("internal error: mapping %s has %s among keys but value lookup fails", x.Type(), k)
-				}
-
-				if err := emit(v, append(keyParts, s)); err != nil {
-					return fmt.Errorf("in %s key %s: %v", x.Type(), k, err)
-				}
+			v, found, err := x.Get(k)
+			if err != nil || !found {
+				return fmt.Errorf("internal error: mapping %s has %s among keys but value lookup fails", x.Type(), k)
 			}
 
-		case starlark.Iterable:
-			// e.g. tuple, list
-			iter := x.Iterate()
-			defer iter.Done()
-			var elem starlark.Value
-			for i := 0; iter.Next(&elem); i++ {
-				if err := emit(elem, append(keyParts, fmt.Sprint(i))); err != nil {
-					return fmt.Errorf("at %s index %d: %v", x.Type(), i, err)
-				}
+			n := e.push(s)
+			if err := e.emit(v); err != nil {
+				return fmt.Errorf("in %s key %s: %v", x.Type(), k, err)
 			}
+			e.key = e.key[:n]
+		}
 
-		case starlark.HasAttrs:
-			// e.g. struct
-			var names []string
-			names = append(names, x.AttrNames()...)
-			sort.Strings(names)
-			for _, name := range names {
-				v, err := x.Attr(name)
-				if err != nil || v == nil {
-					log.Fatalf("internal error: dir(%s) includes %q but value has no .%s field", x.Type(), name, name)
-				}
-				if err := emit(v, append(keyParts, name)); err != nil {
-					return fmt.Errorf("in field .%s: %v", name, err)
-				}
+	case starlark.Iterable:
+		// e.g. tuple, list
+		iter := x.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		var index [20]byte
+		for i := 0; iter.Next(&elem); i++ {
+			n := e.push(string(strconv.AppendInt(index[:0], int64(i), 10)))
+			if err := e.emit(elem); err != nil {
+				return fmt.Errorf("at %s index %d: %v", x.Type(), i, err)
 			}
+			e.key = e.key[:n]
+		}
 
-		default:
-			return fmt.Errorf("cannot encode %s as JSON", x.Type())
+	case starlark.HasAttrs:
+		// e.g. struct
+		var names []string
+		names = append(names, x.AttrNames()...)
+		sort.Strings(names)
+		for _, name := range names {
+			v, err := x.Attr(name)
+			if err != nil || v == nil {
+				return fmt.Errorf("internal error: dir(%s) includes %q but value has no .%s field", x.Type(), name, name)
+			}
+			n := e.push(name)
+			if err := e.emit(v); err != nil {
+				return fmt.Errorf("in field .%s: %v", name, err)
+			}
+			e.key = e.key[:n]
 		}
-		return nil
+
+	default:
+		return fmt.Errorf("cannot encode %s as JSON", x.Type())
 	}
+	return nil
+}
 
-	if err := emit(v, []string{}); err != nil {
-		return "", fmt.Errorf("emit: %w", err)
+// appendQueryEscape appends s escaped as url.QueryEscape does, but
+// leaving brackets as they are if key is set, since they delimit the
+// parts of keys.
+func appendQueryEscape(dst []byte, s string, key bool) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			dst = append(dst, c)
+		case key && (c == '[' || c == ']'):
+			dst = append(dst, c)
+		case c == ' ':
+			dst = append(dst, '+')
+		default:
+			dst = append(dst, '%', hex[c>>4], hex[c&15])
+		}
 	}
-	return body.Encode(), nil
+	return dst
 }
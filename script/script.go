@@ -6,14 +6,18 @@ package script
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math/rand"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"go.starlark.net/starlark"
 
@@ -25,26 +29,180 @@ const scriptTlsKey = "script_tls"
 
 type Script struct {
 	config Config
+	env    *envModule
+	logger *slog.Logger
+	// shared is ctx.shared, shared by every call of Do.
+	shared *sharedDict
+	// maxBodyBytes caps how much of each HTTP response is read, if
+	// positive.
+	maxBodyBytes int64
+	// compressRequests gzips the bodies of HTTP requests by default.
+	compressRequests bool
+}
+
+// An Option configures a Script.
+type Option func(*options)
+
+type options struct {
+	env        map[string]string
+	source     []byte
+	modules    starlark.StringDict
+	logger     *slog.Logger
+	fileReader FileReader
+
+	maxBodyBytes     int64
+	compressRequests bool
+}
+
+// WithEnv makes the variables in env, such as those read from a .env
+// file by ReadEnvFile, available to the script from the env module and
+// as ctx.vars.  Each call of main gets its own copy of ctx.vars, so a
+// script may change it freely; state shared between workers belongs in
+// ctx.shared.
+func WithEnv(env map[string]string) Option {
+	return func(o *options) {
+		o.env = env
+	}
+}
+
+// WithLogger sends the output of print() to logger, rather than
+// slog.Default().  While running, prints go to the Reporter's logger
+// instead if it is a requester.LoggingReporter, which adds the
+// attributes of the run and worker.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithMaxBodyBytes reads at most n bytes of each HTTP response, so that
+// unexpectedly large responses aren't downloaded in full again and
+// again.  The rest of the body is discarded unread, and the response's
+// truncated attribute is set.  n <= 0, the default, reads bodies in
+// full.
+func WithMaxBodyBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBodyBytes = n
+	}
+}
+
+// WithCompressRequests gzips the bodies of the script's HTTP requests,
+// setting Content-Encoding, as the real clients of many ingestion APIs
+// do.  A requests.post() can override it with compress_request.
+func WithCompressRequests() Option {
+	return func(o *options) {
+		o.compressRequests = true
+	}
+}
+
+// WithSource makes src the source of the script instead of the file
+// New is given, which then only names it, for scripts read from stdin
+// or the command line.  load() still resolves modules relative to it.
+func WithSource(src []byte) Option {
+	return func(o *options) {
+		o.source = src
+	}
 }
 
 type scriptTls struct {
 	ctx      context.Context
 	client   *http.Client
 	reporter requester.Reporter
-	count    int
+	// clock times the requests reporter is told about.
+	clock *requester.Clock
+	// rand is the worker's random number generator, for anything
+	// random about the script's requests.
+	rand   *rand.Rand
+	logger *slog.Logger
+	// maxBodyBytes caps how much of each HTTP response is read.
+	maxBodyBytes int64
+	// compressRequests gzips request bodies by default.
+	compressRequests bool
+	count            int
+	// closers are connections opened by the script, closed when it
+	// returns if it didn't close them itself.
+	closers []io.Closer
+	// published maps the topic and payload of MQTT messages sent by
+	// the script to when they were sent, so that receiving one can be
+	// reported as its end-to-end delivery.
+	published map[string]time.Duration
+	// batches are the script's unsent Kafka records, by cluster, topic,
+	// partition and acks.
+	batches map[string]*kafkaBatch
 }
 
-// predeclaredModules is a helper that returns new predeclared modules.
-// Returns proto module separately for (optional) extra initialization.
-func predeclaredModules() (modules starlark.StringDict) {
+// deadline returns the deadline for a single read or write by a
+// connection-oriented module like ws or tcp: the request timeout, or
+// the context's deadline if that is sooner.  The zero time means no
+// deadline.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if cd, ok := ctx.Deadline(); ok && (d.IsZero() || cd.Before(d)) {
+		d = cd
+	}
+	return d
+}
+
+// clientTLSConfig returns the TLS configuration of c's transport, so
+// that TLS options apply to the connections of modules like ws and tcp
+// too.  Transports wrapping another, with an Unwrap method, are looked
+// through.
+func clientTLSConfig(c *http.Client, serverName string) *tls.Config {
+	rt := c.Transport
+	for {
+		w, ok := rt.(interface{ Unwrap() http.RoundTripper })
+		if !ok {
+			break
+		}
+		rt = w.Unwrap()
+	}
+	var config *tls.Config
+	if t, ok := rt.(*http.Transport); ok && t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	return config
+}
+
+// predeclaredModules is a helper that returns new predeclared modules,
+// the built in ones and those registered with RegisterModule.
+func predeclaredModules(env *envModule) starlark.StringDict {
+	modules := builtinModules(env)
+	registeredModules(modules)
+	return modules
+}
+
+// builtinModules returns new instances of the built in modules.
+func builtinModules(env *envModule) starlark.StringDict {
 	return starlark.StringDict{
+		"check":    starlark.NewBuiltin("check", fnCheck),
+		"dns":      DNSModule(),
+		"env":      env,
+		"grpc":     GRPCModule(),
 		"json":     starlarkjson.Module,
+		"kafka":    KafkaModule(),
+		"mqtt":     MQTTModule(),
+		"random":   RandomModule(),
 		"requests": RequestsModule(),
+		"smtp":     SMTPModule(),
+		"tcp":      TCPModule(),
+		"ws":       WSModule(),
 	}
 }
 
-func print(t *starlark.Thread, msg string) {
-	_, _ = fmt.Fprintf(os.Stderr, "[%v] %s\n", t.CallFrame(1).Pos, msg)
+// printer returns the Print function of threads, which logs the
+// messages to logger with where they were printed from.
+func printer(logger *slog.Logger) func(*starlark.Thread, string) {
+	return func(t *starlark.Thread, msg string) {
+		logger.Info(msg, "pos", t.CallFrame(1).Pos.String())
+	}
 }
 
 // A FileReader controls how load() calls resolve and read other modules.
@@ -89,17 +247,38 @@ func (r *localFileReader) ReadFile(ctx context.Context, path string) ([]byte, er
 	return ioutil.ReadFile(path)
 }
 
+// sourceFileReader reads the root module from memory, and anything it
+// loads with the FileReader it wraps.
+type sourceFileReader struct {
+	FileReader
+	filename string
+	source   []byte
+}
+
+func (r *sourceFileReader) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	if path == r.filename {
+		return r.source, nil
+	}
+	return r.FileReader.ReadFile(ctx, path)
+}
+
 // A Config is a hithere script that has been fully loaded and is ready
 // for execution.
 type Config struct {
 	filename string
 	globals  starlark.StringDict
 	locals   starlark.StringDict
+	// versions are the API versions of the script and the modules it
+	// loaded, by path.
+	versions map[string]int
 }
 
 type loadOptions struct {
 	globals    starlark.StringDict
 	fileReader FileReader
+	logger     *slog.Logger
+	// versions are set to the API versions of the modules loaded.
+	versions map[string]int
 }
 
 var (
@@ -148,28 +327,76 @@ func loadImpl(ctx context.Context, opts *loadOptions, filename string) (starlark
 
 		cache[modulePath] = nil
 		globals, err := starlark.ExecFile(thread, modulePath, moduleSource, opts.globals)
+		if err == nil {
+			var version int
+			version, err = moduleAPIVersion(modulePath, globals)
+			opts.versions[modulePath] = version
+		}
 		cache[modulePath] = &cacheEntry{globals, err}
 
 		return globals, err
 	}
-	locals, err := load(&starlark.Thread{
-		Print: print,
+	thread := &starlark.Thread{
+		Print: printer(opts.logger),
 		Load:  load,
-	}, filename)
-	return locals, err
+	}
+	thread.SetLocal(apiVersionsKey, opts.versions)
+	return load(thread, filename)
 }
 
-func New(filename string) (*Script, error) {
-	s := &Script{}
+// New loads the script filename, which is a local path, or a URI
+// selecting where the script and the modules it loads are read from:
+// a zip archive, a git repository or a registered FS, see RegisterFS.
+func New(filename string, opts ...Option) (*Script, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &Script{
+		env:    EnvModule(o.env),
+		logger: o.logger,
+		shared: newSharedDict(),
+
+		maxBodyBytes:     o.maxBodyBytes,
+		compressRequests: o.compressRequests,
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
 
 	ctx := context.Background()
 
-	modules := predeclaredModules()
+	modules := predeclaredModules(s.env)
+	for name, m := range o.modules {
+		if _, ok := modules[name]; ok {
+			return nil, fmt.Errorf("module %q is already predeclared", name)
+		}
+		modules[name] = m
+	}
+	reader, rootPath := o.fileReader, filename
+	if reader == nil && o.source != nil {
+		// only names the script; there's nothing to open
+		reader = LocalFileReader(filepath.Dir(filename))
+	}
+	if reader == nil {
+		var closeReader func() error
+		var err error
+		reader, rootPath, closeReader, err = openFileReader(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer closeReader()
+	}
 	parsedOpts := &loadOptions{
 		globals:    modules,
-		fileReader: LocalFileReader(filepath.Dir(filename)),
+		fileReader: reader,
+		logger:     s.logger,
+		versions:   make(map[string]int),
+	}
+	if o.source != nil {
+		parsedOpts.fileReader = &sourceFileReader{parsedOpts.fileReader, rootPath, o.source}
 	}
-	scriptLocals, err := loadImpl(ctx, parsedOpts, filename)
+	scriptLocals, err := loadImpl(ctx, parsedOpts, rootPath)
 	if err != nil {
 		return nil, err
 	}
@@ -178,40 +405,76 @@ func New(filename string) (*Script, error) {
 		filename: filename,
 		globals:  parsedOpts.globals,
 		locals:   scriptLocals,
+		versions: parsedOpts.versions,
 	}
 	return s, nil
 }
 
-func (s *Script) Do(ctx context.Context, client *http.Client, reporter requester.Reporter) (err error) {
-	vars := &starlark.Dict{}
-
+// main returns the script's main function.
+func (s *Script) main() (starlark.Callable, error) {
 	mainVal, ok := s.config.locals["main"]
 	if !ok {
-		return fmt.Errorf("no `main' function found in %q", s.config.filename)
+		return nil, fmt.Errorf("no `main' function found in %q", s.config.filename)
 	}
 	main, ok := mainVal.(starlark.Callable)
 	if !ok {
-		return fmt.Errorf("`main' must be a function (got a %s)", mainVal.Type())
+		return nil, fmt.Errorf("`main' must be a function (got a %s)", mainVal.Type())
+	}
+	return main, nil
+}
+
+// Validate returns an error if the script has no main function for Do
+// to call.
+func (s *Script) Validate() error {
+	_, err := s.main()
+	return err
+}
+
+// Do calls the script's main function with a ctx whose vars are a new
+// dict of the variables given WithEnv, and whose shared dict is shared
+// with every other call, so Do is safe to call from concurrent workers.
+func (s *Script) Do(ctx context.Context, client *http.Client, reporter requester.Reporter) (err error) {
+	vars := s.env.vars()
+
+	main, err := s.main()
+	if err != nil {
+		return err
 	}
 
 	tls := &scriptTls{
 		ctx:      ctx,
 		client:   client,
 		reporter: reporter,
+		clock:    reporterClock(reporter),
+		rand:     reporterRand(reporter),
+		logger:   s.logger,
 		count:    0,
+
+		maxBodyBytes:     s.maxBodyBytes,
+		compressRequests: s.compressRequests,
+	}
+	if r, ok := reporter.(requester.LoggingReporter); ok {
+		tls.logger = r.Logger()
 	}
 
 	thread := &starlark.Thread{
-		Print: print,
+		Print: printer(tls.logger),
 	}
 	thread.SetLocal("context", ctx)
 	thread.SetLocal(scriptTlsKey, tls)
+	thread.SetLocal(apiVersionsKey, s.config.versions)
 	mainCtx := &Module{
 		Name: "hithere_ctx",
 		Attrs: starlark.StringDict(map[string]starlark.Value{
-			"vars": vars,
+			"vars":   vars,
+			"shared": s.shared,
 		}),
 	}
+	defer func() {
+		for _, c := range tls.closers {
+			c.Close()
+		}
+	}()
 	args := starlark.Tuple([]starlark.Value{mainCtx})
 	_, err = starlark.Call(thread, main, args, nil)
 	if err != nil {
@@ -5,10 +5,42 @@
 package script
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 
 	"go.starlark.net/starlark"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
 
+	"github.com/bpowers/hithere/grpc"
+	"github.com/bpowers/hithere/requester"
 	"github.com/bpowers/hithere/script/starlarkjson"
 )
 
@@ -25,6 +57,19 @@ func TestNestedSerialize(t *testing.T) {
 			src:      `{"card": {"number": "4242424242424242"}}`,
 			expected: `card[number]=4242424242424242`,
 		},
+		{
+			// siblings' keys are independent however deeply nested
+			src:      `{"a": {"b": [1, {"c": 2}, [3, [4, 5]], 6]}}`,
+			expected: `a[b][0]=1&a[b][1][c]=2&a[b][2][0]=3&a[b][2][1][0]=4&a[b][2][1][1]=5&a[b][3]=6`,
+		},
+		{
+			src:      `{"q": "a b&c=d/é"}`,
+			expected: `q=a+b%26c%3Dd%2F%C3%A9`,
+		},
+		{
+			src:      `{"k[0] x": [true, null, 12345678901234567890123]}`,
+			expected: `k[0]+x[0]=true&k[0]+x[1]=null&k[0]+x[2]=12345678901234567890123`,
+		},
 	}
 
 	for _, test := range cases {
@@ -43,4 +88,1742 @@ func TestNestedSerialize(t *testing.T) {
 			t.Fatalf("expected equal:\n%s\n%s\n", test.expected, string(body))
 		}
 	}
+
+	if _, err := urlencodeBody(starlark.String("x")); err == nil {
+		t.Errorf("expected an error encoding a string as a form")
+	}
+}
+
+// formSrc is a form like one for a payments API, for
+// BenchmarkURLEncodeBody.
+const formSrc = `{
+    "amount": 2000,
+    "currency": "usd",
+    "capture": True,
+    "description": None,
+    "card": {"number": "4242424242424242", "exp_month": 12, "exp_year": 2030, "cvc": "123"},
+    "metadata": {"order_id": "6735", "tags": ["a b", "c&d"]},
+}`
+
+func BenchmarkURLEncodeBody(b *testing.B) {
+	form, err := starlark.Eval(&starlark.Thread{}, "form.star", formSrc, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	form.(*starlark.Dict).SetKey(starlark.String("rate"), starlark.Float(0.25))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := urlencodeBody(form); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// jsonPayload returns a JSON array of n objects like those of a
+// listing API, for BenchmarkResponseJSON.
+func jsonPayload(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":%d,"name":"item \"%d\"","price":%d.99,"tags":["sale","new"],"seller":{"id":9007199254740993,"verified":true,"note":null}}`, i, i, i)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+func TestResponseJSON(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{`{"z": 1, "a": [2, 3.5, -4e2], "m": null}`, `{"z": 1, "a": (2, 3.5, -400), "m": None}`},
+		{`{"id": 9007199254740993, "big": -123456789012345678901234567890}`, `{"id": 9007199254740993, "big": -123456789012345678901234567890}`},
+		{` "tab\there \"q\" \u00e9\ud83d\ude00\ud800" `, `"tab\there \"q\" é😀�"`},
+		{`[[], {}, true, false]`, `((), {}, True, False)`},
+		{`{"a": 1, "a": 2}`, `{"a": 2}`},
+	} {
+		r := &responseAttr{&response{body: []byte(tc.body)}, "json"}
+		v, err := r.CallInternal(nil, nil, nil)
+		if err != nil {
+			t.Errorf("json(%s): %s", tc.body, err)
+			continue
+		}
+		if got := v.String(); got != tc.want {
+			t.Errorf("json(%s) = %s; want %s", tc.body, got, tc.want)
+		}
+	}
+
+	for _, body := range []string{
+		``, `{`, `[1,]`, `{"a" 1}`, `01`, `1.`, `-`, `"\x"`, `"\u12"`, "\"a\nb\"", `nul`, `1 2`,
+		strings.Repeat("[", 10001) + strings.Repeat("]", 10001),
+	} {
+		r := &responseAttr{&response{body: []byte(body)}, "json"}
+		if _, err := r.CallInternal(nil, nil, nil); err == nil || !strings.HasPrefix(err.Error(), "response.json: ") {
+			t.Errorf("json(%.20q): expected a response.json error, got %v", body, err)
+		}
+	}
+}
+
+func BenchmarkResponseJSON(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		body := jsonPayload(n)
+		b.Run(fmt.Sprintf("%dKB", len(body)/1000), func(b *testing.B) {
+			r := &responseAttr{&response{body: body}, "json"}
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.CallInternal(nil, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type testReporter struct {
+	results []*requester.Result
+}
+
+func (r *testReporter) Start()                       {}
+func (r *testReporter) Finish(res *requester.Result) { r.results = append(r.results, res) }
+func (r *testReporter) UserAgent() string            { return "hithere-test" }
+
+func TestWS(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    conn = ws.connect("ws://` + strings.TrimPrefix(server.URL, "http://") + `/echo")
+    conn.ping()
+    conn.send("hello")
+    if conn.recv() != "hello":
+        fail("unexpected echo")
+    conn.close()
+`
+	filename := filepath.Join(dir, "ws.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected connect and message results, got %d", len(reporter.results))
+	}
+	for _, res := range reporter.results {
+		if res.Err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("unexpected result %+v", res)
+		}
+	}
+	if msg := reporter.results[1]; msg.ContentLength != 5 || msg.Name != "WS MESSAGE "+strings.Replace(server.URL, "http", "ws", 1)+"/echo" {
+		t.Errorf("unexpected message result %+v", msg)
+	}
+}
+
+// echoFileDescriptor is the FileDescriptorProto of:
+//
+//	syntax = "proto3";
+//	package test;
+//	enum Kind { A = 0; B = 1; }
+//	message Msg { string text = 1; repeated int32 nums = 2; Kind kind = 3; }
+//	service Echo { rpc Say(Msg) returns (Msg); }
+func echoFileDescriptor() []byte {
+	field := func(name string, num, label, typ int, typeName string) []byte {
+		var b []byte
+		b = grpc.AppendStringField(b, 1, name)
+		b = grpc.AppendVarintField(b, 3, uint64(num))
+		b = grpc.AppendVarintField(b, 4, uint64(label))
+		b = grpc.AppendVarintField(b, 5, uint64(typ))
+		return grpc.AppendStringField(b, 6, typeName)
+	}
+	var msg []byte
+	msg = grpc.AppendStringField(msg, 1, "Msg")
+	msg = grpc.AppendBytesField(msg, 2, field("text", 1, 1, grpc.TypeString, ""))
+	msg = grpc.AppendBytesField(msg, 2, field("nums", 2, 3, grpc.TypeInt32, ""))
+	msg = grpc.AppendBytesField(msg, 2, field("kind", 3, 1, grpc.TypeEnum, ".test.Kind"))
+
+	value := func(name string, num int) []byte {
+		return grpc.AppendVarintField(grpc.AppendStringField(nil, 1, name), 2, uint64(num))
+	}
+	var enum []byte
+	enum = grpc.AppendStringField(enum, 1, "Kind")
+	enum = grpc.AppendBytesField(enum, 2, value("A", 0))
+	enum = grpc.AppendBytesField(enum, 2, value("B", 1))
+
+	var method []byte
+	method = grpc.AppendStringField(method, 1, "Say")
+	method = grpc.AppendStringField(method, 2, ".test.Msg")
+	method = grpc.AppendStringField(method, 3, ".test.Msg")
+	var svc []byte
+	svc = grpc.AppendStringField(svc, 1, "Echo")
+	svc = grpc.AppendBytesField(svc, 2, method)
+
+	var file []byte
+	file = grpc.AppendStringField(file, 1, "echo.proto")
+	file = grpc.AppendStringField(file, 2, "test")
+	file = grpc.AppendBytesField(file, 4, msg)
+	file = grpc.AppendBytesField(file, 5, enum)
+	file = grpc.AppendBytesField(file, 6, svc)
+	return grpc.AppendStringField(file, 12, "proto3")
+}
+
+// grpcTestServer echoes calls to /test.Echo/Say and answers server
+// reflection requests with echoFileDescriptor.
+func grpcTestServer() *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("trailer", "grpc-status")
+		w.WriteHeader(http.StatusOK)
+		for {
+			var hdr [5]byte
+			if _, err := io.ReadFull(r.Body, hdr[:]); err != nil {
+				break
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+			if _, err := io.ReadFull(r.Body, msg); err != nil {
+				break
+			}
+			resp := msg
+			if r.URL.Path != "/test.Echo/Say" {
+				fields, _ := grpc.ParseFields(msg)
+				var files []byte
+				files = grpc.AppendBytesField(files, 1, echoFileDescriptor())
+				switch fields[0].Num {
+				case 7:
+					svc := grpc.AppendStringField(nil, 1, "test.Echo")
+					resp = grpc.AppendBytesField(nil, 6, grpc.AppendBytesField(nil, 1, svc))
+				default:
+					resp = grpc.AppendBytesField(nil, 4, files)
+				}
+			}
+			binary.BigEndian.PutUint32(hdr[1:], uint32(len(resp)))
+			w.Write(append(hdr[:], resp...))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("grpc-status", "0")
+	}
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handler), &http2.Server{}))
+}
+
+func TestGRPC(t *testing.T) {
+	server := grpcTestServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	descriptors := filepath.Join(dir, "echo.pb")
+	set := grpc.AppendBytesField(nil, 1, echoFileDescriptor())
+	if err := ioutil.WriteFile(descriptors, set, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `
+def main(ctx):
+    for conn in [grpc.connect("` + server.URL + `", descriptors="` + descriptors + `"), grpc.connect("` + server.URL + `")]:
+        resp = conn.call("test.Echo/Say", {"text": "hi", "nums": [1, -2], "kind": "B"})
+        resp.raise_for_status()
+        if resp.response != {"text": "hi", "nums": [1, -2], "kind": "B"}:
+            fail("unexpected response %s" % resp.response)
+`
+	filename := filepath.Join(dir, "grpc.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	for _, res := range reporter.results {
+		if res.Err != nil || res.StatusCode != grpc.OK || res.Name != "GRPC /test.Echo/Say" {
+			t.Errorf("unexpected result %+v", res)
+		}
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("content-type") != "application/grpc-web+proto" || r.Header.Get("x-grpc-web") != "1" {
+			http.Error(w, "not gRPC-Web", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("content-type", "application/grpc-web+proto")
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+		trailers := "grpc-status: 0\r\n"
+		hdr := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(trailers)))
+		w.Write(append(hdr, trailers...))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	descriptors := filepath.Join(dir, "echo.pb")
+	set := grpc.AppendBytesField(nil, 1, echoFileDescriptor())
+	if err := ioutil.WriteFile(descriptors, set, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `
+def main(ctx):
+    conn = grpc.connect("` + server.URL + `", descriptors="` + descriptors + `", web=True)
+    resp = conn.call("test.Echo/Say", {"text": "hi", "nums": [1, -2], "kind": "B"})
+    resp.raise_for_status()
+    if resp.response != {"text": "hi", "nums": [1, -2], "kind": "B"}:
+        fail("unexpected response %s" % resp.response)
+`
+	filename := filepath.Join(dir, "grpcweb.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil || res.StatusCode != grpc.OK {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Variables["id"] == "1" {
+			io.WriteString(w, `{"data": {"user": {"name": "a"}}}`)
+		} else {
+			io.WriteString(w, `{"data": null, "errors": [{"message": "not found"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    for id in ["1", "2"]:
+        requests.graphql("` + server.URL + `", "query User($id: ID!) { user(id: $id) { name } }", variables={"id": id})
+`
+	filename := filepath.Join(dir, "graphql.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	for _, res := range reporter.results {
+		if res.Name != "GRAPHQL User" {
+			t.Errorf("unexpected name %q", res.Name)
+		}
+	}
+	if err := reporter.results[0].Err; err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if err := reporter.results[1].Err; err == nil || err.Error() != "graphql: not found" {
+		t.Errorf("expected a graphql error, got %v", err)
+	}
+}
+
+func TestSOAP(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Header.Get("SOAPAction")+" "+string(body))
+		if strings.Contains(string(body), "<symbol>ACME</symbol>") {
+			io.WriteString(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><GetQuoteResponse><price>1.5</price></GetQuoteResponse></soap:Body></soap:Envelope>`)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><soap:Fault><faultcode>soap:Client</faultcode><faultstring>unknown symbol</faultstring></soap:Fault></soap:Body></soap:Envelope>`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    for symbol in ["ACME", "NOPE"]:
+        requests.soap("` + server.URL + `", "GetQuote", {"GetQuote": {"@xmlns": "urn:stock", "symbol": symbol, "fields": ["bid", "ask"]}})
+`
+	filename := filepath.Join(dir, "soap.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	expected := `"GetQuote" <?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+		`<GetQuote xmlns="urn:stock"><symbol>ACME</symbol><fields>bid</fields><fields>ask</fields></GetQuote>` +
+		`</soap:Body></soap:Envelope>`
+	if requests[0] != expected {
+		t.Errorf("unexpected request %s", requests[0])
+	}
+	if res := reporter.results[0]; res.Err != nil || res.Name != "SOAP GetQuote" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if err := reporter.results[1].Err; err == nil || err.Error() != "soap: fault soap:Client: unknown symbol" {
+		t.Errorf("expected a soap fault, got %v", err)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var calls []struct {
+			Method string          `json:"method"`
+			Params []int           `json:"params"`
+			ID     json.RawMessage `json:"id"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		batch := body[0] == '['
+		if !batch {
+			body = []byte("[" + string(body) + "]")
+		}
+		json.Unmarshal(body, &calls)
+		var replies []string
+		// reply in reverse order, to check they're matched up by ID
+		for i := len(calls) - 1; i >= 0; i-- {
+			c := calls[i]
+			if c.Method == "add" {
+				replies = append(replies, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %s, "result": %d}`, c.ID, c.Params[0]+c.Params[1]))
+			} else {
+				replies = append(replies, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %s, "error": {"code": -32601, "message": "Method not found"}}`, c.ID))
+			}
+		}
+		if batch {
+			io.WriteString(w, "["+strings.Join(replies, ",")+"]")
+		} else {
+			io.WriteString(w, replies[0])
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    r = requests.jsonrpc("` + server.URL + `", "add", [1, 2])
+    if not r.ok or r.result != 3:
+        fail("unexpected response %s" % r.result)
+    rs = requests.jsonrpc("` + server.URL + `", batch=[("add", [2, 3]), {"method": "sub", "params": [1, 1]}])
+    if rs[0].result != 5:
+        fail("unexpected result %s" % rs[0].result)
+    if rs[1].ok or rs[1].error["code"] != -32601:
+        fail("expected an error, got %s" % rs[1].error)
+`
+	filename := filepath.Join(dir, "jsonrpc.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil || res.Name != "JSONRPC add" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	res := reporter.results[1]
+	if res.Name != "JSONRPC [add, sub]" {
+		t.Errorf("unexpected name %q", res.Name)
+	}
+	if res.Err == nil || res.Err.Error() != "jsonrpc: sub: Method not found (-32601)" {
+		t.Errorf("expected a jsonrpc error, got %v", res.Err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "+OK ready\r\n")
+		io.Copy(c, c)
+	}()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	src := `
+def main(ctx):
+    conn = tcp.connect("` + host + `", ` + port + `)
+    if conn.expect("\r\n") != "+OK ready\r\n":
+        fail("unexpected greeting")
+    conn.send("PING\r\nextra")
+    if conn.expect("\r\n") != "PING\r\n":
+        fail("unexpected reply")
+    if conn.recv(5) != "extra":
+        fail("unexpected leftover")
+    conn.close()
+`
+	filename := filepath.Join(dir, "tcp.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	// connect, greeting, reply and leftover
+	if len(reporter.results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil || res.Name != "TCP CONNECT "+ln.Addr().String() {
+		t.Errorf("unexpected connect result %+v", res)
+	}
+	if res := reporter.results[2]; res.Err != nil || res.ContentLength != 6 {
+		t.Errorf("unexpected round trip result %+v", res)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			hdr, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			hdr.Response = true
+			if q.Name.String() != "example.test." {
+				hdr.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, hdr)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if hdr.RCode == dnsmessage.RCodeSuccess {
+				rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+				switch q.Type {
+				case dnsmessage.TypeA:
+					b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+				case dnsmessage.TypeSRV:
+					target := dnsmessage.MustNewName("svc.example.test.")
+					b.SRVResource(rh, dnsmessage.SRVResource{Priority: 10, Weight: 5, Port: 8080, Target: target})
+				}
+			}
+			msg, _ := b.Finish()
+			pc.WriteTo(msg, addr)
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    r = dns.query("` + pc.LocalAddr().String() + `", "example.test")
+    if not r.ok or r.answers != ["192.0.2.1"]:
+        fail("unexpected A response %s %s" % (r.rcode, r.answers))
+    r = dns.query("` + pc.LocalAddr().String() + `", "example.test", type="SRV")
+    if r.answers != ["10 5 8080 svc.example.test."]:
+        fail("unexpected SRV response %s" % r.answers)
+    r = dns.query("` + pc.LocalAddr().String() + `", "missing.test")
+    if r.ok or r.rcode != "NXDOMAIN":
+        fail("unexpected rcode %s" % r.rcode)
+`
+	filename := filepath.Join(dir, "dns.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil || res.StatusCode != 0 || res.Name != "DNS A @"+pc.LocalAddr().String() {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if res := reporter.results[2]; res.StatusCode != int(dnsmessage.RCodeNameError) {
+		t.Errorf("expected NXDOMAIN status code, got %d", res.StatusCode)
+	}
+}
+
+// mqttTestBroker accepts a single connection and echoes messages
+// published with QoS 1 back to it, for a subscriber on the same
+// connection.
+func mqttTestBroker(ln net.Listener) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		h, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		n, _ := binary.ReadUvarint(r)
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch h >> 4 {
+		case 1: // CONNECT
+			c.Write([]byte{0x20, 2, 0, 0})
+		case 8: // SUBSCRIBE
+			c.Write([]byte{0x90, 3, body[0], body[1], 1})
+		case 3: // PUBLISH
+			topicLen := int(binary.BigEndian.Uint16(body))
+			id := body[2+topicLen : 4+topicLen]
+			c.Write([]byte{0x40, 2, id[0], id[1]})
+			c.Write(append([]byte{h, byte(n)}, body...))
+		case 4: // PUBACK of the echoed message
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go mqttTestBroker(ln)
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	src := `
+def main(ctx):
+    conn = mqtt.connect("` + host + `", port=` + port + `)
+    conn.subscribe("sensors/1", qos=1)
+    conn.publish("sensors/1", "21.5", qos=1)
+    msg = conn.recv()
+    if msg.topic != "sensors/1" or msg.payload != "21.5" or msg.qos != 1:
+        fail("unexpected message %s" % msg)
+    if conn.recv(timeout=0) != None:
+        fail("unexpected second message")
+    conn.close()
+`
+	filename := filepath.Join(dir, "mqtt.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	// connect, subscribe, publish and delivery
+	var names []string
+	for _, res := range reporter.results {
+		if res.Err != nil {
+			t.Errorf("unexpected error in %+v", res)
+		}
+		names = append(names, res.Name)
+	}
+	expected := []string{
+		"MQTT CONNECT " + ln.Addr().String(),
+		"MQTT SUBSCRIBE sensors/1",
+		"MQTT PUBLISH sensors/1",
+		"MQTT DELIVER sensors/1",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected results %v, got %v", expected, names)
+	}
+	if res := reporter.results[1]; res.StatusCode != 1 {
+		t.Errorf("expected granted QoS 1, got %d", res.StatusCode)
+	}
+}
+
+// kafkaTestBroker serves a cluster of one broker, with a single
+// partition of every topic, counting the records produced to it.
+func kafkaTestBroker(t *testing.T, ln net.Listener, records *int64) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		apiKey := binary.BigEndian.Uint16(req)
+		correlationID := req[4:8]
+		clientIDLen := int(binary.BigEndian.Uint16(req[8:]))
+		body := req[10+clientIDLen:]
+
+		resp := append([]byte{}, correlationID...)
+		be16 := func(v int) { resp = append(resp, byte(v>>8), byte(v)) }
+		be32 := func(v int) { resp = append(resp, byte(v>>24), byte(v>>16), byte(v>>8), byte(v)) }
+		str := func(s string) { be16(len(s)); resp = append(resp, s...) }
+		switch apiKey {
+		case 3: // Metadata v4
+			topicLen := int(binary.BigEndian.Uint16(body[4:]))
+			topic := string(body[6 : 6+topicLen])
+			be32(0)
+			be32(1)
+			be32(7)
+			str(host)
+			be32(portNum)
+			be16(-1) // rack
+			be16(-1) // cluster ID
+			be32(7)
+			be32(1)
+			be16(0)
+			str(topic)
+			resp = append(resp, 0)
+			be32(1)
+			be16(0)
+			be32(0)
+			be32(7)
+			be32(0)
+			be32(0)
+		case 0: // Produce v3
+			acks := binary.BigEndian.Uint16(body[2:])
+			topicLen := int(binary.BigEndian.Uint16(body[12:]))
+			topic := string(body[14 : 14+topicLen])
+			batch := body[14+topicLen+12:]
+			// base offset, length, leader epoch, magic, then the CRC
+			crc := binary.BigEndian.Uint32(batch[17:])
+			if crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) != crc {
+				t.Errorf("bad record batch CRC")
+			}
+			base := *records
+			*records += int64(binary.BigEndian.Uint32(batch[57:]))
+			if acks == 0 {
+				continue
+			}
+			be32(1)
+			str(topic)
+			be32(1)
+			be32(0)
+			be16(0)
+			resp = append(resp, 0, 0, 0, 0)
+			be32(int(base))
+			resp = append(resp, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+			be32(0)
+		}
+		var out [4]byte
+		binary.BigEndian.PutUint32(out[:], uint32(len(resp)))
+		c.Write(append(out[:], resp...))
+	}
+}
+
+func TestKafka(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var records int64
+	done := make(chan struct{})
+	go func() {
+		kafkaTestBroker(t, ln, &records)
+		close(done)
+	}()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := `
+def main(ctx):
+    brokers = ["` + ln.Addr().String() + `"]
+    if kafka.produce(brokers, "events", "k", "one", batch_size=2) != None:
+        fail("expected the record to be batched")
+    offset = kafka.produce(brokers, "events", "k", "two", batch_size=2)
+    if offset != 1:
+        fail("unexpected offset %s" % offset)
+    kafka.produce(brokers, "events", None, "three", batch_size=2)
+`
+	filename := filepath.Join(dir, "kafka.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	// the second batch is only flushed when the script returns
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	for _, res := range reporter.results {
+		if res.Err != nil || res.Name != "KAFKA PRODUCE events" {
+			t.Errorf("unexpected result %+v", res)
+		}
+	}
+	if res := reporter.results[0]; res.ContentLength != int64(len("kone")+len("ktwo")) {
+		t.Errorf("unexpected batch size %d", res.ContentLength)
+	}
+
+	ln.Close()
+	getKafkaClient([]string{ln.Addr().String()}).Close()
+	<-done
+	if records != 3 {
+		t.Errorf("expected 3 records, got %d", records)
+	}
+}
+
+// smtpTestServer accepts connections until ln is closed, accepting
+// messages for any recipient but nobody@example.com.
+func smtpTestServer(ln net.Listener, messages chan<- string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			tc := textproto.NewConn(c)
+			tc.PrintfLine("220 test ESMTP")
+			for {
+				line, err := tc.ReadLine()
+				if err != nil {
+					return
+				}
+				switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+				case "EHLO":
+					tc.PrintfLine("250-test\r\n250 8BITMIME")
+				case "RCPT":
+					if strings.Contains(line, "nobody@example.com") {
+						tc.PrintfLine("550 no such user")
+					} else {
+						tc.PrintfLine("250 OK")
+					}
+				case "DATA":
+					tc.PrintfLine("354 go ahead")
+					msg, err := tc.ReadDotBytes()
+					if err != nil {
+						return
+					}
+					messages <- string(msg)
+					tc.PrintfLine("250 queued")
+				case "QUIT":
+					tc.PrintfLine("221 bye")
+					return
+				default:
+					tc.PrintfLine("250 OK")
+				}
+			}
+		}()
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	messages := make(chan string, 2)
+	go smtpTestServer(ln, messages)
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	src := `
+def main(ctx):
+    r = smtp.send("` + host + `", "load@example.com", ["a@example.com", "b@example.com"], subject="hi", body="hello\n", port=` + port + `)
+    if not r.ok:
+        fail("unexpected response %s" % r.message)
+    r = smtp.send("` + host + `", "load@example.com", "nobody@example.com", port=` + port + `)
+    if r.ok or r.code != 550:
+        fail("unexpected response %d" % r.code)
+`
+	filename := filepath.Join(dir, "smtp.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil || res.StatusCode != 250 || res.Name != "SMTP SEND "+ln.Addr().String() {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if res := reporter.results[1]; res.Err != nil || res.StatusCode != 550 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	msg := <-messages
+	if !strings.Contains(msg, "To: a@example.com, b@example.com\n") || !strings.HasSuffix(msg, "\n\nhello\n") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, ".env.staging")
+	envSrc := `# staging
+export BASE_URL=https://staging.example.com # comment
+TOKEN="a\tb"
+LITERAL='a\tb'
+HITHERE_TEST_HOME=ignored
+`
+	if err := ioutil.WriteFile(envFile, []byte(envSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env, err := ReadEnvFile(envFile)
+	if err != nil {
+		t.Fatalf("ReadEnvFile: %s", err)
+	}
+	os.Setenv("HITHERE_TEST_HOME", "/home/load")
+	defer os.Unsetenv("HITHERE_TEST_HOME")
+
+	src := `
+BASE_URL = env.get("BASE_URL")
+
+def main(ctx):
+    if BASE_URL != "https://staging.example.com":
+        fail("unexpected BASE_URL %s" % BASE_URL)
+    if env.get("TOKEN") != "a\tb" or ctx.vars["LITERAL"] != "a\\tb":
+        fail("unexpected quoting")
+    if ctx.vars["HITHERE_TEST_HOME"] != "/home/load":
+        fail("expected the environment to take precedence")
+    if env.get("MISSING", "x") != "x":
+        fail("expected the default")
+`
+	filename := filepath.Join(dir, "env.star")
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(filename, WithEnv(env))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+}
+
+// randReporter is a testReporter with a seeded random number
+// generator.
+type randReporter struct {
+	testReporter
+	rng *rand.Rand
+}
+
+func (r *randReporter) Rand() *rand.Rand { return r.rng }
+
+func TestRandom(t *testing.T) {
+	src := []byte(`
+def main(ctx):
+    ctx.shared["v"] = (random.randint(1, 1000000), random.choice(["a", "b", "c"]), 0 <= random.random() and random.random() < 1)
+`)
+	s, err := New("random.star", WithSource(src))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if err := s.Do(context.Background(), http.DefaultClient, &randReporter{rng: rand.New(rand.NewSource(1))}); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	want := starlark.Tuple{starlark.MakeInt64(1 + rng.Int63n(1000000)), starlark.String([]string{"a", "b", "c"}[rng.Intn(3)]), starlark.True}
+	if v, _, _ := s.shared.Get(starlark.String("v")); v.String() != want.String() {
+		t.Errorf("expected the worker's random numbers %s, got %s", want, v)
+	}
+
+	// without a RandReporter, the process's generator is used
+	if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	for _, src := range []string{`random.randint(2, 1)`, `random.choice([])`} {
+		s, err := New("random.star", WithSource([]byte("def main(ctx):\n    "+src+"\n")))
+		if err != nil {
+			t.Fatalf("New: %s", err)
+		}
+		if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestShared(t *testing.T) {
+	src := `
+def main(ctx):
+    ctx.vars["WORKER"] = "me"
+    token = ctx.shared.setdefault("token", {"value": "abc"})
+    if token["value"] != "abc":
+        fail("unexpected token %s" % token)
+    n = ctx.shared.incr("count")
+    ctx.shared["last"] = [n]
+    if "last" not in ctx.shared or len(ctx.shared) != 3:
+        fail("unexpected keys %s" % ctx.shared.keys())
+    if ctx.shared.get("missing", 7) != 7 or ctx.shared.pop("missing", None) != None:
+        fail("expected the defaults")
+    ctx.shared["last"].append(0)
+`
+	s, err := New("shared.star", WithSource([]byte(src)), WithEnv(map[string]string{"WORKER": ""}))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	const workers, calls = 8, 50
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < calls; j++ {
+				if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err == nil || !strings.Contains(err.Error(), "frozen") {
+					errs <- fmt.Errorf("expected appending to a shared value to fail, got %v", err)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _, _ := s.shared.Get(starlark.String("count")); n != starlark.MakeInt(workers*calls) {
+		t.Errorf("expected count to be %d, got %v", workers*calls, n)
+	}
+}
+
+func TestWithSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := `GREETING = "hi"`
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.star"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `
+load("lib.star", "GREETING")
+
+def main(ctx):
+    if GREETING != "hi":
+        fail("unexpected GREETING %s" % GREETING)
+`
+	s, err := New(filepath.Join(dir, "<stdin>"), WithSource([]byte(src)))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+}
+
+func TestURLRequester(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != `a"b` {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	r, err := requester.New("url", server.URL+"/search?q=a%22b")
+	if err != nil {
+		t.Fatalf("requester.New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := r.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if len(reporter.results) != 1 || reporter.results[0].StatusCode != http.StatusOK {
+		t.Errorf("unexpected results: %+v", reporter.results)
+	}
+
+	if _, err := requester.New("url", "example.com"); err == nil {
+		t.Errorf("expected an error for a relative URL")
+	}
+}
+
+func TestWithModules(t *testing.T) {
+	proprietary := &Module{
+		Name: "acme",
+		Attrs: starlark.StringDict{
+			"call": starlark.NewBuiltin("acme.call", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				reporter := ThreadReporter(thread)
+				if reporter == nil || ThreadContext(thread) == nil || ThreadClient(thread) == nil {
+					return nil, fmt.Errorf("acme.call must be called from main()")
+				}
+				reporter.Start()
+				reporter.Finish(&requester.Result{Name: "acme.call", StatusCode: 200})
+				return starlark.None, nil
+			}),
+		},
+	}
+	src := []byte(`
+def main(ctx):
+    acme.call()
+`)
+	s, err := New("acme.star", WithSource(src), WithModules(starlark.StringDict{"acme": proprietary}))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if len(reporter.results) != 1 || reporter.results[0].Name != "acme.call" {
+		t.Errorf("unexpected results: %+v", reporter.results)
+	}
+
+	if _, err := New("acme.star", WithSource(src), WithModules(starlark.StringDict{"requests": proprietary})); err == nil {
+		t.Errorf("expected an error replacing a built in module")
+	}
+	if _, err := LoadPlugin(filepath.Join(os.TempDir(), "no-such-plugin.so")); err == nil {
+		t.Errorf("expected an error loading a missing plugin")
+	}
+}
+
+// loggingReporter is a testReporter with a logger, as Work's are.
+type loggingReporter struct {
+	testReporter
+	logger *slog.Logger
+}
+
+func (r *loggingReporter) Logger() *slog.Logger { return r.logger }
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	src := []byte(`
+print("loaded")
+
+def main(ctx):
+    print("running")
+`)
+	s, err := New("print.star", WithSource(src), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if !strings.Contains(buf.String(), `msg=loaded pos=print.star:2:6`) {
+		t.Errorf("expected the top level print in %q", buf.String())
+	}
+
+	buf.Reset()
+	reporter := &loggingReporter{logger: logger.With("worker", 3)}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if !strings.Contains(buf.String(), `msg=running worker=3 pos=print.star:5:10`) {
+		t.Errorf("expected the print from main with the reporter's attributes in %q", buf.String())
+	}
+}
+
+// hookReporter is a testReporter with hooks, as Work's are.
+type hookReporter struct {
+	testReporter
+	hooks []requester.Hook
+}
+
+func (r *hookReporter) Hooks() []requester.Hook { return r.hooks }
+
+// statusHook fails results with the given status code.
+type statusHook struct {
+	code int
+}
+
+func (h statusHook) BeforeRequest(*http.Request) error { return nil }
+
+func (h statusHook) AfterResponse(req *http.Request, resp *http.Response, res *requester.Result) {
+	if resp != nil && resp.StatusCode == h.code {
+		res.Err = fmt.Errorf("status %d", h.code)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "Bearer t0k" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	src := []byte(`
+def main(ctx):
+    requests.get("` + server.URL + `/tea", data=None, headers={})
+    requests.get("` + server.URL + `/admin", data=None, headers={})
+`)
+	s, err := New("hooks.star", WithSource(src))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &hookReporter{hooks: []requester.Hook{
+		requester.BeforeRequestFunc(func(req *http.Request) error {
+			req.Header.Set("authorization", "Bearer t0k")
+			return nil
+		}),
+		requester.BeforeRequestFunc(func(req *http.Request) error {
+			if req.URL.Path == "/admin" {
+				return fmt.Errorf("vetoed")
+			}
+			return nil
+		}),
+		statusHook{http.StatusTeapot},
+	}}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err == nil || !strings.Contains(err.Error(), "vetoed") {
+		t.Fatalf("expected the vetoed request to fail main, got %v", err)
+	}
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.StatusCode != http.StatusTeapot || res.Err == nil {
+		t.Errorf("expected the authorized request to be failed by the hook: %+v", res)
+	}
+	if res := reporter.results[1]; res.StatusCode != 0 || res.Err == nil || res.Name != "GET "+server.URL+"/admin" {
+		t.Errorf("expected the vetoed request to be reported failed: %+v", res)
+	}
+}
+
+func TestAssertionHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok": true, "items": [{"id": 7}]}`)
+	}))
+	defer server.Close()
+
+	var hooks []requester.Hook
+	for _, src := range []string{
+		"GET */api => json $.items[0].id == 7",
+		`body contains "\"ok\": true"`,
+		"GET */other => json $.ok == false",
+	} {
+		a, err := requester.ParseAssertion(src)
+		if err != nil {
+			t.Fatalf("ParseAssertion: %s", err)
+		}
+		hooks = append(hooks, a)
+	}
+	src := []byte(`
+def main(ctx):
+    r = requests.get("` + server.URL + `/api", data=None, headers={})
+    ctx.vars["ok"] = r.json()["ok"]
+    requests.get("` + server.URL + `/other", data=None, headers={})
+`)
+	s, err := New("assert.star", WithSource(src))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &hookReporter{hooks: hooks}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if len(reporter.results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(reporter.results))
+	}
+	if res := reporter.results[0]; res.Err != nil {
+		t.Errorf("expected the assertions to pass: %s", res.Err)
+	}
+	if res := reporter.results[1]; res.Err == nil || res.Err.Error() != "assertion failed: GET */other => json $.ok == false" {
+		t.Errorf("expected the json assertion to fail, got %v", res.Err)
+	}
+}
+
+func TestFileReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"bundle/main.star":         "load(\"lib/greeting.star\", \"GREETING\")\n\ndef main(ctx):\n    pass\n",
+		"bundle/lib/greeting.star": `GREETING = "hi"`,
+	}
+	mem := fstest.MapFS{}
+	for name, src := range files {
+		mem[name] = &fstest.MapFile{Data: []byte(src)}
+	}
+	RegisterFS("mem-test", mem)
+
+	archive := filepath.Join(dir, "bundle.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, src := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, src)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	names := []string{
+		"mem-test:bundle/main.star",
+		"zip://" + archive + "//bundle/main.star",
+	}
+	if _, err := exec.LookPath("git"); err == nil {
+		repo := filepath.Join(dir, "repo")
+		for name, src := range files {
+			p := filepath.Join(repo, filepath.FromSlash(name))
+			os.MkdirAll(filepath.Dir(p), 0755)
+			if err := ioutil.WriteFile(p, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git := func(args ...string) {
+			cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+			cmd.Dir = repo
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %v: %s: %s", args, err, out)
+			}
+		}
+		git("init", "--quiet")
+		git("add", ".")
+		git("commit", "--quiet", "-m", "bundle")
+		git("tag", "v1")
+		names = append(names, "git+file://"+filepath.ToSlash(repo)+"//bundle/main.star?ref=v1")
+	}
+
+	for _, name := range names {
+		s, err := New(name)
+		if err != nil {
+			t.Errorf("New(%q): %s", name, err)
+			continue
+		}
+		if err := s.Validate(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if _, err := New("nope:main.star"); err == nil {
+		t.Errorf("expected an error for an unknown scheme")
+	}
+	for _, name := range []string{
+		"git+https://example.com/r.git//../../etc/x.star",
+		"zip://" + archive + "//bundle/../../x.star",
+	} {
+		if _, err := New(name); err == nil || !strings.Contains(err.Error(), "is outside") {
+			t.Errorf("New(%q): expected an error for a path outside the location, got %v", name, err)
+		}
+	}
+	if _, err := New("bundle/main.star", WithFileReader(FSFileReader(mem, "bundle"))); err != nil {
+		t.Errorf("New with a FileReader: %s", err)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	var instances int
+	RegisterModule("acme_auth", func() starlark.Value {
+		instances++
+		return NewModule("acme_auth", starlark.StringDict{
+			"token": starlark.String("t0k"),
+		})
+	})
+	RegisterBuiltin("acme_sign", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var s string
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s); err != nil {
+			return nil, err
+		}
+		return starlark.String("signed:" + s), nil
+	})
+
+	src := []byte(`
+def main(ctx):
+    if acme_sign(acme_auth.token) != "signed:t0k":
+        fail("unexpected signature")
+`)
+	for i := 0; i < 2; i++ {
+		s, err := New("acme.star", WithSource(src))
+		if err != nil {
+			t.Fatalf("New: %s", err)
+		}
+		if err := s.Do(context.Background(), http.DefaultClient, &testReporter{}); err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+	}
+	if instances != 2 {
+		t.Errorf("expected a module instance per script, got %d", instances)
+	}
+
+	for _, name := range []string{"requests", "acme_auth"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %q to panic", name)
+				}
+			}()
+			RegisterModule(name, func() starlark.Value { return starlark.None })
+		}()
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "hithere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := `
+def get_v1(url):
+    requests.get(url, data=None, headers={})
+
+def get_short(url):
+    requests.get(url)
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.star"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	url := starlark.String(server.URL).String()
+	for _, tc := range []struct {
+		src     string
+		wantErr string
+	}{
+		{"api_version = 2\n\ndef main(ctx):\n    requests.get(" + url + ")\n    requests.post(" + url + ")\n", ""},
+		{"def main(ctx):\n    requests.get(" + url + ")\n", "missing argument for data"},
+		// the library keeps the behavior of the version it was written for
+		{"load(\"lib.star\", \"get_v1\")\napi_version = 2\n\ndef main(ctx):\n    get_v1(" + url + ")\n", ""},
+		{"load(\"lib.star\", \"get_short\")\napi_version = 2\n\ndef main(ctx):\n    get_short(" + url + ")\n", "missing argument for data"},
+	} {
+		s, err := New(filepath.Join(dir, "main.star"), WithSource([]byte(tc.src)))
+		if err != nil {
+			t.Fatalf("New(%q): %s", tc.src, err)
+		}
+		err = s.Do(context.Background(), http.DefaultClient, &testReporter{})
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("Do(%q): %s", tc.src, err)
+		} else if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("Do(%q): expected an error containing %q, got %v", tc.src, tc.wantErr, err)
+		}
+	}
+
+	for _, src := range []string{"api_version = 3\n", "api_version = \"2\"\n"} {
+		if _, err := New("v.star", WithSource([]byte(src))); err == nil || !strings.Contains(err.Error(), "api_version") {
+			t.Errorf("New(%q): expected an api_version error, got %v", src, err)
+		}
+	}
+}
+
+// BenchmarkInstrument measures the per-request overhead of timing and
+// reporting requests, against a local server.
+func BenchmarkInstrument(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		reporter := &discardReporter{}
+		for pb.Next() {
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := instrument(server.Client(), req, reporter, processClock, 0, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// discardReporter drops results, as a reporter that has aggregated them
+// does.
+type discardReporter struct{}
+
+func (discardReporter) Start()                       {}
+func (discardReporter) Finish(res *requester.Result) {}
+func (discardReporter) UserAgent() string            { return "hithere-test" }
+
+func TestMaxBodyBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1<<20))
+	}))
+	defer server.Close()
+
+	src := []byte(`
+def main(ctx):
+    resp = requests.get(` + starlark.String(server.URL).String() + `, data=None, headers={})
+    if not resp.truncated or len(resp.text) != 100:
+        fail("expected a truncated body of 100 bytes, got %d" % len(resp.text))
+`)
+	s, err := New("cap.star", WithSource(src), WithMaxBodyBytes(100))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), http.DefaultClient, reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if len(reporter.results) != 1 || reporter.results[0].ContentLength != 100 || reporter.results[0].Err != nil {
+		t.Errorf("unexpected results: %+v", reporter.results)
+	}
+
+	for _, tc := range []struct {
+		body      string
+		max       int64
+		truncated bool
+	}{
+		{"hello", 0, false},
+		{"hello", 5, false},
+		{"hello", 4, true},
+	} {
+		body, truncated, err := readBody(strings.NewReader(tc.body), tc.max)
+		want := tc.body
+		if tc.truncated {
+			want = tc.body[:tc.max]
+		}
+		if err != nil || string(body) != want || truncated != tc.truncated {
+			t.Errorf("readBody(%q, %d) = %q, %t, %v", tc.body, tc.max, body, truncated, err)
+		}
+	}
+}
+
+func TestDrainBody(t *testing.T) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		io.WriteString(w, strings.Repeat("x", n))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	url := starlark.String(server.URL).String()
+	src := []byte(`
+def main(ctx):
+    for n in [1000, 1 << 20, 10, 10]:
+        requests.get(` + url + ` + "?n=%d" % n, data=None, headers={})
+`)
+	s, err := New("drain.star", WithSource(src), WithMaxBodyBytes(100))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	reporter := &testReporter{}
+	if err := s.Do(context.Background(), server.Client(), reporter); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	var forced, reused []bool
+	for _, res := range reporter.results {
+		forced = append(forced, res.ForcedClose)
+		reused = append(reused, res.ConnReused)
+		if res.NewConn == res.ConnReused || res.DNSLookup || res.TLSHandshake {
+			t.Errorf("unexpected connection stats %+v", res)
+		}
+	}
+	if want := []bool{false, true, false, false}; !reflect.DeepEqual(forced, want) {
+		t.Errorf("expected forced closes %v, got %v", want, forced)
+	}
+	if want := []bool{false, true, false, true}; !reflect.DeepEqual(reused, want) {
+		t.Errorf("expected reused connections %v, got %v", want, reused)
+	}
+	// the first connection is reused after draining the rest of the
+	// first body, but not after giving up on the second
+	if n := atomic.LoadInt64(&conns); n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+}
+
+func TestCompressRequest(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, _ := ioutil.ReadAll(body)
+		mu.Lock()
+		got = append(got, r.Header.Get("Content-Encoding")+":"+r.Header.Get("Content-Type")+":"+string(b))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	url := starlark.String(server.URL).String()
+	src := []byte(`
+def main(ctx):
+    requests.post(` + url + `, data="plain", headers={})
+    requests.post(` + url + `, data="zipped", headers={}, compress_request=True)
+    requests.post(` + url + `, data={"a": "b"}, headers={}, compress_request=False)
+`)
+	for _, tt := range []struct {
+		opts []Option
+		want []string
+	}{
+		{nil, []string{"::plain", "gzip::zipped", ":application/x-www-form-urlencoded:a=b"}},
+		{[]Option{WithCompressRequests()}, []string{"gzip::plain", "gzip::zipped", ":application/x-www-form-urlencoded:a=b"}},
+	} {
+		got = nil
+		s, err := New("compress.star", append([]Option{WithSource(src)}, tt.opts...)...)
+		if err != nil {
+			t.Fatalf("New: %s", err)
+		}
+		if err := s.Do(context.Background(), server.Client(), &testReporter{}); err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expected the server to get %q, got %q", tt.want, got)
+		}
+	}
 }
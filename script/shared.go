@@ -0,0 +1,198 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+var sharedDictAttrs = []string{"get", "incr", "items", "keys", "pop", "setdefault"}
+
+// A sharedDict is ctx.shared: a dict shared by every worker running a
+// Script, for state like an auth token fetched once, or a counter.
+// Every operation holds a lock, and values are frozen as they are
+// stored, so that no worker can change one another is reading.
+type sharedDict struct {
+	mu sync.Mutex
+	d  *starlark.Dict
+}
+
+func newSharedDict() *sharedDict {
+	return &sharedDict{d: new(starlark.Dict)}
+}
+
+var (
+	_ starlark.HasSetKey = (*sharedDict)(nil)
+	_ starlark.HasAttrs  = (*sharedDict)(nil)
+	_ starlark.Sequence  = (*sharedDict)(nil)
+)
+
+func (s *sharedDict) String() string        { return "<shared_dict>" }
+func (s *sharedDict) Type() string          { return "shared_dict" }
+func (s *sharedDict) Freeze()               {} // shared by design
+func (s *sharedDict) Truth() starlark.Bool  { return s.Len() > 0 }
+func (s *sharedDict) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", s.Type()) }
+func (s *sharedDict) AttrNames() []string   { return sharedDictAttrs }
+
+func (s *sharedDict) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.d.Len()
+}
+
+// Iterate iterates over a snapshot of the keys, which other workers may
+// change meanwhile.
+func (s *sharedDict) Iterate() starlark.Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return starlark.Tuple(s.d.Keys()).Iterate()
+}
+
+func (s *sharedDict) Get(k starlark.Value) (starlark.Value, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.d.Get(k)
+}
+
+func (s *sharedDict) SetKey(k, v starlark.Value) error {
+	v.Freeze()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.d.SetKey(k, v)
+}
+
+func (s *sharedDict) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "get":
+		return starlark.NewBuiltin("shared.get", s.fnGet), nil
+	case "incr":
+		return starlark.NewBuiltin("shared.incr", s.fnIncr), nil
+	case "items":
+		return starlark.NewBuiltin("shared.items", s.fnItems), nil
+	case "keys":
+		return starlark.NewBuiltin("shared.keys", s.fnKeys), nil
+	case "pop":
+		return starlark.NewBuiltin("shared.pop", s.fnPop), nil
+	case "setdefault":
+		return starlark.NewBuiltin("shared.setdefault", s.fnSetdefault), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (s *sharedDict) fnGet(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key starlark.Value
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	v, found, err := s.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if !found {
+		return def, nil
+	}
+	return v, nil
+}
+
+// fnSetdefault stores def under key unless the key is already set, and
+// returns the value stored, so that one worker's value wins a race to
+// set it.
+func (s *sharedDict) fnSetdefault(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key starlark.Value
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	def.Freeze()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, found, err := s.d.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if found {
+		return v, nil
+	}
+	if err := s.d.SetKey(key, def); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return def, nil
+}
+
+// fnIncr adds delta to the int stored under key, or to 0 if there is
+// none, and returns the sum.
+func (s *sharedDict) fnIncr(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key starlark.Value
+	delta := starlark.MakeInt(1)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "delta?", &delta); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, found, err := s.d.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	n := starlark.MakeInt(0)
+	if found {
+		var ok bool
+		if n, ok = v.(starlark.Int); !ok {
+			return nil, fmt.Errorf("%s: %s is a %s, not an int", fn.Name(), key, v.Type())
+		}
+	}
+	n = n.Add(delta)
+	if err := s.d.SetKey(key, n); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return n, nil
+}
+
+func (s *sharedDict) fnPop(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, def starlark.Value
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key, "default?", &def); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, found, err := s.d.Delete(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if !found {
+		if def == nil {
+			return nil, fmt.Errorf("%s: missing key %s", fn.Name(), key)
+		}
+		return def, nil
+	}
+	return v, nil
+}
+
+func (s *sharedDict) fnKeys(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return starlark.NewList(s.d.Keys()), nil
+}
+
+func (s *sharedDict) fnItems(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.d.Items()
+	list := make([]starlark.Value, len(items))
+	for i, item := range items {
+		list[i] = item
+	}
+	return starlark.NewList(list), nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// smtpAccepted is the reply code reported when a message is accepted
+// for delivery.
+const smtpAccepted = 250
+
+var smtpResponseAttrs = []string{
+	"code",    // int
+	"message", // str
+	"ok",      // bool
+}
+
+type smtpModule struct {
+	Module
+}
+
+// SMTPModule returns the smtp module, for load testing mail relays.
+// Each message is sent over a new connection, and reported as a result
+// whose status code is the server's reply: 250 if the message was
+// accepted, or the code it was rejected with.
+func SMTPModule() *smtpModule {
+	m := &smtpModule{
+		Module: Module{
+			Name:  "smtp",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["send"] = starlark.NewBuiltin("smtp.send", m.fnSend)
+
+	return m
+}
+
+// fnSend implements smtp.send(host, sender, recipients, subject="",
+// body="", headers=None, port=25, username=None, password=None,
+// tls=False, starttls=True, server_name=None, helo=None).  tls is for
+// servers expecting TLS from the start, like port 465; otherwise the
+// connection is upgraded with STARTTLS if the server offers it, unless
+// starttls is False.  As with net/smtp, credentials are only sent over
+// TLS or to localhost.
+//
+// The result's connection and TLS timings are the dial and TLS
+// handshake, its delay is the wait for the server's greeting, its
+// request duration covers the rest of the conversation up to the end
+// of the message, and its response duration is the wait for the
+// server to accept it.
+func (m *smtpModule) fnSend(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("smtp can't be used at top level, only in function bodies")
+	}
+
+	var host, sender, subject, body, username, password, serverName, helo string
+	var recipientsVal starlark.Value
+	var headers *starlark.Dict
+	port := 25
+	var useTLS bool
+	startTLS := true
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "host", &host, "sender", &sender, "recipients", &recipientsVal, "subject?", &subject, "body?", &body, "headers?", &headers, "port?", &port, "username?", &username, "password?", &password, "tls?", &useTLS, "starttls?", &startTLS, "server_name?", &serverName, "helo?", &helo); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	var recipients []string
+	if s, ok := starlark.AsString(recipientsVal); ok {
+		recipients = []string{s}
+	} else if iterable, ok := recipientsVal.(starlark.Iterable); ok {
+		iter := iterable.Iterate()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			s, ok := starlark.AsString(elem)
+			if !ok {
+				iter.Done()
+				return nil, fmt.Errorf("%s: expected recipient to be a string, got %s", fn.Name(), elem.Type())
+			}
+			recipients = append(recipients, s)
+		}
+		iter.Done()
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("%s: no recipients", fn.Name())
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	msg, err := smtpMessage(stls.rand, sender, recipients, subject, body, headers)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	timeout := stls.client.Timeout
+
+	stls.count++
+	stls.reporter.Start()
+	s := stls.clock.Now()
+	var connDuration, tlsDuration, delayDuration, reqDuration, resDuration time.Duration
+	err = func() error {
+		dialer := &net.Dialer{Timeout: timeout}
+		nc, err := dialer.DialContext(stls.ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer nc.Close()
+		nc.SetDeadline(deadline(stls.ctx, timeout))
+		connDuration = stls.clock.Now() - s
+		tlsConfig := clientTLSConfig(stls.client, serverName)
+		if useTLS {
+			tlsStart := stls.clock.Now()
+			tc := tls.Client(nc, tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				return err
+			}
+			tlsDuration = stls.clock.Now() - tlsStart
+			nc = tc
+		}
+
+		greetingStart := stls.clock.Now()
+		c, err := smtp.NewClient(nc, host)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		delayDuration = stls.clock.Now() - greetingStart
+
+		reqStart := stls.clock.Now()
+		var startTLSDuration time.Duration
+		if helo != "" {
+			if err := c.Hello(helo); err != nil {
+				return err
+			}
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok && startTLS && !useTLS {
+			tlsStart := stls.clock.Now()
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+			startTLSDuration = stls.clock.Now() - tlsStart
+			tlsDuration = startTLSDuration
+		}
+		if username != "" {
+			if err := c.Auth(smtp.PlainAuth("", username, password, host)); err != nil {
+				return err
+			}
+		}
+		if err := c.Mail(sender); err != nil {
+			return err
+		}
+		for _, r := range recipients {
+			if err := c.Rcpt(r); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		resStart := stls.clock.Now()
+		reqDuration = resStart - reqStart - startTLSDuration
+		if err := w.Close(); err != nil {
+			return err
+		}
+		resDuration = stls.clock.Now() - resStart
+		// the message has been accepted, however the server says
+		// goodbye
+		c.Quit()
+		return nil
+	}()
+
+	resp := &smtpResponse{code: smtpAccepted, message: "OK"}
+	if perr, ok := err.(*textproto.Error); ok {
+		resp.code = perr.Code
+		resp.message = perr.Msg
+		err = nil
+	}
+	code := resp.code
+	if err != nil {
+		code = 0
+	}
+	stls.reporter.Finish(&requester.Result{
+		Offset:        s,
+		StatusCode:    code,
+		Duration:      stls.clock.Now() - s,
+		Err:           err,
+		ContentLength: int64(len(msg)),
+		ConnDuration:  connDuration,
+		TLSDuration:   tlsDuration,
+		ReqDuration:   reqDuration,
+		ResDuration:   resDuration,
+		DelayDuration: delayDuration,
+		Name:          "SMTP SEND " + addr,
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return resp, nil
+}
+
+// smtpMessage generates an RFC 5322 message, with a Message-Id from rng.
+// headers may override the generated ones, or add to them.
+func smtpMessage(rng *rand.Rand, sender string, recipients []string, subject, body string, headers *starlark.Dict) ([]byte, error) {
+	h := textproto.MIMEHeader{}
+	h.Set("From", sender)
+	h.Set("To", strings.Join(recipients, ", "))
+	h.Set("Subject", subject)
+	h.Set("Date", time.Now().Format(time.RFC1123Z))
+	h.Set("Message-Id", fmt.Sprintf("<%016x@hithere>", rng.Uint64()))
+	h.Set("Mime-Version", "1.0")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	if headers != nil {
+		for _, item := range headers.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("expected header name to be a string, got %s", item[0].Type())
+			}
+			v, ok := starlark.AsString(item[1])
+			if !ok {
+				v = item[1].String()
+			}
+			h.Set(k, v)
+		}
+	}
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, h.Get(k))
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+	return buf.Bytes(), nil
+}
+
+type smtpResponse struct {
+	code    int
+	message string
+}
+
+var _ starlark.HasAttrs = (*smtpResponse)(nil)
+
+func (r *smtpResponse) String() string        { return fmt.Sprintf("<smtp.response %d>", r.code) }
+func (r *smtpResponse) Type() string          { return "smtp.response" }
+func (r *smtpResponse) Freeze()               {}
+func (r *smtpResponse) Truth() starlark.Bool  { return starlark.True }
+func (r *smtpResponse) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", r.Type()) }
+func (r *smtpResponse) AttrNames() []string   { return smtpResponseAttrs }
+
+func (r *smtpResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "code":
+		return starlark.MakeInt(r.code), nil
+	case "message":
+		return starlark.String(r.message), nil
+	case "ok":
+		return starlark.Bool(r.code == smtpAccepted), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
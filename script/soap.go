@@ -0,0 +1,206 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// fnRequestsSOAP implements requests.soap(url, action, envelope,
+// header=None, headers=None, version="1.1").  envelope is a dict
+// describing the contents of the SOAP body, and header those of the
+// SOAP header: each key is an element name, and each value the
+// element's text, a dict of its children, or a list for repeated
+// elements.  Keys starting with "@" are attributes, and "#text" is
+// text alongside children.  For example
+//
+//	{"GetQuote": {"@xmlns": "http://example.com/stock", "symbol": "ACME"}}
+//
+// becomes <GetQuote xmlns="http://example.com/stock"><symbol>ACME</symbol></GetQuote>.
+// Results are named after the action, and responses containing a SOAP
+// fault are reported as failures.
+func (r *requestsModule) fnRequestsSOAP(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	tls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || tls == nil {
+		return starlark.None, fmt.Errorf("requests can't be used at top level, only in function bodies")
+	}
+
+	var url, action string
+	var envelope, header, headers *starlark.Dict
+	version := "1.1"
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &url, "action", &action, "envelope", &envelope, "header?", &header, "headers?", &headers, "version?", &version); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	var ns, contentType string
+	switch version {
+	case "1.1":
+		ns = soap11Namespace
+		contentType = "text/xml; charset=utf-8"
+	case "1.2":
+		ns = soap12Namespace
+		contentType = fmt.Sprintf("application/soap+xml; charset=utf-8; action=%q", action)
+	default:
+		return nil, fmt.Errorf("%s: unsupported SOAP version %q", fn.Name(), version)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<soap:Envelope xmlns:soap="%s">`, ns)
+	if header != nil {
+		buf.WriteString("<soap:Header>")
+		if err := soapAppendChildren(&buf, header); err != nil {
+			return nil, fmt.Errorf("%s: header: %w", fn.Name(), err)
+		}
+		buf.WriteString("</soap:Header>")
+	}
+	buf.WriteString("<soap:Body>")
+	if err := soapAppendChildren(&buf, envelope); err != nil {
+		return nil, fmt.Errorf("%s: envelope: %w", fn.Name(), err)
+	}
+	buf.WriteString("</soap:Body></soap:Envelope>")
+
+	req, err := newRequest(tls.ctx, "POST", url, buf.Bytes(), tls.compressRequests)
+	if err != nil {
+		return starlark.None, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if headers != nil {
+		if err := setHeaders(req, headers); err != nil {
+			return nil, err
+		}
+	}
+	if req.Header.Get("content-type") == "" {
+		req.Header.Set("content-type", contentType)
+	}
+	if version == "1.1" && req.Header.Get("soapaction") == "" {
+		req.Header.Set("soapaction", strconv.Quote(action))
+	}
+	req.Header.Set("user-agent", tls.reporter.UserAgent())
+
+	tls.count++
+	resp, err := instrument(tls.client, req, tls.reporter, tls.clock, tls.maxBodyBytes, func(resp *response, res *requester.Result) {
+		res.Name = "SOAP " + action
+		res.Err = soapFault(resp.body)
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("r.c.Do: %w", err)
+	}
+
+	return resp, nil
+}
+
+// soapAppendChildren appends the elements described by d.
+func soapAppendChildren(buf *bytes.Buffer, d *starlark.Dict) error {
+	for _, item := range d.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return fmt.Errorf("expected element name to be a string, got %s", item[0].Type())
+		}
+		if strings.HasPrefix(name, "@") || name == "#text" {
+			continue
+		}
+		if err := soapAppendElement(buf, name, item[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func soapAppendElement(buf *bytes.Buffer, name string, v starlark.Value) error {
+	switch v := v.(type) {
+	case *starlark.List, starlark.Tuple:
+		iter := v.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			if err := soapAppendElement(buf, name, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case starlark.NoneType:
+		fmt.Fprintf(buf, "<%s/>", name)
+		return nil
+	case *starlark.Dict:
+		fmt.Fprintf(buf, "<%s", name)
+		var text string
+		for _, item := range v.Items() {
+			k, _ := starlark.AsString(item[0])
+			if k == "#text" {
+				text = soapText(item[1])
+			} else if strings.HasPrefix(k, "@") {
+				fmt.Fprintf(buf, ` %s="`, k[1:])
+				xml.EscapeText(buf, []byte(soapText(item[1])))
+				buf.WriteString(`"`)
+			}
+		}
+		buf.WriteString(">")
+		xml.EscapeText(buf, []byte(text))
+		if err := soapAppendChildren(buf, v); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "</%s>", name)
+		return nil
+	}
+	fmt.Fprintf(buf, "<%s>", name)
+	xml.EscapeText(buf, []byte(soapText(v)))
+	fmt.Fprintf(buf, "</%s>", name)
+	return nil
+}
+
+// soapText returns the XML Schema lexical form of a scalar.
+func soapText(v starlark.Value) string {
+	switch v := v.(type) {
+	case starlark.String:
+		return string(v)
+	case starlark.Bool:
+		return strconv.FormatBool(bool(v))
+	}
+	return v.String()
+}
+
+// soapFault returns the fault in a SOAP 1.1 or 1.2 response body, if
+// any.  Bodies that aren't XML are assumed not to be faults.
+func soapFault(body []byte) error {
+	var fault struct {
+		Code   string `xml:"faultcode"`
+		String string `xml:"faultstring"`
+		// SOAP 1.2
+		Value  string `xml:"Code>Value"`
+		Reason string `xml:"Reason>Text"`
+	}
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "Fault" {
+			continue
+		}
+		if err := d.DecodeElement(&fault, &se); err != nil {
+			return fmt.Errorf("soap: malformed fault: %w", err)
+		}
+		break
+	}
+	code, reason := fault.Code, fault.String
+	if code == "" {
+		code, reason = fault.Value, fault.Reason
+	}
+	return fmt.Errorf("soap: fault %s: %s", strings.TrimSpace(code), strings.TrimSpace(reason))
+}
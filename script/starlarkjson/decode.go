@@ -0,0 +1,320 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package starlarkjson
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+)
+
+// maxDepth bounds the nesting of arrays and objects, as encoding/json
+// does, so that hostile input can't exhaust the stack.
+const maxDepth = 10000
+
+// DecodeString returns the Starlark value that the JSON s denotes,
+// as decode does: objects are dicts, in the order of their keys in s,
+// arrays are tuples, and numbers are ints, of any size, unless they
+// have a fraction or exponent, in which case they are floats.  It
+// decodes straight to Starlark values, and the strings it returns
+// share memory with s.
+func DecodeString(s string) (starlark.Value, error) {
+	d := decoder{s: s}
+	d.skipSpace()
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	d.skipSpace()
+	if d.i < len(s) {
+		return nil, d.errorf("unexpected %q after top-level value", s[d.i])
+	}
+	return v, nil
+}
+
+type decoder struct {
+	s string
+	i int
+}
+
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", d.i, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) skipSpace() {
+	for d.i < len(d.s) {
+		switch d.s[d.i] {
+		case ' ', '\t', '\n', '\r':
+			d.i++
+		default:
+			return
+		}
+	}
+}
+
+// value decodes the value at d.i, which must not be preceded by space.
+func (d *decoder) value(depth int) (starlark.Value, error) {
+	if d.i == len(d.s) {
+		return nil, d.errorf("unexpected end of JSON input")
+	}
+	switch c := d.s[d.i]; {
+	case c == '{':
+		return d.object(depth + 1)
+	case c == '[':
+		return d.array(depth + 1)
+	case c == '"':
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.String(s), nil
+	case c == '-' || '0' <= c && c <= '9':
+		return d.number()
+	case strings.HasPrefix(d.s[d.i:], "true"):
+		d.i += len("true")
+		return starlark.True, nil
+	case strings.HasPrefix(d.s[d.i:], "false"):
+		d.i += len("false")
+		return starlark.False, nil
+	case strings.HasPrefix(d.s[d.i:], "null"):
+		d.i += len("null")
+		return starlark.None, nil
+	default:
+		return nil, d.errorf("invalid character %q looking for beginning of value", c)
+	}
+}
+
+func (d *decoder) object(depth int) (starlark.Value, error) {
+	if depth > maxDepth {
+		return nil, d.errorf("exceeded max depth")
+	}
+	d.i++ // {
+	dict := new(starlark.Dict)
+	d.skipSpace()
+	if d.i < len(d.s) && d.s[d.i] == '}' {
+		d.i++
+		return dict, nil
+	}
+	for {
+		if d.i == len(d.s) || d.s[d.i] != '"' {
+			return nil, d.errorf("expected string for object key")
+		}
+		k, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		d.skipSpace()
+		if d.i == len(d.s) || d.s[d.i] != ':' {
+			return nil, d.errorf("expected ':' after object key")
+		}
+		d.i++
+		d.skipSpace()
+		v, err := d.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		dict.SetKey(starlark.String(k), v) // can't fail
+		d.skipSpace()
+		if d.i == len(d.s) {
+			return nil, d.errorf("unexpected end of JSON input")
+		}
+		switch d.s[d.i] {
+		case ',':
+			d.i++
+			d.skipSpace()
+		case '}':
+			d.i++
+			return dict, nil
+		default:
+			return nil, d.errorf("expected ',' or '}' after object field")
+		}
+	}
+}
+
+func (d *decoder) array(depth int) (starlark.Value, error) {
+	if depth > maxDepth {
+		return nil, d.errorf("exceeded max depth")
+	}
+	d.i++ // [
+	var tuple starlark.Tuple
+	d.skipSpace()
+	if d.i < len(d.s) && d.s[d.i] == ']' {
+		d.i++
+		return starlark.Tuple{}, nil
+	}
+	for {
+		v, err := d.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		tuple = append(tuple, v)
+		d.skipSpace()
+		if d.i == len(d.s) {
+			return nil, d.errorf("unexpected end of JSON input")
+		}
+		switch d.s[d.i] {
+		case ',':
+			d.i++
+			d.skipSpace()
+		case ']':
+			d.i++
+			return tuple, nil
+		default:
+			return nil, d.errorf("expected ',' or ']' after array element")
+		}
+	}
+}
+
+// string decodes the string at d.i, returning a substring of the
+// input if it has no escapes.
+func (d *decoder) string() (string, error) {
+	d.i++ // "
+	start := d.i
+	for d.i < len(d.s) {
+		switch c := d.s[d.i]; {
+		case c == '"':
+			d.i++
+			return d.s[start : d.i-1], nil
+		case c == '\\':
+			return d.unescape(start)
+		case c < ' ':
+			return "", d.errorf("invalid character %q in string literal", c)
+		}
+		d.i++
+	}
+	return "", d.errorf("unexpected end of JSON input")
+}
+
+// unescape decodes the rest of the string started at start, from the
+// first escape at d.i.
+func (d *decoder) unescape(start int) (string, error) {
+	var b strings.Builder
+	b.WriteString(d.s[start:d.i])
+	for d.i < len(d.s) {
+		c := d.s[d.i]
+		switch {
+		case c == '"':
+			d.i++
+			return b.String(), nil
+		case c < ' ':
+			return "", d.errorf("invalid character %q in string literal", c)
+		case c != '\\':
+			b.WriteByte(c)
+			d.i++
+			continue
+		}
+		if d.i+1 == len(d.s) {
+			break
+		}
+		d.i++
+		switch e := d.s[d.i]; e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, ok := d.hex4(d.i + 1)
+			if !ok {
+				return "", d.errorf("invalid \\u escape")
+			}
+			d.i += 4
+			if utf16.IsSurrogate(r) {
+				r2, ok := rune(0), false
+				if strings.HasPrefix(d.s[d.i+1:], `\u`) {
+					r2, ok = d.hex4(d.i + 3)
+				}
+				if dec := utf16.DecodeRune(r, r2); ok && dec != utf8.RuneError {
+					r = dec
+					d.i += 6
+				} else {
+					r = utf8.RuneError
+				}
+			}
+			b.WriteRune(r)
+		default:
+			return "", d.errorf("invalid escape \\%c in string literal", e)
+		}
+		d.i++
+	}
+	return "", d.errorf("unexpected end of JSON input")
+}
+
+// hex4 parses the four hex digits at i.
+func (d *decoder) hex4(i int) (rune, bool) {
+	if i+4 > len(d.s) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(d.s[i:i+4], 16, 32)
+	return rune(n), err == nil
+}
+
+// number decodes the number at d.i: an int unless it has a fraction or
+// exponent.
+func (d *decoder) number() (starlark.Value, error) {
+	start := d.i
+	if d.s[d.i] == '-' {
+		d.i++
+	}
+	digits := d.digits()
+	if digits == 0 || digits > 1 && d.s[d.i-digits] == '0' {
+		return nil, d.errorf("invalid number %q", d.s[start:d.i])
+	}
+	isFloat := false
+	if d.i < len(d.s) && d.s[d.i] == '.' {
+		d.i++
+		if d.digits() == 0 {
+			return nil, d.errorf("invalid number %q", d.s[start:d.i])
+		}
+		isFloat = true
+	}
+	if d.i < len(d.s) && (d.s[d.i] == 'e' || d.s[d.i] == 'E') {
+		d.i++
+		if d.i < len(d.s) && (d.s[d.i] == '+' || d.s[d.i] == '-') {
+			d.i++
+		}
+		if d.digits() == 0 {
+			return nil, d.errorf("invalid number %q", d.s[start:d.i])
+		}
+		isFloat = true
+	}
+	num := d.s[start:d.i]
+	if isFloat {
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, d.errorf("invalid number %q: %v", num, err)
+		}
+		return starlark.Float(f), nil
+	}
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return starlark.MakeInt64(n), nil
+	}
+	n, ok := new(big.Int).SetString(num, 10)
+	if !ok {
+		return nil, d.errorf("invalid number %q", num)
+	}
+	return starlark.MakeBigInt(n), nil
+}
+
+// digits skips the digits at d.i, returning how many there were.
+func (d *decoder) digits() int {
+	start := d.i
+	for d.i < len(d.s) && '0' <= d.s[d.i] && d.s[d.i] <= '9' {
+		d.i++
+	}
+	return d.i - start
+}
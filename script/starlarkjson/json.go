@@ -49,8 +49,9 @@ import (
 //
 // The decode function accepts one positional parameter, a JSON string.
 // It returns the Starlark value that the string denotes.
-// - Numbers may be parsed as as int or float, depending on magnitude.
-// - JSON objects are parsed as Starlark dicts.
+// - Numbers are parsed as int, of any size, unless they have a
+//   fraction or exponent, in which case they are parsed as float.
+// - JSON objects are parsed as Starlark dicts, in document order.
 // - JSON arrays are parsed as Starlark tuples.
 // Decoding fails if x is not a valid JSON string.
 //
@@ -241,50 +242,7 @@ func Decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	// instead of tuple, or struct instead of dict; or any type that
 	// satisfies json.Unmarshaller).
 
-	// This implementation is just a sketch.
-	// TODO(adonovan) reimplement it independent of the Go decoder.
-	// For example, we could decode large integers to bigint, not float.
-	var x interface{}
-	if err := json.Unmarshal([]byte(str), &x); err != nil {
-		return nil, fmt.Errorf("%s: %v", b.Name(), err)
-	}
-	var decode func(x interface{}) (starlark.Value, error)
-	decode = func(x interface{}) (starlark.Value, error) {
-		switch x := x.(type) {
-		case nil:
-			return starlark.None, nil
-		case bool:
-			return starlark.Bool(x), nil
-		case int:
-			return starlark.MakeInt(x), nil
-		case float64:
-			return starlark.Float(x), nil
-		case string:
-			return starlark.String(x), nil
-		case map[string]interface{}: // object
-			dict := new(starlark.Dict)
-			for k, v := range x {
-				vv, err := decode(v)
-				if err != nil {
-					return nil, fmt.Errorf("in object field .%s, %v", k, err)
-				}
-				dict.SetKey(starlark.String(k), vv) // can't fail
-			}
-			return dict, nil
-		case []interface{}: // array
-			tuple := make(starlark.Tuple, len(x))
-			for i, v := range x {
-				vv, err := decode(v)
-				if err != nil {
-					return nil, fmt.Errorf("at array index %d, %v", i, err)
-				}
-				tuple[i] = vv
-			}
-			return tuple, nil
-		}
-		panic(x) // unreachable
-	}
-	v, err := decode(x)
+	v, err := DecodeString(str)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
@@ -0,0 +1,321 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// tcpReadSize is how much recv reads at once when no size is given.
+const tcpReadSize = 64 * 1024
+
+var errTCPOutstanding = errors.New("tcp connection closed with a reply outstanding")
+
+var tcpConnAttrs = []string{
+	"send",   // def send(self, data: str) -> None: ...
+	"recv",   // def recv(self, size: int = 0) -> str: ...
+	"expect", // def expect(self, delim: str) -> str: ...
+	"close",  // def close(self) -> None: ...
+}
+
+type tcpModule struct {
+	Module
+}
+
+// TCPModule returns the tcp module, for load testing bespoke TCP
+// protocols.  Connecting and each send/reply round trip are reported
+// as results.
+func TCPModule() *tcpModule {
+	m := &tcpModule{
+		Module: Module{
+			Name:  "tcp",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["connect"] = starlark.NewBuiltin("tcp.connect", m.fnConnect)
+
+	return m
+}
+
+// fnConnect implements tcp.connect(host, port, tls=False,
+// server_name=None).
+func (m *tcpModule) fnConnect(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("tcp can't be used at top level, only in function bodies")
+	}
+
+	var host, serverName string
+	var port int
+	var useTLS bool
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "host", &host, "port", &port, "tls?", &useTLS, "server_name?", &serverName); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	timeout := stls.client.Timeout
+
+	stls.count++
+	stls.reporter.Start()
+	s := stls.clock.Now()
+	var connDuration, tlsDuration time.Duration
+	nc, err := func() (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		nc, err := dialer.DialContext(stls.ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		connDuration = stls.clock.Now() - s
+		if !useTLS {
+			return nc, nil
+		}
+
+		tlsStart := stls.clock.Now()
+		tc := tls.Client(nc, clientTLSConfig(stls.client, serverName))
+		tc.SetDeadline(deadline(stls.ctx, timeout))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		tlsDuration = stls.clock.Now() - tlsStart
+		return tc, nil
+	}()
+
+	stls.reporter.Finish(&requester.Result{
+		Offset:       s,
+		Duration:     stls.clock.Now() - s,
+		Err:          err,
+		ConnDuration: connDuration,
+		TLSDuration:  tlsDuration,
+		Name:         "TCP CONNECT " + addr,
+	})
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	c := &tcpConn{
+		ctx:      stls.ctx,
+		reporter: stls.reporter,
+		clock:    stls.clock,
+		nc:       nc,
+		addr:     addr,
+		timeout:  timeout,
+		name:     "TCP MESSAGE " + addr,
+	}
+	stls.closers = append(stls.closers, c)
+	return c, nil
+}
+
+// tcpConn is a connected TCP socket.  Like a WebSocket, a round trip
+// is measured from the first send after the previous reply to the
+// next recv or expect that returns data.
+type tcpConn struct {
+	ctx      context.Context
+	reporter requester.Reporter
+	clock    *requester.Clock
+	nc       net.Conn
+	addr     string
+	timeout  time.Duration
+	name     string
+	closed   bool
+
+	// buf holds data read past the end of an expect.
+	buf []byte
+
+	pending      bool
+	sendStart    time.Duration
+	sendDuration time.Duration
+}
+
+var (
+	_ starlark.HasAttrs = (*tcpConn)(nil)
+	_ io.Closer         = (*tcpConn)(nil)
+)
+
+func (c *tcpConn) String() string        { return fmt.Sprintf("<tcp.conn %q>", c.addr) }
+func (c *tcpConn) Type() string          { return "tcp.conn" }
+func (c *tcpConn) Freeze()               {}
+func (c *tcpConn) Truth() starlark.Bool  { return starlark.True }
+func (c *tcpConn) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+func (c *tcpConn) AttrNames() []string   { return tcpConnAttrs }
+
+func (c *tcpConn) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "send":
+		return starlark.NewBuiltin("tcp.conn.send", c.fnSend), nil
+	case "recv":
+		return starlark.NewBuiltin("tcp.conn.recv", c.fnRecv), nil
+	case "expect":
+		return starlark.NewBuiltin("tcp.conn.expect", c.fnExpect), nil
+	case "close":
+		return starlark.NewBuiltin("tcp.conn.close", c.fnClose), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (c *tcpConn) fnSend(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "data", &data); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	s := c.clock.Now()
+	if !c.pending {
+		c.reporter.Start()
+		c.pending = true
+		c.sendStart = s
+		c.sendDuration = 0
+	}
+	c.nc.SetWriteDeadline(deadline(c.ctx, c.timeout))
+	_, err := io.WriteString(c.nc, data)
+	c.sendDuration += c.clock.Now() - s
+	if err != nil {
+		c.finish(0, err)
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// fnRecv returns the next size bytes, or if size isn't given, whatever
+// data arrives next.  It returns "" once the server has closed the
+// connection.
+func (c *tcpConn) fnRecv(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var size int
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "size?", &size); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	return c.read(fn, func() (int, bool) {
+		if size > 0 {
+			return size, len(c.buf) >= size
+		}
+		return len(c.buf), len(c.buf) > 0
+	})
+}
+
+// fnExpect reads until delim arrives, returning everything up to and
+// including it.  Anything read beyond it is kept for the next recv or
+// expect.
+func (c *tcpConn) fnExpect(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var delim string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "delim", &delim); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if delim == "" {
+		return nil, fmt.Errorf("%s: empty delimiter", fn.Name())
+	}
+
+	return c.read(fn, func() (int, bool) {
+		i := bytes.Index(c.buf, []byte(delim))
+		if i < 0 {
+			return 0, false
+		}
+		return i + len(delim), true
+	})
+}
+
+// read fills buf until ready reports it holds a complete reply, and
+// returns that many bytes of it.
+func (c *tcpConn) read(fn *starlark.Builtin, ready func() (n int, ok bool)) (starlark.Value, error) {
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	if !c.pending {
+		c.sendStart = c.clock.Now()
+		c.sendDuration = 0
+	}
+	var err error
+	n, ok := ready()
+	for !ok && err == nil {
+		c.nc.SetReadDeadline(deadline(c.ctx, c.timeout))
+		chunk := make([]byte, tcpReadSize)
+		var m int
+		m, err = c.nc.Read(chunk)
+		c.buf = append(c.buf, chunk[:m]...)
+		n, ok = ready()
+	}
+	if !ok {
+		if err == io.EOF && !c.pending {
+			// nothing was outstanding, so this isn't a failed round trip
+			return starlark.String(""), nil
+		}
+		if !c.pending {
+			c.reporter.Start()
+			c.pending = true
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.finish(0, err)
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	reply := string(c.buf[:n])
+	c.buf = c.buf[n:]
+	if !c.pending {
+		c.reporter.Start()
+		c.pending = true
+	}
+	c.finish(n, nil)
+	return starlark.String(reply), nil
+}
+
+func (c *tcpConn) fnClose(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if err := c.Close(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// Close closes the connection, if the script hasn't already.
+func (c *tcpConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.pending {
+		c.finish(0, errTCPOutstanding)
+	}
+	return c.nc.Close()
+}
+
+// finish reports the outstanding round trip.
+func (c *tcpConn) finish(size int, err error) {
+	t := c.clock.Now()
+	c.reporter.Finish(&requester.Result{
+		Offset:        c.sendStart,
+		Duration:      t - c.sendStart,
+		Err:           err,
+		ContentLength: int64(size),
+		ReqDuration:   c.sendDuration,
+		DelayDuration: t - c.sendStart - c.sendDuration,
+		Name:          c.name,
+	})
+	c.pending = false
+}
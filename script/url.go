@@ -0,0 +1,37 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+	"net/url"
+
+	"go.starlark.net/starlark"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+func init() {
+	requester.Register("script", func(target string) (requester.Requester, error) {
+		return New(target)
+	})
+	requester.Register("url", func(target string) (requester.Requester, error) {
+		return NewURL(target)
+	})
+}
+
+// NewURL returns a Script that GETs u, like the original hey, for when
+// a script would only be a single request.
+func NewURL(u string) (*Script, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("%q isn't an absolute URL", u)
+	}
+	src := fmt.Sprintf("def main(ctx):\n    requests.get(%s, data=None, headers={})\n", starlark.String(u).String())
+	return New("<url>", WithSource([]byte(src)))
+}
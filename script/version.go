@@ -0,0 +1,62 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// APIVersion is the latest version of the script API.  A script, or a
+// module it loads, declares the version it is written against with a
+// top level
+//
+//	api_version = 2
+//
+// and the builtins it calls behave as they did in that version, so
+// that libraries of scenarios keep working as the API changes.  Modules
+// that don't declare one get version 1.  The versions are:
+//
+//	1  requests.get and requests.post require data and headers.
+//	2  data and headers are optional, and default to no body and no
+//	   extra headers.
+const APIVersion = 2
+
+const (
+	apiVersionGlobal  = "api_version"
+	apiVersionsKey    = "api_versions"
+	defaultAPIVersion = 1
+)
+
+// moduleAPIVersion returns the API version the module at path, with
+// globals, declares.
+func moduleAPIVersion(path string, globals starlark.StringDict) (int, error) {
+	v, ok := globals[apiVersionGlobal]
+	if !ok {
+		return defaultAPIVersion, nil
+	}
+	version, err := starlark.AsInt32(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s must be an int, not a %s", path, apiVersionGlobal, v.Type())
+	}
+	if version < 1 || version > APIVersion {
+		return 0, fmt.Errorf("%s: %s %d isn't supported; this version of hithere supports 1 to %d", path, apiVersionGlobal, version, APIVersion)
+	}
+	return version, nil
+}
+
+// apiVersion returns the API version of the module calling the builtin
+// thread is running, for builtins whose behavior has changed.
+func apiVersion(thread *starlark.Thread) int {
+	versions, _ := thread.Local(apiVersionsKey).(map[string]int)
+	if thread.CallStackDepth() < 2 {
+		return defaultAPIVersion
+	}
+	if v, ok := versions[thread.CallFrame(1).Pos.Filename()]; ok {
+		return v
+	}
+	return defaultAPIVersion
+}
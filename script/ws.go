@@ -0,0 +1,382 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/net/websocket"
+
+	"github.com/bpowers/hithere/requester"
+)
+
+// wsStatusCode is reported for every successful WebSocket result: the
+// connection is only usable once the server has switched protocols.
+const wsStatusCode = http.StatusSwitchingProtocols
+
+var (
+	errWSClosed      = errors.New("websocket closed by the server")
+	errWSOutstanding = errors.New("websocket closed with a message outstanding")
+)
+
+var wsConnAttrs = []string{
+	"send",  // def send(self, data: str) -> None: ...
+	"recv",  // def recv(self) -> Optional[str]: ...
+	"ping",  // def ping(self, data: str = "") -> None: ...
+	"close", // def close(self) -> None: ...
+}
+
+type wsModule struct {
+	Module
+}
+
+// WSModule returns the ws module, a WebSocket client.  The connection
+// handshake and each send/recv round trip are reported as results.
+func WSModule() *wsModule {
+	m := &wsModule{
+		Module: Module{
+			Name:  "ws",
+			Attrs: starlark.StringDict{},
+		},
+	}
+
+	m.Attrs["connect"] = starlark.NewBuiltin("ws.connect", m.fnConnect)
+
+	return m
+}
+
+func (m *wsModule) fnConnect(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	stls, ok := t.Local(scriptTlsKey).(*scriptTls)
+	if !ok || stls == nil {
+		return starlark.None, fmt.Errorf("ws can't be used at top level, only in function bodies")
+	}
+
+	var urlString, subprotocol string
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &urlString, "headers?", &headers, "subprotocol?", &subprotocol); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		origin.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("expected a ws:// or wss:// url, got %q", urlString)
+	}
+
+	config := &websocket.Config{
+		Location: u,
+		Origin:   origin,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   make(http.Header),
+	}
+	if subprotocol != "" {
+		config.Protocol = []string{subprotocol}
+	}
+	if headers != nil {
+		for _, item := range headers.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				k = item[0].String()
+			}
+			v, ok := starlark.AsString(item[1])
+			if !ok {
+				v = item[1].String()
+			}
+			config.Header.Set(k, v)
+		}
+	}
+	config.Header.Set("user-agent", stls.reporter.UserAgent())
+
+	stls.count++
+	conn, err := wsConnect(stls, config)
+	if err != nil {
+		return starlark.None, fmt.Errorf("ws.connect: %w", err)
+	}
+	return conn, nil
+}
+
+// wsConnect dials and performs the WebSocket handshake, reporting the
+// dial, TLS handshake and upgrade timings as a single result.
+func wsConnect(stls *scriptTls, config *websocket.Config) (*wsConn, error) {
+	u := config.Location
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	timeout := stls.client.Timeout
+
+	stls.reporter.Start()
+	s := stls.clock.Now()
+	var connDuration, tlsDuration, delayDuration time.Duration
+	ws, err := func() (*websocket.Conn, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		nc, err := dialer.DialContext(stls.ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		connDuration = stls.clock.Now() - s
+		if timeout > 0 {
+			nc.SetDeadline(time.Now().Add(timeout))
+		}
+
+		if u.Scheme == "wss" {
+			tlsStart := stls.clock.Now()
+			tc := tls.Client(nc, clientTLSConfig(stls.client, u.Hostname()))
+			if err := tc.Handshake(); err != nil {
+				nc.Close()
+				return nil, err
+			}
+			tlsDuration = stls.clock.Now() - tlsStart
+			nc = tc
+		}
+
+		upgradeStart := stls.clock.Now()
+		ws, err := websocket.NewClient(config, nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		delayDuration = stls.clock.Now() - upgradeStart
+		nc.SetDeadline(time.Time{})
+		return ws, nil
+	}()
+
+	code := wsStatusCode
+	if err != nil {
+		code = 0
+	}
+	stls.reporter.Finish(&requester.Result{
+		Offset:        s,
+		StatusCode:    code,
+		Duration:      stls.clock.Now() - s,
+		Err:           err,
+		ConnDuration:  connDuration,
+		TLSDuration:   tlsDuration,
+		DelayDuration: delayDuration,
+		Name:          wsEndpointName("CONNECT", u),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &wsConn{
+		ctx:      stls.ctx,
+		reporter: stls.reporter,
+		clock:    stls.clock,
+		ws:       ws,
+		timeout:  timeout,
+		name:     wsEndpointName("MESSAGE", u),
+	}
+	stls.closers = append(stls.closers, c)
+	return c, nil
+}
+
+// wsEndpointName identifies WebSocket results for per-endpoint
+// statistics, leaving out the query string like endpointName.
+func wsEndpointName(kind string, u *url.URL) string {
+	v := *u
+	v.RawQuery = ""
+	v.Fragment = ""
+	return "WS " + kind + " " + v.String()
+}
+
+// wsConn is a connected WebSocket.  A message round trip is measured
+// from the first send after the previous recv to the next recv;
+// messages the server pushes without a preceding send are measured
+// from the start of the recv.
+type wsConn struct {
+	ctx      context.Context
+	reporter requester.Reporter
+	clock    *requester.Clock
+	ws       *websocket.Conn
+	timeout  time.Duration
+	name     string
+	closed   bool
+	// eof is whether the server has closed the connection.
+	eof bool
+
+	// pending is whether a round trip is in progress, and sendStart
+	// and sendDuration are its timings.
+	pending      bool
+	sendStart    time.Duration
+	sendDuration time.Duration
+}
+
+var (
+	_ starlark.HasAttrs = (*wsConn)(nil)
+	_ io.Closer         = (*wsConn)(nil)
+)
+
+func (c *wsConn) String() string        { return fmt.Sprintf("<ws.conn %q>", c.ws.Config().Location) }
+func (c *wsConn) Type() string          { return "ws.conn" }
+func (c *wsConn) Freeze()               {}
+func (c *wsConn) Truth() starlark.Bool  { return starlark.True }
+func (c *wsConn) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+func (c *wsConn) AttrNames() []string   { return wsConnAttrs }
+
+func (c *wsConn) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "send":
+		return starlark.NewBuiltin("ws.conn.send", c.fnSend), nil
+	case "recv":
+		return starlark.NewBuiltin("ws.conn.recv", c.fnRecv), nil
+	case "ping":
+		return starlark.NewBuiltin("ws.conn.ping", c.fnPing), nil
+	case "close":
+		return starlark.NewBuiltin("ws.conn.close", c.fnClose), nil
+	}
+	// returns (nil, nil) if attribute not present
+	return nil, nil
+}
+
+func (c *wsConn) fnSend(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "data", &data); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	s := c.clock.Now()
+	if !c.pending {
+		c.reporter.Start()
+		c.pending = true
+		c.sendStart = s
+		c.sendDuration = 0
+	}
+	c.ws.SetWriteDeadline(deadline(c.ctx, c.timeout))
+	err := websocket.Message.Send(c.ws, data)
+	c.sendDuration += c.clock.Now() - s
+	if err != nil {
+		c.finish(nil, err)
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// fnRecv returns the next text or binary message, or None once the
+// server has closed the connection.  Pings are answered while waiting.
+func (c *wsConn) fnRecv(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	if !c.pending {
+		c.sendStart = c.clock.Now()
+		c.sendDuration = 0
+	}
+	c.ws.SetReadDeadline(deadline(c.ctx, c.timeout))
+	var msg []byte
+	err := websocket.Message.Receive(c.ws, &msg)
+	if err == io.EOF && !c.pending {
+		// nothing was outstanding, so this isn't a failed round trip
+		c.eof = true
+		return starlark.None, nil
+	}
+	if !c.pending {
+		c.reporter.Start()
+		c.pending = true
+	}
+	if err == io.EOF {
+		c.eof = true
+		c.finish(nil, errWSClosed)
+		return starlark.None, nil
+	}
+	c.finish(msg, err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.String(msg), nil
+}
+
+func (c *wsConn) fnPing(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "data?", &data); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if c.closed {
+		return nil, fmt.Errorf("%s: connection is closed", fn.Name())
+	}
+
+	c.ws.SetWriteDeadline(deadline(c.ctx, c.timeout))
+	c.ws.PayloadType = websocket.PingFrame
+	_, err := c.ws.Write([]byte(data))
+	c.ws.PayloadType = websocket.TextFrame
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+func (c *wsConn) fnClose(t *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, fmt.Errorf("UnpackArgs: %w", err)
+	}
+	if err := c.Close(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.None, nil
+}
+
+// Close closes the connection, if the script hasn't already.
+func (c *wsConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.pending {
+		c.finish(nil, errWSOutstanding)
+	}
+	err := c.ws.Close()
+	if c.eof {
+		// the close frame can't be sent to a server that's gone
+		return nil
+	}
+	return err
+}
+
+// finish reports the outstanding round trip.
+func (c *wsConn) finish(msg []byte, err error) {
+	t := c.clock.Now()
+	code := wsStatusCode
+	if err != nil {
+		code = 0
+	}
+	c.reporter.Finish(&requester.Result{
+		Offset:        c.sendStart,
+		StatusCode:    code,
+		Duration:      t - c.sendStart,
+		Err:           err,
+		ContentLength: int64(len(msg)),
+		ReqDuration:   c.sendDuration,
+		DelayDuration: t - c.sendStart - c.sendDuration,
+		Name:          c.name,
+	})
+	c.pending = false
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsScope       = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcsEndpoint    = "https://storage.googleapis.com"
+)
+
+type gcsUploader struct {
+	bucket   string
+	prefix   string
+	endpoint string
+
+	tokenOnce sync.Once
+	token     string
+	tokenErr  error
+}
+
+func newGCSUploader(bucket, prefix string) *gcsUploader {
+	return &gcsUploader{bucket: bucket, prefix: prefix, endpoint: gcsEndpoint}
+}
+
+func (g *gcsUploader) Put(ctx context.Context, name string, body []byte, contentType string) error {
+	g.tokenOnce.Do(func() {
+		g.token, g.tokenErr = gcsToken(ctx)
+	})
+	if g.tokenErr != nil {
+		return fmt.Errorf("gcs: %w", g.tokenErr)
+	}
+
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		g.endpoint, url.PathEscape(g.bucket), url.QueryEscape(objectName(g.prefix, name)))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("content-type", contentType)
+	req.Header.Set("authorization", "Bearer "+g.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("gcs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("gcs: upload %s: %s: %s", name, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// gcsToken finds an OAuth2 access token for Cloud Storage, trying in
+// order: the GOOGLE_OAUTH_ACCESS_TOKEN environment variable, the
+// service account key named by GOOGLE_APPLICATION_CREDENTIALS, and the
+// GCE metadata server.
+func gcsToken(ctx context.Context) (string, error) {
+	if tok := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); tok != "" {
+		return tok, nil
+	}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return serviceAccountToken(ctx, path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", gcsMetadataURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("metadata-flavor", "Google")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("no credentials found (metadata server: %w)", err)
+	}
+	return decodeToken(resp)
+}
+
+// serviceAccountToken exchanges a signed JWT for an access token, per
+// https://developers.google.com/identity/protocols/oauth2/service-account.
+func serviceAccountToken(ctx context.Context, path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", fmt.Errorf("json.Unmarshal(%s): %w", path, err)
+	}
+	if key.Type != "service_account" {
+		return "", fmt.Errorf("%s: unsupported credential type %q", path, key.Type)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("%s: malformed private_key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("x509.ParsePKCS8PrivateKey: %w", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("%s: private_key is not an RSA key", path)
+	}
+
+	now := time.Now().Unix()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": gcsScope,
+		"aud":   key.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal: %w", err)
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("rsa.SignPKCS1v15: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	return decodeToken(resp)
+}
+
+func decodeToken(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("ioutil.ReadAll: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return tok.AccessToken, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+package upload
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGCSUpload(t *testing.T) {
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "tok")
+
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/upload/storage/v1/b/bucket/o" || r.URL.Query().Get("uploadType") != "media" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "runs/denied.json" {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		objects[name] = r.Header.Get("content-type") + " " + string(body)
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	u, err := New("gs://bucket/runs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.(*gcsUploader).endpoint = server.URL
+	ctx := context.Background()
+	for name, body := range map[string]string{"summary.json": "{}", "results/a b.csv": "x,y"} {
+		if err := u.Put(ctx, name, []byte(body), "text/plain"); err != nil {
+			t.Errorf("Put(%q): %s", name, err)
+		}
+	}
+	if objects["runs/summary.json"] != "text/plain {}" || objects["runs/results/a b.csv"] != "text/plain x,y" {
+		t.Errorf("unexpected objects: %q", objects)
+	}
+
+	err = u.Put(ctx, "denied.json", nil, "application/json")
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden: access denied") {
+		t.Errorf("expected the upload to be denied, got %v", err)
+	}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "unsupported grant type", http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "malformed JWT", http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var claims struct {
+			Iss, Scope, Aud string
+			Iat, Exp        int64
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(payload, &claims)
+		if claims.Iss != "load@project.iam.gserviceaccount.com" || claims.Scope != gcsScope || !strings.HasSuffix(claims.Aud, "/token") || claims.Exp-claims.Iat != 3600 {
+			http.Error(w, "unexpected claims "+string(payload), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "sa-token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	write := func(typ, tokenURI string) string {
+		path := filepath.Join(dir, typ+".json")
+		creds, _ := json.Marshal(map[string]string{
+			"type":         typ,
+			"client_email": "load@project.iam.gserviceaccount.com",
+			"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			"token_uri":    tokenURI,
+		})
+		if err := ioutil.WriteFile(path, creds, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", write("service_account", server.URL+"/token"))
+	if tok, err := gcsToken(context.Background()); tok != "sa-token" || err != nil {
+		t.Errorf("gcsToken: got %q, %v", tok, err)
+	}
+
+	if _, err := serviceAccountToken(context.Background(), write("authorized_user", server.URL+"/token")); err == nil || !strings.Contains(err.Error(), `unsupported credential type "authorized_user"`) {
+		t.Errorf("expected an error for user credentials, got %v", err)
+	}
+	if _, err := serviceAccountToken(context.Background(), write("service_account", server.URL+"/other")); err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Errorf("expected the token exchange to fail, got %v", err)
+	}
+}
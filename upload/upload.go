@@ -0,0 +1,68 @@
+// Copyright 2020 The hithere Authors. All rights reserved.
+// Use of this source code is governed by the Apache License,
+// Version 2.0, that can be found in the LICENSE file.
+
+// Package upload stores report artifacts in object storage (S3 or
+// GCS) or a local directory at the end of a run.
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An Uploader stores named artifacts under a destination prefix.
+type Uploader interface {
+	Put(ctx context.Context, name string, body []byte, contentType string) error
+}
+
+// New returns an Uploader for dest, which is one of:
+//
+//	s3://bucket/prefix/   Amazon S3, credentials from the AWS_* environment
+//	gs://bucket/prefix/   Google Cloud Storage, see gcsToken for credentials
+//	/some/dir, file:///some/dir   a local directory
+func New(dest string) (Uploader, error) {
+	if !strings.Contains(dest, "://") {
+		return &dirUploader{dest}, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return newS3Uploader(u.Host, prefix)
+	case "gs":
+		return newGCSUploader(u.Host, prefix), nil
+	case "file":
+		return &dirUploader{u.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported report destination %q", dest)
+}
+
+// objectName joins an artifact name onto a bucket prefix.
+func objectName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return path.Join(prefix, name)
+}
+
+type dirUploader struct {
+	dir string
+}
+
+func (d *dirUploader) Put(ctx context.Context, name string, body []byte, contentType string) error {
+	p := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	return ioutil.WriteFile(p, body, 0644)
+}